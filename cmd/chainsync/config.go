@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+	"github.com/parallelcointeam/duo/pkg/sync"
+)
+
+// ConfigName is the name of the configuration file looked for in the data directory
+const ConfigName = "chainsync.conf"
+
+// CookieName is the name of the file in the data directory the server's credentials are written to when no password is set
+const CookieName = "chainsync.cookie"
+
+// EnvPrefix is prepended to the upper cased name of a setting, with dots replaced by underscores, to give the environment variable that sets it
+const EnvPrefix = "CHAINSYNC_"
+
+// settings is everything that configures a chainsync process
+type settings struct {
+	node      sync.Config
+	listen    string
+	user      string
+	pass      string
+	follow    bool
+	interval  time.Duration
+	notify    string
+	rpcNotify bool
+	config    string
+}
+
+// newFlagSet defines a flag for every setting, with the defaults of the main network
+func newFlagSet(s *settings) *flag.FlagSet {
+	fs := flag.NewFlagSet("chainsync", flag.ContinueOnError)
+	*s = settings{node: sync.DefaultConfig(sync.Mainnet)}
+	n := &s.node
+	fs.StringVar(&s.config, "config", "", "configuration file, default "+ConfigName+" in the data directory")
+	fs.StringVar(&n.Network, "network", n.Network, "network the full node is on, mainnet or testnet")
+	fs.StringVar(&n.RPCHost, "rpchost", n.RPCHost, "host of the full node's RPC server")
+	fs.IntVar(&n.RPCPort, "rpcport", 0, "port of the full node's RPC server, default by network")
+	fs.StringVar(&n.RPCUser, "rpcuser", n.RPCUser, "RPC user name")
+	fs.StringVar(&n.RPCPass, "rpcpass", n.RPCPass, "RPC password")
+	fs.StringVar(&n.RPCCookie, "rpccookie", "", "cookie file to read the RPC credentials from instead of rpcuser and rpcpass")
+	fs.BoolVar(&n.RPCTLS, "rpctls", false, "connect to the RPC server over TLS")
+	fs.StringVar(&n.RPCTLSConfig.CAFile, "rpccafile", "", "PEM file of the certificate authorities to check the RPC server's certificate against instead of the system's")
+	fs.Var(listValue{&n.RPCTLSConfig.Fingerprints}, "rpcfingerprints", "comma separated SHA256 fingerprints of the certificates to accept from the RPC server, whoever signed them")
+	fs.StringVar(&n.RPCTLSConfig.KnownHosts, "rpcknownhosts", "", "file of RPC server certificate fingerprints trusted on first use")
+	fs.StringVar(&n.RPCTLSConfig.CertFile, "rpccert", "", "PEM file of a client certificate for the RPC server")
+	fs.StringVar(&n.RPCTLSConfig.KeyFile, "rpckey", "", "PEM file of the key of the client certificate")
+	fs.StringVar(&n.RPCTLSConfig.ServerName, "rpcservername", "", "name the RPC server's certificate must be for, default rpchost")
+	fs.BoolVar(&n.RPCTLSConfig.Insecure, "rpcinsecure", false, "accept any certificate from the RPC server, letting anyone in the way read and change the connection")
+	fs.IntVar(&n.RPCConcurrency, "rpcconcurrency", rpc.DefaultConcurrency, "most requests sent to the RPC server at once")
+	fs.Var(listValue{&n.RPCEndpoints}, "rpcendpoints", "comma separated host[:port] of further RPC servers to fail over to")
+	fs.IntVar(&n.RPCRetries, "rpcretries", rpc.DefaultRetries, "times to retry an RPC request that fails with a transient error, -1 for none")
+	fs.StringVar(&n.Peer, "peer", "", "host[:port] of a full node to download blocks from over the peer to peer protocol instead of RPC")
+	fs.StringVar(&n.DataDir, "datadir", "", "directory to keep the index and block archive in, default by network")
+	fs.BoolVar(&n.Archive, "archive", false, "keep a compressed copy of every raw block so the index can be rebuilt offline with reindex")
+	fs.IntVar(&n.Workers, "workers", sync.DefaultWorkers, "number of concurrent RPC fetch workers")
+	fs.IntVar(&n.BatchSize, "batchsize", sync.DefaultBatchSize, "number of blocks committed to the index at once")
+	fs.Int64Var(&n.DB.MaxTableSize, "db.maxtablesize", 0, "size of each index table file, default badger's")
+	fs.Int64Var(&n.DB.ValueLogFileSize, "db.valuelogfilesize", 0, "size of each index value log file, default badger's")
+	fs.IntVar(&n.DB.ValueThreshold, "db.valuethreshold", 0, "value size from which index values are kept in the value log, default badger's")
+	fs.IntVar(&n.DB.NumMemtables, "db.nummemtables", 0, "number of index tables kept in memory, default badger's")
+	fs.IntVar(&n.DB.NumCompactors, "db.numcompactors", 0, "number of index compaction workers, default badger's")
+	fs.BoolVar(&n.DB.NoSyncWrites, "db.nosync", false, "do not wait for index writes to reach the disk")
+	fs.BoolVar(&n.DB.LowMemory, "db.lowmemory", false, "memory map the index tables instead of loading them")
+	fs.StringVar(&s.listen, "listen", "127.0.0.1:11049", "address to serve the JSON-RPC and msgpack endpoints on")
+	fs.StringVar(&s.user, "user", "chainsync", "user name clients of the JSON-RPC and msgpack endpoints authenticate with")
+	fs.StringVar(&s.pass, "pass", "", "password clients authenticate with, default a random one written to "+CookieName+" in the data directory")
+	fs.BoolVar(&s.follow, "follow", true, "keep indexing new blocks as the full node receives them")
+	fs.DurationVar(&s.interval, "interval", 10*time.Second, "how often to poll the full node for a new best block")
+	fs.StringVar(&s.notify, "notify", "", "unix socket to listen on for block notifications, for example from blocknotify")
+	fs.BoolVar(&s.rpcNotify, "rpcnotify", false, "subscribe to block notifications from the full node's websocket endpoint, or long poll it if it has none")
+	return fs
+}
+
+// listValue is a flag holding a comma separated list
+type listValue struct {
+	list *[]string
+}
+
+func (l listValue) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+// Set replaces the list, so a setting on the command line overrides the same one in the file rather than adding to it
+func (l listValue) Set(s string) error {
+	*l.list = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.list = append(*l.list, item)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable for a setting
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, ".", "_", -1))
+}
+
+// loadSettings reads the settings from the command line, the environment and the configuration file, in that order of precedence. The settings in the file are the flag names without the dash, one name=value per line, and lines starting with # are comments. It returns the arguments left after the flags.
+func loadSettings(args []string, getenv func(string) string) (s settings, rest []string, err error) {
+	fs := newFlagSet(&s)
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fromEnv := func(name string) (err error) {
+		if v := getenv(envName(name)); v != "" && !set[name] {
+			if err = fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %v", envName(name), err)
+			}
+			set[name] = true
+		}
+		return
+	}
+	// the location of the file may itself come from the environment
+	for _, name := range []string{"config", "network", "datadir"} {
+		if err = fromEnv(name); err != nil {
+			return
+		}
+	}
+	path, explicit := s.config, s.config != ""
+	if !explicit {
+		dir := s.node.DataDir
+		if dir == "" {
+			if dir, err = sync.DefaultDataDir(s.node.Network); err != nil {
+				return
+			}
+		}
+		path = filepath.Join(dir, ConfigName)
+	}
+	file, err := readConfigFile(path)
+	if os.IsNotExist(err) && !explicit {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if err == nil {
+			err = fromEnv(f.Name)
+		}
+	})
+	if err != nil {
+		return
+	}
+	for name, v := range file {
+		if name == "config" || fs.Lookup(name) == nil {
+			return s, nil, fmt.Errorf("%s: unknown setting %s", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err = fs.Set(name, v); err != nil {
+			return s, nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return s, fs.Args(), nil
+}
+
+// writeCookie makes up a random password for the server and writes the user name and password, separated by a colon, to the cookie file in the data directory, readable only by its owner, for clients on the same host to authenticate with
+func writeCookie(s *settings) (path string, err error) {
+	dir := s.node.DataDir
+	if dir == "" {
+		if dir, err = sync.DefaultDataDir(s.node.Network); err != nil {
+			return
+		}
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	s.pass, path = hex.EncodeToString(b), filepath.Join(dir, CookieName)
+	return path, ioutil.WriteFile(path, []byte(s.user+":"+s.pass), 0600)
+}
+
+// readConfigFile reads the name=value lines of a configuration file
+func readConfigFile(path string) (values map[string]string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	values = make(map[string]string)
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected name=value", path, n)
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return values, lines.Err()
+}
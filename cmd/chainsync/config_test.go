@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := "# test\nnetwork = testnet\nrpcuser=file\nrpcpass=file\nrpcport=1234\ndb.nosync=true\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, ConfigName), []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CHAINSYNC_DATADIR":   dir,
+		"CHAINSYNC_RPCUSER":   "env",
+		"CHAINSYNC_RPCPASS":   "env",
+		"CHAINSYNC_DB_NOSYNC": "false",
+	}
+	s, args, err := loadSettings([]string{"-rpcpass", "flag", "reindex"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := s.node
+	if n.Network != "testnet" || n.RPCPort != 1234 || n.DataDir != dir ||
+		n.RPCUser != "env" || n.RPCPass != "flag" || n.DB.NoSyncWrites {
+		t.Errorf("unexpected settings %+v", n)
+	}
+	if len(args) != 1 || args[0] != "reindex" {
+		t.Error("unexpected arguments", args)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, ConfigName), []byte("rpcusr=typo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = loadSettings(nil, func(k string) string { return env[k] }); err == nil {
+		t.Error("unknown setting accepted")
+	}
+	if _, _, err = loadSettings([]string{"-config", filepath.Join(dir, "missing")}, func(string) string { return "" }); err == nil {
+		t.Error("missing configuration file accepted")
+	}
+}
+
+func TestWriteCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _, err := loadSettings([]string{"-datadir", dir}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := writeCookie(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if len(s.pass) != 64 || string(b) != "chainsync:"+s.pass || info.Mode().Perm() != 0600 {
+		t.Error("unexpected cookie", string(b), info.Mode())
+	}
+}
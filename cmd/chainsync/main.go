@@ -1,20 +1,126 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 
 	"github.com/parallelcointeam/duo/pkg/sync"
 )
 
+// reports are the commands that report on the index and exit, by name
+var reports = map[string]func(node *sync.Node, args []string) error{
+	"richlist": richList,
+	"stats":    chainStats,
+	"verify":   verify,
+}
+
 func main() {
-	node := sync.NewNode()
-	// node.RemoveOldVersions()
-	node.Sync()
-	if !node.OK() {
-		fmt.Println(node.Error())
-	}
-	node.RemoveOldVersions()
-	// fmt.Println(node.GetLatestSynced())
-	// node.UpdateAddresses()
+	s, args, err := loadSettings(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	var command string
+	if len(args) > 0 {
+		command = args[0]
+	}
+	reindex := command == "reindex"
+	if reindex {
+		s.node.Archive, s.node.IgnoreSchema = true, true
+	}
+	node, err := sync.NewNode(s.node)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if reindex {
+		node.Reindex()
+		if !node.OK() {
+			fmt.Println(node.Error())
+		}
+		node.Close()
+		return
+	}
+	if report, ok := reports[command]; ok {
+		err = report(node, args[1:])
+		node.Close()
+		if err == flag.ErrHelp {
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if s.pass == "" {
+		path, err := writeCookie(&s)
+		if err != nil {
+			fmt.Println("writing cookie", err)
+			os.Exit(1)
+		}
+		fmt.Println("clients authenticate with the credentials in", path)
+	}
+	handler := sync.NewServer(node)
+	handler.User, handler.Pass = s.user, s.pass
+	server := &http.Server{Addr: s.listen, Handler: handler}
+	go func() {
+		fmt.Println("serving JSON-RPC on", s.listen, "and msgpack on", s.listen+sync.MsgpackPath)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+
+	// the index is served while it catches up, as the first sync can take days, and queries see it advance
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var blocks <-chan struct{}
+	if s.follow {
+		switch {
+		case s.notify != "" && s.rpcNotify:
+			fmt.Println("-notify and -rpcnotify cannot be used together")
+			os.Exit(1)
+		case s.notify != "":
+			if blocks, err = sync.ListenNotify(s.notify, stop); err != nil {
+				fmt.Println("listening for block notifications", err)
+				os.Exit(1)
+			}
+		case s.rpcNotify:
+			blocks = sync.ListenRPC(node.RPC, s.interval, stop)
+		}
+	}
+	go func() {
+		defer close(done)
+		// remove what the last run left behind before writing more
+		node.RemoveOldVersions()
+		if s.follow {
+			// Follow finds the index behind the node and catches up first
+			node.Follow(s.interval, blocks, stop)
+		} else if !node.Sync().OK() {
+			fmt.Println(node.Error())
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	close(stop)
+	server.Close()
+	select {
+	case <-done:
+	default:
+		// a sync is not stopped part way, but the index is left consistent if the process is
+		fmt.Println("waiting for the sync to finish, interrupt again to stop now")
+		select {
+		case <-done:
+		case <-interrupt:
+			os.Exit(1)
+		}
+	}
 	node.Close()
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// checkFormat returns an error for an output format other than json or csv
+func checkFormat(format string) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown format %s, must be json or csv", format)
+	}
+	return nil
+}
+
+// writeReport writes a report to a file, or standard output if the path is empty, as indented JSON or with the CSV writer
+func writeReport(path, format string, report interface{}, writeCSV func(io.Writer) error) (err error) {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	if format == "csv" {
+		return writeCSV(w)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/parallelcointeam/duo/pkg/sync"
+)
+
+// richList writes the rich list report of the index, taking the arguments after the richlist command
+func richList(node *sync.Node, args []string) (err error) {
+	fs := flag.NewFlagSet("richlist", flag.ContinueOnError)
+	n := fs.Int("n", 100, "number of addresses to list, 0 for every funded address")
+	height := fs.Uint("height", uint(^uint32(0)), "height to report balances at, default the latest indexed block")
+	format := fs.String("format", "json", "output format, json for the full report or csv for the list of addresses")
+	output := fs.String("o", "", "file to write the report to, default standard output")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if err = checkFormat(*format); err != nil {
+		return
+	}
+	list, err := node.TopAddresses(*n, uint32(*height))
+	if err != nil {
+		return
+	}
+	return writeReport(*output, *format, list, list.WriteCSV)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/sync"
+)
+
+// parseTime reads a time given as unix seconds, a date or an RFC3339 time, with the empty string meaning no time
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot read time %s, expected unix seconds, 2006-01-02 or RFC3339", s)
+}
+
+// chainStats writes a time series of the block statistics in the index, taking the arguments after the stats command
+func chainStats(node *sync.Node, args []string) (err error) {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	from := fs.Uint("from", 0, "first height")
+	to := fs.Uint("to", uint(^uint32(0)), "last height, default the latest indexed block")
+	since := fs.String("since", "", "only blocks with a time at or after this, as unix seconds, 2006-01-02 or RFC3339")
+	until := fs.String("until", "", "only blocks with a time before this")
+	step := fs.Duration("step", 24*time.Hour, "width of each point in block time")
+	blocks := fs.Int64("blocks", 0, "width of each point in blocks, instead of -step")
+	format := fs.String("format", "json", "output format, json or csv")
+	output := fs.String("o", "", "file to write the series to, default standard output")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if err = checkFormat(*format); err != nil {
+		return
+	}
+	q := sync.SeriesQuery{From: uint32(*from), To: uint32(*to), Step: int64(*step / time.Second)}
+	if q.Since, err = parseTime(*since); err != nil {
+		return
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		return
+	}
+	if *blocks > 0 {
+		q.Step, q.ByHeight = *blocks, true
+	}
+	series, err := node.StatsSeries(q)
+	if err != nil {
+		return
+	}
+	return writeReport(*output, *format, series, func(w io.Writer) error { return sync.WriteSeriesCSV(w, series) })
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/parallelcointeam/duo/pkg/sync"
+)
+
+// errInconsistent is returned by verify when problems were found and not repaired
+var errInconsistent = errors.New("the index is inconsistent, run verify with -repair or rebuild it with reindex")
+
+// verify checks the index and optionally repairs it, taking the arguments after the verify command
+func verify(node *sync.Node, args []string) (err error) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	from := fs.Uint("from", 0, "first height to check the block records of")
+	to := fs.Uint("to", uint(^uint32(0)), "last height to check the block records of, default the latest indexed block")
+	repair := fs.Bool("repair", false, "rebuild bad address records from the undo journal and index bad blocks again")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	report, err := node.CheckIndex(uint32(*from), uint32(*to))
+	if err != nil {
+		return
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("checked blocks %d to %d and %d address records: %d bad blocks, %d bad address records\n",
+		report.From, report.To, report.Addresses, len(report.BadHeights), len(report.BadAddresses))
+	if report.OK() {
+		return
+	}
+	if !*repair {
+		return errInconsistent
+	}
+	if !node.RepairIndex(report).OK() {
+		return errors.New(node.Error())
+	}
+	if report, err = node.CheckIndex(uint32(*from), uint32(*to)); err != nil {
+		return
+	}
+	if !report.OK() {
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		return errInconsistent
+	}
+	fmt.Println("repaired")
+	return
+}
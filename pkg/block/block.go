@@ -34,6 +34,7 @@ package block
 
 */
 
+// Tx is a decoded transaction
 type Tx struct {
 	Version  uint32
 	Ins      []TxIn
@@ -41,18 +42,22 @@ type Tx struct {
 	Locktime uint32
 }
 
+// TxIn is a transaction input, spending an output of an earlier transaction
 type TxIn struct {
+	// PrevTxHash is the id of the transaction whose output is spent, in the byte order ids are shown in, the reverse of the serialised form, and all zero for a coinbase
 	PrevTxHash     []byte
 	PrevTxoutIndex int32
 	Script         []byte
 	Sequence       uint32
 }
 
+// TxOut is a transaction output, paying Value satoshis to whoever can satisfy Script
 type TxOut struct {
 	Value  uint64
 	Script []byte
 }
 
+// Raw is a decoded block. The hashes are in the byte order they are shown in, the reverse of the serialised form, and Bits is the big-endian compact target, as the full node shows them.
 type Raw struct {
 	Version        uint32
 	HashPrevBlock  []byte
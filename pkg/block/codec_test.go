@@ -0,0 +1,198 @@
+package block_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+)
+
+// block 102920 of the Parallelcoin mainnet, as broken down in blockdecoding.txt. It is mined with scrypt and holds only its coinbase; blocks mined with sha256d and transactions with several inputs are round-tripped by TestDecodeEncodeBlock against a chain served by rpctest.Node.
+const (
+	testBlockPrev   = "000000000001bbf8ce581d88fabcc9d3b0dc130eb6d5e4b329c48e6d68d1edcf"
+	testBlockMerkle = "f55daf675b4f894359333d770047dc02f2be2b9b667089dfa9962909c80aaaa9"
+	testBlockTx     = "01000000" + "01" +
+		"0000000000000000000000000000000000000000000000000000000000000000" + "ffffffff" +
+		"27" + "03089201062f503253482f046a9d675608400005c9050000000d2f6e6f64655374726174756d2f" +
+		"00000000" +
+		"01" + "00c2eb0b00000000" + "19" + "76a914d824c23fda79ac92294e2174c01bc303d6bab4f488ac" +
+		"00000000"
+	testBlockRaw = "02020000" +
+		"cfedd1686d8ec429b3e4d5b60e13dcb0d3c9bcfa881d58cef8bb010000000000" +
+		"a9aa0ac8092996a9df8970669b2bbef202dc4700773d335943894f5b67af5df5" +
+		"689d6756" + "2ad8331c" + "f30665ef" +
+		"01" + testBlockTx
+)
+
+func TestDecodeMainnet(t *testing.T) {
+	raw, _ := hex.DecodeString(testBlockRaw)
+	b, err := block.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Version != 514 || block.Hx(b.HashPrevBlock) != testBlockPrev || block.Hx(b.HashMerkleRoot) != testBlockMerkle ||
+		b.Time != 1449631080 || block.Hx(b.Bits) != "1c33d82a" || b.Nonce != 4016375539 || len(b.Transactions) != 1 {
+		t.Fatalf("unexpected header %+v", b)
+	}
+	tx := b.Transactions[0]
+	if tx.Version != 1 || len(tx.Ins) != 1 || len(tx.Outs) != 1 || tx.Locktime != 0 {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+	if in := tx.Ins[0]; !bytes.Equal(in.PrevTxHash, make([]byte, 32)) || in.PrevTxoutIndex != -1 || len(in.Script) != 0x27 || in.Sequence != 0 {
+		t.Errorf("unexpected coinbase input %+v", in)
+	}
+	if out := tx.Outs[0]; out.Value != 200000000 || block.Hx(out.Script) != "76a914d824c23fda79ac92294e2174c01bc303d6bab4f488ac" {
+		t.Errorf("unexpected output %+v", out)
+	}
+	if re, err := block.Encode(b); err != nil || !bytes.Equal(re, raw) {
+		t.Error("block does not encode back to the same bytes", err)
+	}
+	if re, err := block.EncodeTx(tx); err != nil || block.Hx(re) != testBlockTx {
+		t.Error("transaction does not encode back to the same bytes", err)
+	}
+	txRaw, _ := hex.DecodeString(testBlockTx)
+	if decoded, err := block.DecodeTx(txRaw); err != nil || !reflect.DeepEqual(decoded, tx) {
+		t.Error("transaction decoded on its own differs", err)
+	}
+}
+
+// testBlock returns a block with two transactions, using the longer forms of compact ints for a script length and an output count
+func testBlock() block.Raw {
+	prev := make([]byte, 32)
+	for i := range prev {
+		prev[i] = byte(i)
+	}
+	outs := make([]block.TxOut, 300)
+	for i := range outs {
+		outs[i] = block.TxOut{Value: uint64(i) << 40, Script: []byte{0x51}}
+	}
+	return block.Raw{
+		Version: 2, HashPrevBlock: prev, HashMerkleRoot: prev, Time: 1449631080, Bits: []byte{0x1c, 0x33, 0xd8, 0x2a}, Nonce: 7,
+		Transactions: []block.Tx{{
+			Version: 1,
+			Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, 2}, Sequence: ^uint32(0)}},
+			Outs:    []block.TxOut{{Value: 5000000000, Script: bytes.Repeat([]byte{0x6a}, 0x1234)}},
+		}, {
+			Version:  1,
+			Ins:      []block.TxIn{{PrevTxHash: prev, PrevTxoutIndex: 3, Sequence: 0xfffffffe}},
+			Outs:     outs,
+			Locktime: 102920,
+		}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := testBlock()
+	raw, err := block.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := block.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, b) {
+		t.Error("block differs after encoding and decoding")
+	}
+	_, txs, err := block.Split(raw)
+	if err != nil || len(txs) != 2 {
+		t.Fatal("split", len(txs), err)
+	}
+	if re, err := block.EncodeTx(b.Transactions[1]); err != nil || !bytes.Equal(re, txs[1]) {
+		t.Error("transaction encoded on its own differs", err)
+	}
+
+	// a stream of blocks
+	var buf bytes.Buffer
+	raw102920, _ := hex.DecodeString(testBlockRaw)
+	buf.Write(raw102920)
+	if err = block.WriteBlock(&buf, b); err != nil {
+		t.Fatal(err)
+	}
+	if first, err := block.ReadBlock(&buf); err != nil || first.Nonce != 4016375539 {
+		t.Error("first block of the stream", err)
+	}
+	if second, err := block.ReadBlock(&buf); err != nil || !reflect.DeepEqual(second, b) {
+		t.Error("second block of the stream", err)
+	}
+	if _, err = block.ReadBlock(&buf); err != io.EOF {
+		t.Error("expected the end of the stream, got", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	raw, _ := hex.DecodeString(testBlockRaw)
+	for i := 0; i < len(raw); i++ {
+		if _, err := block.Decode(raw[:i]); err != block.ErrTruncated {
+			t.Fatal("expected truncated error at length", i, "got", err)
+		}
+		if i > 0 {
+			if _, err := block.ReadBlock(bytes.NewReader(raw[:i])); err != block.ErrTruncated {
+				t.Fatal("expected truncated error reading length", i, "got", err)
+			}
+		}
+	}
+	if _, err := block.Decode(append(raw, 0)); err != block.ErrTrailingData {
+		t.Error("expected trailing data error, got", err)
+	}
+	// the transaction count of 1 in three bytes
+	long := append(append(append([]byte{}, raw[:block.HeaderSize]...), 0xFD, 1, 0), raw[block.HeaderSize+1:]...)
+	if _, err := block.Decode(long); err != block.ErrNonCanonical {
+		t.Error("expected non-canonical error, got", err)
+	}
+	// an input script claimed to be 4GB long
+	script := block.HeaderSize + 1 + 4 + 1 + 36
+	huge := append(append(append([]byte{}, raw[:script]...), 0xFE, 0xff, 0xff, 0xff, 0xff), raw[script+1:]...)
+	if _, err := block.Decode(huge); err != block.ErrTooLarge {
+		t.Error("expected too large error, got", err)
+	}
+
+	b := testBlock()
+	b.Transactions[1].Ins[0].PrevTxHash = make([]byte, 31)
+	if _, err := block.Encode(b); err == nil {
+		t.Error("encoded a short hash")
+	}
+	b = testBlock()
+	b.Bits = nil
+	if _, err := block.Encode(b); err == nil {
+		t.Error("encoded without bits")
+	}
+}
+
+func TestCompactInt(t *testing.T) {
+	for _, c := range []struct {
+		v   uint64
+		hex string
+	}{
+		{0, "00"},
+		{0xFC, "fc"},
+		{0xFD, "fdfd00"},
+		{0xFFFF, "fdffff"},
+		{0x10000, "fe00000100"},
+		{0xFFFFFFFF, "feffffffff"},
+		{0x100000000, "ff0000000001000000"},
+	} {
+		enc := block.AppendCompactInt([]byte{0xAA}, c.v)
+		if block.Hx(enc) != "aa"+c.hex {
+			t.Errorf("%#x encoded as %x, want %s", c.v, enc[1:], c.hex)
+		}
+		v, rest, err := block.ReadCompactInt(append(enc[1:], 0xBB))
+		if err != nil || v != c.v || !bytes.Equal(rest, []byte{0xBB}) {
+			t.Errorf("%s decoded as %#x, %v", c.hex, v, err)
+		}
+		for i := 0; i < len(enc)-1; i++ {
+			if _, _, err = block.ReadCompactInt(enc[1 : 1+i]); err != block.ErrTruncated {
+				t.Errorf("%s cut to %d bytes: expected truncated error, got %v", c.hex, i, err)
+			}
+		}
+	}
+	for _, long := range []string{"fdfc00", "feffff0000", "ffffffffff00000000"} {
+		in, _ := hex.DecodeString(long)
+		if _, _, err := block.ReadCompactInt(in); err != block.ErrNonCanonical {
+			t.Errorf("%s: expected non-canonical error, got %v", long, err)
+		}
+	}
+}
@@ -1,98 +1,169 @@
 package block
 
 import (
-	"github.com/parallelcointeam/duo/pkg/core"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 )
 
-// Decode reads a protocol serialised block and returns the raw block structure
-func Decode(in []byte) (out Raw) {
+// MaxBlockSize is the largest serialised block the full node accepts, which also bounds every count and length read from serialised data, so corrupt data cannot make the decoder allocate more
+const MaxBlockSize = 1000000
 
-	in, t := split(in, 4)
-	core.BytesToInt(&out.Version, &t)
-
-	in, t = split(in, 32)
-	out.HashPrevBlock = *rev(t)
-
-	in, t = split(in, 32)
-	out.HashMerkleRoot = *rev(t)
-
-	in, t = split(in, 4)
-	core.BytesToInt(&out.Time, &t)
-
-	in, t = split(in, 4)
-	out.Bits = *rev(t)
-
-	in, t = split(in, 4)
-	core.BytesToInt(&out.Nonce, &t)
-
-	var txCount uint64
-	var txCountIface interface{}
-	in, txCountIface = ExtractCompactInt(txCount, in)
-	txCount = txCountIface.(uint64)
-
-	txc := int(txCount)
-	for txs := 0; txs < txc; txs++ {
-
-		var tx Tx
-		out.Transactions = append(out.Transactions, tx)
-
-		var t []byte
-		in, t = split(in, 4)
-		core.BytesToInt(&out.Transactions[txs].Version, &t)
-
-		var txV uint32
-		var txVi uint64
-		var txI interface{}
-		in, txI = ExtractCompactInt(txVi, in)
-		txiV := int(txI.(uint64))
-
-		for txis := 0; txis < txiV; txis++ {
-			var txIn TxIn
-
-			in, txIn.PrevTxHash = split(in, 32)
+var (
+	// ErrTooLarge is returned when serialised data holds a count or length larger than a block can hold
+	ErrTooLarge = errors.New("block data holds a count or length too large for a block")
+	// ErrNonCanonical is returned when serialised data holds a compact int that is not in its shortest form, which would not encode back to the same bytes
+	ErrNonCanonical = errors.New("block data holds a compact int that is not in its shortest form")
+	// ErrTrailingData is returned by Decode and DecodeTx when the input goes on after the end of the block or transaction
+	ErrTrailingData = errors.New("data after the end of the block or transaction")
+)
 
-			in, t = split(in, 4)
-			core.BytesToInt(&txIn.PrevTxoutIndex, &t)
+// Decode reads a protocol serialised block and returns the raw block structure. It returns ErrTruncated if the input ends before the block does and ErrTrailingData if it goes on after it.
+func Decode(in []byte) (out Raw, err error) {
+	rd := bytes.NewReader(in)
+	if out, err = ReadBlock(rd); err == io.EOF {
+		err = ErrTruncated
+	}
+	if err == nil && rd.Len() > 0 {
+		err = ErrTrailingData
+	}
+	return
+}
 
-			var txsl interface{}
-			in, txsl = ExtractCompactInt(txV, in)
-			txV = txsl.(uint32)
+// DecodeTx reads a protocol serialised transaction, as Decode does a block
+func DecodeTx(in []byte) (out Tx, err error) {
+	rd := bytes.NewReader(in)
+	if out, err = ReadTx(rd); err == io.EOF {
+		err = ErrTruncated
+	}
+	if err == nil && rd.Len() > 0 {
+		err = ErrTrailingData
+	}
+	return
+}
 
-			txIn.Script = make([]byte, txV)
-			copy(txIn.Script, in[:txV])
-			in = in[txV:]
+// ReadBlock reads a protocol serialised block from a stream, reading no further than its end, so a stream of blocks can be read one after the other. It returns io.EOF if the stream ends before the block starts, and ErrTruncated if it ends part way through it.
+func ReadBlock(r io.Reader) (out Raw, err error) {
+	rd := &reader{r: r}
+	out.Version = rd.uint32()
+	if rd.err == io.EOF && rd.n == 0 {
+		return out, io.EOF
+	}
+	out.HashPrevBlock = rd.hash()
+	out.HashMerkleRoot = rd.hash()
+	out.Time = rd.uint32()
+	out.Bits = *rev(rd.bytes(4))
+	out.Nonce = rd.uint32()
+	for n, i := rd.compactInt(), uint64(0); i < n && rd.err == nil; i++ {
+		out.Transactions = append(out.Transactions, rd.tx())
+	}
+	return out, rd.error()
+}
 
-			t = in[:4]
-			core.BytesToInt(&txIn.Sequence, &t)
-			in = in[4:]
+// ReadTx reads a protocol serialised transaction from a stream, as ReadBlock does a block
+func ReadTx(r io.Reader) (out Tx, err error) {
+	rd := &reader{r: r}
+	out = rd.tx()
+	if rd.err == io.EOF && rd.n == 0 {
+		return out, io.EOF
+	}
+	return out, rd.error()
+}
 
-			out.Transactions[txs].Ins = append(out.Transactions[txs].Ins, txIn)
-		}
+// reader reads the fields of serialised blocks from a stream, keeping the first error so a whole structure can be read before checking it
+type reader struct {
+	r   io.Reader
+	err error
+	// n is the number of bytes read
+	n   int
+	buf [9]byte
+}
 
-		in, txI = ExtractCompactInt(txV, in)
-		txoV := int(txI.(uint32))
+// error returns the first error reading, with the stream ending treated as the data being truncated
+func (rd *reader) error() error {
+	if rd.err == io.EOF || rd.err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return rd.err
+}
 
-		for txos := 0; txos < txoV; txos++ {
+// full fills b from the stream
+func (rd *reader) full(b []byte) {
+	if rd.err != nil {
+		return
+	}
+	var n int
+	n, rd.err = io.ReadFull(rd.r, b)
+	rd.n += n
+}
 
-			var txOut TxOut
+// bytes reads n bytes into a new slice, or returns nil if n is zero
+func (rd *reader) bytes(n uint64) []byte {
+	if rd.err != nil || n == 0 {
+		return nil
+	}
+	if n > MaxBlockSize {
+		rd.err = ErrTooLarge
+		return nil
+	}
+	b := make([]byte, n)
+	rd.full(b)
+	return b
+}
 
-			tx1val := in[:8]
-			in = in[8:]
-			core.BytesToInt(&txOut.Value, &tx1val)
+// hash reads a 32 byte hash and returns it in the byte order it is shown in
+func (rd *reader) hash() []byte {
+	return *rev(rd.bytes(32))
+}
 
-			in, txI = ExtractCompactInt(txV, in)
-			txV = txI.(uint32)
+func (rd *reader) uint32() uint32 {
+	rd.full(rd.buf[:4])
+	return binary.LittleEndian.Uint32(rd.buf[:4])
+}
 
-			txOut.Script = make([]byte, txV)
-			copy(txOut.Script, in[:txV])
-			in = in[txV:]
+func (rd *reader) uint64() uint64 {
+	rd.full(rd.buf[:8])
+	return binary.LittleEndian.Uint64(rd.buf[:8])
+}
 
-			out.Transactions[txs].Outs = append(out.Transactions[txs].Outs, txOut)
-		}
-		var lockb []byte
-		in, lockb = split(in, 4)
-		core.BytesToInt(out.Transactions[txs].Locktime, &lockb)
+// compactInt reads a protocol compact int with ReadCompactInt, rejecting one larger than a block can hold
+func (rd *reader) compactInt() (v uint64) {
+	rd.full(rd.buf[:1])
+	if rd.err != nil {
+		return 0
+	}
+	size := compactIntSize(rd.buf[0])
+	rd.full(rd.buf[1:size])
+	if rd.err != nil {
+		return 0
 	}
+	if v, _, rd.err = ReadCompactInt(rd.buf[:size]); rd.err == nil && v > MaxBlockSize {
+		rd.err = ErrTooLarge
+	}
+	if rd.err != nil {
+		return 0
+	}
+	return v
+}
 
+// tx reads a transaction
+func (rd *reader) tx() (tx Tx) {
+	tx.Version = rd.uint32()
+	for n, i := rd.compactInt(), uint64(0); i < n && rd.err == nil; i++ {
+		var in TxIn
+		in.PrevTxHash = rd.hash()
+		in.PrevTxoutIndex = int32(rd.uint32())
+		in.Script = rd.bytes(rd.compactInt())
+		in.Sequence = rd.uint32()
+		tx.Ins = append(tx.Ins, in)
+	}
+	for n, i := rd.compactInt(), uint64(0); i < n && rd.err == nil; i++ {
+		var out TxOut
+		out.Value = rd.uint64()
+		out.Script = rd.bytes(rd.compactInt())
+		tx.Outs = append(tx.Outs, out)
+	}
+	tx.Locktime = rd.uint32()
 	return
 }
@@ -1,34 +1,108 @@
 package block
 
-import "github.com/parallelcointeam/duo/pkg/core"
-
-// Encode turns a completed block data structure into a serialised stream in protocol format
-func Encode(in Raw) (out []byte) {
-	out = append(out, *core.IntToBytes(in.Version)...)
-	out = append(out, *rev(in.HashPrevBlock)...)
-	out = append(out, *rev(in.HashMerkleRoot)...)
-	out = append(out, *core.IntToBytes(in.Time)...)
-	out = append(out, *rev(in.Bits)...)
-	out = append(out, *core.IntToBytes(in.Nonce)...)
-	out = AppendCompactInt(out, len(in.Transactions))
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encode turns a completed block data structure into a serialised stream in protocol format. It returns an error if a hash is not 32 bytes long or the bits not 4, as the block could not be decoded again.
+func Encode(in Raw) (out []byte, err error) {
+	var buf bytes.Buffer
+	if err = WriteBlock(&buf, in); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// EncodeTx serialises a transaction in protocol format, as Encode does a block
+func EncodeTx(in Tx) (out []byte, err error) {
+	var buf bytes.Buffer
+	if err = WriteTx(&buf, in); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteBlock writes a block to a stream in protocol format, as Encode does
+func WriteBlock(w io.Writer, in Raw) error {
+	wr := &writer{w: w}
+	wr.uint32(in.Version)
+	wr.hash("previous block hash", in.HashPrevBlock)
+	wr.hash("merkle root", in.HashMerkleRoot)
+	wr.uint32(in.Time)
+	if len(in.Bits) != 4 && wr.err == nil {
+		wr.err = fmt.Errorf("bits are %d bytes long, not 4", len(in.Bits))
+	}
+	wr.bytes(*rev(in.Bits))
+	wr.uint32(in.Nonce)
+	wr.compactInt(uint64(len(in.Transactions)))
 	for i := range in.Transactions {
-		out = append(out, *core.IntToBytes(in.Transactions[i].Version)...)
-		T := in.Transactions[i]
-		out = AppendCompactInt(out, len(T.Ins))
-		for ins := range T.Ins {
-			out = append(out, T.Ins[ins].PrevTxHash...)
-			out = append(out, *core.IntToBytes(T.Ins[ins].PrevTxoutIndex)...)
-			out = AppendCompactInt(out, len(T.Ins[ins].Script))
-			out = append(out, T.Ins[ins].Script...)
-			out = append(out, *core.IntToBytes(T.Ins[ins].Sequence)...)
-		}
-		out = AppendCompactInt(out, len(T.Outs))
-		for outs := range T.Outs {
-			out = append(out, *core.IntToBytes(T.Outs[outs].Value)...)
-			out = AppendCompactInt(out, len(T.Outs[outs].Script))
-			out = append(out, T.Outs[outs].Script...)
-		}
-		out = append(out, *core.IntToBytes(uint32(in.Transactions[i].Locktime))...)
-	}
-	return
+		wr.tx(&in.Transactions[i])
+	}
+	return wr.err
+}
+
+// WriteTx writes a transaction to a stream in protocol format, as EncodeTx does
+func WriteTx(w io.Writer, in Tx) error {
+	wr := &writer{w: w}
+	wr.tx(&in)
+	return wr.err
+}
+
+// writer writes the fields of serialised blocks to a stream, keeping the first error so a whole structure can be written before checking it
+type writer struct {
+	w   io.Writer
+	err error
+	buf [9]byte
+}
+
+func (wr *writer) bytes(b []byte) {
+	if wr.err == nil {
+		_, wr.err = wr.w.Write(b)
+	}
+}
+
+// hash writes a 32 byte hash given in the byte order it is shown in
+func (wr *writer) hash(name string, h []byte) {
+	if len(h) != 32 && wr.err == nil {
+		wr.err = fmt.Errorf("%s is %d bytes long, not 32", name, len(h))
+	}
+	wr.bytes(*rev(h))
+}
+
+func (wr *writer) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(wr.buf[:4], v)
+	wr.bytes(wr.buf[:4])
+}
+
+func (wr *writer) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(wr.buf[:8], v)
+	wr.bytes(wr.buf[:8])
+}
+
+// compactInt writes a protocol compact int in its shortest form
+func (wr *writer) compactInt(v uint64) {
+	wr.bytes(AppendCompactInt(wr.buf[:0], v))
+}
+
+// tx writes a transaction
+func (wr *writer) tx(tx *Tx) {
+	wr.uint32(tx.Version)
+	wr.compactInt(uint64(len(tx.Ins)))
+	for _, in := range tx.Ins {
+		wr.hash("previous transaction hash", in.PrevTxHash)
+		wr.uint32(uint32(in.PrevTxoutIndex))
+		wr.compactInt(uint64(len(in.Script)))
+		wr.bytes(in.Script)
+		wr.uint32(in.Sequence)
+	}
+	wr.compactInt(uint64(len(tx.Outs)))
+	for _, out := range tx.Outs {
+		wr.uint64(out.Value)
+		wr.compactInt(uint64(len(out.Script)))
+		wr.bytes(out.Script)
+	}
+	wr.uint32(tx.Locktime)
 }
@@ -0,0 +1,7 @@
+package block
+
+// Rev and Hx expose the byte helpers to the external tests
+var (
+	Rev = rev
+	Hx  = hx
+)
@@ -0,0 +1,43 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// doubleHash returns the double SHA256 hash of data in the serialised byte order, the reverse of the order it is shown in
+func doubleHash(data []byte) []byte {
+	first := sha256.Sum256(data)
+	h := sha256.Sum256(first[:])
+	return h[:]
+}
+
+// Hash returns the block hash, the double SHA256 hash of the serialised header, in the byte order it is shown in. The full node shows it as the block's hash whatever the proof of work algorithm of the block, which has its own pow_hash. It returns an error if the header does not serialise, as Encode does.
+func (r Raw) Hash() ([]byte, error) {
+	var buf bytes.Buffer
+	r.Transactions = nil
+	if err := WriteBlock(&buf, r); err != nil {
+		return nil, err
+	}
+	return *rev(doubleHash(buf.Bytes()[:HeaderSize])), nil
+}
+
+// TxID returns the id of the transaction, the double SHA256 hash of its serialised form, in the byte order it is shown in. It returns an error if the transaction does not serialise, as EncodeTx does.
+func (tx Tx) TxID() ([]byte, error) {
+	raw, err := EncodeTx(tx)
+	if err != nil {
+		return nil, err
+	}
+	return *rev(doubleHash(raw)), nil
+}
+
+// TxIDs returns the ids of the block's transactions in order
+func (r Raw) TxIDs() (txids [][]byte, err error) {
+	txids = make([][]byte, len(r.Transactions))
+	for i := range r.Transactions {
+		if txids[i], err = r.Transactions[i].TxID(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
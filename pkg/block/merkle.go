@@ -0,0 +1,149 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMerkleRoot is returned when a block's merkle root is not the one of its transactions
+	ErrMerkleRoot = errors.New("merkle root does not match the block's transactions")
+	// ErrDuplicateTx is returned when a block holds the same transaction more than once, which the full node rejects as the merkle root would be the same as with one copy of it
+	ErrDuplicateTx = errors.New("block holds the same transaction more than once")
+)
+
+// MerkleProof shows that a transaction is in a block to someone who only has the block's header, by giving the hashes needed to compute the merkle root from the transaction's id
+type MerkleProof struct {
+	// TxID is the id of the transaction, in the byte order it is shown in
+	TxID []byte
+	// Index is the position of the transaction in the block
+	Index int
+	// Branch is the other hash paired with the transaction's branch at each level of the tree, from the transactions up, in the byte order they are shown in
+	Branch [][]byte
+}
+
+// merkleLevel returns the level of a merkle tree above a level of hashes in the serialised byte order. Each hash is paired with the next, and the last with itself if there is an odd number of them, as the full node does.
+func merkleLevel(level [][]byte) (up [][]byte) {
+	for i := 0; i < len(level); i += 2 {
+		j := i + 1
+		if j == len(level) {
+			j = i
+		}
+		up = append(up, merkleHash(level[i], level[j]))
+	}
+	return
+}
+
+// merkleHash returns the double SHA256 hash of a pair of hashes in the serialised byte order
+func merkleHash(left, right []byte) []byte {
+	return doubleHash(append(append(make([]byte, 0, 64), left...), right...))
+}
+
+// serialised returns hashes given in the byte order they are shown in reversed into the serialised byte order
+func serialised(hashes [][]byte) (out [][]byte) {
+	out = make([][]byte, len(hashes))
+	for i := range hashes {
+		out[i] = *rev(hashes[i])
+	}
+	return
+}
+
+// MerkleRoot returns the merkle root of transactions by their ids, both in the byte order they are shown in. The ids are hashed in pairs to make the level of the tree above them, with the last one paired with itself if there is an odd number, and so on up to a single hash. The merkle root of no transactions is all zero, as the full node has it.
+func MerkleRoot(txids [][]byte) []byte {
+	if len(txids) == 0 {
+		return make([]byte, 32)
+	}
+	level := serialised(txids)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return *rev(level[0])
+}
+
+// MerkleBranch returns the branch of a merkle proof of the transaction at an index in a list of transaction ids, in the byte order they are shown in, or nil if the index is out of range
+func MerkleBranch(txids [][]byte, index int) (branch [][]byte) {
+	if index < 0 || index >= len(txids) {
+		return nil
+	}
+	branch = [][]byte{}
+	for level := serialised(txids); len(level) > 1; level, index = merkleLevel(level), index/2 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = len(level) - 1
+		}
+		branch = append(branch, *rev(level[sibling]))
+	}
+	return
+}
+
+// ComputeMerkleRoot returns the merkle root of the block's transactions, in the byte order it is shown in
+func (r Raw) ComputeMerkleRoot() ([]byte, error) {
+	txids, err := r.TxIDs()
+	if err != nil {
+		return nil, err
+	}
+	return MerkleRoot(txids), nil
+}
+
+// CheckMerkleRoot checks that the block's merkle root is the one of its transactions, so the transactions are the ones the header was mined with. It returns ErrDuplicateTx if a transaction is in the block twice, which the merkle root cannot tell from some blocks where it is not, and ErrMerkleRoot if the root does not match.
+func (r Raw) CheckMerkleRoot() error {
+	txids, err := r.TxIDs()
+	if err != nil {
+		return err
+	}
+	return VerifyMerkleRoot(r.HashMerkleRoot, txids)
+}
+
+// VerifyMerkleRoot is CheckMerkleRoot for a caller that already has the ids of the block's transactions, in the order they are in the block, so they are not hashed again
+func VerifyMerkleRoot(root []byte, txids [][]byte) error {
+	seen := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		if seen[string(txid)] {
+			return ErrDuplicateTx
+		}
+		seen[string(txid)] = true
+	}
+	if !bytes.Equal(MerkleRoot(txids), root) {
+		return ErrMerkleRoot
+	}
+	return nil
+}
+
+// MerkleProof returns a proof that the transaction at an index is in the block
+func (r Raw) MerkleProof(index int) (p *MerkleProof, err error) {
+	if index < 0 || index >= len(r.Transactions) {
+		return nil, fmt.Errorf("block has no transaction %d", index)
+	}
+	txids, err := r.TxIDs()
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleProof{TxID: txids[index], Index: index, Branch: MerkleBranch(txids, index)}, nil
+}
+
+// Root returns the merkle root the proof leads to, in the byte order it is shown in, or nil if a hash in the proof is not 32 bytes long. At each level the branch hash goes on the left if the transaction's branch is on the right, which is when that bit of the index is set.
+func (p *MerkleProof) Root() []byte {
+	if len(p.TxID) != 32 || p.Index < 0 {
+		return nil
+	}
+	h, index := *rev(p.TxID), p.Index
+	for _, other := range p.Branch {
+		if len(other) != 32 {
+			return nil
+		}
+		if index&1 == 1 {
+			h = merkleHash(*rev(other), h)
+		} else {
+			h = merkleHash(h, *rev(other))
+		}
+		index >>= 1
+	}
+	return *rev(h)
+}
+
+// Verify returns true if the proof leads to a merkle root, in the byte order it is shown in, such as the HashMerkleRoot of a block header
+func (p *MerkleProof) Verify(root []byte) bool {
+	r := p.Root()
+	return r != nil && bytes.Equal(r, root)
+}
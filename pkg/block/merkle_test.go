@@ -0,0 +1,141 @@
+package block_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+)
+
+const testBlockHash = "a0aa90c9392f7c9f413017b2224abbfd9336da779534902d273912c5321ae3e7"
+
+func TestHashes(t *testing.T) {
+	raw, _ := hex.DecodeString(testBlockRaw)
+	b, err := block.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := b.Hash(); err != nil || block.Hx(hash) != testBlockHash {
+		t.Errorf("block hash %x, want %s, %v", hash, testBlockHash, err)
+	}
+	if txid, err := b.Transactions[0].TxID(); err != nil || block.Hx(txid) != testBlockMerkle {
+		t.Errorf("txid %x, want %s, %v", txid, testBlockMerkle, err)
+	}
+	if root, err := b.ComputeMerkleRoot(); err != nil || !bytes.Equal(root, b.HashMerkleRoot) {
+		t.Error("merkle root of a single transaction is not its id", err)
+	}
+	if err = b.CheckMerkleRoot(); err != nil {
+		t.Error(err)
+	}
+	p, err := b.MerkleProof(0)
+	if err != nil || len(p.Branch) != 0 || !p.Verify(b.HashMerkleRoot) {
+		t.Error("proof of the only transaction", p, err)
+	}
+	if _, err = b.MerkleProof(1); err == nil {
+		t.Error("proof of a transaction not in the block")
+	}
+	b.HashPrevBlock = b.HashPrevBlock[1:]
+	if _, err = b.Hash(); err == nil {
+		t.Error("hashed a header with a short hash")
+	}
+}
+
+// TestMerkleRoot checks the merkle root of a block of the Bitcoin chain, which the Parallelcoin full node builds the same way
+func TestMerkleRoot(t *testing.T) {
+	var txids [][]byte
+	for _, s := range []string{
+		"8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87",
+		"fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4",
+		"6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4",
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	} {
+		txid, _ := hex.DecodeString(s)
+		txids = append(txids, txid)
+	}
+	if root := block.Hx(block.MerkleRoot(txids)); root != "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766" {
+		t.Error("merkle root of bitcoin block 100000 is", root)
+	}
+
+	// with an odd number the last hash is paired with itself
+	pair := func(a, b []byte) []byte {
+		first := sha256.Sum256(append(*block.Rev(a), *block.Rev(b)...))
+		h := sha256.Sum256(first[:])
+		return *block.Rev(h[:])
+	}
+	want := pair(pair(txids[0], txids[1]), pair(txids[2], txids[2]))
+	if root := block.MerkleRoot(txids[:3]); !bytes.Equal(root, want) {
+		t.Errorf("merkle root of three transactions %x, want %x", root, want)
+	}
+	if root := block.MerkleRoot(nil); !bytes.Equal(root, make([]byte, 32)) {
+		t.Error("merkle root of no transactions is not zero")
+	}
+}
+
+// testTxs returns n transactions with different ids
+func testTxs(n int) (txs []block.Tx) {
+	for i := 0; i < n; i++ {
+		txs = append(txs, block.Tx{
+			Version: 1,
+			Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, byte(i)}, Sequence: ^uint32(0)}},
+			Outs:    []block.TxOut{{Value: 5000000000, Script: []byte{0x51}}},
+		})
+	}
+	return
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		b := block.Raw{HashPrevBlock: make([]byte, 32), Bits: make([]byte, 4), Transactions: testTxs(n)}
+		root, err := b.ComputeMerkleRoot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.CheckMerkleRoot(); err != block.ErrMerkleRoot {
+			t.Error("expected merkle root error, got", err)
+		}
+		b.HashMerkleRoot = root
+		if err = b.CheckMerkleRoot(); err != nil {
+			t.Error(n, "transactions:", err)
+		}
+		for i := 0; i < n; i++ {
+			p, err := b.MerkleProof(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !p.Verify(root) {
+				t.Errorf("proof of transaction %d of %d does not verify", i, n)
+			}
+			if n == 1 {
+				continue
+			}
+			// the same hashes claimed for another position
+			moved := *p
+			moved.Index ^= 1
+			if moved.Index < n && moved.Verify(root) && !bytes.Equal(p.Branch[0], p.TxID) {
+				t.Errorf("proof of transaction %d of %d verifies at %d", i, n, moved.Index)
+			}
+			tampered := *p
+			tampered.Branch = append([][]byte{*block.Rev(p.Branch[0])}, p.Branch[1:]...)
+			if tampered.Verify(root) {
+				t.Errorf("tampered proof of transaction %d of %d verifies", i, n)
+			}
+		}
+	}
+}
+
+// TestDuplicateTx checks that repeating the last transaction of a block, which leaves the merkle root the same, is caught
+func TestDuplicateTx(t *testing.T) {
+	txs := testTxs(3)
+	b := block.Raw{HashPrevBlock: make([]byte, 32), Bits: make([]byte, 4), Transactions: txs}
+	b.HashMerkleRoot, _ = b.ComputeMerkleRoot()
+	mutated := b
+	mutated.Transactions = append(txs[:3:3], txs[2])
+	if root, _ := mutated.ComputeMerkleRoot(); !bytes.Equal(root, b.HashMerkleRoot) {
+		t.Fatal("merkle root changed by repeating the last transaction")
+	}
+	if err := mutated.CheckMerkleRoot(); err != block.ErrDuplicateTx {
+		t.Error("expected duplicate transaction error, got", err)
+	}
+}
@@ -0,0 +1,90 @@
+package block
+
+import "errors"
+
+// HeaderSize is the length of a serialised block header
+const HeaderSize = 80
+
+// ErrTruncated is returned when serialised data ends before the structure it encodes
+var ErrTruncated = errors.New("block data is truncated")
+
+// Split separates a protocol serialised block into its header and the serialised form of each of its transactions, which is what the transaction ids are hashed from, without decoding the transactions. It returns ErrTruncated if the input ends before the block does.
+func Split(in []byte) (header []byte, txs [][]byte, err error) {
+	if len(in) < HeaderSize {
+		return nil, nil, ErrTruncated
+	}
+	header, in = in[:HeaderSize], in[HeaderSize:]
+	count, in, err := ReadCompactInt(in)
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < count; i++ {
+		var n int
+		if n, err = txLength(in); err != nil {
+			return
+		}
+		txs = append(txs, in[:n])
+		in = in[n:]
+	}
+	return
+}
+
+// txLength returns the length of the serialised transaction at the start of the input
+func txLength(in []byte) (n int, err error) {
+	// skip advances past a field of fixed length
+	skip := func(l uint64) error {
+		if uint64(len(in)-n) < l {
+			return ErrTruncated
+		}
+		n += int(l)
+		return nil
+	}
+	// compact reads a compact int and advances past it
+	compact := func() (uint64, error) {
+		v, rest, err := ReadCompactInt(in[n:])
+		if err == nil {
+			n = len(in) - len(rest)
+		}
+		return v, err
+	}
+	if err = skip(4); err != nil {
+		return
+	}
+	ins, err := compact()
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < ins; i++ {
+		if err = skip(36); err != nil {
+			return
+		}
+		var l uint64
+		if l, err = compact(); err != nil {
+			return
+		}
+		if err = skip(l); err != nil {
+			return
+		}
+		if err = skip(4); err != nil {
+			return
+		}
+	}
+	outs, err := compact()
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < outs; i++ {
+		if err = skip(8); err != nil {
+			return
+		}
+		var l uint64
+		if l, err = compact(); err != nil {
+			return
+		}
+		if err = skip(l); err != nil {
+			return
+		}
+	}
+	err = skip(4)
+	return
+}
@@ -0,0 +1,34 @@
+package block_test
+
+import (
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+)
+
+func TestSplit(t *testing.T) {
+	tx := block.Tx{
+		Version: 1,
+		Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, 2, 3}}},
+		Outs:    []block.TxOut{{Value: 1, Script: []byte{0x51}}, {Value: 2, Script: nil}},
+	}
+	raw, err := block.Encode(block.Raw{
+		HashPrevBlock: make([]byte, 32), HashMerkleRoot: make([]byte, 32), Bits: make([]byte, 4),
+		Transactions: []block.Tx{tx, tx},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, txs, err := block.Split(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != block.HeaderSize || len(txs) != 2 || len(txs[0]) != 4+1+36+1+3+4+1+8+1+1+8+1+4 {
+		t.Error("unexpected split", len(header), len(txs))
+	}
+	for i := 0; i < len(raw); i++ {
+		if _, _, err = block.Split(raw[:i]); err != block.ErrTruncated {
+			t.Fatal("expected truncated error at length", i, "got", err)
+		}
+	}
+}
@@ -1,18 +1,22 @@
-package block
+package block_test
 
 import (
 	"bytes"
-	"crypto/rand"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/anaskhan96/base58check"
 
 	"github.com/parallelcointeam/duo/gocoin/btc"
+	"github.com/parallelcointeam/duo/pkg/block"
 
 	"github.com/parallelcointeam/duo/pkg/core"
 	"github.com/parallelcointeam/duo/pkg/hash160"
 	"github.com/parallelcointeam/duo/pkg/key"
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
 	"github.com/parallelcointeam/duo/pkg/sync"
 )
 
@@ -33,21 +37,75 @@ Transactions
 
 */
 
+// testNode returns a node with its index in a temporary directory and an rpctest.Node serving it a mined chain, whose blocks 1 and 2 are mined with scrypt and sha256d and whose block 3 spends both their coinbases in one transaction, and a function that closes them and removes the directory
+func testNode(t *testing.T) (node *sync.Node, cleanup func()) {
+	to := rpctest.P2PKH("ajkviVcqSE518qMnqME8D9smwggWSyEogW")
+	coinbase := func(tag byte) block.Tx {
+		return block.Tx{
+			Version: 1,
+			Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, tag}, Sequence: ^uint32(0)}},
+			Outs:    []block.TxOut{{Value: rpctest.Subsidy, Script: to}},
+		}
+	}
+	a, b := coinbase(1), coinbase(2)
+	// a signature and a compressed public key, which are not checked
+	sig := append(append(append([]byte{71}, bytes.Repeat([]byte{0x30}, 71)...), 33, 2), bytes.Repeat([]byte{1}, 32)...)
+	spend := block.Tx{Version: 1, Outs: []block.TxOut{{Value: 2*rpctest.Subsidy - 1000000, Script: to}}}
+	for _, tx := range []block.Tx{a, b} {
+		id, _ := tx.TxID()
+		spend.Ins = append(spend.Ins, block.TxIn{PrevTxHash: id, Script: sig, Sequence: ^uint32(0)})
+	}
+	chain := []block.Raw{
+		{Version: 2, Transactions: []block.Tx{coinbase(0)}},
+		{Version: 514, Transactions: []block.Tx{a}},
+		{Version: 2, Transactions: []block.Tx{b}},
+		{Version: 2, Transactions: []block.Tx{coinbase(3), spend}},
+	}
+	prev := make([]byte, 32)
+	var raws [][]byte
+	for _, b := range chain {
+		b.HashPrevBlock, b.Bits = prev, make([]byte, 4)
+		b.HashMerkleRoot, _ = b.ComputeMerkleRoot()
+		raw, err := block.Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpctest.Mine(raw)
+		hash, _ := p2p.BlockHash(raw)
+		raws, prev = append(raws, raw), hash.Shown()
+	}
+
+	dir, err := ioutil.TempDir("", "block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := sync.DefaultConfig(sync.Mainnet)
+	cfg.DataDir = dir
+	if node, err = sync.NewNode(cfg); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	n := rpctest.NewNode(sync.Mainnet, raws)
+	node.RPC = n.Client()
+	return node, func() {
+		node.Close()
+		n.Close()
+		os.RemoveAll(dir)
+	}
+}
+
 func TestGetRawBlock(t *testing.T) {
-	node := sync.NewNode()
-	best := node.LegacyGetBestBlockHeight()
-	var B uint32
-	b := make([]byte, 4)
-	for i := 0; i < 20; i++ {
-		for {
-			rand.Read(b)
-			core.BytesToInt(&B, &b)
-			if B < best {
-				break
-			}
+	node, cleanup := testNode(t)
+	defer cleanup()
+	best, err := node.LegacyGetBestBlockHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for B := uint32(0); B <= best; B++ {
+		r, err := node.GetRawBlock(uint64(B))
+		if err != nil {
+			t.Fatal(err)
 		}
-		rb := node.GetRawBlock(uint64(B))
-		r := *rb
 
 		fmt.Println("BLOCK", B)
 
@@ -63,43 +121,43 @@ func TestGetRawBlock(t *testing.T) {
 		// 	fmt.Println(" : Scrypt PoW")
 		// }
 
-		// HashPrevBlock := *rev(r[:32])
+		// HashPrevBlock := *block.Rev(r[:32])
 		r = r[32:]
-		// fmt.Println("HashPrevBlock          ", hx(HashPrevBlock))
+		// fmt.Println("HashPrevBlock          ", block.Hx(HashPrevBlock))
 
-		// HashMerkleRoot := *rev(r[:32])
+		// HashMerkleRoot := *block.Rev(r[:32])
 		r = r[32:]
-		// fmt.Println("HashMerkleRoot         ", hx(HashMerkleRoot))
+		// fmt.Println("HashMerkleRoot         ", block.Hx(HashMerkleRoot))
 
 		ti := r[:4]
 		r = r[4:]
 		var t32 int32
 		core.BytesToInt(&t32, &ti)
 		// BlockTime := int64(t32)
-		// fmt.Println("Unix timestamp         ", hx(ti))
+		// fmt.Println("Unix timestamp         ", block.Hx(ti))
 		// fmt.Println("Time", time.Unix(BlockTime, 0))
 
-		// Bits := *rev(r[:4])
+		// Bits := *block.Rev(r[:4])
 		r = r[4:]
-		// fmt.Println("Bits                   ", hx(Bits))
+		// fmt.Println("Bits                   ", block.Hx(Bits))
 		// coeff := Bits[0]
 		// base := Bits[1:]
 		// tail := make([]byte, coeff-3)
 		// tgt := append(base, tail...)
 		// Target := append(make([]byte, 32-len(tgt)), tgt...)
-		// fmt.Println("                 Target", hx(Target))
+		// fmt.Println("                 Target", block.Hx(Target))
 
 		nn := r[:4]
-		nn = *rev(nn)
+		nn = *block.Rev(nn)
 		r = r[4:]
 		var Nonce uint32
 		core.BytesToInt(&Nonce, &nn)
 		// fmt.Println("Nonce                  ", Nonce)
 
-		var txCount uint64
-		var txCountIface interface{}
-		r, txCountIface = ExtractCompactInt(txCount, r)
-		txCount = txCountIface.(uint64)
+		txCount, r, err := block.ReadCompactInt(r)
+		if err != nil {
+			t.Fatal(err)
+		}
 		// fmt.Println("TxCount                 ", txCount)
 
 		txc := int(txCount)
@@ -123,22 +181,23 @@ func TestGetRawBlock(t *testing.T) {
 			// 	r = r[2:]
 			// }
 
-			var txV uint64
-			var txI interface{}
-			r, txI = ExtractCompactInt(txV, r)
-			txiV := int(txI.(uint64))
+			var txV, txI uint64
+			if txI, r, err = block.ReadCompactInt(r); err != nil {
+				t.Fatal(err)
+			}
+			txiV := int(txI)
 			// fmt.Println("    in-counter", txiV)
 
 			for txis := 0; txis < txiV; txis++ {
 
-				tx1pth := *rev(r[:32])
+				tx1pth := *block.Rev(r[:32])
 				r = r[32:]
 				// tx1txi := r[:4]
 				r = r[4:]
 
-				var txsl interface{}
-				r, txsl = ExtractCompactInt(txV, r)
-				txV = txsl.(uint64)
+				if txV, r, err = block.ReadCompactInt(r); err != nil {
+					t.Fatal(err)
+				}
 				// fmt.Println("     Txin script length", txV)
 				tx1scr := r[:txV]
 				r = r[txV:]
@@ -147,23 +206,27 @@ func TestGetRawBlock(t *testing.T) {
 				r = r[4:]
 				if bytes.Compare(make([]byte, 32), tx1pth) != 0 {
 					// fmt.Println("    Txin", txis)
-					// fmt.Println("             PrevTxHash", hx(tx1pth))
+					// fmt.Println("             PrevTxHash", block.Hx(tx1pth))
 
 					// GET VALUE OF PREVTX
-					value := uint64(node.GetTxValue(tx1pth) * float64(core.COIN))
+					txValue, err := node.GetTxValue(tx1pth)
+					if err != nil {
+						t.Fatal(err)
+					}
+					value := uint64(txValue * float64(core.COIN))
 					// fmt.Println("                 value", value)
 
 					// fmt.Printf("       Prev Txout Index %08x\n", tx1txi)
 
-					// fmt.Println("                 script", hx(tx1scr))
+					// fmt.Println("                 script", block.Hx(tx1scr))
 
 					var p1 string
 					if len(tx1scr) > 64 {
-						p1 = hx(tx1scr[1 : tx1scr[0]+1])
+						p1 = block.Hx(tx1scr[1 : tx1scr[0]+1])
 						// fmt.Println("           signature  ", p1)
 						if len(tx1scr) > len(p1)/2 {
-							rem := *rev(tx1scr[tx1scr[0]+2:])
-							k, _ := base58check.Encode(key.B58prefixes["mainnet"]["pubkey"], hx(*hash160.Sum(&rem)))
+							rem := *block.Rev(tx1scr[tx1scr[0]+2:])
+							k, _ := base58check.Encode(key.B58prefixes["mainnet"]["pubkey"], block.Hx(*hash160.Sum(&rem)))
 
 							fmt.Printf("    %s -%012d\n", k, value)
 
@@ -171,14 +234,16 @@ func TestGetRawBlock(t *testing.T) {
 							// fmt.Println("                    >>> Typical payment redemption")
 						}
 					}
-					// fmt.Println("             seq number", hx(tx1seq))
+					// fmt.Println("             seq number", block.Hx(tx1seq))
 				} else {
 					// fmt.Println(">>> Generation transaction")
 				}
 
 			}
-			r, txI = ExtractCompactInt(txV, r)
-			txoV := int(txI.(uint64))
+			if txI, r, err = block.ReadCompactInt(r); err != nil {
+				t.Fatal(err)
+			}
+			txoV := int(txI)
 			// fmt.Println("    out-counter", txoV)
 
 			for txos := 0; txos < txoV; txos++ {
@@ -193,8 +258,9 @@ func TestGetRawBlock(t *testing.T) {
 				core.BytesToInt(&value, &tx1val)
 				// fmt.Printf("                  value %4.7f\n", float64(tx1V)/core.COIN)
 
-				r, txI = ExtractCompactInt(txV, r)
-				txV = txI.(uint64)
+				if txV, r, err = block.ReadCompactInt(r); err != nil {
+					t.Fatal(err)
+				}
 				// fmt.Println("        Txout script length", txV)
 
 				tx1scro := r[:txV]
@@ -209,52 +275,67 @@ func TestGetRawBlock(t *testing.T) {
 
 					// fmt.Println("                    >>>", k)
 				} else {
-					// fmt.Println(">>>>>>>", hx(tx1scro[1:tx1scro[0]]))
+					// fmt.Println(">>>>>>>", block.Hx(tx1scro[1:tx1scro[0]]))
 					k := tx1scro[1:tx1scro[0]]
-					// fmt.Println(hx(k))
-					K, _ := base58check.Encode(key.B58prefixes["mainnet"]["pubkey"], hx(*hash160.Sum(&k)))
+					// fmt.Println(block.Hx(k))
+					K, _ := base58check.Encode(key.B58prefixes["mainnet"]["pubkey"], block.Hx(*hash160.Sum(&k)))
 					// fmt.Println(K, "+", value)
 					fmt.Printf("%s +%012d\n", K, value)
 
 					// fmt.Println("                    >>>", K)
-					// fmt.Println("                 script", hx(tx1scro))
+					// fmt.Println("                 script", block.Hx(tx1scro))
 				}
 
 			}
 			lockb := r[:4]
 			r = r[4:]
 			var lock uint32
-			core.BytesToInt(lock, &lockb)
+			core.BytesToInt(&lock, &lockb)
 			if lock != 0 {
 				fmt.Println("    locktime", lock)
 			}
 		}
-		// fmt.Println("Rest:\n", hx(r))
+		// fmt.Println("Rest:\n", block.Hx(r))
 		// fmt.Println()
 	}
 }
 
 func TestDecodeEncodeBlock(t *testing.T) {
-	b := make([]byte, 4)
-	node := sync.NewNode()
-	best := node.LegacyGetBestBlockHeight()
-	var B uint32
-	for i := 0; i < 10; i++ {
-		for {
-			rand.Read(b)
-			core.BytesToInt(&B, &b)
-			if B < best {
-				break
-			}
+	node, cleanup := testNode(t)
+	defer cleanup()
+	best, err := node.LegacyGetBestBlockHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chain has blocks mined with each algorithm and a transaction with several inputs
+	var sha256d, scrypt, multiInput bool
+	for B := uint32(0); B <= best; B++ {
+		in, err := node.GetRawBlock(uint64(B))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := block.Decode(in)
+		if err != nil {
+			t.Fatal("block", B, err)
+		}
+		re, err := block.Encode(out)
+		if err != nil || !bytes.Equal(re, in) {
+			t.Error("block", B, "does not encode back to the same bytes", err)
+		}
+		if err = out.CheckMerkleRoot(); err != nil {
+			t.Error("block", B, err)
 		}
-		rb := node.GetRawBlock(uint64(B))
-		in := *rb
-		fmt.Println("\nblock", B)
-		out := Decode(in)
-		// j, _ := json.MarshalIndent(out, "", "  ")
-		// fmt.Println(string(j))
-		re := Encode(out)
-		fmt.Println(hx(re))
-		fmt.Println(hx(in))
+		switch out.Version {
+		case 2:
+			sha256d = true
+		case 514:
+			scrypt = true
+		}
+		for _, tx := range out.Transactions {
+			multiInput = multiInput || len(tx.Ins) > 1
+		}
+	}
+	if !sha256d || !scrypt || !multiInput {
+		t.Error("blocks of some kinds not found", sha256d, scrypt, multiInput)
 	}
 }
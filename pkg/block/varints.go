@@ -1,12 +1,8 @@
 package block
 
-import (
-	"fmt"
+import "github.com/parallelcointeam/duo/pkg/core"
 
-	"github.com/parallelcointeam/duo/pkg/core"
-)
-
-// AppendCompactInt takes any type of integer and returns the CompactInt appended to a byte slice. This is for the bitcoin protocol format varint that stores up to FC in 1 byte, FD means two bytes with uint16 after, FE 4 bytes after, FF 8 bytes after. The bytes are in little-endian, with the MSB first
+// AppendCompactInt takes any type of integer and returns the CompactInt appended to a byte slice. This is for the bitcoin protocol format varint that stores up to FC in 1 byte, FD means two bytes with uint16 after, FE 4 bytes after, FF 8 bytes after. The bytes after the marker are little-endian, and the shortest form that holds the value is used.
 func AppendCompactInt(to []byte, in interface{}) (out []byte) {
 	var outint uint64
 	switch in.(type) {
@@ -33,83 +29,53 @@ func AppendCompactInt(to []byte, in interface{}) (out []byte) {
 	default:
 		return to
 	}
-	out = to
 	// Bytes are appended from lowest to highest, ie little-endian
 	switch {
 	case outint < 0xFD:
-		out = append(out, byte(outint))
-	case outint >= 0xFD && outint < uint64(^uint16(0)):
-		out = []byte{0xFE}
-		t := uint16(outint)
-		out = append(out, byte(t<<8>>8))
-		out = append(out, byte(t>>8))
-	case outint < uint64(^uint32(0)):
-		t := uint32(outint)
-		out = append(out, byte(t>>24))
-		out = append(out, byte(t<<8>>24))
-		out = append(out, byte(t<<16>>24))
-		out = append(out, byte(t<<24>>24))
+		out = append(to, byte(outint))
+	case outint <= uint64(^uint16(0)):
+		out = append(append(to, 0xFD), *core.IntToBytes(uint16(outint))...)
+	case outint <= uint64(^uint32(0)):
+		out = append(append(to, 0xFE), *core.IntToBytes(uint32(outint))...)
 	default:
-		t := uint64(outint)
-		out = append(out, byte(t>>56))
-		out = append(out, byte(t<<8>>56))
-		out = append(out, byte(t<<16>>56))
-		out = append(out, byte(t<<24>>56))
-		out = append(out, byte(t<<32>>56))
-		out = append(out, byte(t<<40>>56))
-		out = append(out, byte(t<<48>>56))
-		out = append(out, byte(t<<56>>56))
+		out = append(append(to, 0xFF), *core.IntToBytes(outint)...)
 	}
 	return
 }
 
-// ExtractCompactInt reads the first varint contained in a given byte slice and returns the value according to the type of the typ parameter, and slices the input bytes removing the extracted integer
-func ExtractCompactInt(typ interface{}, in []byte) (outbytes []byte, outint interface{}) {
-	var out uint64
-	switch {
-	case in[0] < 0xFD:
-		outbytes = in[1:]
-		out = uint64(in[0])
-	case in[0] == 0xFD:
-		var o uint16
-		t := in[1:3]
-		core.BytesToInt(&o, &t)
-		outbytes = in[3:]
-		out = uint64(o)
-	case in[0] == 0xFE:
-		var o uint32
-		t := in[1:5]
-		core.BytesToInt(&o, &t)
-		outbytes = in[5:]
-		out = uint64(o)
-	case in[0] == 0xFF:
-		t := in[1:9]
-		core.BytesToInt(&out, &t)
-		outbytes = in[9:]
+// ReadCompactInt reads the compact int at the start of the input and returns its value and the rest of the input. It returns ErrTruncated if the input ends before the compact int does, and ErrNonCanonical if it is not in the shortest form that holds its value, as AppendCompactInt would not give back the same bytes.
+func ReadCompactInt(in []byte) (v uint64, rest []byte, err error) {
+	if len(in) < 1 {
+		return 0, nil, ErrTruncated
 	}
-	switch typ.(type) {
-	case byte:
-		outint = byte(out)
-	case uint16:
-		outint = uint16(out)
-	case uint32:
-		outint = uint32(out)
-	case uint64:
-		outint = uint64(out)
-	case int8:
-		outint = int8(out)
-	case int16:
-		outint = int16(out)
-	case int32:
-		outint = int32(out)
-	case int64:
-		outint = int64(out)
-	case int:
-		outint = int(out)
-	case uint:
-		outint = uint(out)
-	default:
-		fmt.Println("wtf?")
+	size := compactIntSize(in[0])
+	if size == 1 {
+		return uint64(in[0]), in[1:], nil
 	}
-	return
+	if len(in) < size {
+		return 0, nil, ErrTruncated
+	}
+	for i := size - 1; i > 0; i-- {
+		v = v<<8 | uint64(in[i])
+	}
+	if v < compactIntMin[size] {
+		return 0, nil, ErrNonCanonical
+	}
+	return v, in[size:], nil
+}
+
+// compactIntMin is the smallest value held by each of the longer forms of compact int, any smaller being held by a shorter one
+var compactIntMin = map[int]uint64{3: 0xFD, 5: 0x10000, 9: 0x100000000}
+
+// compactIntSize returns the length of a compact int from its first byte
+func compactIntSize(first byte) int {
+	switch first {
+	case 0xFD:
+		return 3
+	case 0xFE:
+		return 5
+	case 0xFF:
+		return 9
+	}
+	return 1
 }
@@ -0,0 +1,159 @@
+package kv
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Badger is a Store on a badger database
+type Badger struct {
+	DB *badger.DB
+}
+
+// OpenBadger opens a badger database as a Store
+func OpenBadger(opt badger.Options) (*Badger, error) {
+	db, err := badger.Open(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Badger{DB: db}, nil
+}
+
+// View runs a function in a badger read-only transaction
+func (b *Badger) View(fn func(Reader) error) error {
+	return b.DB.View(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn})
+	})
+}
+
+// Update runs a function in a badger read-write transaction
+func (b *Badger) Update(fn func(Txn) error) error {
+	return b.DB.Update(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn})
+	})
+}
+
+// NewBatch starts a batch of writes, which are committed each time the transaction they are in becomes too big
+func (b *Badger) NewBatch() Batch {
+	return &badgerBatch{badgerTxn: badgerTxn{b.DB.NewTransaction(true)}, db: b.DB}
+}
+
+// Close closes the database
+func (b *Badger) Close() error {
+	return b.DB.Close()
+}
+
+// Compact marks the earlier versions of every value to be discarded and runs the value log garbage collector
+func (b *Badger) Compact() (n int, err error) {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = false
+	err = b.DB.Update(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(opt)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if iter.Item().DiscardEarlierVersions() {
+				n++
+			}
+		}
+		return nil
+	})
+	// there being nothing to collect is not an error
+	b.DB.RunValueLogGC(0.5)
+	return
+}
+
+// badgerTxn is a Txn on a badger transaction
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+func (t *badgerTxn) Get(k []byte) ([]byte, error) {
+	item, err := t.txn.Get(k)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return item.Value()
+}
+
+func (t *badgerTxn) Iterate(prefix, start []byte, fn func(k, v []byte) error) error {
+	return t.iterate(prefix, start, true, func(item *badger.Item) error {
+		v, err := item.Value()
+		if err != nil {
+			return err
+		}
+		return fn(item.Key(), v)
+	})
+}
+
+func (t *badgerTxn) Keys(prefix, start []byte, fn func(k []byte) error) error {
+	return t.iterate(prefix, start, false, func(item *badger.Item) error {
+		return fn(item.Key())
+	})
+}
+
+func (t *badgerTxn) iterate(prefix, start []byte, values bool, fn func(item *badger.Item) error) (err error) {
+	opt := badger.DefaultIteratorOptions
+	opt.PrefetchValues = values
+	iter := t.txn.NewIterator(opt)
+	defer iter.Close()
+	seek := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		seek = start
+	}
+	for iter.Seek(seek); iter.ValidForPrefix(prefix); iter.Next() {
+		if err = fn(iter.Item()); err != nil {
+			break
+		}
+	}
+	if err == ErrStop {
+		err = nil
+	}
+	return
+}
+
+// Put writes a value, marking the earlier versions of it to be discarded
+func (t *badgerTxn) Put(k, v []byte) error {
+	return t.txn.SetWithDiscard(k, v, 0)
+}
+
+func (t *badgerTxn) Delete(k []byte) error {
+	return t.txn.Delete(k)
+}
+
+// badgerBatch is a Batch that commits its transaction and starts another when it becomes too big
+type badgerBatch struct {
+	badgerTxn
+	db *badger.DB
+}
+
+// retry runs a write, and if the transaction is too big for it commits the transaction and runs it again in a new one
+func (b *badgerBatch) retry(write func() error) error {
+	err := write()
+	if err == badger.ErrTxnTooBig {
+		if err = b.txn.Commit(nil); err != nil {
+			return err
+		}
+		b.txn = b.db.NewTransaction(true)
+		err = write()
+	}
+	return err
+}
+
+func (b *badgerBatch) Put(k, v []byte) error {
+	return b.retry(func() error { return b.badgerTxn.Put(k, v) })
+}
+
+func (b *badgerBatch) Delete(k []byte) error {
+	return b.retry(func() error { return b.badgerTxn.Delete(k) })
+}
+
+func (b *badgerBatch) Commit() error {
+	return b.txn.Commit(nil)
+}
+
+func (b *badgerBatch) Discard() {
+	b.txn.Discard()
+}
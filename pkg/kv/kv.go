@@ -0,0 +1,54 @@
+// Package kv is the ordered key value store interface the sync index is kept in, with implementations on a badger database and in memory
+package kv
+
+import "errors"
+
+var (
+	// ErrNotFound is returned by Get for a key that has no value
+	ErrNotFound = errors.New("key not found")
+	// ErrStop may be returned by an iteration function to end the iteration early without an error
+	ErrStop = errors.New("stop iterating")
+)
+
+// Reader reads from a consistent snapshot of a store. Keys and values passed to or returned from its methods must not be modified, and are only valid until the transaction ends, so they must be copied to be kept.
+type Reader interface {
+	// Get returns the value of a key, or ErrNotFound if it has none
+	Get(k []byte) (v []byte, err error)
+	// Iterate calls fn with each key that starts with prefix and its value, in key order, starting at start if it sorts after prefix. It stops at the first error fn returns, which it returns unless it is ErrStop.
+	Iterate(prefix, start []byte, fn func(k, v []byte) error) error
+	// Keys is Iterate without the values, which may be much faster
+	Keys(prefix, start []byte, fn func(k []byte) error) error
+}
+
+// Txn is a read-write transaction. Its reads see its own writes.
+type Txn interface {
+	Reader
+	Put(k, v []byte) error
+	Delete(k []byte) error
+}
+
+// Batch writes more changes than may fit in a single transaction, committing them in as many transactions as it takes, so a batch is not atomic as a whole. Its reads see all of its writes.
+type Batch interface {
+	Txn
+	// Commit commits the writes not yet committed
+	Commit() error
+	// Discard drops the writes not yet committed, and does nothing after Commit
+	Discard()
+}
+
+// Store is an ordered key value store
+type Store interface {
+	// View runs a function with a read-only snapshot of the store
+	View(fn func(Reader) error) error
+	// Update runs a function in a read-write transaction, which is committed if the function returns nil and discarded otherwise
+	Update(fn func(Txn) error) error
+	// NewBatch starts a batch of writes, which must be ended with Commit or Discard
+	NewBatch() Batch
+	Close() error
+}
+
+// Compacter is a store that can reclaim the space taken by old versions of its values
+type Compacter interface {
+	// Compact reclaims the space of old versions of values and returns the number of keys that had them
+	Compact() (n int, err error)
+}
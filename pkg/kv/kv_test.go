@@ -0,0 +1,180 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// testStores runs a test on an empty store of each kind
+func testStores(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+	t.Run("badger", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "kv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opt := badger.DefaultOptions
+		opt.Dir, opt.ValueDir = dir, dir
+		// small tables make small transactions, so TestBatch has to commit in several
+		opt.MaxTableSize = 1 << 20
+		s, err := OpenBadger(opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+}
+
+// keys returns the keys an iteration visits joined by spaces
+func keys(t *testing.T, r Reader, prefix, start string, limit int) string {
+	var out []string
+	err := r.Iterate([]byte(prefix), []byte(start), func(k, v []byte) error {
+		if string(v) != "v"+string(k) {
+			t.Errorf("key %q has value %q", k, v)
+		}
+		out = append(out, string(k))
+		if len(out) == limit {
+			return ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestStore(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		err := s.Update(func(txn Txn) error {
+			for _, k := range []string{"b2", "a", "b1", "c", "b3", "bb"} {
+				if err := txn.Put([]byte(k), []byte("v"+k)); err != nil {
+					return err
+				}
+			}
+			// reads see the transaction's own writes
+			if v, err := txn.Get([]byte("b1")); err != nil || string(v) != "vb1" {
+				t.Errorf("got %q %v before commit", v, err)
+			}
+			return txn.Delete([]byte("b3"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.View(func(r Reader) error {
+			if _, err := r.Get([]byte("b3")); err != ErrNotFound {
+				t.Error("deleted key found:", err)
+			}
+			for _, c := range []struct {
+				prefix, start string
+				limit         int
+				want          string
+			}{
+				{"", "", 0, "a b1 b2 bb c"},
+				{"b", "", 0, "b1 b2 bb"},
+				{"b", "b2", 0, "b2 bb"},
+				{"b", "a", 0, "b1 b2 bb"},
+				{"b", "", 2, "b1 b2"},
+				{"d", "", 0, ""},
+			} {
+				if got := keys(t, r, c.prefix, c.start, c.limit); got != c.want {
+					t.Errorf("iterating %q from %q got %q, want %q", c.prefix, c.start, got, c.want)
+				}
+			}
+			var n int
+			r.Keys([]byte("b"), nil, func(k []byte) error { n++; return nil })
+			if n != 3 {
+				t.Error("Keys found", n, "keys")
+			}
+			return nil
+		})
+
+		// a failed update changes nothing
+		failed := errors.New("failed")
+		err = s.Update(func(txn Txn) error {
+			txn.Put([]byte("a"), []byte("changed"))
+			return failed
+		})
+		if err != failed {
+			t.Error("update returned", err)
+		}
+		s.View(func(r Reader) error {
+			if v, _ := r.Get([]byte("a")); string(v) != "va" {
+				t.Errorf("failed update wrote %q", v)
+			}
+			return nil
+		})
+	})
+}
+
+func TestBatch(t *testing.T) {
+	testStores(t, func(t *testing.T, s Store) {
+		discarded := s.NewBatch()
+		discarded.Put([]byte("gone"), []byte("vgone"))
+		discarded.Discard()
+
+		b := s.NewBatch()
+		defer b.Discard()
+		for i := 0; i < 20000; i++ {
+			k := fmt.Sprintf("k%05d", i)
+			if err := b.Put([]byte(k), []byte("v"+k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Delete([]byte("k00001")); err != nil {
+			t.Fatal(err)
+		}
+		if got := keys(t, b, "k", "", 2); got != "k00000 k00002" {
+			t.Errorf("batch reads %q", got)
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		s.View(func(r Reader) error {
+			var n int
+			r.Keys(nil, nil, func(k []byte) error { n++; return nil })
+			if n != 19999 {
+				t.Error("store has", n, "keys after commit")
+			}
+			if _, err := r.Get([]byte("gone")); err != ErrNotFound {
+				t.Error("discarded write found:", err)
+			}
+			// views may be nested inside each other
+			return s.View(func(r Reader) error {
+				if v, err := r.Get([]byte("k19999")); err != nil || string(v) != "vk19999" {
+					t.Errorf("nested view got %q %v", v, err)
+				}
+				return nil
+			})
+		})
+	})
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	s := NewMemory()
+	s.Update(func(txn Txn) error { return txn.Put([]byte("a"), []byte("1")) })
+	s.View(func(r Reader) error {
+		// a write committed during a view is not seen by it
+		s.Update(func(txn Txn) error { return txn.Put([]byte("a"), []byte("2")) })
+		if v, _ := r.Get([]byte("a")); string(v) != "1" {
+			t.Errorf("view saw %q", v)
+		}
+		return nil
+	})
+	s.View(func(r Reader) error {
+		if v, _ := r.Get([]byte("a")); string(v) != "2" {
+			t.Errorf("got %q after update", v)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package kv
+
+import (
+	"bytes"
+	"sort"
+	gosync "sync"
+)
+
+// Memory is a Store held in memory, for tests and small indexes. Each transaction reads the snapshot of the store that was current when it began, and its writes are applied when it commits, so where two transactions write the same key the last to commit wins. Nothing is locked while a transaction runs, so transactions may be nested.
+type Memory struct {
+	mu   gosync.Mutex
+	snap *memSnapshot
+}
+
+// memSnapshot is an immutable state of a Memory store
+type memSnapshot struct {
+	keys []string
+	vals map[string][]byte
+}
+
+// NewMemory returns an empty memory store
+func NewMemory() *Memory {
+	return &Memory{snap: &memSnapshot{vals: make(map[string][]byte)}}
+}
+
+func (m *Memory) current() *memSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snap
+}
+
+// apply makes a new snapshot with a set of writes, where a nil value is a delete
+func (m *Memory) apply(writes map[string][]byte) {
+	if len(writes) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vals := make(map[string][]byte, len(m.snap.vals)+len(writes))
+	for k, v := range m.snap.vals {
+		vals[k] = v
+	}
+	for k, v := range writes {
+		if v == nil {
+			delete(vals, k)
+		} else {
+			vals[k] = v
+		}
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	m.snap = &memSnapshot{keys: keys, vals: vals}
+}
+
+// View runs a function with the current snapshot
+func (m *Memory) View(fn func(Reader) error) error {
+	return fn(&memTxn{base: m.current()})
+}
+
+// Update runs a function with the current snapshot and applies its writes if it returns nil
+func (m *Memory) Update(fn func(Txn) error) error {
+	t := &memTxn{base: m.current(), writes: make(map[string][]byte)}
+	if err := fn(t); err != nil {
+		return err
+	}
+	m.apply(t.writes)
+	return nil
+}
+
+// NewBatch starts a batch of writes, which are all applied together on Commit
+func (m *Memory) NewBatch() Batch {
+	return &memBatch{memTxn: memTxn{base: m.current(), writes: make(map[string][]byte)}, m: m}
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
+
+// memTxn reads a snapshot through the writes made on top of it
+type memTxn struct {
+	base   *memSnapshot
+	writes map[string][]byte
+}
+
+func (t *memTxn) Get(k []byte) ([]byte, error) {
+	v, ok := t.writes[string(k)]
+	if !ok {
+		v, ok = t.base.vals[string(k)]
+	}
+	if !ok || v == nil {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (t *memTxn) Iterate(prefix, start []byte, fn func(k, v []byte) error) (err error) {
+	seek := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		seek = start
+	}
+	in := func(k string) bool {
+		return k >= string(seek) && bytes.HasPrefix([]byte(k), prefix)
+	}
+	keys := t.base.keys[sort.SearchStrings(t.base.keys, string(seek)):]
+	if len(t.writes) > 0 {
+		merged := make(map[string]bool)
+		for _, k := range keys {
+			if !in(k) {
+				break
+			}
+			merged[k] = true
+		}
+		for k := range t.writes {
+			if in(k) {
+				merged[k] = true
+			}
+		}
+		keys = make([]string, 0, len(merged))
+		for k := range merged {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	}
+	for _, k := range keys {
+		if !in(k) {
+			break
+		}
+		v, e := t.Get([]byte(k))
+		if e == ErrNotFound {
+			continue
+		}
+		if err = fn([]byte(k), v); err != nil {
+			break
+		}
+	}
+	if err == ErrStop {
+		err = nil
+	}
+	return
+}
+
+func (t *memTxn) Keys(prefix, start []byte, fn func(k []byte) error) error {
+	return t.Iterate(prefix, start, func(k, v []byte) error { return fn(k) })
+}
+
+// Put writes a copy of a value, so the caller may reuse it
+func (t *memTxn) Put(k, v []byte) error {
+	t.writes[string(k)] = append([]byte{}, v...)
+	return nil
+}
+
+func (t *memTxn) Delete(k []byte) error {
+	t.writes[string(k)] = nil
+	return nil
+}
+
+// memBatch is a Batch in memory, which has no limit on its size so is committed all at once
+type memBatch struct {
+	memTxn
+	m *Memory
+}
+
+func (b *memBatch) Commit() error {
+	b.m.apply(b.writes)
+	b.writes = make(map[string][]byte)
+	return nil
+}
+
+func (b *memBatch) Discard() {
+	b.writes = make(map[string][]byte)
+}
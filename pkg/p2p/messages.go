@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"time"
+)
+
+// Inventory types
+const (
+	InvTx    uint32 = 1
+	InvBlock uint32 = 2
+)
+
+// InvVect identifies a transaction or block in inv, getdata and notfound messages
+type InvVect struct {
+	Type uint32
+	Hash Hash
+}
+
+// EncodeInv serialises the payload of an inv, getdata or notfound message
+func EncodeInv(inv []InvVect) (out []byte) {
+	out = appendVarInt(nil, uint64(len(inv)))
+	for _, iv := range inv {
+		out = append(appendUint32(out, iv.Type), iv.Hash[:]...)
+	}
+	return
+}
+
+// DecodeInv decodes the payload of an inv, getdata or notfound message
+func DecodeInv(b []byte) (inv []InvVect, err error) {
+	r := &reader{b: b}
+	n := r.count(36)
+	for i := 0; i < n && r.err == nil; i++ {
+		inv = append(inv, InvVect{Type: r.uint32(), Hash: r.hash()})
+	}
+	return inv, r.err
+}
+
+// Version is the version message each side sends when a connection opens. The network addresses in it are not used, so they are sent empty and skipped when received.
+type Version struct {
+	Version     uint32
+	Services    uint64
+	Timestamp   int64
+	Nonce       uint64
+	UserAgent   string
+	StartHeight int32
+	// Relay asks the peer to announce its transactions, and is only sent from relayVersion on
+	Relay bool
+}
+
+// netAddrSize is the length of a network address without a timestamp, as it is sent in a version message
+const netAddrSize = 26
+
+// Encode serialises the payload of a version message
+func (v *Version) Encode() (out []byte) {
+	out = appendUint32(nil, v.Version)
+	out = appendUint64(out, v.Services)
+	out = appendUint64(out, uint64(v.Timestamp))
+	out = append(out, make([]byte, 2*netAddrSize)...)
+	out = appendUint64(out, v.Nonce)
+	out = append(appendVarInt(out, uint64(len(v.UserAgent))), v.UserAgent...)
+	out = appendUint32(out, uint32(v.StartHeight))
+	if v.Version >= relayVersion {
+		relay := byte(0)
+		if v.Relay {
+			relay = 1
+		}
+		out = append(out, relay)
+	}
+	return
+}
+
+// DecodeVersion decodes the payload of a version message. The fields a peer's version is too old to send are left zero, and the relay flag is set for those before relayVersion, as that is what they do.
+func DecodeVersion(b []byte) (v *Version, err error) {
+	r := &reader{b: b}
+	v = &Version{Version: r.uint32(), Services: r.uint64(), Timestamp: int64(r.uint64()), Relay: true}
+	r.bytes(netAddrSize)
+	if r.err == nil && len(r.b) > 0 {
+		r.bytes(netAddrSize)
+		v.Nonce = r.uint64()
+		v.UserAgent = string(r.bytes(r.count(1)))
+		v.StartHeight = int32(r.uint32())
+	}
+	if r.err == nil && len(r.b) > 0 && v.Version >= relayVersion {
+		v.Relay = r.byte() != 0
+	}
+	return v, r.err
+}
+
+// newVersion returns the version message the client sends
+func newVersion(nonce uint64) *Version {
+	return &Version{Version: ProtocolVersion, Timestamp: time.Now().Unix(), Nonce: nonce, UserAgent: "/chainsync/"}
+}
+
+// GetHeaders asks for the headers of the blocks after the first hash in Locator that is on the peer's best chain, up to MaxHeaders of them or as far as Stop if it is not zero
+type GetHeaders struct {
+	Version uint32
+	Locator []Hash
+	Stop    Hash
+}
+
+// Encode serialises the payload of a getheaders message
+func (g *GetHeaders) Encode() (out []byte) {
+	out = appendVarInt(appendUint32(nil, g.Version), uint64(len(g.Locator)))
+	for _, h := range g.Locator {
+		out = append(out, h[:]...)
+	}
+	return append(out, g.Stop[:]...)
+}
+
+// DecodeGetHeaders decodes the payload of a getheaders message
+func DecodeGetHeaders(b []byte) (g *GetHeaders, err error) {
+	r := &reader{b: b}
+	g = &GetHeaders{Version: r.uint32()}
+	n := r.count(32)
+	for i := 0; i < n && r.err == nil; i++ {
+		g.Locator = append(g.Locator, r.hash())
+	}
+	g.Stop = r.hash()
+	return g, r.err
+}
+
+// Header is a block header
+type Header struct {
+	Version    uint32
+	Prev       Hash
+	MerkleRoot Hash
+	Time       uint32
+	Bits       uint32
+	Nonce      uint32
+}
+
+// Encode serialises the header
+func (h *Header) Encode() (out []byte) {
+	out = appendUint32(nil, h.Version)
+	out = append(append(out, h.Prev[:]...), h.MerkleRoot[:]...)
+	return appendUint32(appendUint32(appendUint32(out, h.Time), h.Bits), h.Nonce)
+}
+
+// Hash returns the hash of the block the header is for
+func (h *Header) Hash() Hash {
+	return DoubleHash(h.Encode())
+}
+
+// DecodeHeader decodes a serialised header, which may be followed by the rest of its block
+func DecodeHeader(b []byte) (h Header, err error) {
+	r := &reader{b: b}
+	h = decodeHeader(r)
+	return h, r.err
+}
+
+func decodeHeader(r *reader) Header {
+	return Header{Version: r.uint32(), Prev: r.hash(), MerkleRoot: r.hash(), Time: r.uint32(), Bits: r.uint32(), Nonce: r.uint32()}
+}
+
+// EncodeHeaders serialises the payload of a headers message, in which each header is followed by a transaction count of zero
+func EncodeHeaders(headers []Header) (out []byte) {
+	out = appendVarInt(nil, uint64(len(headers)))
+	for i := range headers {
+		out = append(append(out, headers[i].Encode()...), 0)
+	}
+	return
+}
+
+// DecodeHeaders decodes the payload of a headers message
+func DecodeHeaders(b []byte) (headers []Header, err error) {
+	r := &reader{b: b}
+	n := r.count(HeaderSize + 1)
+	for i := 0; i < n && r.err == nil; i++ {
+		headers = append(headers, decodeHeader(r))
+		r.varInt()
+	}
+	return headers, r.err
+}
@@ -0,0 +1,221 @@
+package p2p_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/p2p/p2ptest"
+)
+
+// testChain makes a chain of blocks that each have a header and no transactions
+func testChain(n int) (blocks [][]byte, hashes []p2p.Hash) {
+	var prev p2p.Hash
+	for i := 0; i < n; i++ {
+		h := p2p.Header{Version: 2, Prev: prev, Time: uint32(1500000000 + i*300), Bits: 0x1e0fffff, Nonce: uint32(i)}
+		blocks = append(blocks, append(h.Encode(), 0))
+		prev = h.Hash()
+		hashes = append(hashes, prev)
+	}
+	return
+}
+
+func TestMessage(t *testing.T) {
+	magic := p2p.Networks["mainnet"].Magic
+	inv := make([]p2p.InvVect, 300)
+	for i := range inv {
+		inv[i] = p2p.InvVect{Type: p2p.InvBlock, Hash: p2p.Hash{byte(i), byte(i >> 8)}}
+	}
+	var buf bytes.Buffer
+	if err := p2p.WriteMessage(&buf, magic, p2p.Message{Command: p2p.CmdGetData, Payload: p2p.EncodeInv(inv)}); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	m, err := p2p.ReadMessage(bytes.NewReader(raw), magic)
+	if err != nil || m.Command != p2p.CmdGetData {
+		t.Fatal("reading message", m.Command, err)
+	}
+	if got, err := p2p.DecodeInv(m.Payload); err != nil || !reflect.DeepEqual(got, inv) {
+		t.Error("inventory did not round trip", err)
+	}
+	if _, err = p2p.ReadMessage(bytes.NewReader(raw), p2p.Networks["testnet"].Magic); err != p2p.ErrMagic {
+		t.Error("message for another network accepted", err)
+	}
+	corrupt := append([]byte{}, raw...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err = p2p.ReadMessage(bytes.NewReader(corrupt), magic); err != p2p.ErrChecksum {
+		t.Error("corrupt message accepted", err)
+	}
+	if _, err = p2p.DecodeInv(m.Payload[:100]); err != p2p.ErrTruncated {
+		t.Error("truncated inventory accepted", err)
+	}
+	if err = p2p.WriteMessage(&buf, magic, p2p.Message{Command: strings.Repeat("x", 13)}); err == nil {
+		t.Error("long command written")
+	}
+
+	v := &p2p.Version{Version: p2p.ProtocolVersion, Services: 1, Timestamp: 1500000000, Nonce: 42, UserAgent: "/test/", StartHeight: 100}
+	if got, err := p2p.DecodeVersion(v.Encode()); err != nil || !reflect.DeepEqual(got, v) {
+		t.Error("version did not round trip", got, err)
+	}
+	v.Version = 60001
+	if got, err := p2p.DecodeVersion(v.Encode()); err != nil || !got.Relay {
+		t.Error("relay not assumed before the relay flag", got, err)
+	}
+
+	blocks, hashes := testChain(3)
+	var headers []p2p.Header
+	for _, b := range blocks {
+		h, _ := p2p.DecodeHeader(b)
+		headers = append(headers, h)
+	}
+	if got, err := p2p.DecodeHeaders(p2p.EncodeHeaders(headers)); err != nil || !reflect.DeepEqual(got, headers) {
+		t.Error("headers did not round trip", err)
+	}
+	if h := p2p.NewHash(hashes[1].Shown()); h != hashes[1] || h.String() != hex.EncodeToString(h.Shown()) || h.Shown()[31] != h[0] {
+		t.Error("hash did not round trip through its shown form", h)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	v := &p2p.Version{Version: p2p.ProtocolVersion, Services: 1, Timestamp: 1500000000, Nonce: 42, UserAgent: "/test/", StartHeight: 100, Relay: true}
+	blocks, _ := testChain(2)
+	header, _ := p2p.DecodeHeader(blocks[0])
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		decode  func([]byte) error
+		// complete are the lengths short of the whole payload that are still a whole message
+		complete map[int]bool
+	}{
+		{"inv", p2p.EncodeInv([]p2p.InvVect{{Type: p2p.InvBlock}, {Type: p2p.InvTx}}), func(b []byte) error {
+			_, err := p2p.DecodeInv(b)
+			return err
+		}, nil},
+		// a version message from before the relay flag ends after the first network address or the start height
+		{"version", v.Encode(), func(b []byte) error {
+			_, err := p2p.DecodeVersion(b)
+			return err
+		}, map[int]bool{46: true, len(v.Encode()) - 1: true}},
+		{"getheaders", (&p2p.GetHeaders{Version: p2p.ProtocolVersion, Locator: make([]p2p.Hash, 2)}).Encode(), func(b []byte) error {
+			_, err := p2p.DecodeGetHeaders(b)
+			return err
+		}, nil},
+		{"header", header.Encode(), func(b []byte) error {
+			_, err := p2p.DecodeHeader(b)
+			return err
+		}, nil},
+		{"headers", p2p.EncodeHeaders([]p2p.Header{header, header}), func(b []byte) error {
+			_, err := p2p.DecodeHeaders(b)
+			return err
+		}, nil},
+	} {
+		if err := c.decode(c.payload); err != nil {
+			t.Error(c.name, "not decoded", err)
+		}
+		for n := 0; n < len(c.payload); n++ {
+			if err := c.decode(c.payload[:n]); err == nil && !c.complete[n] {
+				t.Error(c.name, "truncated to", n, "bytes accepted")
+			}
+		}
+	}
+}
+
+func TestPeer(t *testing.T) {
+	blocks, hashes := testChain(p2p.MaxHeaders + 500)
+	fake := p2ptest.NewPeer("mainnet", blocks)
+	defer fake.Close()
+	if _, err := p2p.Dial(fake.Addr, "nonet"); err != p2p.ErrNetwork {
+		t.Error("unknown network accepted", err)
+	}
+	peer, err := p2p.Dial(fake.Addr, "mainnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if peer.Remote.StartHeight != int32(len(blocks)-1) || peer.Remote.UserAgent != "/p2ptest/" {
+		t.Errorf("unexpected remote version %+v", peer.Remote)
+	}
+
+	// with no known hash in the locator the headers start after the genesis block
+	headers, err := peer.GetHeaders([]p2p.Hash{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != p2p.MaxHeaders || headers[0].Prev != hashes[0] || headers[len(headers)-1].Hash() != hashes[p2p.MaxHeaders] {
+		t.Fatal("unexpected first headers", len(headers))
+	}
+	if headers, err = peer.GetHeaders([]p2p.Hash{{1}, hashes[p2p.MaxHeaders], hashes[0]}); err != nil || len(headers) != 499 {
+		t.Fatal("unexpected rest of the headers", len(headers), err)
+	}
+	if headers, err = peer.GetHeaders([]p2p.Hash{hashes[len(hashes)-1]}); err != nil || len(headers) != 0 {
+		t.Fatal("headers after the tip", len(headers), err)
+	}
+	if fake.Received(p2p.CmdPong) < 2 {
+		t.Error("pings not answered")
+	}
+
+	got, err := peer.GetBlocks([]p2p.Hash{hashes[5], hashes[3], hashes[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[0], blocks[5]) || !bytes.Equal(got[1], blocks[3]) || !bytes.Equal(got[2], blocks[0]) {
+		t.Error("blocks not returned in the order asked for")
+	}
+	if _, err = peer.GetBlocks([]p2p.Hash{hashes[1], {9}}); err == nil || !strings.Contains(err.Error(), "does not have") {
+		t.Error("missing block not reported", err)
+	}
+	// the connection is still usable after a block is not found
+	if got, err = peer.GetBlocks([]p2p.Hash{hashes[2]}); err != nil || !bytes.Equal(got[0], blocks[2]) {
+		t.Error("block after a missing block", err)
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	nw := p2p.Networks["mainnet"]
+	send := func(command string, payload []byte) error {
+		return p2p.WriteMessage(remote, nw.Magic, p2p.Message{Command: command, Payload: payload})
+	}
+	// the remote end completes the handshake and then only sends pings and addresses, never answering a request
+	go func() {
+		for {
+			if _, err := p2p.ReadMessage(remote, nw.Magic); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		v := &p2p.Version{Version: p2p.ProtocolVersion, Nonce: 1, UserAgent: "/chatty/"}
+		if send(p2p.CmdVersion, v.Encode()) != nil || send(p2p.CmdVerack, nil) != nil {
+			return
+		}
+		for {
+			time.Sleep(5 * time.Millisecond)
+			if send(p2p.CmdPing, []byte{1, 2, 3, 4, 5, 6, 7, 8}) != nil || send("addr", []byte{0}) != nil {
+				return
+			}
+		}
+	}()
+	peer, err := p2p.NewPeer(local, nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err = peer.GetHeaders([]p2p.Hash{{}}); err == nil {
+		t.Error("headers from a peer that never sends any")
+	}
+	if _, err = peer.GetBlocks([]p2p.Hash{{1}}); err == nil {
+		t.Error("blocks from a peer that never sends any")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("unrelated messages kept the requests waiting for", d)
+	}
+}
@@ -0,0 +1,162 @@
+// Package p2ptest runs fake full nodes that serve a chain of blocks over the wire protocol, for testing clients of package p2p in the same process
+package p2ptest
+
+import (
+	"fmt"
+	"net"
+	gosync "sync"
+
+	"github.com/parallelcointeam/duo/pkg/p2p"
+)
+
+// Peer is a fake full node listening on a local port, serving a fixed chain of serialised blocks from the genesis block on. It answers version, getheaders and getdata messages, sends a ping before each headers message to check that it is answered, and ignores everything else.
+type Peer struct {
+	// Addr is the address the peer listens on
+	Addr     string
+	network  p2p.Network
+	listener net.Listener
+	blocks   [][]byte
+	headers  []p2p.Header
+	heights  map[p2p.Hash]int
+	wg       gosync.WaitGroup
+	mu       gosync.Mutex
+	conns    map[net.Conn]bool
+	received map[string]int
+}
+
+// NewPeer starts a peer on a network serving a chain of blocks. It panics if the blocks cannot be decoded or it cannot listen, as it is only for use in tests.
+func NewPeer(network string, blocks [][]byte) *Peer {
+	nw, ok := p2p.Networks[network]
+	if !ok {
+		panic(p2p.ErrNetwork)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("p2ptest: listening: %v", err))
+	}
+	p := &Peer{
+		Addr:     l.Addr().String(),
+		network:  nw,
+		listener: l,
+		blocks:   blocks,
+		heights:  make(map[p2p.Hash]int),
+		conns:    make(map[net.Conn]bool),
+		received: make(map[string]int),
+	}
+	for i, raw := range blocks {
+		h, err := p2p.DecodeHeader(raw)
+		if err != nil {
+			panic(fmt.Sprintf("p2ptest: block %d: %v", i, err))
+		}
+		p.headers = append(p.headers, h)
+		p.heights[h.Hash()] = i
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.conns[conn] = true
+			p.mu.Unlock()
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.serve(conn)
+				p.mu.Lock()
+				delete(p.conns, conn)
+				p.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+// Close stops the peer and closes its connections
+func (p *Peer) Close() {
+	p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Received returns the number of messages with a command the peer has received
+func (p *Peer) Received(command string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.received[command]
+}
+
+// serve answers the messages on a connection until it is closed or sends something malformed
+func (p *Peer) serve(conn net.Conn) {
+	send := func(command string, payload []byte) error {
+		return p2p.WriteMessage(conn, p.network.Magic, p2p.Message{Command: command, Payload: payload})
+	}
+	for {
+		m, err := p2p.ReadMessage(conn, p.network.Magic)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.received[m.Command]++
+		p.mu.Unlock()
+		switch m.Command {
+		case p2p.CmdVersion:
+			v := &p2p.Version{Version: p2p.ProtocolVersion, Nonce: 1, UserAgent: "/p2ptest/", StartHeight: int32(len(p.blocks) - 1)}
+			if send(p2p.CmdVersion, v.Encode()) != nil || send(p2p.CmdVerack, nil) != nil {
+				return
+			}
+		case p2p.CmdGetHeaders:
+			req, err := p2p.DecodeGetHeaders(m.Payload)
+			if err != nil {
+				return
+			}
+			if send(p2p.CmdPing, []byte{1, 2, 3, 4, 5, 6, 7, 8}) != nil || send(p2p.CmdHeaders, p2p.EncodeHeaders(p.after(req))) != nil {
+				return
+			}
+		case p2p.CmdGetData:
+			inv, err := p2p.DecodeInv(m.Payload)
+			if err != nil {
+				return
+			}
+			var missing []p2p.InvVect
+			for _, iv := range inv {
+				if i, ok := p.heights[iv.Hash]; ok && iv.Type == p2p.InvBlock {
+					if send(p2p.CmdBlock, p.blocks[i]) != nil {
+						return
+					}
+				} else {
+					missing = append(missing, iv)
+				}
+			}
+			if len(missing) > 0 && send(p2p.CmdNotFound, p2p.EncodeInv(missing)) != nil {
+				return
+			}
+		}
+	}
+}
+
+// after returns the headers a getheaders message asks for, those after the first locator hash in the chain, or after the genesis block if there is none
+func (p *Peer) after(req *p2p.GetHeaders) (headers []p2p.Header) {
+	start := 1
+	for _, h := range req.Locator {
+		if i, ok := p.heights[h]; ok {
+			start = i + 1
+			break
+		}
+	}
+	for i := start; i < len(p.headers) && len(headers) < p2p.MaxHeaders; i++ {
+		headers = append(headers, p.headers[i])
+		if p.headers[i].Hash() == req.Stop {
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	gosync "sync"
+	"time"
+)
+
+const (
+	// MaxHeaders is the most headers a peer sends in reply to one getheaders message
+	MaxHeaders = 2000
+	// DefaultTimeout is how long to wait for a connection, and for a peer to answer a request
+	DefaultTimeout = time.Minute
+)
+
+// ErrSelfConnection is returned when the client has connected to itself
+var ErrSelfConnection = errors.New("connected to self")
+
+// Peer is a connection to a full node over the wire protocol. Its methods may be called from several goroutines, and each waits for the one before it to finish.
+type Peer struct {
+	gosync.Mutex
+	conn    net.Conn
+	network Network
+	// Remote is the version message the peer sent when the connection opened
+	Remote *Version
+	// Timeout is how long to wait for the peer to complete the handshake or answer a request, or in GetBlocks for each block asked for. Other messages the peer sends in the meantime do not extend it.
+	Timeout time.Duration
+}
+
+// Dial connects to a full node on a network and completes the version handshake. The address is a host with an optional port, which defaults to the network's.
+func Dial(addr, network string) (p *Peer, err error) {
+	nw, ok := Networks[network]
+	if !ok {
+		return nil, ErrNetwork
+	}
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(nw.Port))
+	}
+	conn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		return
+	}
+	if p, err = NewPeer(conn, nw); err != nil {
+		conn.Close()
+	}
+	return
+}
+
+// NewPeer completes the version handshake on an open connection
+func NewPeer(conn net.Conn, network Network) (p *Peer, err error) {
+	p = &Peer{conn: conn, network: network, Timeout: DefaultTimeout}
+	var nonce [8]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return
+	}
+	local := newVersion(binary.LittleEndian.Uint64(nonce[:]))
+	if err = p.write(CmdVersion, local.Encode()); err != nil {
+		return
+	}
+	gotVerack := false
+	deadline := time.Now().Add(p.Timeout)
+	for p.Remote == nil || !gotVerack {
+		var m Message
+		if m, err = p.read(deadline); err != nil {
+			return nil, fmt.Errorf("handshake: %v", err)
+		}
+		switch m.Command {
+		case CmdVersion:
+			var v *Version
+			if v, err = DecodeVersion(m.Payload); err != nil {
+				return nil, fmt.Errorf("handshake: %v", err)
+			}
+			if v.Nonce == local.Nonce {
+				return nil, ErrSelfConnection
+			}
+			if v.Version < MinProtocolVersion {
+				return nil, fmt.Errorf("peer protocol version %d is older than %d", v.Version, MinProtocolVersion)
+			}
+			p.Remote = v
+			if err = p.write(CmdVerack, nil); err != nil {
+				return
+			}
+		case CmdVerack:
+			gotVerack = true
+		}
+	}
+	return
+}
+
+// Close closes the connection
+func (p *Peer) Close() error {
+	return p.conn.Close()
+}
+
+// write sends a message
+func (p *Peer) write(command string, payload []byte) error {
+	p.conn.SetWriteDeadline(time.Now().Add(p.Timeout))
+	return WriteMessage(p.conn, p.network.Magic, Message{Command: command, Payload: payload})
+}
+
+// read returns the next message from the peer, answering any pings on the way, and fails if none has arrived by the deadline
+func (p *Peer) read(deadline time.Time) (m Message, err error) {
+	p.conn.SetReadDeadline(deadline)
+	for {
+		if m, err = ReadMessage(p.conn, p.network.Magic); err != nil {
+			return
+		}
+		if m.Command != CmdPing {
+			return
+		}
+		// peers before pingNonceVersion send an empty ping and do not understand pong
+		if len(m.Payload) == 8 {
+			if err = p.write(CmdPong, m.Payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// GetHeaders returns the headers of up to MaxHeaders blocks on the peer's best chain after the first hash in the locator that is on it. The peer starts after its genesis block if none are. The headers are checked to form a chain.
+func (p *Peer) GetHeaders(locator []Hash) (headers []Header, err error) {
+	p.Lock()
+	defer p.Unlock()
+	req := &GetHeaders{Version: ProtocolVersion, Locator: locator}
+	if err = p.write(CmdGetHeaders, req.Encode()); err != nil {
+		return
+	}
+	deadline := time.Now().Add(p.Timeout)
+	for {
+		var m Message
+		if m, err = p.read(deadline); err != nil {
+			return
+		}
+		if m.Command != CmdHeaders {
+			continue
+		}
+		if headers, err = DecodeHeaders(m.Payload); err != nil {
+			return
+		}
+		for i := 1; i < len(headers); i++ {
+			if headers[i].Prev != headers[i-1].Hash() {
+				return nil, fmt.Errorf("header %d of %d does not follow the one before it", i, len(headers))
+			}
+		}
+		return
+	}
+}
+
+// GetBlocks downloads the serialised blocks with the given hashes, returning them in the same order. Blocks the peer sends that were not asked for are ignored.
+func (p *Peer) GetBlocks(hashes []Hash) (blocks [][]byte, err error) {
+	p.Lock()
+	defer p.Unlock()
+	want := make(map[Hash]int, len(hashes))
+	inv := make([]InvVect, len(hashes))
+	for i, h := range hashes {
+		want[h] = i
+		inv[i] = InvVect{Type: InvBlock, Hash: h}
+	}
+	if err = p.write(CmdGetData, EncodeInv(inv)); err != nil {
+		return
+	}
+	blocks = make([][]byte, len(hashes))
+	deadline := time.Now().Add(p.Timeout)
+	for left := len(want); left > 0; {
+		var m Message
+		if m, err = p.read(deadline); err != nil {
+			return nil, err
+		}
+		switch m.Command {
+		case CmdBlock:
+			h, err := BlockHash(m.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if i, ok := want[h]; ok && blocks[i] == nil {
+				blocks[i] = m.Payload
+				left--
+				deadline = time.Now().Add(p.Timeout)
+			}
+		case CmdNotFound:
+			missing, err := DecodeInv(m.Payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, iv := range missing {
+				if _, ok := want[iv.Hash]; ok && iv.Type == InvBlock {
+					return nil, fmt.Errorf("peer does not have block %v", iv.Hash)
+				}
+			}
+		}
+	}
+	return
+}
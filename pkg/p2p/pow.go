@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Proof of work algorithm ids, as held in the bits of a block version from 9 up
+const (
+	AlgoSHA256D = 0
+	AlgoScrypt  = 1
+)
+
+var (
+	// ErrBits is returned for a header whose bits do not stand for a target a block can be mined to
+	ErrBits = errors.New("header bits are not a valid target")
+	// ErrProofOfWork is returned for a header whose proof of work hash is above the target of its bits
+	ErrProofOfWork = errors.New("header hash is above its target")
+	// ErrPowLimit is returned for a header whose bits are a target above the easiest one the network allows
+	ErrPowLimit = errors.New("header target is above the proof of work limit")
+)
+
+// Algo returns the proof of work algorithm id of the header's version, so version 2 is sha256d and 514 is scrypt
+func (h *Header) Algo() uint32 {
+	return h.Version >> 9 & 7
+}
+
+// PowHash returns the hash the header's proof of work is checked with, which is the block hash for sha256d blocks and the scrypt hash of the header, with the parameters Litecoin uses, for scrypt blocks
+func (h *Header) PowHash() (hash Hash, err error) {
+	if h.Algo() != AlgoScrypt {
+		return h.Hash(), nil
+	}
+	b := h.Encode()
+	out, err := scrypt.Key(b, b, 1024, 1, 1, len(hash))
+	copy(hash[:], out)
+	return
+}
+
+// CheckProofOfWork checks that the header's proof of work hash is no higher than the target of its bits. It returns ErrBits if the bits are not a valid target and ErrProofOfWork if the hash is too high.
+func (h *Header) CheckProofOfWork() error {
+	target := Target(h.Bits)
+	if target == nil {
+		return ErrBits
+	}
+	hash, err := h.PowHash()
+	if err != nil {
+		return err
+	}
+	if new(big.Int).SetBytes(hash.Shown()).Cmp(target) > 0 {
+		return ErrProofOfWork
+	}
+	return nil
+}
+
+// CheckPowLimit checks that the target of the header's bits is no higher than the target of the limit bits, the easiest target a block on the network may be mined to
+func (h *Header) CheckPowLimit(limit uint32) error {
+	target, max := Target(h.Bits), Target(limit)
+	if target == nil {
+		return ErrBits
+	}
+	if max == nil || target.Cmp(max) > 0 {
+		return ErrPowLimit
+	}
+	return nil
+}
+
+// Target returns the target a compact bits value stands for, a 256 bit number the proof of work hash must not be above, or nil if it is zero, negative or too large
+func Target(bits uint32) *big.Int {
+	mantissa, exponent := int64(bits&0x007fffff), uint(bits>>24)
+	if mantissa == 0 || bits&0x00800000 != 0 {
+		return nil
+	}
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if target.Sign() == 0 || target.BitLen() > 256 {
+		return nil
+	}
+	return target
+}
+
+// Work returns the number of hashes expected to find a block with the bits, 2^256 / (target + 1), which the full node adds up to find the chain with the most work. It is zero for bits that are not a valid target.
+func Work(bits uint32) *big.Int {
+	target := Target(bits)
+	if target == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), target.Add(target, big.NewInt(1)))
+}
@@ -0,0 +1,59 @@
+package p2p_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/p2p"
+)
+
+// the header of block 102920 of the mainnet, which is mined with scrypt
+const testHeader = "02020000" +
+	"cfedd1686d8ec429b3e4d5b60e13dcb0d3c9bcfa881d58cef8bb010000000000" +
+	"a9aa0ac8092996a9df8970669b2bbef202dc4700773d335943894f5b67af5df5" +
+	"689d6756" + "2ad8331c" + "f30665ef"
+
+func TestProofOfWork(t *testing.T) {
+	raw, _ := hex.DecodeString(testHeader)
+	h, err := p2p.DecodeHeader(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Algo() != p2p.AlgoScrypt {
+		t.Fatal("unexpected algorithm", h.Algo())
+	}
+	if err = h.CheckProofOfWork(); err != nil {
+		t.Fatal(err)
+	}
+	// the block hash is far above the target, so only the scrypt hash can meet it
+	if hash := h.Hash(); hash.String() != "a0aa90c9392f7c9f413017b2224abbfd9336da779534902d273912c5321ae3e7" {
+		t.Error("unexpected block hash", hash)
+	}
+	h.Nonce++
+	if err = h.CheckProofOfWork(); err != p2p.ErrProofOfWork {
+		t.Error("expected proof of work error, got", err)
+	}
+	h.Version = 2
+	if err = h.CheckProofOfWork(); err != p2p.ErrProofOfWork {
+		t.Error("scrypt block accepted as sha256d, got", err)
+	}
+	for _, bits := range []uint32{0, 0x1d800000 | 0x00ffff, 0x01003456, 0xff00ffff} {
+		if h.Bits = bits; h.CheckProofOfWork() != p2p.ErrBits {
+			t.Errorf("bits %08x accepted", bits)
+		}
+	}
+	for bits, want := range map[uint32]error{0x1d00ffff: nil, 0x1e0fffff: nil, 0x1e100000: p2p.ErrPowLimit, 0x207fffff: p2p.ErrPowLimit} {
+		if h.Bits = bits; h.CheckPowLimit(0x1e0fffff) != want {
+			t.Errorf("bits %08x against the limit: expected %v", bits, want)
+		}
+	}
+}
+
+func TestWork(t *testing.T) {
+	if w := p2p.Work(0x1d00ffff); w.String() != "4295032833" {
+		t.Error("unexpected work of difficulty 1", w)
+	}
+	if w := p2p.Work(0); w.Sign() != 0 {
+		t.Error("work for invalid bits", w)
+	}
+}
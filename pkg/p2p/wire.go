@@ -0,0 +1,259 @@
+// Package p2p is a client for the Parallelcoin peer to peer wire protocol, implementing enough of it to download block headers and blocks from a full node without going through its RPC server
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// ProtocolVersion is the protocol version announced to peers. It has the relay flag in the version message, which is cleared so peers do not announce their transactions.
+	ProtocolVersion = 70002
+	// MinProtocolVersion is the oldest protocol version a peer may have, the first with getheaders
+	MinProtocolVersion = 31800
+	// pingNonceVersion is the first protocol version with a nonce in ping and pong messages
+	pingNonceVersion = 60001
+	// relayVersion is the first protocol version with the relay flag in the version message
+	relayVersion = 70001
+
+	// HeaderSize is the length of a serialised block header
+	HeaderSize = 80
+	// messageHeaderSize is the length of the header in front of every message
+	messageHeaderSize = 24
+	// commandSize is the length of the null padded command in a message header
+	commandSize = 12
+	// MaxPayload is the largest message payload accepted
+	MaxPayload = 32 << 20
+)
+
+// The commands of the messages used by the client
+const (
+	CmdVersion    = "version"
+	CmdVerack     = "verack"
+	CmdPing       = "ping"
+	CmdPong       = "pong"
+	CmdInv        = "inv"
+	CmdGetData    = "getdata"
+	CmdNotFound   = "notfound"
+	CmdGetHeaders = "getheaders"
+	CmdHeaders    = "headers"
+	CmdBlock      = "block"
+)
+
+// Network is the wire protocol parameters of a network
+type Network struct {
+	// Magic is the four bytes every message starts with
+	Magic [4]byte
+	// Port is the default port full nodes listen on
+	Port int
+}
+
+// Networks are the parameters of each network by name, as the full node has them
+var Networks = map[string]Network{
+	"mainnet": {Magic: [4]byte{0xcd, 0x08, 0xac, 0xff}, Port: 11047},
+	"testnet": {Magic: [4]byte{0x0b, 0x11, 0x09, 0x07}, Port: 21047},
+}
+
+var (
+	// ErrNetwork is returned for a network that is not in Networks
+	ErrNetwork = errors.New("unknown network, must be mainnet or testnet")
+	// ErrMagic is returned when a message does not start with the magic of the network
+	ErrMagic = errors.New("message is for a different network")
+	// ErrChecksum is returned when the checksum of a message payload does not match it
+	ErrChecksum = errors.New("message checksum does not match its payload")
+	// ErrTruncated is returned when a message payload ends before the structure it encodes
+	ErrTruncated = errors.New("message payload is truncated")
+)
+
+// Hash is a block or transaction hash in the byte order it is sent in, the reverse of the order it is shown in
+type Hash [32]byte
+
+// NewHash makes a Hash from the bytes of a hash in the order it is shown in, as the RPC server returns it and the index stores it
+func NewHash(shown []byte) (h Hash) {
+	for i := 0; i < len(h) && i < len(shown); i++ {
+		h[i] = shown[len(shown)-1-i]
+	}
+	return
+}
+
+// Shown returns the bytes of the hash in the order it is shown in
+func (h Hash) Shown() []byte {
+	out := make([]byte, len(h))
+	for i := range h {
+		out[i] = h[len(h)-1-i]
+	}
+	return out
+}
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h.Shown())
+}
+
+// DoubleHash returns the double SHA256 hash of some data, which is how blocks, transactions and message checksums are hashed
+func DoubleHash(b []byte) Hash {
+	first := sha256.Sum256(b)
+	return sha256.Sum256(first[:])
+}
+
+// BlockHash returns the hash of a serialised block, which is the hash of its header
+func BlockHash(raw []byte) (h Hash, err error) {
+	if len(raw) < HeaderSize {
+		return h, ErrTruncated
+	}
+	return DoubleHash(raw[:HeaderSize]), nil
+}
+
+// Message is a wire protocol message with its payload still serialised
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+// WriteMessage writes a message framed with the magic of a network and a checksum of its payload
+func WriteMessage(w io.Writer, magic [4]byte, m Message) (err error) {
+	if len(m.Command) > commandSize {
+		return fmt.Errorf("command %q is too long", m.Command)
+	}
+	if len(m.Payload) > MaxPayload {
+		return fmt.Errorf("%s payload of %d bytes is too long", m.Command, len(m.Payload))
+	}
+	out := make([]byte, messageHeaderSize, messageHeaderSize+len(m.Payload))
+	copy(out, magic[:])
+	copy(out[4:], m.Command)
+	binary.LittleEndian.PutUint32(out[16:], uint32(len(m.Payload)))
+	sum := DoubleHash(m.Payload)
+	copy(out[20:], sum[:4])
+	_, err = w.Write(append(out, m.Payload...))
+	return
+}
+
+// ReadMessage reads the next message, checking its magic and the checksum of its payload
+func ReadMessage(r io.Reader, magic [4]byte) (m Message, err error) {
+	var head [messageHeaderSize]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if !bytes.Equal(head[:4], magic[:]) {
+		return m, ErrMagic
+	}
+	m.Command = string(bytes.TrimRight(head[4:16], "\x00"))
+	length := binary.LittleEndian.Uint32(head[16:])
+	if length > MaxPayload {
+		return m, fmt.Errorf("%s payload of %d bytes is too long", m.Command, length)
+	}
+	m.Payload = make([]byte, length)
+	if _, err = io.ReadFull(r, m.Payload); err != nil {
+		return
+	}
+	if sum := DoubleHash(m.Payload); !bytes.Equal(sum[:4], head[20:]) {
+		return m, ErrChecksum
+	}
+	return
+}
+
+// appendVarInt appends a protocol compact int, which stores values below 0xFD in one byte, and otherwise a byte of 0xFD, 0xFE or 0xFF followed by the value in 2, 4 or 8 little endian bytes
+func appendVarInt(b []byte, v uint64) []byte {
+	switch {
+	case v < 0xFD:
+		return append(b, byte(v))
+	case v <= 0xFFFF:
+		return append(b, 0xFD, byte(v), byte(v>>8))
+	case v <= 0xFFFFFFFF:
+		b = append(b, 0xFE, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(v))
+		return b
+	}
+	b = append(b, 0xFF, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
+
+// appendUint32 appends a little endian 32 bit integer
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendUint64 appends a little endian 64 bit integer
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+// reader decodes a message payload. The first read past the end sets err, and every read after it returns zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = ErrTruncated
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) varInt() uint64 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	switch b[0] {
+	case 0xFD:
+		if b = r.bytes(2); b != nil {
+			return uint64(binary.LittleEndian.Uint16(b))
+		}
+	case 0xFE:
+		return uint64(r.uint32())
+	case 0xFF:
+		return r.uint64()
+	default:
+		return uint64(b[0])
+	}
+	return 0
+}
+
+// count reads the number of items in a list, each at least size bytes long, rejecting counts the rest of the payload cannot hold
+func (r *reader) count(size int) int {
+	n := r.varInt()
+	if r.err == nil && n > uint64(len(r.b)/size) {
+		r.err = ErrTruncated
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) hash() (h Hash) {
+	copy(h[:], r.bytes(len(h)))
+	return
+}
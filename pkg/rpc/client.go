@@ -3,16 +3,22 @@ package rpc
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// NewClient creates a new RPC client
+// ErrCookie is returned when a cookie file does not hold credentials in the form user:password
+var ErrCookie = errors.New("malformed cookie file")
+
+// NewClient creates a new RPC client. Over TLS the node's certificate is checked against the system's certificate authorities, see NewTLSClient for the other ways to check it.
 func NewClient(host string, port int, user, passwd string, useTLS bool) *Client {
 	if len(host) == 0 {
 		host = "127.0.0.1"
@@ -20,22 +26,65 @@ func NewClient(host string, port int, user, passwd string, useTLS bool) *Client
 	if port == 0 || port < 1024 {
 		port = 11048
 	}
-	var URL string
-	var httpClient *http.Client
+	c := &Client{URL: fmt.Sprintf("http://%s:%d", host, port), Username: user, Password: passwd}
 	if useTLS {
-		URL = "https://"
-		t := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		// the default configuration has no files to read, so it cannot fail
+		d, _ := newTLSDialer(nil)
+		c.URL, c.dialTLS = "https"+strings.TrimPrefix(c.URL, "http"), d.dial
+	}
+	c.httpClient = &http.Client{Transport: newTransport(c.dialTLS)}
+	return c
+}
+
+// newTransport returns an HTTP transport that keeps connections to the server open between requests, enough of them for every request a client may have in flight. HTTPS connections are made with dialTLS, which checks the server's certificate.
+func newTransport(dialTLS func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   RPCClientTimeout * time.Second,
+			KeepAlive: RPCClientTimeout * time.Second,
+		}).DialContext,
+		DialTLSContext:      dialTLS,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: DefaultConcurrency,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// init sets up the client before its first request
+func (c *Client) init() {
+	c.initOnce.Do(func() {
+		n := c.Concurrency
+		if n < 1 {
+			n = DefaultConcurrency
+		}
+		c.sem = make(chan struct{}, n)
+		if c.httpClient == nil {
+			c.httpClient = &http.Client{Transport: newTransport(nil)}
+		}
+		if t, ok := c.httpClient.Transport.(*http.Transport); ok && t.MaxIdleConnsPerHost < n {
+			t.MaxIdleConnsPerHost = n
 		}
-		httpClient = &http.Client{Transport: t}
-	} else {
-		URL = "http://"
-		httpClient = &http.Client{}
+	})
+}
+
+// LoadCookie reads the credentials from the client's cookie file
+func (c *Client) LoadCookie() error {
+	b, err := ioutil.ReadFile(c.CookieFile)
+	if err != nil {
+		return err
+	}
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return ErrCookie
 	}
-	return &Client{URL: fmt.Sprintf("%s%s:%d", URL, host, port), Username: user, Password: passwd, httpClient: httpClient}
+	c.mutex.Lock()
+	c.Username, c.Password = string(b[:i]), strings.TrimSpace(string(b[i+1:]))
+	c.mutex.Unlock()
+	return nil
 }
 
-// DoTimeoutRequest process a HTTP request with timeout
+// DoTimeoutRequest process a HTTP request with timeout. Calls are cancelled through their context instead, this is kept for callers outside the package.
 func (c *Client) DoTimeoutRequest(timer *time.Timer, req *http.Request) (*http.Response, error) {
 	type result struct {
 		resp *http.Response
@@ -55,43 +104,169 @@ func (c *Client) DoTimeoutRequest(timer *time.Timer, req *http.Request) (*http.R
 	}
 }
 
-// Call prepare & exec the request
+// Call prepare & exec the request. If the node answers with an error it is returned as an *Error.
 func (c *Client) Call(method string, params interface{}) (rr Response, err error) {
-	connectTimer := time.NewTimer(RPCClientTimeout * time.Second)
-	rpcR := Request{method, params, time.Now().UnixNano(), "1.0"}
-	payloadBuffer := &bytes.Buffer{}
-	jsonEncoder := json.NewEncoder(payloadBuffer)
-	err = jsonEncoder.Encode(rpcR)
-	if err != nil {
+	return c.CallContext(context.Background(), method, params)
+}
+
+// CallContext is Call with a context, which cancels the request if it is done before the response arrives
+func (c *Client) CallContext(ctx context.Context, method string, params interface{}) (rr Response, err error) {
+	if err = c.do(ctx, ReadOnlyMethods[method], Request{method, params, time.Now().UnixNano(), "1.0"}, &rr); err == nil && rr.Err != nil {
+		err = rr.Err
+	}
+	return
+}
+
+// CallBatch sends several requests to the server in one JSON-RPC batch and returns their responses in the same order. Each request is sent with its place in the batch as its ID. The error is for the batch as a whole, the errors of single requests are in the Err of their responses.
+func (c *Client) CallBatch(reqs []Request) ([]Response, error) {
+	return c.CallBatchContext(context.Background(), reqs)
+}
+
+// CallBatchContext is CallBatch with a context, which cancels the batch if it is done before the responses arrive
+func (c *Client) CallBatchContext(ctx context.Context, reqs []Request) (out []Response, err error) {
+	if len(reqs) == 0 {
 		return
 	}
-	req, err := http.NewRequest("POST", c.URL, payloadBuffer)
-	if err != nil {
+	batch, readOnly := make([]Request, len(reqs)), true
+	for i := range reqs {
+		readOnly = readOnly && ReadOnlyMethods[reqs[i].Method]
+		batch[i] = reqs[i]
+		batch[i].ID = int64(i)
+		if batch[i].JSONRPC == "" {
+			batch[i].JSONRPC = "1.0"
+		}
+	}
+	var data json.RawMessage
+	if err = c.do(ctx, readOnly, batch, &data); err != nil {
 		return
 	}
-	req.Header.Add("Content-Type", "application/json;charset=utf-8")
-	req.Header.Add("Accept", "application/json")
-
-	// Auth ?
-	if len(c.Username) > 0 || len(c.Password) > 0 {
-		req.SetBasicAuth(c.Username, c.Password)
+	var resps []Response
+	if err = json.Unmarshal(data, &resps); err != nil {
+		// a server that cannot read the batch answers it with a single error
+		var single Response
+		if json.Unmarshal(data, &single) == nil && single.Err != nil {
+			return nil, fmt.Errorf("batch rejected: %v", single.Err)
+		}
+		return
+	}
+	out = make([]Response, len(reqs))
+	got := make([]bool, len(reqs))
+	for _, rr := range resps {
+		if rr.ID < 0 || rr.ID >= int64(len(reqs)) || got[rr.ID] {
+			return nil, fmt.Errorf("unexpected response id %d in batch", rr.ID)
+		}
+		out[rr.ID], got[rr.ID] = rr, true
 	}
+	for i := range got {
+		if !got[i] {
+			return nil, fmt.Errorf("no response to %s, request %d of the batch", reqs[i].Method, i)
+		}
+	}
+	return
+}
 
-	resp, err := c.DoTimeoutRequest(connectTimer, req)
+// do sends a request or a batch of them and decodes the response into out. It waits for one of the Concurrency requests that may be in flight to finish first. A request that fails with a transient error is sent again, see Retries. Unless every method in it is read only, the request is only sent to URL, and only sent again if it could not be sent at all, see ReadOnlyMethods.
+func (c *Client) do(ctx context.Context, readOnly bool, in, out interface{}) (err error) {
+	c.init()
+	payload, err := json.Marshal(in)
 	if err != nil {
 		return
 	}
-	defer resp.Body.Close()
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	endpoints := c.endpoints()
+	if !readOnly {
+		endpoints = endpoints[:1]
+	}
+	retries := c.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	for attempt, waits := 0, uint(0); ; attempt++ {
+		i, url := c.endpoint(endpoints)
+		var raw json.RawMessage
+		if err = c.attempt(ctx, url, payload, &raw); err == nil {
+			return json.Unmarshal(raw, out)
+		}
+		if !IsTransient(err) || ctx.Err() != nil || attempt >= retries || !readOnly && !unsent(err) {
+			return
+		}
+		c.failover(i, len(endpoints))
+		// every endpoint is tried once before waiting to try them again
+		if (attempt+1)%len(endpoints) == 0 {
+			if err = c.wait(ctx, waits); err != nil {
+				return
+			}
+			waits++
+		}
+	}
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	//fmt.Println(string(data))
+// attempt sends an encoded request to an endpoint once and decodes the response into out, giving up after Timeout
+func (c *Client) attempt(ctx context.Context, url string, payload []byte, out interface{}) (err error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = RPCClientTimeout * time.Second
+	}
+	return c.send(ctx, url, payload, timeout, out)
+}
+
+// send sends an encoded request to an endpoint once and decodes the response into out, giving up after timeout
+func (c *Client) send(ctx context.Context, url string, payload []byte, timeout time.Duration, out interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := c.post(ctx, url, payload)
 	if err != nil {
 		return
 	}
+	if resp.StatusCode == http.StatusUnauthorized && c.CookieFile != "" {
+		// the node has restarted and written a new cookie
+		drain(resp)
+		if err = c.LoadCookie(); err != nil {
+			return
+		}
+		if resp, err = c.post(ctx, url, payload); err != nil {
+			return
+		}
+	}
+	defer drain(resp)
 	if resp.StatusCode != 200 {
-		err = errors.New("HTTP error: " + resp.Status)
-		return
+		// the node answers a failed call with an error status and the error in the body
+		var rr Response
+		if json.NewDecoder(resp.Body).Decode(&rr) == nil && rr.Err != nil {
+			return rr.Err
+		}
+		return &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
-	err = json.Unmarshal(data, &rr)
-	return
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// drain reads what is left of a response body and closes it, so its connection can be used again
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// post sends an encoded request to an endpoint
+func (c *Client) post(ctx context.Context, url string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Content-Type", "application/json;charset=utf-8")
+	req.Header.Add("Accept", "application/json")
+
+	// Auth ?
+	c.mutex.Lock()
+	user, pass := c.Username, c.Password
+	c.mutex.Unlock()
+	if len(user) > 0 || len(pass) > 0 {
+		req.SetBasicAuth(user, pass)
+	}
+	return c.httpClient.Do(req)
 }
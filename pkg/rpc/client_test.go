@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves a handler and returns a client for it
+func testServer(t *testing.T, handler http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+	return testClient(srv), srv
+}
+
+// testClient returns a client for a test server
+func testClient(srv *httptest.Server) *Client {
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return NewClient(host, p, "", "", false)
+}
+
+// echo answers each request, or each request in a batch in reverse order, with its method
+func echo(w http.ResponseWriter, req *http.Request) {
+	var body json.RawMessage
+	json.NewDecoder(req.Body).Decode(&body)
+	var batch []Request
+	if json.Unmarshal(body, &batch) != nil {
+		var in Request
+		json.Unmarshal(body, &in)
+		json.NewEncoder(w).Encode(Response{ID: in.ID, Result: json.RawMessage(strconv.Quote(in.Method))})
+		return
+	}
+	out := make([]Response, len(batch))
+	for i, in := range batch {
+		out[len(out)-1-i] = Response{ID: in.ID, Result: json.RawMessage(strconv.Quote(in.Method))}
+		if in.Method == "bad" {
+			out[len(out)-1-i] = Response{ID: in.ID, Result: json.RawMessage("null"), Err: &Error{Code: ErrCodeMisc, Message: "bad"}}
+		}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func TestCallBatch(t *testing.T) {
+	c, srv := testServer(t, echo)
+	defer srv.Close()
+
+	methods := []string{"getblockhash", "bad", "getblock", "getinfo"}
+	reqs := make([]Request, len(methods))
+	for i, m := range methods {
+		reqs[i] = Request{Method: m, Params: []interface{}{i}}
+	}
+	resps, err := c.CallBatch(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, resp := range resps {
+		var method string
+		json.Unmarshal(resp.Result, &method)
+		switch {
+		case methods[i] == "bad" && resp.Err == nil:
+			t.Error("error of request", i, "lost")
+		case methods[i] != "bad" && method != methods[i]:
+			t.Errorf("response %d is for %q, want %q", i, method, methods[i])
+		}
+	}
+	if resps, err = c.CallBatch(nil); err != nil || resps != nil {
+		t.Error("empty batch returned", resps, err)
+	}
+
+	// responses must match the requests
+	short, srv2 := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]Response{{ID: 0}})
+	})
+	defer srv2.Close()
+	if _, err = short.CallBatch(reqs); err == nil {
+		t.Error("batch with missing responses accepted")
+	}
+	rejected, srv3 := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(Response{Err: &Error{Code: -32700, Message: "parse error"}})
+	})
+	defer srv3.Close()
+	if _, err = rejected.CallBatch(reqs); err == nil {
+		t.Error("rejected batch accepted")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var inFlight, most, conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		echo(w, req)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := testClient(srv)
+	c.Concurrency = 3
+	var wg gosync.WaitGroup
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.Call("getinfo", nil); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if most > 3 || most < 2 {
+		t.Error(most, "requests in flight at once")
+	}
+	// connections are kept open and used again
+	if conns > 3 {
+		t.Error(conns, "connections opened for 30 requests")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	release := make(chan struct{})
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		echo(w, req)
+	})
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.CallContext(ctx, "getinfo", nil); err == nil {
+		t.Error("cancelled call returned no error")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("call not cancelled")
+	}
+
+	// a timeout is transient, so it would be retried
+	c.Timeout, c.Retries = 50*time.Millisecond, -1
+	if _, err := c.CallBatch([]Request{{Method: "getinfo"}}); err == nil {
+		t.Error("batch did not time out")
+	}
+}
@@ -0,0 +1,63 @@
+package rpc
+
+// GetMiningInfo is the response from getmininginfo
+type GetMiningInfo struct {
+	Blocks            uint32  `json:"blocks"`
+	CurrentBlockSize  uint64  `json:"currentblocksize"`
+	CurrentBlockTx    uint64  `json:"currentblocktx"`
+	PoWAlgoID         uint32  `json:"pow_algo_id"`
+	PoWAlgo           string  `json:"pow_algo"`
+	Difficulty        float64 `json:"difficulty"`
+	DifficultySHA256d float64 `json:"difficulty_sha256d"`
+	DifficultyScrypt  float64 `json:"difficulty_scrypt"`
+	Errors            string  `json:"errors"`
+	Generate          bool    `json:"generate"`
+	GenProcLimit      int     `json:"genproclimit"`
+	HashesPerSec      float64 `json:"hashespersec"`
+	NetworkHashPS     float64 `json:"networkhashps"`
+	PooledTx          uint64  `json:"pooledtx"`
+	Testnet           bool    `json:"testnet"`
+}
+
+// GetWork is the response from getwork without data, the header of a block to hash in the form used by old miners
+type GetWork struct {
+	Midstate string `json:"midstate"`
+	Data     string `json:"data"`
+	Hash1    string `json:"hash1"`
+	Target   string `json:"target"`
+}
+
+// TemplateRequest is the parameter of getblocktemplate. A request with the LongPollID of a template is only answered once the template is out of date, by nodes that support long polling.
+type TemplateRequest struct {
+	Mode         string   `json:"mode,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	LongPollID   string   `json:"longpollid,omitempty"`
+}
+
+// TemplateTransaction is a transaction to include in a block made from a template
+type TemplateTransaction struct {
+	Data    string  `json:"data"`
+	Hash    string  `json:"hash"`
+	Depends []int64 `json:"depends"`
+	Fee     int64   `json:"fee"`
+	SigOps  int64   `json:"sigops"`
+}
+
+// GetBlockTemplate is the response from getblocktemplate
+type GetBlockTemplate struct {
+	Version           uint32                `json:"version"`
+	PreviousBlockHash string                `json:"previousblockhash"`
+	Transactions      []TemplateTransaction `json:"transactions"`
+	CoinbaseAux       map[string]string     `json:"coinbaseaux"`
+	CoinbaseValue     int64                 `json:"coinbasevalue"`
+	Target            string                `json:"target"`
+	MinTime           int64                 `json:"mintime"`
+	Mutable           []string              `json:"mutable"`
+	NonceRange        string                `json:"noncerange"`
+	SigOpLimit        int64                 `json:"sigoplimit"`
+	SizeLimit         int64                 `json:"sizelimit"`
+	CurTime           int64                 `json:"curtime"`
+	Bits              string                `json:"bits"`
+	Height            uint32                `json:"height"`
+	LongPollID        string                `json:"longpollid,omitempty"`
+}
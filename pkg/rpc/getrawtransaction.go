@@ -93,3 +93,24 @@ type TransactionOutSet struct {
 	HashSerialized  string  `json:"hash_serialized"`
 	TotalAmount     float64 `json:"total_amount"`
 }
+
+// TxInput is an output to spend in createrawtransaction
+type TxInput struct {
+	Txid string `json:"txid"`
+	Vout uint32 `json:"vout"`
+}
+
+// PrevTx is an output spent by a transaction given to signrawtransaction, for outputs the node does not know of
+type PrevTx struct {
+	Txid         string `json:"txid"`
+	Vout         uint32 `json:"vout"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	RedeemScript string `json:"redeemScript,omitempty"`
+}
+
+// SignRawTransaction is the response from signrawtransaction
+type SignRawTransaction struct {
+	Hex string `json:"hex"`
+	// Complete is true if every input has a complete signature
+	Complete bool `json:"complete"`
+}
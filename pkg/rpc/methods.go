@@ -0,0 +1,246 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// call makes a call with a list of parameters and decodes its result into out, unless out is nil
+func (c *Client) call(out interface{}, method string, params ...interface{}) error {
+	return c.callContext(context.Background(), out, method, params...)
+}
+
+// callContext is call with a context, which cancels the call if it is done before the result arrives
+func (c *Client) callContext(ctx context.Context, out interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	resp, err := c.CallContext(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(resp.Result, out); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	return nil
+}
+
+// GetInfo returns the state of the node
+func (c *Client) GetInfo() (info *GetInfo, err error) {
+	info = new(GetInfo)
+	if err = c.call(info, "getinfo"); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetBlockCount returns the height of the node's best block
+func (c *Client) GetBlockCount() (height uint32, err error) {
+	err = c.call(&height, "getblockcount")
+	return
+}
+
+// GetBlockHash returns the hash of the block at a height on the best chain
+func (c *Client) GetBlockHash(height uint32) (hash string, err error) {
+	err = c.call(&hash, "getblockhash", height)
+	return
+}
+
+// GetBestBlockHash returns the hash of the node's best block
+func (c *Client) GetBestBlockHash() (hash string, err error) {
+	err = c.call(&hash, "getbestblockhash")
+	return
+}
+
+// GetBlock returns a block with the ids of its transactions
+func (c *Client) GetBlock(hash string) (block *GetBlock, err error) {
+	block = new(GetBlock)
+	if err = c.call(block, "getblock", hash, true); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetBlockHex returns a serialised block in hexadecimal
+func (c *Client) GetBlockHex(hash string) (raw string, err error) {
+	err = c.call(&raw, "getblock", hash, false)
+	return
+}
+
+// GetDifficulty returns the difficulty of the next block as a multiple of the minimum
+func (c *Client) GetDifficulty() (difficulty float64, err error) {
+	err = c.call(&difficulty, "getdifficulty")
+	return
+}
+
+// GetMiningInfo returns the state of mining on the node
+func (c *Client) GetMiningInfo() (info *GetMiningInfo, err error) {
+	info = new(GetMiningInfo)
+	if err = c.call(info, "getmininginfo"); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetConnectionCount returns the number of peers the node is connected to
+func (c *Client) GetConnectionCount() (n uint32, err error) {
+	err = c.call(&n, "getconnectioncount")
+	return
+}
+
+// GetPeerInfo returns the peers the node is connected to
+func (c *Client) GetPeerInfo() (peers []GetPeerInfo, err error) {
+	err = c.call(&peers, "getpeerinfo")
+	return
+}
+
+// GetRawMempool returns the ids of the transactions in the node's memory pool
+func (c *Client) GetRawMempool() (txids []string, err error) {
+	err = c.call(&txids, "getrawmempool")
+	return
+}
+
+// GetRawTransaction returns a decoded transaction. Unless the node keeps a transaction index it only has the transactions in its memory pool and the unspent ones.
+func (c *Client) GetRawTransaction(txid string) (tx *RawTransaction, err error) {
+	tx = new(RawTransaction)
+	if err = c.call(tx, "getrawtransaction", txid, 1); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetRawTransactionHex returns a serialised transaction in hexadecimal
+func (c *Client) GetRawTransactionHex(txid string) (raw string, err error) {
+	err = c.call(&raw, "getrawtransaction", txid, 0)
+	return
+}
+
+// GetTransaction returns a transaction in the node's wallet
+func (c *Client) GetTransaction(txid string) (tx *Transaction, err error) {
+	tx = new(Transaction)
+	if err = c.call(tx, "gettransaction", txid); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetTxOut returns an unspent transaction output, or nil if it is spent or does not exist. Outputs spent in the memory pool count as spent if mempool is true.
+func (c *Client) GetTxOut(txid string, n uint32, mempool bool) (out *UTransactionOut, err error) {
+	err = c.call(&out, "gettxout", txid, n, mempool)
+	return
+}
+
+// GetTxOutSetInfo returns statistics about the unspent transaction outputs
+func (c *Client) GetTxOutSetInfo() (info *TransactionOutSet, err error) {
+	info = new(TransactionOutSet)
+	if err = c.call(info, "gettxoutsetinfo"); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// DecodeRawTransaction decodes a serialised transaction in hexadecimal
+func (c *Client) DecodeRawTransaction(raw string) (tx *RawTransaction, err error) {
+	tx = new(RawTransaction)
+	if err = c.call(tx, "decoderawtransaction", raw); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// CreateRawTransaction returns an unsigned transaction in hexadecimal spending some outputs and paying amounts in coins to addresses
+func (c *Client) CreateRawTransaction(inputs []TxInput, outputs map[string]float64) (raw string, err error) {
+	if inputs == nil {
+		inputs = []TxInput{}
+	}
+	err = c.call(&raw, "createrawtransaction", inputs, outputs)
+	return
+}
+
+// SignRawTransaction signs the inputs of a transaction in hexadecimal with the keys in the node's wallet, or with privKeys if they are given. The outputs it spends that the node does not know of are given in prevTxs, which may be nil.
+func (c *Client) SignRawTransaction(raw string, prevTxs []PrevTx, privKeys []string) (signed *SignRawTransaction, err error) {
+	params := []interface{}{raw}
+	if prevTxs != nil || privKeys != nil {
+		if prevTxs == nil {
+			prevTxs = []PrevTx{}
+		}
+		params = append(params, prevTxs)
+	}
+	if privKeys != nil {
+		params = append(params, privKeys)
+	}
+	signed = new(SignRawTransaction)
+	if err = c.call(signed, "signrawtransaction", params...); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// SendRawTransaction submits a signed transaction in hexadecimal to the node and returns its id
+func (c *Client) SendRawTransaction(raw string) (txid string, err error) {
+	err = c.call(&txid, "sendrawtransaction", raw)
+	return
+}
+
+// ValidateAddress checks an address, and returns what the node's wallet knows of it
+func (c *Client) ValidateAddress(address string) (v *ValidateAddress, err error) {
+	v = new(ValidateAddress)
+	if err = c.call(v, "validateaddress", address); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// ListUnspent returns the unspent outputs in the node's wallet with between minConf and maxConf confirmations, paying any of the given addresses or all of them if there are none
+func (c *Client) ListUnspent(minConf, maxConf int, addresses ...string) (unspent []Unspent, err error) {
+	params := []interface{}{minConf, maxConf}
+	if len(addresses) > 0 {
+		params = append(params, addresses)
+	}
+	err = c.call(&unspent, "listunspent", params...)
+	return
+}
+
+// GetWork returns a block header to hash in the form used by old miners
+func (c *Client) GetWork() (work *GetWork, err error) {
+	work = new(GetWork)
+	if err = c.call(work, "getwork"); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// SubmitWork submits the data of a solved getwork header and returns true if the node accepted the block
+func (c *Client) SubmitWork(data string) (accepted bool, err error) {
+	err = c.call(&accepted, "getwork", data)
+	return
+}
+
+// GetBlockTemplate returns a template to build a block on. The request may be nil.
+func (c *Client) GetBlockTemplate(req *TemplateRequest) (tmpl *GetBlockTemplate, err error) {
+	var params []interface{}
+	if req != nil {
+		params = append(params, req)
+	}
+	tmpl = new(GetBlockTemplate)
+	if err = c.call(tmpl, "getblocktemplate", params...); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// SubmitBlock submits a serialised block in hexadecimal to the node. The node answers a block it rejects with the reason, which is returned as the error.
+func (c *Client) SubmitBlock(raw string) error {
+	var reason *string
+	if err := c.call(&reason, "submitblock", raw); err != nil {
+		return err
+	}
+	if reason != nil {
+		return fmt.Errorf("block rejected: %s", *reason)
+	}
+	return nil
+}
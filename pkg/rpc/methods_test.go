@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMethods(t *testing.T) {
+	var got Request
+	results := map[string]string{
+		"getblockcount":        `42`,
+		"getblockhash":         `"00ab"`,
+		"getblock":             `{"hash":"00ab","height":42,"tx":["aa","bb"]}`,
+		"getrawtransaction":    `{"txid":"aa","vout":[{"value":1.5,"n":0}]}`,
+		"getpeerinfo":          `[{"addr":"1.2.3.4:11047","startingheight":41}]`,
+		"gettxout":             `null`,
+		"validateaddress":      `{"isvalid":false}`,
+		"listunspent":          `[{"txid":"aa","vout":1,"amount":2}]`,
+		"signrawtransaction":   `{"hex":"0100","complete":true}`,
+		"getblocktemplate":     `{"height":43,"transactions":[{"hash":"aa","fee":10}]}`,
+		"submitblock":          `"rejected"`,
+		"createrawtransaction": `"0100"`,
+	}
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		got = Request{}
+		json.NewDecoder(req.Body).Decode(&got)
+		json.NewEncoder(w).Encode(Response{ID: got.ID, Result: json.RawMessage(results[got.Method])})
+	})
+	defer srv.Close()
+	params := func(want ...interface{}) {
+		t.Helper()
+		if want == nil {
+			want = []interface{}{}
+		}
+		b, _ := json.Marshal(want)
+		var w interface{}
+		json.Unmarshal(b, &w)
+		if !reflect.DeepEqual(got.Params, w) {
+			t.Errorf("%s sent %v, want %v", got.Method, got.Params, w)
+		}
+	}
+
+	if n, err := c.GetBlockCount(); err != nil || n != 42 {
+		t.Error("getblockcount", n, err)
+	}
+	params()
+	if h, err := c.GetBlockHash(42); err != nil || h != "00ab" {
+		t.Error("getblockhash", h, err)
+	}
+	params(42)
+	if b, err := c.GetBlock("00ab"); err != nil || b.Height != 42 || len(b.Tx) != 2 {
+		t.Error("getblock", b, err)
+	}
+	params("00ab", true)
+	if tx, err := c.GetRawTransaction("aa"); err != nil || tx.Vout[0].Value != 1.5 {
+		t.Error("getrawtransaction", tx, err)
+	}
+	params("aa", 1)
+	if peers, err := c.GetPeerInfo(); err != nil || len(peers) != 1 || peers[0].StartingHeight != 41 {
+		t.Error("getpeerinfo", peers, err)
+	}
+	if out, err := c.GetTxOut("aa", 1, true); err != nil || out != nil {
+		t.Error("spent output returned", out, err)
+	}
+	params("aa", 1, true)
+	if v, err := c.ValidateAddress("x"); err != nil || v.IsValid {
+		t.Error("validateaddress", v, err)
+	}
+	if u, err := c.ListUnspent(1, 9999999, "a", "b"); err != nil || len(u) != 1 || u[0].Amount != 2 {
+		t.Error("listunspent", u, err)
+	}
+	params(1, 9999999, []string{"a", "b"})
+	if raw, err := c.CreateRawTransaction(nil, map[string]float64{"a": 1}); err != nil || raw != "0100" {
+		t.Error("createrawtransaction", raw, err)
+	}
+	params([]TxInput{}, map[string]float64{"a": 1})
+	if s, err := c.SignRawTransaction("0100", nil, []string{"key"}); err != nil || !s.Complete {
+		t.Error("signrawtransaction", s, err)
+	}
+	params("0100", []PrevTx{}, []string{"key"})
+	if tmpl, err := c.GetBlockTemplate(nil); err != nil || tmpl.Height != 43 || tmpl.Transactions[0].Fee != 10 {
+		t.Error("getblocktemplate", tmpl, err)
+	}
+	params()
+	if err := c.SubmitBlock("00"); err == nil {
+		t.Error("rejected block accepted")
+	}
+}
+
+func TestError(t *testing.T) {
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		// the node answers errors with a server error status
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Err: &Error{Code: ErrCodeInvalidAddressOrKey, Message: "No information available about transaction"}})
+	})
+	defer srv.Close()
+	_, err := c.GetRawTransaction("aa")
+	if !IsCode(err, ErrCodeInvalidAddressOrKey) {
+		t.Errorf("got %#v, want an *Error with code %d", err, ErrCodeInvalidAddressOrKey)
+	}
+
+	plain, srv2 := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+	defer srv2.Close()
+	if _, err = plain.GetBlockCount(); err == nil || IsCode(err, ErrCodeMisc) {
+		t.Error("HTTP error not returned:", err)
+	}
+}
@@ -0,0 +1,522 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// WebsocketPath is the path of the websocket endpoint of a node that sends btcd style notifications
+	WebsocketPath = "/ws"
+	// MaxReorgDepth is the most blocks of the best chain a polling subscription keeps to find where a new best chain forks from it. A reorganisation deeper than that is delivered as all of them being disconnected.
+	MaxReorgDepth = 100
+
+	// NtfnBlockConnected is sent for each block added to the best chain, see NotifyBlocks
+	NtfnBlockConnected = "blockconnected"
+	// NtfnBlockDisconnected is sent for each block removed from the best chain by a reorganisation, from the top down, before the blocks of the new branch are connected
+	NtfnBlockDisconnected = "blockdisconnected"
+	// NtfnTxAccepted is sent for each transaction accepted to the node's memory pool, see NotifyNewTransactions
+	NtfnTxAccepted = "txaccepted"
+	// NtfnTxAcceptedVerbose is sent instead of NtfnTxAccepted when verbose notifications are asked for
+	NtfnTxAcceptedVerbose = "txacceptedverbose"
+	// NtfnRecvTx is sent for each transaction paying a watched address, see NotifyReceived
+	NtfnRecvTx = "recvtx"
+	// NtfnRedeemingTx is sent for each transaction spending an output that paid a watched address
+	NtfnRedeemingTx = "redeemingtx"
+)
+
+// ErrNotSupported is returned when subscribing to notifications a polling subscription cannot give, which is all but block notifications
+var ErrNotSupported = errors.New("notifications not supported without a websocket endpoint")
+
+// ErrSubscriptionClosed is returned for a request on a subscription that has ended
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// Notification is an event on the node
+type Notification struct {
+	// Type is the method of the notification, one of the Ntfn constants for those that are decoded
+	Type string
+	// Hash, Height and Time are the block for block notifications, and the block a transaction is in for NtfnRecvTx and NtfnRedeemingTx if it is in one
+	Hash   string
+	Height uint32
+	Time   int64
+	// Txid and Amount are the transaction and the total of its outputs for NtfnTxAccepted
+	Txid   string
+	Amount float64
+	// Tx is the transaction for NtfnTxAcceptedVerbose, NtfnRecvTx and NtfnRedeemingTx. Only its Hex is set for the last two.
+	Tx *RawTransaction
+	// Params are the parameters of the notification as the node sent them
+	Params []json.RawMessage
+}
+
+// Subscription delivers a node's notifications. It is made by Subscribe and receives nothing until it is asked for some kind of notification.
+type Subscription struct {
+	// Notifications receives the notifications subscribed to, in the order the node sends them. It is closed when the subscription ends, after which Err gives the reason. No more notifications are read from the node while it is full, so it must be received from.
+	Notifications <-chan Notification
+	client        *Client
+	// conn is the websocket, or nil if the node is polled
+	conn    *websocket.Conn
+	ntfns   chan Notification
+	writeMu gosync.Mutex
+	// mu guards pending, nextID and err
+	mu      gosync.Mutex
+	pending map[int64]chan Response
+	nextID  int64
+	err     error
+	// blocks is closed to start polling for blocks
+	blocks     chan struct{}
+	blocksOnce gosync.Once
+	// closing is closed by Close, and done once the subscription has ended
+	closing   chan struct{}
+	closeOnce gosync.Once
+	done      chan struct{}
+	cancel    context.CancelFunc
+}
+
+// Subscribe opens a subscription to the node's notifications over its websocket endpoint. A node without one, as the legacy full node is, is polled instead, which only gives block notifications: getblocktemplate is long polled if the node supports it, and otherwise getbestblockhash is asked every PollInterval. The subscription ends when ctx is done or it is closed.
+func (c *Client) Subscribe(ctx context.Context) (s *Subscription, err error) {
+	c.init()
+	s = &Subscription{
+		client:  c,
+		ntfns:   make(chan Notification, 16),
+		pending: make(map[int64]chan Response),
+		blocks:  make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.Notifications = s.ntfns
+	conn, resp, err := c.dialWebsocket(ctx)
+	if err == websocket.ErrBadHandshake && resp != nil && resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		// not a websocket endpoint
+		conn, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	var pollCtx context.Context
+	pollCtx, s.cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	if conn != nil {
+		go func() { s.finish(s.read()) }()
+	} else {
+		go func() {
+			select {
+			case <-s.blocks:
+				s.finish(s.poll(pollCtx))
+			case <-pollCtx.Done():
+				s.finish(nil)
+			}
+		}()
+	}
+	return
+}
+
+// dialWebsocket connects to the websocket endpoint of the endpoint in use, with the credentials of the client
+func (c *Client) dialWebsocket(ctx context.Context) (conn *websocket.Conn, resp *http.Response, err error) {
+	_, u := c.endpoint(c.endpoints())
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = RPCClientTimeout * time.Second
+	}
+	dialer := &websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: timeout}
+	header := func() http.Header {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		h := make(http.Header)
+		if len(c.Username) > 0 || len(c.Password) > 0 {
+			h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+		}
+		return h
+	}
+	url := "ws" + strings.TrimPrefix(u, "http") + WebsocketPath
+	if c.dialTLS != nil {
+		// the TLS handshake is done by dialTLS, so the websocket is opened over what looks to the dialer like a plain connection, which cannot go through a proxy
+		dialer.NetDialContext, dialer.Proxy = c.dialTLS, nil
+		url = "ws" + strings.TrimPrefix(url, "wss")
+	}
+	conn, resp, err = dialer.DialContext(ctx, url, header())
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized && c.CookieFile != "" {
+		// the node has restarted and written a new cookie
+		if err = c.LoadCookie(); err != nil {
+			return
+		}
+		conn, resp, err = dialer.DialContext(ctx, url, header())
+	}
+	return
+}
+
+// Websocket returns true if the notifications come over a websocket, and false if the node is polled
+func (s *Subscription) Websocket() bool {
+	return s.conn != nil
+}
+
+// NotifyBlocks asks for NtfnBlockConnected and NtfnBlockDisconnected notifications
+func (s *Subscription) NotifyBlocks(ctx context.Context) error {
+	if s.conn == nil {
+		s.blocksOnce.Do(func() { close(s.blocks) })
+		return nil
+	}
+	return s.call(ctx, "notifyblocks")
+}
+
+// NotifyNewTransactions asks for a notification for each transaction accepted to the node's memory pool, NtfnTxAcceptedVerbose with the decoded transaction if verbose is true and otherwise NtfnTxAccepted
+func (s *Subscription) NotifyNewTransactions(ctx context.Context, verbose bool) error {
+	if s.conn == nil {
+		return ErrNotSupported
+	}
+	return s.call(ctx, "notifynewtransactions", verbose)
+}
+
+// NotifyReceived asks for NtfnRecvTx notifications for transactions paying any of the addresses, and NtfnRedeemingTx notifications for transactions spending the outputs they are paid
+func (s *Subscription) NotifyReceived(ctx context.Context, addresses ...string) error {
+	if s.conn == nil {
+		return ErrNotSupported
+	}
+	return s.call(ctx, "notifyreceived", addresses)
+}
+
+// Close ends the subscription and waits for Notifications to be closed
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.cancel()
+		if s.conn != nil {
+			s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			s.conn.Close()
+		}
+	})
+	<-s.done
+	return nil
+}
+
+// Err returns why the subscription ended, or nil if it has not or was closed
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// finish records why the subscription ended, unless it was closed, and closes Notifications
+func (s *Subscription) finish(err error) {
+	s.mu.Lock()
+	select {
+	case <-s.closing:
+	default:
+		s.err = err
+	}
+	s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	close(s.ntfns)
+	close(s.done)
+}
+
+// deliver sends a notification on Notifications, and returns false if the subscription is closed first
+func (s *Subscription) deliver(n Notification) bool {
+	select {
+	case s.ntfns <- n:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+// call sends a request over the websocket and waits for its response
+func (s *Subscription) call(ctx context.Context, method string, params ...interface{}) (err error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	ch := make(chan Response, 1)
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+	s.writeMu.Lock()
+	err = s.conn.WriteJSON(Request{method, params, id, "1.0"})
+	s.writeMu.Unlock()
+	if err != nil {
+		return
+	}
+	select {
+	case rr := <-ch:
+		if rr.Err != nil {
+			return rr.Err
+		}
+		return nil
+	case <-s.done:
+		if err = s.Err(); err == nil {
+			err = ErrSubscriptionClosed
+		}
+		return
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wsMessage is a response or a notification read from the websocket. Notifications are requests from the node with a null id.
+type wsMessage struct {
+	ID     *int64            `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result json.RawMessage   `json:"result"`
+	Err    *Error            `json:"error"`
+}
+
+// read passes the responses read from the websocket to the calls waiting for them and the notifications to Notifications, until the websocket is closed or sends something that cannot be decoded
+func (s *Subscription) read() error {
+	for {
+		var m wsMessage
+		if err := s.conn.ReadJSON(&m); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+		if m.Method == "" {
+			if m.ID == nil {
+				return errors.New("websocket message with neither an id nor a method")
+			}
+			s.mu.Lock()
+			ch := s.pending[*m.ID]
+			s.mu.Unlock()
+			if ch != nil {
+				ch <- Response{ID: *m.ID, Result: m.Result, Err: m.Err}
+			}
+			continue
+		}
+		n, err := decodeNotification(m.Method, m.Params)
+		if err != nil {
+			return err
+		}
+		if !s.deliver(n) {
+			return nil
+		}
+	}
+}
+
+// blockDetails is the block a transaction is in, in NtfnRecvTx and NtfnRedeemingTx notifications
+type blockDetails struct {
+	Height uint32 `json:"height"`
+	Hash   string `json:"hash"`
+	Index  int    `json:"index"`
+	Time   int64  `json:"time"`
+}
+
+// decodeNotification decodes the parameters of the notifications with a Ntfn constant, and leaves those of others in Params
+func decodeNotification(method string, params []json.RawMessage) (n Notification, err error) {
+	n = Notification{Type: method, Params: params}
+	arg := func(i int, v interface{}) {
+		if err == nil && i < len(params) {
+			err = json.Unmarshal(params[i], v)
+		}
+	}
+	want := func(count int) {
+		if err == nil && len(params) < count {
+			err = fmt.Errorf("%d parameters, want %d", len(params), count)
+		}
+	}
+	switch method {
+	case NtfnBlockConnected, NtfnBlockDisconnected:
+		want(3)
+		arg(0, &n.Hash)
+		arg(1, &n.Height)
+		arg(2, &n.Time)
+	case NtfnTxAccepted:
+		want(2)
+		arg(0, &n.Txid)
+		arg(1, &n.Amount)
+	case NtfnTxAcceptedVerbose:
+		want(1)
+		n.Tx = new(RawTransaction)
+		arg(0, n.Tx)
+		n.Txid = n.Tx.Txid
+	case NtfnRecvTx, NtfnRedeemingTx:
+		want(1)
+		n.Tx = new(RawTransaction)
+		arg(0, &n.Tx.Hex)
+		var b *blockDetails
+		arg(1, &b)
+		if b != nil {
+			n.Hash, n.Height, n.Time = b.Hash, b.Height, b.Time
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%s notification: %v", method, err)
+	}
+	return
+}
+
+// polledBlock is a block on the best chain as last seen by a polling subscription
+type polledBlock struct {
+	hash   string
+	height uint32
+	time   int64
+}
+
+// poll delivers block notifications for the changes to the best chain. It waits for them by long polling getblocktemplate until the node answers that with an error, as a node without long polling does, and from then on by asking for the best block every PollInterval.
+func (s *Subscription) poll(ctx context.Context) error {
+	c := s.client
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	best, err := s.block(ctx, "")
+	if err != nil {
+		return err
+	}
+	chain := []polledBlock{best}
+	longPoll, longPollID := true, ""
+	for {
+		wait := !longPoll
+		if longPoll {
+			tmpl, err := s.longPoll(ctx, longPollID)
+			var rpcErr *Error
+			switch {
+			case errors.As(err, &rpcErr) || err == nil && tmpl.LongPollID == "":
+				longPoll, wait = false, true
+			case ctx.Err() != nil:
+				return nil
+			case errors.Is(err, context.DeadlineExceeded):
+				// the template did not change while the long poll was waited for
+				continue
+			case IsTransient(err):
+				// the endpoint may be down, which the retries of the update find out, after waiting as a poll would so a node that drops long polls is not asked again at once
+				wait = true
+			case err != nil:
+				return err
+			default:
+				longPollID = tmpl.LongPollID
+			}
+		}
+		if wait {
+			t := time.NewTimer(interval)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil
+			}
+		}
+		if chain, err = s.update(ctx, chain); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// longPoll asks for a block template, which the node holds back until the template is no longer the one with the id if it is not empty. It is sent once to the endpoint in use and waited for LongPollTimeout, as the node taking its time is not a reason to retry it or fail over, and does not take one of the Concurrency requests the client may have in flight for as long as it is held.
+func (s *Subscription) longPoll(ctx context.Context, id string) (tmpl GetBlockTemplate, err error) {
+	c := s.client
+	timeout := c.LongPollTimeout
+	if timeout <= 0 {
+		timeout = DefaultLongPollTimeout
+	}
+	payload, err := json.Marshal(Request{"getblocktemplate", []interface{}{&TemplateRequest{LongPollID: id}}, time.Now().UnixNano(), "1.0"})
+	if err != nil {
+		return
+	}
+	_, url := c.endpoint(c.endpoints())
+	var rr Response
+	if err = c.send(ctx, url, payload, timeout, &rr); err != nil {
+		return
+	}
+	if rr.Err != nil {
+		return tmpl, rr.Err
+	}
+	if err = json.Unmarshal(rr.Result, &tmpl); err != nil {
+		err = fmt.Errorf("getblocktemplate: %v", err)
+	}
+	return
+}
+
+// block returns a block with its hash, or the best block if the hash is empty
+func (s *Subscription) block(ctx context.Context, hash string) (b polledBlock, err error) {
+	if hash == "" {
+		if err = s.client.callContext(ctx, &hash, "getbestblockhash"); err != nil {
+			return
+		}
+	}
+	var blk GetBlock
+	if err = s.client.callContext(ctx, &blk, "getblock", hash, true); err != nil {
+		return
+	}
+	return polledBlock{blk.Hash, blk.Height, blk.Time}, nil
+}
+
+// update asks for the best block and delivers notifications for the blocks disconnected from and connected to the chain last seen, then returns the new chain, keeping its last MaxReorgDepth blocks. Every block the best chain has been extended by is connected, however many there are.
+func (s *Subscription) update(ctx context.Context, chain []polledBlock) ([]polledBlock, error) {
+	var hash string
+	if err := s.client.callContext(ctx, &hash, "getbestblockhash"); err != nil {
+		return chain, err
+	}
+	seen := make(map[string]int)
+	var low uint32
+	for i, b := range chain {
+		seen[b.hash] = i
+	}
+	if len(chain) > 0 {
+		low = chain[0].height
+	}
+	// walk back from the new best block to the chain last seen, or to below it if all of it has been replaced. The walk is bounded by the height of the bottom of the chain rather than by a number of blocks, as the best chain may have grown by more than MaxReorgDepth since the last poll.
+	var connected []polledBlock
+	fork := -1
+	for {
+		if i, ok := seen[hash]; ok {
+			fork = i
+			break
+		}
+		var blk GetBlock
+		if err := s.client.callContext(ctx, &blk, "getblock", hash, true); err != nil {
+			return chain, err
+		}
+		if blk.Height < low {
+			break
+		}
+		connected = append(connected, polledBlock{blk.Hash, blk.Height, blk.Time})
+		if hash = blk.PreviousBlockHash; hash == "" {
+			break
+		}
+	}
+	for i := len(chain) - 1; i > fork; i-- {
+		b := chain[i]
+		if !s.deliver(Notification{Type: NtfnBlockDisconnected, Hash: b.hash, Height: b.height, Time: b.time}) {
+			return chain, nil
+		}
+	}
+	chain = chain[:fork+1]
+	for i := len(connected) - 1; i >= 0; i-- {
+		b := connected[i]
+		if !s.deliver(Notification{Type: NtfnBlockConnected, Hash: b.hash, Height: b.height, Time: b.time}) {
+			return chain, nil
+		}
+		chain = append(chain, b)
+	}
+	if len(chain) > MaxReorgDepth {
+		chain = append([]polledBlock(nil), chain[len(chain)-MaxReorgDepth:]...)
+	}
+	return chain, nil
+}
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// TestLongPoll checks that a node without a websocket endpoint is long polled with getblocktemplate for new blocks
+func TestLongPoll(t *testing.T) {
+	var mu gosync.Mutex
+	best := 1
+	hash := func(h int) string { return fmt.Sprintf("%064x", h) }
+	newBlock := make(chan struct{})
+	polls := make(chan string, 10)
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var in struct {
+			ID     int64             `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(req.Body).Decode(&in)
+		mu.Lock()
+		tip := best
+		mu.Unlock()
+		var result interface{}
+		switch in.Method {
+		case "getblocktemplate":
+			var tr TemplateRequest
+			json.Unmarshal(in.Params[0], &tr)
+			polls <- tr.LongPollID
+			if tr.LongPollID != "" {
+				select {
+				case <-newBlock:
+				case <-req.Context().Done():
+					return
+				}
+				mu.Lock()
+				tip = best
+				mu.Unlock()
+			}
+			result = GetBlockTemplate{PreviousBlockHash: hash(tip), Height: uint32(tip + 1), LongPollID: hash(tip)}
+		case "getbestblockhash":
+			result = hash(tip)
+		case "getblock":
+			var h string
+			json.Unmarshal(in.Params[0], &h)
+			var height int
+			fmt.Sscanf(h, "%x", &height)
+			b := GetBlock{Hash: h, Height: uint32(height)}
+			if height > 0 {
+				b.PreviousBlockHash = hash(height - 1)
+			}
+			result = b
+		}
+		raw, _ := json.Marshal(result)
+		json.NewEncoder(w).Encode(Response{ID: in.ID, Result: raw})
+	})
+	defer srv.Close()
+	// a long poll is held for longer than a request may take, which must not make the client send it again
+	c.Timeout = 50 * time.Millisecond
+
+	sub, err := c.Subscribe(context.Background())
+	if err != nil || sub.Websocket() {
+		t.Fatal("node not polled", err)
+	}
+	defer sub.Close()
+	if err = sub.NotifyNewTransactions(context.Background(), false); err != ErrNotSupported {
+		t.Error("transaction notifications while polling", err)
+	}
+	if err = sub.NotifyBlocks(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if id := <-polls; id != "" {
+		t.Fatal("first poll with long poll id", id)
+	}
+	if id := <-polls; id != hash(1) {
+		t.Fatal("long poll id not sent", id)
+	}
+	time.Sleep(4 * c.Timeout)
+	mu.Lock()
+	best = 3
+	mu.Unlock()
+	newBlock <- struct{}{}
+	for h := uint32(2); h <= 3; h++ {
+		select {
+		case n := <-sub.Notifications:
+			if n.Type != NtfnBlockConnected || n.Height != h || n.Hash != hash(int(h)) {
+				t.Errorf("got %s at %d, want %s at %d", n.Type, n.Height, NtfnBlockConnected, h)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification for block", h)
+		}
+	}
+	if id := <-polls; id != hash(3) {
+		t.Error("long poll id not updated", id)
+	}
+}
+
+// TestPollUpdate checks that a polling subscription connects every block when the best chain grows by more than MaxReorgDepth between polls, and disconnects only the replaced blocks in a reorganisation
+func TestPollUpdate(t *testing.T) {
+	hash := func(h int) string { return fmt.Sprintf("%064x", h) }
+	fork := func(h int) string { return fmt.Sprintf("f%063x", h) }
+	top := 1 + MaxReorgDepth + 50
+	blocks := make(map[string]GetBlock)
+	for h := 0; h <= top; h++ {
+		b := GetBlock{Hash: hash(h), Height: uint32(h)}
+		if h > 0 {
+			b.PreviousBlockHash = hash(h - 1)
+		}
+		blocks[b.Hash] = b
+	}
+	// a branch replacing the top two blocks
+	for h := top - 1; h <= top+1; h++ {
+		b := GetBlock{Hash: fork(h), Height: uint32(h), PreviousBlockHash: fork(h - 1)}
+		if h == top-1 {
+			b.PreviousBlockHash = hash(h - 1)
+		}
+		blocks[b.Hash] = b
+	}
+	var mu gosync.Mutex
+	best := hash(top)
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		var in struct {
+			ID     int64             `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(req.Body).Decode(&in)
+		var result interface{}
+		switch in.Method {
+		case "getbestblockhash":
+			mu.Lock()
+			result = best
+			mu.Unlock()
+		case "getblock":
+			var h string
+			json.Unmarshal(in.Params[0], &h)
+			result = blocks[h]
+		}
+		raw, _ := json.Marshal(result)
+		json.NewEncoder(w).Encode(Response{ID: in.ID, Result: raw})
+	})
+	defer srv.Close()
+	s := &Subscription{client: c, ntfns: make(chan Notification, 2*top), closing: make(chan struct{})}
+	chain, err := s.update(context.Background(), []polledBlock{{hash(1), 1, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.ntfns) != top-1 {
+		t.Fatal("got", len(s.ntfns), "notifications, want", top-1)
+	}
+	for h := 2; h <= top; h++ {
+		if n := <-s.ntfns; n.Type != NtfnBlockConnected || n.Hash != hash(h) {
+			t.Fatalf("got %s of %s, want block %d connected", n.Type, n.Hash, h)
+		}
+	}
+	if len(chain) != MaxReorgDepth || chain[len(chain)-1].hash != hash(top) {
+		t.Error("unexpected chain of", len(chain), "blocks")
+	}
+
+	mu.Lock()
+	best = fork(top + 1)
+	mu.Unlock()
+	if chain, err = s.update(context.Background(), chain); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Notification{
+		{Type: NtfnBlockDisconnected, Hash: hash(top)},
+		{Type: NtfnBlockDisconnected, Hash: hash(top - 1)},
+		{Type: NtfnBlockConnected, Hash: fork(top - 1)},
+		{Type: NtfnBlockConnected, Hash: fork(top)},
+		{Type: NtfnBlockConnected, Hash: fork(top + 1)},
+	}
+	if len(s.ntfns) != len(expected) {
+		t.Fatal("got", len(s.ntfns), "notifications, want", len(expected))
+	}
+	for _, e := range expected {
+		if n := <-s.ntfns; n.Type != e.Type || n.Hash != e.Hash {
+			t.Errorf("got %s of %s, want %s of %s", n.Type, n.Hash, e.Type, e.Hash)
+		}
+	}
+	if len(chain) != MaxReorgDepth || chain[len(chain)-1].hash != fork(top+1) {
+		t.Error("unexpected chain of", len(chain), "blocks")
+	}
+}
@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// HTTPError is returned when a node answers with an HTTP error status and no JSON-RPC error
+type HTTPError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPError) Error() string {
+	return "HTTP error: " + e.Status
+}
+
+// ReadOnlyMethods are the methods that only read the chain, so a request for them may be sent again after the node may already have run it, and to another endpoint. A request for any other method is only sent to a Client's URL, where the wallet it is meant for is, and only sent again if it failed before it was sent, so that a payment is not made twice and a transaction or block that was accepted is not reported as a duplicate.
+var ReadOnlyMethods = map[string]bool{
+	"decoderawtransaction": true,
+	"decodescript":         true,
+	"getbestblockhash":     true,
+	"getblock":             true,
+	"getblockcount":        true,
+	"getblockhash":         true,
+	"getblockheader":       true,
+	"getblocktemplate":     true,
+	"getconnectioncount":   true,
+	"getdifficulty":        true,
+	"getinfo":              true,
+	"getmininginfo":        true,
+	"getnetworkhashps":     true,
+	"getpeerinfo":          true,
+	"getrawmempool":        true,
+	"getrawtransaction":    true,
+	"gettxout":             true,
+	"gettxoutsetinfo":      true,
+}
+
+// unsent returns true if an error is from connecting to the node, before any of the request was written
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// IsTransient returns true if an error is one that may go away if the request is sent again, which is when the node could not be reached, dropped the connection, took too long to answer, is overloaded or is still starting. Errors the node answers a request with are not transient, as it would answer the same again, and neither is the node's certificate not being trusted.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var fpErr *FingerprintError
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &fpErr) || errors.As(err, &certErr) {
+		return false
+	}
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code == ErrCodeInWarmup
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == 429
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// AddEndpoint adds a full node to fail over to, as a host with an optional port that defaults to the port of URL. It is reached the same way as URL, over TLS if URL is.
+func (c *Client) AddEndpoint(addr string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, u.Port())
+	}
+	c.Endpoints = append(c.Endpoints, u.Scheme+"://"+addr)
+	return nil
+}
+
+// endpoints returns URL followed by Endpoints
+func (c *Client) endpoints() []string {
+	return append([]string{c.URL}, c.Endpoints...)
+}
+
+// endpoint returns the endpoint in use and its index
+func (c *Client) endpoint(endpoints []string) (int, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.current >= len(endpoints) {
+		c.current = 0
+	}
+	return c.current, endpoints[c.current]
+}
+
+// failover moves on to the endpoint after the one that failed, unless another request has already moved on from it
+func (c *Client) failover(failed, n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.current == failed {
+		c.current = (failed + 1) % n
+	}
+}
+
+// wait sleeps before the next round of retries. The wait doubles with each round from Backoff up to MaxBackoff, and is jittered between half and all of that so clients that failed together do not retry together.
+func (c *Client) wait(ctx context.Context, round uint) error {
+	d := c.Backoff
+	if d <= 0 {
+		d = DefaultBackoff
+	}
+	for ; round > 0 && d < MaxBackoff; round-- {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EndpointHealth is the state of an endpoint as found by CheckHealth
+type EndpointHealth struct {
+	URL string
+	// Height is the height of the endpoint's best block
+	Height uint32
+	// Err is why the endpoint is not healthy, or nil if it is
+	Err error
+}
+
+// CheckHealth asks every endpoint for its block count once, without retrying, and switches to the healthy endpoint with the most blocks, preferring URL and then the earlier Endpoints where several have as many. It returns the state of each endpoint, and an error if none is healthy.
+func (c *Client) CheckHealth(ctx context.Context) (health []EndpointHealth, err error) {
+	c.init()
+	payload, err := json.Marshal(Request{"getblockcount", []interface{}{}, time.Now().UnixNano(), "1.0"})
+	if err != nil {
+		return
+	}
+	endpoints := c.endpoints()
+	best := -1
+	for i, u := range endpoints {
+		h := EndpointHealth{URL: u}
+		var rr Response
+		if h.Err = c.attempt(ctx, u, payload, &rr); h.Err == nil {
+			if rr.Err != nil {
+				h.Err = rr.Err
+			} else {
+				h.Err = json.Unmarshal(rr.Result, &h.Height)
+			}
+		}
+		if h.Err == nil && (best < 0 || h.Height > health[best].Height) {
+			best = i
+		}
+		health = append(health, h)
+	}
+	if best < 0 {
+		return health, fmt.Errorf("none of the %d endpoints is healthy", len(endpoints))
+	}
+	c.mutex.Lock()
+	c.current = best
+	c.mutex.Unlock()
+	return
+}
@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockCount answers getblockcount with a height, and counts the requests it gets
+func blockCount(height uint32, requests *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		var in Request
+		json.NewDecoder(req.Body).Decode(&in)
+		b, _ := json.Marshal(height)
+		json.NewEncoder(w).Encode(Response{ID: in.ID, Result: b})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// the node is still starting for the first two requests
+	var requests int32
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Response{Err: &Error{Code: ErrCodeInWarmup, Message: "Loading block index..."}})
+			return
+		}
+		blockCount(7, new(int32))(w, req)
+	})
+	defer srv.Close()
+	c.Backoff = time.Millisecond
+	if n, err := c.GetBlockCount(); err != nil || n != 7 || requests != 3 {
+		t.Error("got", n, err, "after", requests, "requests")
+	}
+
+	// errors the node answers with are not retried
+	requests = 0
+	failing, srv2 := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{Err: &Error{Code: ErrCodeInvalidParameter, Message: "Block height out of range"}})
+	})
+	defer srv2.Close()
+	failing.Backoff = time.Millisecond
+	if _, err := failing.GetBlockHash(100); !IsCode(err, ErrCodeInvalidParameter) || requests != 1 {
+		t.Error("got", err, "after", requests, "requests")
+	}
+
+	// retries give up in the end
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	gone := testClient(down)
+	gone.Backoff, gone.Retries = time.Millisecond, 2
+	if _, err := gone.GetBlockCount(); err == nil || !IsTransient(err) {
+		t.Error("unreachable node returned", err)
+	}
+}
+
+func TestRetryWrite(t *testing.T) {
+	// a payment the node may have made is not sent again
+	var requests int32
+	c, srv := testServer(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer srv.Close()
+	c.Backoff = time.Millisecond
+	if _, err := c.Call("sendtoaddress", []interface{}{"addr", 1}); !IsTransient(err) || requests != 1 {
+		t.Error("got", err, "after", requests, "requests")
+	}
+	batch := []Request{{Method: "getblockcount"}, {Method: "sendrawtransaction", Params: []interface{}{"00"}}}
+	if _, err := c.CallBatch(batch); err == nil || requests != 2 {
+		t.Error("batch with a write got", err, "after", requests, "requests")
+	}
+
+	// nor is it sent to another node's wallet when the node cannot be reached
+	var backupRequests int32
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	backup := httptest.NewServer(blockCount(6, &backupRequests))
+	defer backup.Close()
+	gone := testClient(down)
+	gone.Backoff = time.Millisecond
+	if err := gone.AddEndpoint(backup.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gone.Call("sendtoaddress", []interface{}{"addr", 1}); !unsent(err) || backupRequests != 0 {
+		t.Error("got", err, "with", backupRequests, "requests to the backup")
+	}
+	if n, err := gone.GetBlockCount(); err != nil || n != 6 {
+		t.Error("read did not fail over", n, err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var first, second int32
+	down := httptest.NewServer(blockCount(5, &first))
+	backup := httptest.NewServer(blockCount(6, &second))
+	defer backup.Close()
+	c := testClient(down)
+	if err := c.AddEndpoint(backup.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.GetBlockCount(); err != nil || n != 5 {
+		t.Error("got", n, err, "from the first endpoint")
+	}
+	down.Close()
+	for i := 0; i < 3; i++ {
+		if n, err := c.GetBlockCount(); err != nil || n != 6 {
+			t.Error("got", n, err, "after the first endpoint went down")
+		}
+	}
+	// the client stays on the endpoint that works
+	if second != 3 {
+		t.Error("backup endpoint got", second, "requests")
+	}
+
+	health, err := c.CheckHealth(context.Background())
+	if err != nil || len(health) != 2 || health[0].Err == nil || health[1].Height != 6 {
+		t.Error("health", health, err)
+	}
+	backup.Close()
+	if _, err = c.CheckHealth(context.Background()); err == nil {
+		t.Error("no healthy endpoint not reported")
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	var n int32
+	short := httptest.NewServer(blockCount(5, &n))
+	defer short.Close()
+	long := httptest.NewServer(blockCount(9, &n))
+	defer long.Close()
+	c := testClient(short)
+	c.AddEndpoint(long.Listener.Addr().String())
+	if _, err := c.CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the endpoint with the most blocks is used
+	if h, err := c.GetBlockCount(); err != nil || h != 9 {
+		t.Error("got", h, err, "after health check")
+	}
+}
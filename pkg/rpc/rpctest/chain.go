@@ -0,0 +1,232 @@
+package rpctest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/anaskhan96/base58check"
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/hash160"
+	"github.com/parallelcointeam/duo/pkg/key"
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const (
+	// Subsidy is the value of the coinbase output of each block made by Generate
+	Subsidy = 50 * core.COIN
+	// EasyBits are the bits of the blocks made by Generate and Mine, the easiest target there is, so about every other nonce meets it
+	EasyBits = 0x207fffff
+)
+
+// nonce counts the blocks made by Generate and goes in their coinbase, so no two blocks it makes have the same hash
+var nonce uint32
+
+// Generate serialises n blocks on top of a serialised block, or from a new genesis block if parent is nil, with each block linked to the real hash of the one below it and the real merkle root of its transactions. Each block has only a coinbase paying Subsidy to the next of the output scripts in turn, or to an empty script if none are given. Every block has a different coinbase, so a branch generated on the same parent as another has different hashes, and is mined with Mine.
+func Generate(parent []byte, n int, scripts ...[]byte) (raws [][]byte) {
+	for i := 0; i < n; i++ {
+		prev := make([]byte, 32)
+		if parent != nil {
+			h, err := p2p.BlockHash(parent)
+			if err != nil {
+				panic(fmt.Sprintf("rpctest: parent block: %v", err))
+			}
+			prev = h.Shown()
+		}
+		var script []byte
+		if len(scripts) > 0 {
+			script = scripts[i%len(scripts)]
+		}
+		nc := atomic.AddUint32(&nonce, 1)
+		b := block.Raw{
+			Version: 2, HashPrevBlock: prev, Bits: make([]byte, 4), Nonce: nc,
+			Transactions: []block.Tx{{
+				Version: 1,
+				Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{4, byte(nc), byte(nc >> 8), byte(nc >> 16), byte(nc >> 24)}, Sequence: ^uint32(0)}},
+				Outs:    []block.TxOut{{Value: Subsidy, Script: script}},
+			}},
+		}
+		root, err := b.ComputeMerkleRoot()
+		b.HashMerkleRoot = root
+		var raw []byte
+		if err == nil {
+			raw, err = block.Encode(b)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("rpctest: encoding block: %v", err))
+		}
+		Mine(raw)
+		raws, parent = append(raws, raw), raw
+	}
+	return
+}
+
+// Mine sets the bits of a serialised block to EasyBits and counts up its nonce until its header meets them, changing the block in place. It panics if the block is too short to have a header, as it is only for use in tests.
+func Mine(raw []byte) {
+	h, err := p2p.DecodeHeader(raw)
+	if err != nil {
+		panic(fmt.Sprintf("rpctest: mining: %v", err))
+	}
+	for h.Bits = EasyBits; h.CheckProofOfWork() != nil; h.Nonce++ {
+	}
+	copy(raw, h.Encode())
+}
+
+// P2PKH returns the pay to public key hash output script for an address. It panics if the address is not valid, as it is only for use in tests.
+func P2PKH(address string) []byte {
+	id, err := base58check.Decode(address)
+	if err != nil {
+		panic(fmt.Sprintf("rpctest: address %s: %v", address, err))
+	}
+	h, err := hex.DecodeString(id[2:])
+	if err != nil || len(h) != 20 {
+		panic(fmt.Sprintf("rpctest: address %s is not a public key hash", address))
+	}
+	return append(append([]byte{0x76, 0xa9, 0x14}, h...), 0x88, 0xac)
+}
+
+// LoadHex reads serialised blocks from a file with one block in hexadecimal on each line, from the genesis block on. Blank lines and lines starting with # are skipped.
+func LoadHex(path string) (raws [][]byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 2*p2p.MaxPayload)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		raws = append(raws, raw)
+	}
+	return raws, s.Err()
+}
+
+// entry is a block in the chain a Node serves, decoded into the form the full node returns it in
+type entry struct {
+	raw    []byte
+	hash   string
+	header p2p.Header
+	txs    []*rpc.RawTransaction
+	// hexes are the serialised transactions in hexadecimal
+	hexes []string
+}
+
+// decode decodes a serialised block and its transactions
+func decode(raw []byte, network string) (e *entry, err error) {
+	header, txs, err := block.Split(raw)
+	if err != nil {
+		return
+	}
+	h, err := p2p.DecodeHeader(header)
+	if err != nil {
+		return
+	}
+	blk, err := block.Decode(raw)
+	if err != nil {
+		return
+	}
+	if len(blk.Transactions) != len(txs) {
+		return nil, fmt.Errorf("decoded %d transactions from a block of %d", len(blk.Transactions), len(txs))
+	}
+	e = &entry{raw: raw, hash: h.Hash().String(), header: h}
+	for i, tx := range blk.Transactions {
+		e.hexes = append(e.hexes, hex.EncodeToString(txs[i]))
+		e.txs = append(e.txs, rawTransaction(p2p.DoubleHash(txs[i]).String(), tx, network))
+	}
+	return
+}
+
+// rawTransaction converts a decoded transaction into the form the full node returns from getrawtransaction
+func rawTransaction(txid string, tx block.Tx, network string) *rpc.RawTransaction {
+	out := &rpc.RawTransaction{Txid: txid, Version: tx.Version, LockTime: tx.Locktime}
+	for _, in := range tx.Ins {
+		vin := rpc.Vin{ScriptSig: rpc.ScriptSig{Hex: hex.EncodeToString(in.Script)}, Sequence: in.Sequence}
+		if prev := p2p.NewHash(in.PrevTxHash); prev == (p2p.Hash{}) {
+			vin.Coinbase = vin.ScriptSig.Hex
+		} else {
+			vin.Txid, vin.Vout = prev.String(), int(in.PrevTxoutIndex)
+		}
+		out.Vin = append(out.Vin, vin)
+	}
+	for n, o := range tx.Outs {
+		spk := rpc.ScriptPubKey{Hex: hex.EncodeToString(o.Script), Type: "nonstandard"}
+		if typ, reqSigs, addrs := scriptAddresses(o.Script, network); addrs != nil {
+			spk.Type, spk.ReqSigs, spk.Addresses = typ, reqSigs, addrs
+		}
+		out.Vout = append(out.Vout, rpc.Vout{Value: float64(o.Value) / core.COIN, N: n, ScriptPubKey: spk})
+	}
+	return out
+}
+
+// scriptAddresses returns the type of a standard output script, the number of signatures it needs and the addresses it pays to on a network, for pay to public key hash, pay to script hash, pay to public key and bare multisig scripts
+func scriptAddresses(s []byte, network string) (typ string, reqSigs int, addrs []string) {
+	prefixes, ok := key.B58prefixes[network]
+	if !ok {
+		return
+	}
+	prefix, reqSigs := prefixes["pubkey"], 1
+	var hashes [][]byte
+	switch {
+	case len(s) == 25 && s[0] == 0x76 && s[1] == 0xa9 && s[2] == 0x14 && s[23] == 0x88 && s[24] == 0xac:
+		typ, hashes = "pubkeyhash", [][]byte{s[3:23]}
+	case len(s) == 23 && s[0] == 0xa9 && s[1] == 0x14 && s[22] == 0x87:
+		typ, prefix, hashes = "scripthash", prefixes["script"], [][]byte{s[2:22]}
+	case (len(s) == 67 && s[0] == 0x41 || len(s) == 35 && s[0] == 0x21) && s[len(s)-1] == 0xac:
+		pub := s[1 : len(s)-1]
+		typ, hashes = "pubkey", [][]byte{*hash160.Sum(&pub)}
+	default:
+		keys := multisigKeys(s)
+		if keys == nil {
+			return "", 0, nil
+		}
+		typ, reqSigs = "multisig", int(s[0])-0x50
+		for _, pub := range keys {
+			hashes = append(hashes, *hash160.Sum(&pub))
+		}
+	}
+	for _, h := range hashes {
+		addr, err := base58check.Encode(prefix, hex.EncodeToString(h))
+		if err != nil {
+			return "", 0, nil
+		}
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// multisigKeys returns the public keys of a bare multisig script, m, the keys, n and OP_CHECKMULTISIG, where m and n are from 1 to 16, m is no more than n and there are n keys of 33 to 120 bytes, or nil for any other script
+func multisigKeys(s []byte) (keys [][]byte) {
+	if len(s) < 3 || s[len(s)-1] != 0xae {
+		return nil
+	}
+	m, n := int(s[0])-0x50, int(s[len(s)-2])-0x50
+	if m < 1 || n < m || n > 16 {
+		return nil
+	}
+	for rest := s[1 : len(s)-2]; len(rest) > 0; {
+		size := int(rest[0])
+		if size == 0x4c && len(rest) > 1 {
+			size, rest = int(rest[1]), rest[1:]
+		}
+		if size < 33 || size > 120 || len(rest) < 1+size {
+			return nil
+		}
+		keys, rest = append(keys, rest[1:1+size]), rest[1+size:]
+	}
+	if len(keys) != n {
+		return nil
+	}
+	return
+}
@@ -0,0 +1,543 @@
+// Package rpctest runs fake legacy full nodes that answer JSON-RPC calls from a chain of blocks, for testing clients of package rpc in the same process
+package rpctest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	gosync "sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+// Node is a fake parallelcoind listening on a local port, serving a chain of serialised blocks from the genesis block on. It answers getinfo, getblockcount, getbestblockhash, getblockhash, getblock, getrawtransaction, getdifficulty, getconnectioncount and getrawmempool, singly and in batches, the same as the full node does with a transaction index, which does not have the transaction of the genesis block. Any other method is answered with ErrCodeMethodNotFound.
+//
+// The chain can be extended or reorganised with SetChain and Reorg while clients are connected, answers can be slowed down with SetDelay, and calls can be made to fail with Fail.
+//
+// Like a btcd style node it has a websocket endpoint at rpc.WebsocketPath, which answers calls as well as notifyblocks, notifynewtransactions and notifyreceived. Changes to the chain send blockdisconnected and blockconnected notifications, and recvtx and redeemingtx for transactions in connected blocks paying or spending from watched addresses. Other notifications can be sent with Notify. SetWebsocket turns the endpoint off, to test clients against a legacy node.
+type Node struct {
+	// Host and Port are where the node listens, to pass to rpc.NewClient
+	Host     string
+	Port     int
+	network  string
+	server   *httptest.Server
+	mu       gosync.Mutex
+	chain    []*entry
+	heights  map[string]int
+	txs      map[string][2]int
+	delay    time.Duration
+	fails    map[string]failure
+	received map[string]int
+	// noWebsocket is set when the websocket endpoint is turned off
+	noWebsocket bool
+	sockets     map[*socket]bool
+}
+
+// socket is a websocket client of the node and the notifications it has asked for, which are guarded by the node's mutex
+type socket struct {
+	conn      *websocket.Conn
+	writeMu   gosync.Mutex
+	blocks    bool
+	txs       bool
+	verbose   bool
+	addresses map[string]bool
+}
+
+// write sends a message over the websocket
+func (s *socket) write(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(v)
+}
+
+// notification is a notification as the node sends it, a request with a null id
+type notification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	ID      interface{}   `json:"id"`
+}
+
+// message is a notification to send to a socket
+type message struct {
+	to *socket
+	n  notification
+}
+
+// failure is an error to answer calls of a method with, and how many more times, or -1 for every call
+type failure struct {
+	err   *rpc.Error
+	count int
+}
+
+// NewNode starts a node on a network serving a chain of blocks. The network decides the addresses shown for output scripts. It panics if the blocks cannot be decoded, as it is only for use in tests.
+func NewNode(network string, blocks [][]byte) *Node {
+	n := &Node{network: network, fails: make(map[string]failure), received: make(map[string]int), sockets: make(map[*socket]bool)}
+	n.SetChain(blocks)
+	n.server = httptest.NewServer(http.HandlerFunc(n.serve))
+	host, port, _ := net.SplitHostPort(n.server.Listener.Addr().String())
+	n.Host = host
+	n.Port, _ = strconv.Atoi(port)
+	return n
+}
+
+// Client returns a client of the node that does not retry failed calls, so errors set with Fail are seen at once
+func (n *Node) Client() *rpc.Client {
+	c := rpc.NewClient(n.Host, n.Port, "", "", false)
+	c.Retries = -1
+	return c
+}
+
+// Close stops the node and closes its connections
+func (n *Node) Close() {
+	n.SetWebsocket(false)
+	n.server.CloseClientConnections()
+	n.server.Close()
+}
+
+// SetChain replaces the chain the node serves, and notifies the websocket clients of the blocks disconnected from the old chain and connected from the new one. It panics if the blocks cannot be decoded.
+func (n *Node) SetChain(blocks [][]byte) {
+	chain := make([]*entry, len(blocks))
+	heights := make(map[string]int)
+	txs := make(map[string][2]int)
+	for h, raw := range blocks {
+		e, err := decode(raw, n.network)
+		if err != nil {
+			panic(fmt.Sprintf("rpctest: block %d: %v", h, err))
+		}
+		chain[h], heights[e.hash] = e, h
+		if h == 0 {
+			// the full node never adds the genesis block's transaction to its index
+			continue
+		}
+		for i, tx := range e.txs {
+			txs[tx.Txid] = [2]int{h, i}
+		}
+	}
+	n.mu.Lock()
+	fork := -1
+	for fork+1 < len(n.chain) && fork+1 < len(chain) && n.chain[fork+1].hash == chain[fork+1].hash {
+		fork++
+	}
+	var msgs []message
+	for s := range n.sockets {
+		msgs = append(msgs, n.chainNotifications(s, n.chain, chain, txs, fork)...)
+	}
+	n.chain, n.heights, n.txs = chain, heights, txs
+	n.mu.Unlock()
+	send(msgs)
+}
+
+// chainNotifications returns the notifications a socket has asked for when the chain is replaced by one forking from it after a height, where txs locates the transactions of the new chain. The mutex must be held.
+func (n *Node) chainNotifications(s *socket, old, chain []*entry, txs map[string][2]int, fork int) (msgs []message) {
+	add := func(method string, params ...interface{}) {
+		msgs = append(msgs, message{s, notification{JSONRPC: "1.0", Method: method, Params: params}})
+	}
+	for h := len(old) - 1; h > fork && s.blocks; h-- {
+		add(rpc.NtfnBlockDisconnected, old[h].hash, h, old[h].header.Time)
+	}
+	for h := fork + 1; h < len(chain); h++ {
+		e := chain[h]
+		if s.blocks {
+			add(rpc.NtfnBlockConnected, e.hash, h, e.header.Time)
+		}
+		if len(s.addresses) == 0 {
+			continue
+		}
+		details := map[string]interface{}{"height": h, "hash": e.hash, "time": e.header.Time}
+		for i, tx := range e.txs {
+			details["index"] = i
+			if watched(s, tx) {
+				add(rpc.NtfnRecvTx, e.hexes[i], details)
+			}
+			for _, in := range tx.Vin {
+				if loc, ok := txs[in.Txid]; ok && in.Coinbase == "" && watched(s, chain[loc[0]].txs[loc[1]], in.Vout) {
+					add(rpc.NtfnRedeemingTx, e.hexes[i], details)
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+// watched returns true if any of a transaction's outputs, or those of them numbered, pay an address a socket watches
+func watched(s *socket, tx *rpc.RawTransaction, outs ...int) bool {
+	for _, out := range tx.Vout {
+		match := len(outs) == 0
+		for _, i := range outs {
+			match = match || out.N == i
+		}
+		for _, addr := range out.ScriptPubKey.Addresses {
+			if match && s.addresses[addr] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// send sends notifications, dropping those to sockets that cannot be written to
+func send(msgs []message) {
+	for _, m := range msgs {
+		m.to.write(m.n)
+	}
+}
+
+// Notify sends a notification to the websocket clients. Transaction accepted notifications only go to the clients that asked for them in the form they asked for, and any other notification goes to every client.
+func (n *Node) Notify(method string, params ...interface{}) {
+	n.mu.Lock()
+	var msgs []message
+	for s := range n.sockets {
+		if method == rpc.NtfnTxAccepted && (!s.txs || s.verbose) || method == rpc.NtfnTxAcceptedVerbose && (!s.txs || !s.verbose) {
+			continue
+		}
+		msgs = append(msgs, message{s, notification{JSONRPC: "1.0", Method: method, Params: params}})
+	}
+	n.mu.Unlock()
+	send(msgs)
+}
+
+// SetWebsocket turns the websocket endpoint on or off. Turning it off closes the connections to it, and further attempts to connect are answered as the legacy full node answers them, with an error status.
+func (n *Node) SetWebsocket(on bool) {
+	n.mu.Lock()
+	n.noWebsocket = !on
+	var conns []*websocket.Conn
+	if !on {
+		for s := range n.sockets {
+			conns = append(conns, s.conn)
+		}
+	}
+	n.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// upgrader accepts websocket connections from any origin
+var upgrader = websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+// serveWebsocket answers the requests of a websocket client until it goes away
+func (n *Node) serveWebsocket(w http.ResponseWriter, req *http.Request) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	s := &socket{conn: conn, addresses: make(map[string]bool)}
+	n.mu.Lock()
+	n.sockets[s] = true
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.sockets, s)
+		n.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		var in request
+		if conn.ReadJSON(&in) != nil {
+			return
+		}
+		out := response{ID: in.ID}
+		switch in.Method {
+		case "notifyblocks", "notifynewtransactions", "notifyreceived":
+			var verbose bool
+			var addresses []string
+			n.mu.Lock()
+			n.received[in.Method]++
+			switch {
+			case in.Method == "notifyblocks":
+				s.blocks = true
+			case in.Method == "notifynewtransactions" && param(in.Params, 0, &verbose):
+				s.txs, s.verbose = true, verbose
+			case in.Method == "notifyreceived" && len(in.Params) == 1 && param(in.Params, 0, &addresses):
+				for _, addr := range addresses {
+					s.addresses[addr] = true
+				}
+			default:
+				out.Err = &rpc.Error{Code: rpc.ErrCodeInvalidParams, Message: "Invalid parameters for " + in.Method}
+			}
+			n.mu.Unlock()
+		default:
+			out = n.answer(in)
+		}
+		if s.write(out) != nil {
+			return
+		}
+	}
+}
+
+// Reorg replaces the blocks above a height with a branch, or extends the chain if the height is that of its best block. It panics if the height is above the best block or the branch cannot be decoded.
+func (n *Node) Reorg(height int, branch [][]byte) {
+	n.mu.Lock()
+	if height >= len(n.chain) {
+		n.mu.Unlock()
+		panic(fmt.Sprintf("rpctest: reorganising at %d above the best block %d", height, len(n.chain)-1))
+	}
+	blocks := make([][]byte, 0, height+1+len(branch))
+	for _, e := range n.chain[:height+1] {
+		blocks = append(blocks, e.raw)
+	}
+	n.mu.Unlock()
+	n.SetChain(append(blocks, branch...))
+}
+
+// Blocks returns the serialised blocks of the chain the node serves
+func (n *Node) Blocks() (blocks [][]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range n.chain {
+		blocks = append(blocks, e.raw)
+	}
+	return
+}
+
+// Hash returns the hash of the block at a height as the node shows it, or an empty string if there is none
+func (n *Node) Hash(height int) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if height < 0 || height >= len(n.chain) {
+		return ""
+	}
+	return n.chain[height].hash
+}
+
+// SetDelay makes the node wait before answering each request, or each batch of requests. A client that gives up waiting is answered at once.
+func (n *Node) SetDelay(d time.Duration) {
+	n.mu.Lock()
+	n.delay = d
+	n.mu.Unlock()
+}
+
+// Fail makes the node answer the next count calls of a method with an error, or every call if count is negative. A count of 0 or a nil error stops it failing.
+func (n *Node) Fail(method string, count int, err *rpc.Error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if count == 0 || err == nil {
+		delete(n.fails, method)
+		return
+	}
+	n.fails[method] = failure{err: err, count: count}
+}
+
+// Received returns the number of calls of a method the node has received, counting each call in a batch
+func (n *Node) Received(method string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.received[method]
+}
+
+// request is a request as the node reads it, with the params left to each method to decode
+type request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	ID     json.RawMessage   `json:"id"`
+}
+
+// response is the node's answer to a request
+type response struct {
+	Result interface{}     `json:"result"`
+	Err    *rpc.Error      `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// serve answers a request or a batch of requests. As the full node does, it answers a single request that fails with an HTTP error status as well as the error, and a batch always with 200 OK.
+func (n *Node) serve(w http.ResponseWriter, req *http.Request) {
+	n.mu.Lock()
+	ws := !n.noWebsocket
+	n.mu.Unlock()
+	if ws && req.URL.Path == rpc.WebsocketPath && websocket.IsWebSocketUpgrade(req) {
+		n.serveWebsocket(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	var body json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response{Err: &rpc.Error{Code: -32700, Message: "Parse error"}})
+		return
+	}
+	// the body is read first, as the server only notices the client going away once it has been
+	n.mu.Lock()
+	delay := n.delay
+	n.mu.Unlock()
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return
+		}
+	}
+	var batch []request
+	if json.Unmarshal(body, &batch) == nil {
+		out := make([]response, len(batch))
+		for i := range batch {
+			out[i] = n.answer(batch[i])
+		}
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	var in request
+	if err := json.Unmarshal(body, &in); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response{Err: &rpc.Error{Code: -32700, Message: "Parse error"}})
+		return
+	}
+	out := n.answer(in)
+	switch {
+	case out.Err == nil:
+	case out.Err.Code == rpc.ErrCodeMethodNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// answer answers a single request, with an error set with Fail if there is one
+func (n *Node) answer(in request) (out response) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out.ID = in.ID
+	n.received[in.Method]++
+	if f, ok := n.fails[in.Method]; ok {
+		if f.count > 0 {
+			if f.count--; f.count == 0 {
+				delete(n.fails, in.Method)
+			} else {
+				n.fails[in.Method] = f
+			}
+		}
+		out.Err = f.err
+		return
+	}
+	out.Result, out.Err = n.call(in.Method, in.Params)
+	return
+}
+
+// param decodes a parameter into v if it is given, and returns false if it cannot be decoded
+func param(params []json.RawMessage, i int, v interface{}) bool {
+	return i >= len(params) || json.Unmarshal(params[i], v) == nil
+}
+
+// flag decodes a parameter given as a boolean or as a number that is true if it is not 0, which is def if it is missing, and returns false if it cannot be decoded
+func flag(params []json.RawMessage, i int, def bool) (v bool, ok bool) {
+	if i >= len(params) {
+		return def, true
+	}
+	if json.Unmarshal(params[i], &v) == nil {
+		return v, true
+	}
+	var n int
+	if json.Unmarshal(params[i], &n) != nil {
+		return false, false
+	}
+	return n != 0, true
+}
+
+// call runs a method on the chain. The mutex must be held.
+func (n *Node) call(method string, params []json.RawMessage) (result interface{}, err *rpc.Error) {
+	invalid := &rpc.Error{Code: rpc.ErrCodeInvalidParams, Message: "Invalid parameters for " + method}
+	best := len(n.chain) - 1
+	switch method {
+	case "getinfo":
+		return &rpc.GetInfo{Version: 1000000, ProtocolVersion: 70002, Blocks: uint32(best), Difficulty: 1, Testnet: n.network == "testnet"}, nil
+	case "getblockcount":
+		return best, nil
+	case "getbestblockhash":
+		if best < 0 {
+			return nil, &rpc.Error{Code: rpc.ErrCodeMisc, Message: "No blocks"}
+		}
+		return n.chain[best].hash, nil
+	case "getdifficulty":
+		return 1, nil
+	case "getconnectioncount":
+		return 0, nil
+	case "getrawmempool":
+		return []string{}, nil
+	case "getblockhash":
+		var h int
+		if len(params) < 1 || !param(params, 0, &h) {
+			return nil, invalid
+		}
+		if h < 0 || h > best {
+			return nil, &rpc.Error{Code: rpc.ErrCodeInvalidParameter, Message: "Block number out of range."}
+		}
+		return n.chain[h].hash, nil
+	case "getblock":
+		var hash string
+		if len(params) < 1 || !param(params, 0, &hash) {
+			return nil, invalid
+		}
+		v, ok := flag(params, 1, true)
+		if !ok {
+			return nil, invalid
+		}
+		h, found := n.heights[hash]
+		if !found {
+			return nil, &rpc.Error{Code: rpc.ErrCodeInvalidAddressOrKey, Message: "Block not found"}
+		}
+		if !v {
+			return fmt.Sprintf("%x", n.chain[h].raw), nil
+		}
+		return n.getBlock(h), nil
+	case "getrawtransaction":
+		var txid string
+		if len(params) < 1 || !param(params, 0, &txid) {
+			return nil, invalid
+		}
+		v, ok := flag(params, 1, false)
+		if !ok {
+			return nil, invalid
+		}
+		loc, found := n.txs[txid]
+		if !found {
+			return nil, &rpc.Error{Code: rpc.ErrCodeInvalidAddressOrKey, Message: "No information available about transaction"}
+		}
+		e := n.chain[loc[0]]
+		if !v {
+			return e.hexes[loc[1]], nil
+		}
+		tx := *e.txs[loc[1]]
+		tx.Hex = e.hexes[loc[1]]
+		tx.BlockHash = e.hash
+		tx.Confirmations = uint64(best - loc[0] + 1)
+		tx.Time, tx.Blocktime = int64(e.header.Time), int64(e.header.Time)
+		return &tx, nil
+	}
+	return nil, &rpc.Error{Code: rpc.ErrCodeMethodNotFound, Message: "Method not found"}
+}
+
+// getBlock returns the block at a height in the form of the verbose getblock result
+func (n *Node) getBlock(h int) *rpc.GetBlock {
+	e := n.chain[h]
+	b := &rpc.GetBlock{
+		Hash:          e.hash,
+		Confirmations: uint32(len(n.chain) - h),
+		Size:          uint32(len(e.raw)),
+		Height:        uint32(h),
+		Version:       e.header.Version,
+		MerkleRoot:    e.header.MerkleRoot.String(),
+		Time:          int64(e.header.Time),
+		Nonce:         uint64(e.header.Nonce),
+		Bits:          fmt.Sprintf("%08x", e.header.Bits),
+		Difficulty:    1,
+	}
+	for _, tx := range e.txs {
+		b.Tx = append(b.Tx, tx.Txid)
+	}
+	if h > 0 {
+		b.PreviousBlockHash = e.header.Prev.String()
+	}
+	if h+1 < len(n.chain) {
+		b.NextBlockHash = n.chain[h+1].hash
+	}
+	return b
+}
@@ -0,0 +1,225 @@
+package rpctest
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const testAddr = "ajkviVcqSE518qMnqME8D9smwggWSyEogW"
+
+func TestNode(t *testing.T) {
+	blocks := Generate(nil, 3, P2PKH(testAddr))
+	n := NewNode("mainnet", blocks)
+	defer n.Close()
+	c := n.Client()
+
+	if info, err := c.GetInfo(); err != nil || info.Blocks != 2 {
+		t.Fatal("getinfo", info, err)
+	}
+	hash, err := c.GetBlockHash(2)
+	if err != nil || hash != n.Hash(2) {
+		t.Fatal("getblockhash", hash, err)
+	}
+	if best, err := c.GetBestBlockHash(); err != nil || best != hash {
+		t.Error("getbestblockhash", best, err)
+	}
+	b, err := c.GetBlock(hash)
+	if err != nil || b.Height != 2 || b.PreviousBlockHash != n.Hash(1) || b.Confirmations != 1 || len(b.Tx) != 1 {
+		t.Fatal("getblock", b, err)
+	}
+	if raw, err := c.GetBlockHex(hash); err != nil || raw != hex.EncodeToString(blocks[2]) {
+		t.Error("getblock not verbose", err)
+	}
+	tx, err := c.GetRawTransaction(b.Tx[0])
+	if err != nil || tx.BlockHash != hash || tx.Vin[0].Coinbase == "" || tx.Vout[0].Value != 50 ||
+		!reflect.DeepEqual(tx.Vout[0].ScriptPubKey.Addresses, []string{testAddr}) {
+		t.Fatal("getrawtransaction", tx, err)
+	}
+	if _, err = c.GetRawTransaction("00"); !rpc.IsCode(err, rpc.ErrCodeInvalidAddressOrKey) {
+		t.Error("unknown transaction found", err)
+	}
+	if _, err = c.GetBlockHash(3); !rpc.IsCode(err, rpc.ErrCodeInvalidParameter) {
+		t.Error("block above the best found", err)
+	}
+	resps, err := c.CallBatch([]rpc.Request{{Method: "getblockhash", Params: []interface{}{0}}, {Method: "getblockhash", Params: []interface{}{9}}})
+	if err != nil || string(resps[0].Result) != `"`+n.Hash(0)+`"` || !rpc.IsCode(resps[1].Err, rpc.ErrCodeInvalidParameter) {
+		t.Error("batch", resps, err)
+	}
+	if got := n.Received("getblockhash"); got != 4 {
+		t.Error("received", got, "getblockhash calls")
+	}
+
+	// a longer branch replacing block 2
+	n.Reorg(1, Generate(blocks[1], 2, P2PKH(testAddr)))
+	if best, err := c.GetBlockCount(); err != nil || best != 3 || n.Hash(2) == hash {
+		t.Error("not reorganised", best, err)
+	}
+	if _, err = c.GetBlock(hash); !rpc.IsCode(err, rpc.ErrCodeInvalidAddressOrKey) {
+		t.Error("replaced block found", err)
+	}
+	if _, err = c.GetRawTransaction(b.Tx[0]); err == nil {
+		t.Error("transaction of the replaced block found")
+	}
+
+	// failures
+	n.Fail("getblockcount", 1, &rpc.Error{Code: rpc.ErrCodeInWarmup, Message: "Loading block index..."})
+	if _, err = c.GetBlockCount(); !rpc.IsCode(err, rpc.ErrCodeInWarmup) {
+		t.Error("failure not returned", err)
+	}
+	if _, err = c.GetBlockCount(); err != nil {
+		t.Error("failed after the last failure", err)
+	}
+	n.Fail("getblockcount", 1, &rpc.Error{Code: rpc.ErrCodeInWarmup, Message: "Loading block index..."})
+	retrying := rpc.NewClient(n.Host, n.Port, "", "", false)
+	retrying.Backoff = time.Millisecond
+	if _, err = retrying.GetBlockCount(); err != nil {
+		t.Error("warming up node not retried", err)
+	}
+	if _, err = c.Call("getnewaddress", []interface{}{}); !rpc.IsCode(err, rpc.ErrCodeMethodNotFound) {
+		t.Error("unknown method answered", err)
+	}
+
+	// slow answers
+	n.SetDelay(time.Second)
+	c.Timeout = 10 * time.Millisecond
+	if _, err = c.GetBlockCount(); !rpc.IsTransient(err) {
+		t.Error("slow answer not timed out", err)
+	}
+}
+
+// event is the type and height of a notification
+type event struct {
+	typ    string
+	height uint32
+}
+
+// next returns the next notification, failing the test if there is none within a few seconds
+func next(t *testing.T, sub *rpc.Subscription) rpc.Notification {
+	t.Helper()
+	select {
+	case n, ok := <-sub.Notifications:
+		if !ok {
+			t.Fatal("subscription ended", sub.Err())
+		}
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+	return rpc.Notification{}
+}
+
+func TestNotifications(t *testing.T) {
+	ctx := context.Background()
+	blocks := Generate(nil, 3, P2PKH(testAddr))
+	n := NewNode("mainnet", blocks)
+	defer n.Close()
+	c := n.Client()
+	sub, err := c.Subscribe(ctx)
+	if err != nil || !sub.Websocket() {
+		t.Fatal("websocket not used", err)
+	}
+	defer sub.Close()
+	if err = sub.NotifyBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = sub.NotifyReceived(ctx, testAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err = sub.NotifyNewTransactions(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a branch replacing block 2
+	n.Reorg(1, Generate(blocks[1], 2, P2PKH(testAddr)))
+	want := []event{
+		{rpc.NtfnBlockDisconnected, 2},
+		{rpc.NtfnBlockConnected, 2}, {rpc.NtfnRecvTx, 2},
+		{rpc.NtfnBlockConnected, 3}, {rpc.NtfnRecvTx, 3},
+	}
+	for _, w := range want {
+		if got := next(t, sub); got.Type != w.typ || got.Height != w.height || got.Hash != n.Hash(int(w.height)) && w.typ != rpc.NtfnBlockDisconnected {
+			t.Errorf("got %s at %d, want %s at %d", got.Type, got.Height, w.typ, w.height)
+		}
+	}
+	n.Notify(rpc.NtfnTxAccepted, "aa", 1.5)
+	if got := next(t, sub); got.Type != rpc.NtfnTxAccepted || got.Txid != "aa" || got.Amount != 1.5 {
+		t.Error("unexpected notification", got)
+	}
+	// a notification of another type is passed on as it is
+	n.Notify("rescanfinished", "00")
+	if got := next(t, sub); got.Type != "rescanfinished" || len(got.Params) != 1 {
+		t.Error("unexpected notification", got)
+	}
+
+	// the node going away ends the subscription
+	n.SetWebsocket(false)
+	if _, ok := <-sub.Notifications; ok || sub.Err() == nil {
+		t.Error("subscription not ended with an error")
+	}
+
+	// a node without a websocket endpoint is polled
+	c.PollInterval = 10 * time.Millisecond
+	poll, err := c.Subscribe(ctx)
+	if err != nil || poll.Websocket() {
+		t.Fatal("node not polled", err)
+	}
+	if err = poll.NotifyReceived(ctx, testAddr); err != rpc.ErrNotSupported {
+		t.Error("address notifications while polling", err)
+	}
+	calls := n.Received("getbestblockhash")
+	if err = poll.NotifyBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the first check after the one that found the best block
+	for n.Received("getbestblockhash") < calls+2 {
+		time.Sleep(time.Millisecond)
+	}
+	tip := n.Hash(3)
+	n.Reorg(2, Generate(n.Blocks()[2], 2))
+	want = []event{{rpc.NtfnBlockDisconnected, 3}, {rpc.NtfnBlockConnected, 3}, {rpc.NtfnBlockConnected, 4}}
+	for _, w := range want {
+		got := next(t, poll)
+		if got.Type != w.typ || got.Height != w.height {
+			t.Errorf("got %s at %d, want %s at %d", got.Type, got.Height, w.typ, w.height)
+		}
+		if w.typ == rpc.NtfnBlockDisconnected && got.Hash != tip || w.typ == rpc.NtfnBlockConnected && got.Hash != n.Hash(int(w.height)) {
+			t.Error("unexpected hash in", got)
+		}
+	}
+	poll.Close()
+	if _, ok := <-poll.Notifications; ok || poll.Err() != nil {
+		t.Error("closed subscription not ended cleanly", poll.Err())
+	}
+}
+
+func TestLoadHex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := Generate(nil, 2)
+	path := filepath.Join(dir, "chain.hex")
+	text := "# test chain\n" + hex.EncodeToString(blocks[0]) + "\n\n" + hex.EncodeToString(blocks[1]) + "\n"
+	if err = ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHex(path)
+	if err != nil || !reflect.DeepEqual(loaded, blocks) {
+		t.Error("loaded", len(loaded), "blocks", err)
+	}
+	if err = ioutil.WriteFile(path, []byte("zz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadHex(path); err == nil {
+		t.Error("bad hex loaded")
+	}
+}
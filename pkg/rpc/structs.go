@@ -1,8 +1,13 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	gosync "sync"
+	"time"
 
 	"github.com/parallelcointeam/duo/pkg/core"
 )
@@ -14,14 +19,51 @@ const (
 	VERSION = 0.1
 	// RPCClientTimeout represent http timeout for rcp client
 	RPCClientTimeout = 30
+	// DefaultConcurrency is the most requests a Client sends at once if its Concurrency is not set
+	DefaultConcurrency = 16
+	// DefaultRetries is how many times a request is sent again if a Client's Retries is not set
+	DefaultRetries = 5
+	// DefaultBackoff is the first wait between retries if a Client's Backoff is not set
+	DefaultBackoff = 500 * time.Millisecond
+	// MaxBackoff is the longest wait between retries
+	MaxBackoff = 15 * time.Second
+	// DefaultPollInterval is how often a node that cannot send notifications is asked for its best block if a Client's PollInterval is not set
+	DefaultPollInterval = 10 * time.Second
+	// DefaultLongPollTimeout is how long a subscription waits for a getblocktemplate long poll to be answered if a Client's LongPollTimeout is not set
+	DefaultLongPollTimeout = 10 * time.Minute
 )
 
-// A Client is a connection to a websocket JSON RPC server
+// A Client is a connection to a full node's JSON RPC server. Calls are sent over HTTP, and notifications are received over the node's websocket endpoint, see Subscribe.
 type Client struct {
-	URL        string
-	Username   string
-	Password   string
-	httpClient *http.Client
+	URL      string
+	Username string
+	Password string
+	// CookieFile is the path of a cookie file written by the full node, holding user:password. If it is set the credentials are read from it, and read again if the node rejects them, since the node writes a new cookie each time it starts.
+	CookieFile string
+	// Concurrency is the most requests sent to the server at once, DefaultConcurrency if it is not set. Further calls wait for one to finish. It is read when the first request is sent.
+	Concurrency int
+	// Timeout is how long to wait for the response to each request, RPCClientTimeout seconds if it is not set
+	Timeout time.Duration
+	// Endpoints are the URLs of further full nodes to fail over to when the one in use cannot be reached, see AddEndpoint. They are sent the same credentials as URL.
+	Endpoints []string
+	// Retries is how many times a request that fails with a transient error is sent again, DefaultRetries if it is not set and never if it is negative. Each retry goes to the next endpoint, and once every endpoint has been tried the client waits Backoff, doubling each time up to MaxBackoff, before trying them again. Requests for methods that are not in ReadOnlyMethods are only retried on URL, and only if they could not be sent.
+	Retries int
+	// Backoff is the first wait between retries, DefaultBackoff if it is not set
+	Backoff time.Duration
+	// PollInterval is how often a subscription to a node without a websocket endpoint or long polling asks it for its best block, DefaultPollInterval if it is not set
+	PollInterval time.Duration
+	// LongPollTimeout is how long a subscription waits for the node to answer a getblocktemplate long poll before sending it again, DefaultLongPollTimeout if it is not set. The node holds a long poll until its best block or memory pool changes, so it is not bound by Timeout.
+	LongPollTimeout time.Duration
+	httpClient      *http.Client
+	// dialTLS makes the TLS connections to the node and checks its certificate, nil if it is not reached over TLS
+	dialTLS func(ctx context.Context, network, addr string) (net.Conn, error)
+	// sem holds a token for each request in flight
+	sem      chan struct{}
+	initOnce gosync.Once
+	// mutex guards Username and Password while the cookie is read again, and current
+	mutex gosync.Mutex
+	// current is the index of the endpoint in use, where 0 is URL and the rest are Endpoints
+	current int
 	core.State
 }
 
@@ -37,5 +79,45 @@ type Request struct {
 type Response struct {
 	ID     int64           `json:"id"`
 	Result json.RawMessage `json:"result"`
-	Err    interface{}     `json:"error"`
+	Err    *Error          `json:"error"`
+}
+
+// Error is the error a full node answers a request with
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// The codes of the errors a full node answers with that callers are most likely to handle
+const (
+	// ErrCodeMethodNotFound is returned for a method the node does not have, or has disabled
+	ErrCodeMethodNotFound = -32601
+	// ErrCodeInvalidParams is returned for parameters of the wrong type or number
+	ErrCodeInvalidParams = -32602
+	// ErrCodeMisc is returned for errors that have no code of their own
+	ErrCodeMisc = -1
+	// ErrCodeInvalidAddressOrKey is returned for an invalid address or key, and for a transaction or block that is not found
+	ErrCodeInvalidAddressOrKey = -5
+	// ErrCodeInvalidParameter is returned for a parameter with an invalid value
+	ErrCodeInvalidParameter = -8
+	// ErrCodeClientNotConnected is returned by calls that need peers while the node has none
+	ErrCodeClientNotConnected = -9
+	// ErrCodeClientInInitialDownload is returned by calls that need the node to have caught up with the chain while it has not
+	ErrCodeClientInInitialDownload = -10
+	// ErrCodeDeserialization is returned for a transaction or block that cannot be decoded
+	ErrCodeDeserialization = -22
+	// ErrCodeVerify is returned for a transaction that is rejected
+	ErrCodeVerify = -25
+	// ErrCodeInWarmup is returned while the node is starting and loading its block index
+	ErrCodeInWarmup = -28
+)
+
+// IsCode returns true if an error is an *Error with a given code
+func IsCode(err error, code int) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
 }
@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// TLSConfig is how a Client connecting over TLS checks the node's certificate, and the certificate it proves itself with. With none of CAFile, Fingerprints, KnownHosts and Insecure set, the node's certificate is checked against the system's certificate authorities.
+type TLSConfig struct {
+	// CAFile is a PEM file of the certificate authorities to check the node's certificate against instead of the system's
+	CAFile string
+	// Fingerprints pins the node's certificate, which is accepted if its fingerprint as given by Fingerprint is one of these, whoever signed it. This suits nodes with self-signed certificates. Colons between the bytes are ignored.
+	Fingerprints []string
+	// KnownHosts is the path of a file of the fingerprints of the certificates of nodes trusted on first use. The certificate of a node that is not in the file yet is trusted and its fingerprint added to the file, and from then on only that certificate is accepted from the node.
+	KnownHosts string
+	// CertFile and KeyFile are PEM files of a certificate and its key sent to a node that asks for one, for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName is the name the node's certificate must be for when it is checked against certificate authorities, by default the host connected to
+	ServerName string
+	// Insecure accepts any certificate, so anyone in the way of the connection can read and change it. It cannot be combined with the other ways of checking the certificate.
+	Insecure bool
+}
+
+// FingerprintError is returned when a node's certificate is not the one pinned or trusted for it
+type FingerprintError struct {
+	Addr        string
+	Fingerprint string
+}
+
+func (e *FingerprintError) Error() string {
+	return fmt.Sprintf("certificate of %s with fingerprint %s is not trusted", e.Addr, e.Fingerprint)
+}
+
+// Fingerprint returns the SHA256 hash of a certificate in hexadecimal, the form used to pin certificates
+func Fingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+// normalFingerprint returns a fingerprint in lower case without colons
+func normalFingerprint(f string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(f), ":", "", -1))
+}
+
+// NewTLSClient creates a new RPC client that connects to the node over TLS, checking its certificate as set by cfg
+func NewTLSClient(host string, port int, user, passwd string, cfg *TLSConfig) (*Client, error) {
+	d, err := newTLSDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClient(host, port, user, passwd, false)
+	c.URL, c.dialTLS = "https"+strings.TrimPrefix(c.URL, "http"), d.dial
+	c.httpClient = &http.Client{Transport: newTransport(c.dialTLS)}
+	return c, nil
+}
+
+// tlsDialer makes TLS connections, checking the node's certificate as a TLSConfig sets. The certificate is checked by the dialer rather than the TLS configuration, as only the dialer knows the address of the node, which pinned and trusted fingerprints are kept for.
+type tlsDialer struct {
+	config *tls.Config
+	// pins are the fingerprints of pinned certificates
+	pins map[string]bool
+	// known are the certificates trusted on first use, nil if there are none
+	known *knownHosts
+}
+
+// newTLSDialer reads the files a TLSConfig names and returns a dialer that checks certificates as it sets
+func newTLSDialer(cfg *TLSConfig) (d *tlsDialer, err error) {
+	if cfg == nil {
+		cfg = &TLSConfig{}
+	}
+	ways := 0
+	for _, set := range []bool{cfg.CAFile != "", len(cfg.Fingerprints) > 0, cfg.KnownHosts != "", cfg.Insecure} {
+		if set {
+			ways++
+		}
+	}
+	if ways > 1 {
+		return nil, errors.New("only one of a CA file, pinned fingerprints, known hosts and insecure may be set")
+	}
+	d = &tlsDialer{config: &tls.Config{ServerName: cfg.ServerName}}
+	switch {
+	case cfg.Insecure:
+		d.config.InsecureSkipVerify = true
+	case cfg.CAFile != "":
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		d.config.RootCAs = x509.NewCertPool()
+		if !d.config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.CAFile)
+		}
+	case len(cfg.Fingerprints) > 0:
+		// the certificate is checked against the pins once the handshake is done
+		d.config.InsecureSkipVerify = true
+		d.pins = make(map[string]bool)
+		for _, f := range cfg.Fingerprints {
+			f = normalFingerprint(f)
+			if b, err := hex.DecodeString(f); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("fingerprint %s is not a SHA256 hash in hexadecimal", f)
+			}
+			d.pins[f] = true
+		}
+	case cfg.KnownHosts != "":
+		d.config.InsecureSkipVerify = true
+		if d.known, err = loadKnownHosts(cfg.KnownHosts); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		d.config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// dial connects to a node, does the TLS handshake and checks the node's certificate
+func (d *tlsDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{Timeout: RPCClientTimeout * time.Second, KeepAlive: RPCClientTimeout * time.Second}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := d.config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	hsCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err = tc.HandshakeContext(hsCtx); err == nil {
+		err = d.check(addr, tc.ConnectionState())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// check checks a node's certificate against the pinned or trusted fingerprints, if the dialer has any
+func (d *tlsDialer) check(addr string, cs tls.ConnectionState) error {
+	if d.pins == nil && d.known == nil {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%s sent no certificate", addr)
+	}
+	f := Fingerprint(cs.PeerCertificates[0])
+	if d.pins != nil {
+		if !d.pins[f] {
+			return &FingerprintError{Addr: addr, Fingerprint: f}
+		}
+		return nil
+	}
+	return d.known.check(addr, f)
+}
+
+// knownHosts is a file of the fingerprints of certificates trusted on first use, with a line for each node holding its address and the fingerprint, separated by a space
+type knownHosts struct {
+	path  string
+	mutex gosync.Mutex
+	hosts map[string]string
+}
+
+// loadKnownHosts reads a known hosts file, which need not exist yet
+func loadKnownHosts(path string) (k *knownHosts, err error) {
+	k = &knownHosts{path: path, hosts: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected an address and a fingerprint", path, n)
+		}
+		k.hosts[fields[0]] = normalFingerprint(fields[1])
+	}
+	return k, lines.Err()
+}
+
+// check accepts the fingerprint of a node's certificate if it is the one trusted for the node, or if no certificate is trusted for it yet, in which case it is added to the file
+func (k *knownHosts) check(addr, fingerprint string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if trusted, ok := k.hosts[addr]; ok {
+		if trusted != fingerprint {
+			return &FingerprintError{Addr: addr, Fingerprint: fingerprint}
+		}
+		return nil
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "%s %s\n", addr, fingerprint); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	k.hosts[addr] = fingerprint
+	return nil
+}
@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTLSClient returns a client for a test TLS server, checking its certificate as cfg sets
+func testTLSClient(t *testing.T, srv *httptest.Server, cfg *TLSConfig) (*Client, error) {
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	c, err := NewTLSClient(host, p, "", "", cfg)
+	if c != nil {
+		c.Retries = -1
+	}
+	return c, err
+}
+
+// writePEM writes a PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpctls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewTLSServer(http.HandlerFunc(echo))
+	defer srv.Close()
+	fingerprint := Fingerprint(srv.Certificate())
+	works := func(what string, cfg *TLSConfig) {
+		t.Helper()
+		c, err := testTLSClient(t, srv, cfg)
+		if err == nil {
+			_, err = c.Call("getinfo", nil)
+		}
+		if err != nil {
+			t.Error(what, err)
+		}
+	}
+	fails := func(what string, cfg *TLSConfig) error {
+		t.Helper()
+		c, err := testTLSClient(t, srv, cfg)
+		if err == nil {
+			_, err = c.Call("getinfo", nil)
+		}
+		if err == nil {
+			t.Error(what, "accepted")
+		}
+		return err
+	}
+
+	// the test server's certificate is not signed by anyone the system trusts
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	plain := NewClient(host, p, "", "", true)
+	plain.Retries = -1
+	if _, err = plain.Call("getinfo", nil); err == nil || IsTransient(err) {
+		t.Error("self-signed certificate", err)
+	}
+	fails("default configuration", nil)
+	works("insecure", &TLSConfig{Insecure: true})
+	works("CA file", &TLSConfig{CAFile: writePEM(t, dir, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)})
+	works("pinned fingerprint", &TLSConfig{Fingerprints: []string{strings.ToUpper(fingerprint[:2]) + ":" + fingerprint[2:]}})
+	var fpErr *FingerprintError
+	if err = fails("other fingerprint", &TLSConfig{Fingerprints: []string{strings.Repeat("00", 32)}}); !errors.As(err, &fpErr) || IsTransient(err) {
+		t.Error("other fingerprint", err)
+	}
+	if _, err = testTLSClient(t, srv, &TLSConfig{Insecure: true, Fingerprints: []string{fingerprint}}); err == nil {
+		t.Error("insecure combined with pinning")
+	}
+
+	// trust on first use
+	known := filepath.Join(dir, "known_hosts")
+	works("first use", &TLSConfig{KnownHosts: known})
+	if b, _ := ioutil.ReadFile(known); string(b) != srv.Listener.Addr().String()+" "+fingerprint+"\n" {
+		t.Errorf("known hosts file holds %q", b)
+	}
+	works("known host", &TLSConfig{KnownHosts: known})
+	ioutil.WriteFile(known, []byte("# changed\n"+srv.Listener.Addr().String()+" "+strings.Repeat("00", 32)+"\n"), 0600)
+	fails("changed certificate", &TLSConfig{KnownHosts: known})
+
+	// the websocket endpoint is reached through the same checks, and a server without one is polled
+	c, _ := testTLSClient(t, srv, &TLSConfig{Fingerprints: []string{fingerprint}})
+	if sub, err := c.Subscribe(context.Background()); err != nil || sub.Websocket() {
+		t.Error("subscription over TLS", err)
+	} else {
+		sub.Close()
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpctls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chainsync"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(echo))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	srv.TLS.ClientCAs.AddCert(cert)
+	srv.StartTLS()
+	defer srv.Close()
+	pin := []string{Fingerprint(srv.Certificate())}
+
+	c, err := testTLSClient(t, srv, &TLSConfig{Fingerprints: pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Call("getinfo", nil); err == nil {
+		t.Error("accepted without a client certificate")
+	}
+	c, err = testTLSClient(t, srv, &TLSConfig{
+		Fingerprints: pin,
+		CertFile:     writePEM(t, dir, "cert.pem", "CERTIFICATE", der),
+		KeyFile:      writePEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Call("getinfo", nil); err != nil {
+		t.Error("client certificate not accepted", err)
+	}
+}
@@ -0,0 +1,24 @@
+package rpc
+
+// ValidateAddress is the response from validateaddress. Only IsValid is set for an invalid address, and the fields after IsMine only for addresses in the node's wallet.
+type ValidateAddress struct {
+	IsValid      bool   `json:"isvalid"`
+	Address      string `json:"address,omitempty"`
+	IsMine       bool   `json:"ismine,omitempty"`
+	IsScript     bool   `json:"isscript,omitempty"`
+	PubKey       string `json:"pubkey,omitempty"`
+	IsCompressed bool   `json:"iscompressed,omitempty"`
+	Account      string `json:"account,omitempty"`
+}
+
+// Unspent is an entry in the response from listunspent
+type Unspent struct {
+	Txid          string  `json:"txid"`
+	Vout          uint32  `json:"vout"`
+	Address       string  `json:"address"`
+	Account       string  `json:"account,omitempty"`
+	ScriptPubKey  string  `json:"scriptPubKey"`
+	RedeemScript  string  `json:"redeemScript,omitempty"`
+	Amount        float64 `json:"amount"`
+	Confirmations int64   `json:"confirmations"`
+}
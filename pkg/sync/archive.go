@@ -0,0 +1,265 @@
+package sync
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	gosync "sync"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// DefaultArchiveFileSize is the size at which the archive starts a new data file
+	DefaultArchiveFileSize = 128 << 20
+	// archiveIndexName is the file holding one record per height
+	archiveIndexName = "blocks.idx"
+	// archiveRecordSize is the length of an index record, 32 bytes of block hash then the data file number, offset, length and CRC32 of the compressed block as 4 byte little endian integers
+	archiveRecordSize = 48
+)
+
+var (
+	// ErrNotArchived is returned for a height that is not in the archive
+	ErrNotArchived = errors.New("block is not archived")
+	// ErrArchiveGap is returned when a block is stored above the next height of the archive
+	ErrArchiveGap = errors.New("block would leave a gap in the archive")
+	// ErrArchiveCorrupt is returned when an archived block does not match its checksum
+	ErrArchiveCorrupt = errors.New("archived block is corrupt")
+)
+
+// Archive is an append-only store of raw blocks on the best chain, so the index can be rebuilt without the full node. Blocks are compressed with snappy and appended to numbered data files, and an index file holds a fixed size record for each height pointing into them.
+//
+// A reorg truncates the index and the replacement blocks are appended, so the data of orphaned blocks stays in the data files as garbage, as in gocoin's BlockDB. Data is always written before the index record that refers to it, so after a crash the index never points past the data.
+type Archive struct {
+	gosync.Mutex
+	// MaxFileSize is the size at which a new data file is started. Offsets into data files are 4 bytes long, so it is capped at math.MaxUint32.
+	MaxFileSize int64
+	dir         string
+	index       *os.File
+	count       uint32
+	data        *os.File
+	dataNum     uint32
+	dataSize    int64
+	readers     map[uint32]*os.File
+}
+
+// OpenArchive opens the block archive in a directory, creating it if it does not exist
+func OpenArchive(dir string) (a *Archive, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	a = &Archive{MaxFileSize: DefaultArchiveFileSize, dir: dir, readers: make(map[uint32]*os.File)}
+	if a.index, err = os.OpenFile(filepath.Join(dir, archiveIndexName), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	info, err := a.index.Stat()
+	if err != nil {
+		a.index.Close()
+		return nil, err
+	}
+	a.count = uint32(info.Size() / archiveRecordSize)
+	// a record only partly written before a crash is dropped
+	if err = a.index.Truncate(int64(a.count) * archiveRecordSize); err != nil {
+		a.index.Close()
+		return nil, err
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	for _, name := range names {
+		var n uint32
+		if _, err := fmt.Sscanf(filepath.Base(name), "blk%05d.dat", &n); err == nil && n > a.dataNum {
+			a.dataNum = n
+		}
+	}
+	if err = a.openData(a.dataNum); err != nil {
+		a.index.Close()
+		return nil, err
+	}
+	return
+}
+
+// dataName returns the path of a data file
+func (a *Archive) dataName(n uint32) string {
+	return filepath.Join(a.dir, fmt.Sprintf("blk%05d.dat", n))
+}
+
+// openData opens a data file for appending
+func (a *Archive) openData(n uint32) (err error) {
+	f, err := os.OpenFile(a.dataName(n), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	if a.data != nil {
+		a.data.Close()
+	}
+	a.data, a.dataNum, a.dataSize = f, n, info.Size()
+	return
+}
+
+// Count returns the number of blocks in the archive, which is the next height to be stored
+func (a *Archive) Count() uint32 {
+	a.Lock()
+	defer a.Unlock()
+	return a.count
+}
+
+// Put stores the raw block at a height. A height below the count replaces the block there and drops every block above it.
+func (a *Archive) Put(height uint32, hash, raw []byte) (err error) {
+	a.Lock()
+	defer a.Unlock()
+	if height > a.count {
+		return ErrArchiveGap
+	}
+	if len(hash) > 32 {
+		return fmt.Errorf("block hash is %d bytes long", len(hash))
+	}
+	if height < a.count {
+		if err = a.truncate(height); err != nil {
+			return
+		}
+	}
+	data := snappy.Encode(nil, raw)
+	if a.dataSize > 0 && a.dataSize+int64(len(data)) > a.fileLimit() {
+		if err = a.data.Sync(); err != nil {
+			return
+		}
+		if err = a.openData(a.dataNum + 1); err != nil {
+			return
+		}
+	}
+	if _, err = a.data.Write(data); err != nil {
+		a.resetData()
+		return
+	}
+	rec := make([]byte, archiveRecordSize)
+	copy(rec[32-len(hash):32], hash)
+	binary.LittleEndian.PutUint32(rec[32:], a.dataNum)
+	binary.LittleEndian.PutUint32(rec[36:], uint32(a.dataSize))
+	binary.LittleEndian.PutUint32(rec[40:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[44:], crc32.ChecksumIEEE(data))
+	a.dataSize += int64(len(data))
+	if _, err = a.index.WriteAt(rec, int64(height)*archiveRecordSize); err != nil {
+		return
+	}
+	a.count = height + 1
+	return
+}
+
+// fileLimit returns the size at which a new data file is started, which is MaxFileSize unless that is too large for an offset to reach
+func (a *Archive) fileLimit() int64 {
+	if a.MaxFileSize <= 0 || a.MaxFileSize > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return a.MaxFileSize
+}
+
+// resetData cuts the current data file back to its size before a failed write, or reads its size if that fails too, so the data of the next block is stored at the offset its index record gives
+func (a *Archive) resetData() {
+	if a.data.Truncate(a.dataSize) == nil {
+		return
+	}
+	if info, err := a.data.Stat(); err == nil {
+		a.dataSize = info.Size()
+	}
+}
+
+// record reads the index record for a height
+func (a *Archive) record(height uint32) (rec []byte, err error) {
+	if height >= a.count {
+		return nil, ErrNotArchived
+	}
+	rec = make([]byte, archiveRecordSize)
+	_, err = a.index.ReadAt(rec, int64(height)*archiveRecordSize)
+	return
+}
+
+// Hash returns the hash of the archived block at a height
+func (a *Archive) Hash(height uint32) (hash []byte, err error) {
+	a.Lock()
+	defer a.Unlock()
+	rec, err := a.record(height)
+	if err != nil {
+		return
+	}
+	return rec[:32], nil
+}
+
+// Get returns the hash and the raw block at a height
+func (a *Archive) Get(height uint32) (hash, raw []byte, err error) {
+	a.Lock()
+	defer a.Unlock()
+	rec, err := a.record(height)
+	if err != nil {
+		return
+	}
+	num := binary.LittleEndian.Uint32(rec[32:])
+	f, ok := a.readers[num]
+	if !ok {
+		if f, err = os.Open(a.dataName(num)); err != nil {
+			return
+		}
+		a.readers[num] = f
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(rec[40:]))
+	if _, err = f.ReadAt(data, int64(binary.LittleEndian.Uint32(rec[36:]))); err == io.EOF {
+		return nil, nil, ErrArchiveCorrupt
+	} else if err != nil {
+		return
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(rec[44:]) {
+		return nil, nil, ErrArchiveCorrupt
+	}
+	if raw, err = snappy.Decode(nil, data); err != nil {
+		return nil, nil, ErrArchiveCorrupt
+	}
+	return rec[:32], raw, nil
+}
+
+// Truncate drops every block at or above a height
+func (a *Archive) Truncate(height uint32) error {
+	a.Lock()
+	defer a.Unlock()
+	if height >= a.count {
+		return nil
+	}
+	return a.truncate(height)
+}
+
+func (a *Archive) truncate(height uint32) (err error) {
+	if err = a.index.Truncate(int64(height) * archiveRecordSize); err == nil {
+		a.count = height
+	}
+	return
+}
+
+// Sync flushes the data files and then the index to disk
+func (a *Archive) Sync() (err error) {
+	a.Lock()
+	defer a.Unlock()
+	if err = a.data.Sync(); err != nil {
+		return
+	}
+	return a.index.Sync()
+}
+
+// Close flushes and closes the archive
+func (a *Archive) Close() (err error) {
+	err = a.Sync()
+	a.Lock()
+	defer a.Unlock()
+	for _, f := range a.readers {
+		f.Close()
+	}
+	a.data.Close()
+	a.index.Close()
+	return
+}
@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.MaxFileSize = 8
+	raw := func(h uint32) []byte { return bytes.Repeat([]byte{byte(h)}, 100+int(h)) }
+	for h := uint32(0); h < 5; h++ {
+		if err = a.Put(h, testHash(h), raw(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.Put(7, testHash(7), raw(7)); err != ErrArchiveGap {
+		t.Error("expected a gap error, got", err)
+	}
+	// a reorg replaces block 3 and drops block 4
+	if err = a.Put(3, testHash(33), raw(33)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	if a.Count() != 4 {
+		t.Fatal("expected 4 blocks after reopening, got", a.Count())
+	}
+	for h, want := range []uint32{0, 1, 2, 33} {
+		hash, got, err := a.Get(uint32(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, testHash(want)) || !bytes.Equal(got, raw(want)) {
+			t.Error("wrong block at height", h)
+		}
+	}
+	if _, _, err = a.Get(4); err != ErrNotArchived {
+		t.Error("expected not archived, got", err)
+	}
+	if err = a.Truncate(2); err != nil || a.Count() != 2 {
+		t.Error("truncate failed", err, a.Count())
+	}
+	a.Close()
+
+	// the blocks were split across data files, damage the first one
+	if names, _ := filepath.Glob(filepath.Join(dir, "blk*.dat")); len(names) < 2 {
+		t.Error("expected several data files, got", names)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "blk00000.dat"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xFF, 0xFF}, 2)
+	f.Close()
+	if a, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, _, err = a.Get(0); err != ErrArchiveCorrupt {
+		t.Error("expected corrupt block, got", err)
+	}
+
+	// data left by a partial write is cut off, so the next block is found where it was written
+	a.MaxFileSize = 1 << 40
+	if a.fileLimit() != math.MaxUint32 {
+		t.Error("data file size not capped at the largest offset", a.fileLimit())
+	}
+	size := a.dataSize
+	a.data.Write([]byte{1, 2, 3})
+	a.resetData()
+	if info, _ := a.data.Stat(); info.Size() != size || a.dataSize != size {
+		t.Error("partial write not cut off", info.Size(), a.dataSize, size)
+	}
+	if err = a.Put(2, testHash(2), raw(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := a.Get(2); err != nil || !bytes.Equal(got, raw(2)) {
+		t.Error("block after a partial write", err)
+	}
+}
@@ -0,0 +1,361 @@
+package sync
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	gosync "sync"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+// DefaultTxCacheSize is the number of transactions kept in memory for answering address queries
+const DefaultTxCacheSize = 1 << 14
+
+var (
+	// ErrBadAddress is returned when an address is not valid base58check
+	ErrBadAddress = errors.New("invalid address")
+	// ErrNotIndexed is returned when a query refers to a block the index does not have
+	ErrNotIndexed = errors.New("block not in index")
+)
+
+// AddressTx is an entry in the history of an address
+type AddressTx struct {
+	Location
+	TxID string `json:"txid"`
+	// Amount is the total value the address received in the transaction, or for a spend the total value of its coins the transaction consumed
+	Amount uint64 `json:"amount"`
+}
+
+// UTXO is an unspent output paying to an address
+type UTXO struct {
+	TxID   string `json:"txid"`
+	Vout   int    `json:"vout"`
+	Value  uint64 `json:"value"`
+	Height uint32 `json:"height"`
+}
+
+// txCache is a bounded cache of transactions, and of the transaction ids of blocks, fetched from the full node for answering address queries
+type txCache struct {
+	gosync.Mutex
+	txs    map[string]*rpc.RawTransaction
+	blocks map[uint32][]string
+	max    int
+}
+
+func newTxCache(max int) *txCache {
+	return &txCache{txs: make(map[string]*rpc.RawTransaction), blocks: make(map[uint32][]string), max: max}
+}
+
+func (c *txCache) getTx(txid string) (tx *rpc.RawTransaction, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	tx, ok = c.txs[txid]
+	return
+}
+
+func (c *txCache) putTx(tx *rpc.RawTransaction) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.txs) >= c.max {
+		for k := range c.txs {
+			delete(c.txs, k)
+			break
+		}
+	}
+	c.txs[tx.Txid] = tx
+}
+
+func (c *txCache) getBlock(height uint32) (txids []string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	txids, ok = c.blocks[height]
+	return
+}
+
+func (c *txCache) putBlock(height uint32, txids []string) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.blocks) >= c.max {
+		for k := range c.blocks {
+			delete(c.blocks, k)
+			break
+		}
+	}
+	c.blocks[height] = txids
+}
+
+// dropBlocks forgets the transaction ids of blocks above a height, after a rollback
+func (c *txCache) dropBlocks(above uint32) {
+	c.Lock()
+	defer c.Unlock()
+	for h := range c.blocks {
+		if h > above {
+			delete(c.blocks, h)
+		}
+	}
+}
+
+// initCaches creates the in-memory caches the first time they are needed
+func (r *Node) initCaches() {
+	r.cacheOnce.Do(func() {
+		if r.outputs == nil {
+			r.outputs = newOutputCache(DefaultOutputCacheSize)
+		}
+		r.txs = newTxCache(DefaultTxCacheSize)
+	})
+}
+
+// toSatoshis converts an RPC amount in coins to the integer number of base units
+func toSatoshis(v float64) uint64 {
+	return uint64(math.Floor(v*core.COIN + 0.5))
+}
+
+// getTx returns a transaction by id, from the cache if possible
+func (r *Node) getTx(txid string) (tx *rpc.RawTransaction, err error) {
+	r.initCaches()
+	if tx, ok := r.txs.getTx(txid); ok {
+		return tx, nil
+	}
+	if tx, err = r.rpcTx(txid); err != nil {
+		return
+	}
+	r.txs.putTx(tx)
+	return
+}
+
+// blockTxids returns the transaction ids of an indexed block, from the cache if possible
+func (r *Node) blockTxids(height uint32) (txids []string, err error) {
+	r.initCaches()
+	if txids, ok := r.txs.getBlock(height); ok {
+		return txids, nil
+	}
+	hash, err := r.GetBlockHash(height)
+	if err != nil {
+		return
+	} else if hash == nil {
+		return nil, ErrNotIndexed
+	}
+	blk, err := r.RPC.GetBlock(hex.EncodeToString(hash))
+	if err != nil {
+		return nil, fmt.Errorf("getblock %x: %v", hash, err)
+	}
+	r.txs.putBlock(height, blk.Tx)
+	return blk.Tx, nil
+}
+
+// txAt returns the transaction at a location in the index
+func (r *Node) txAt(loc Location) (tx *rpc.RawTransaction, err error) {
+	txids, err := r.blockTxids(loc.Height)
+	if err != nil {
+		return
+	}
+	if int(loc.TxNum) >= len(txids) {
+		return nil, fmt.Errorf("block %d has no transaction %d", loc.Height, loc.TxNum)
+	}
+	return r.getTx(txids[loc.TxNum])
+}
+
+// paysTo returns true if an output pays to the given address
+func paysTo(vout rpc.Vout, addr string) bool {
+	for _, a := range vout.ScriptPubKey.Addresses {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// getLocations returns the index record of an address
+func (r *Node) getLocations(hhash []byte) (locs []Location, err error) {
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(append([]byte{PrefixAddress}, hhash...))
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		locs, err = decodeAddressRecord(v)
+		return err
+	})
+	return
+}
+
+// locationAmount returns the amount an address received in, or had spent by, the transaction at a location
+func (r *Node) locationAmount(addr string, loc Location) (tx *rpc.RawTransaction, amount uint64, err error) {
+	if tx, err = r.txAt(loc); err != nil {
+		return
+	}
+	if !loc.Spend {
+		for _, vout := range tx.Vout {
+			if paysTo(vout, addr) {
+				amount += toSatoshis(vout.Value)
+			}
+		}
+		return
+	}
+	for _, vin := range tx.Vin {
+		if vin.Coinbase != "" || vin.Txid == "" {
+			continue
+		}
+		prev, err := r.getTx(vin.Txid)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, vout := range prev.Vout {
+			if vout.N == vin.Vout && paysTo(vout, addr) {
+				amount += toSatoshis(vout.Value)
+			}
+		}
+	}
+	return
+}
+
+// getBalanceCache returns the cached balance of an address if there is one
+func (r *Node) getBalanceCache(hhash []byte) (bal BalanceCache, found bool, err error) {
+	k := append([]byte{PrefixBalanceCache}, hhash...)
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(k)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rec, err := DecodeRecord(k, v)
+		if err == nil {
+			bal, found = rec.(BalanceCache), true
+		}
+		return err
+	})
+	return
+}
+
+// GetAddressBalance returns the balance of an address as of the given height, which is capped at the latest indexed block.
+//
+// The result is cached, and later queries at the same or a greater height start from the cached balance and only look up the transactions since. Caches are dropped when blocks touching the address are undone or newly indexed at or below the cached height, so a cached balance is always valid for its height.
+func (r *Node) GetAddressBalance(addr string, atHeight uint32) (balance uint64, err error) {
+	hhash := addressHHash(addr)
+	if hhash == nil {
+		return 0, ErrBadAddress
+	}
+	latest, found, err := r.getLatest()
+	if err != nil {
+		return
+	} else if !found {
+		return 0, ErrNotIndexed
+	}
+	if atHeight > latest {
+		atHeight = latest
+	}
+	locs, err := r.getLocations(hhash)
+	if err != nil {
+		return
+	}
+	cache, cached, err := r.getBalanceCache(hhash)
+	if err != nil {
+		return
+	}
+	var from uint32
+	if cached && cache.Height <= atHeight {
+		balance, from = cache.Balance, cache.Height+1
+	}
+	var credit, debit uint64
+	for _, loc := range locs {
+		if loc.Height < from {
+			continue
+		}
+		if loc.Height > atHeight {
+			break
+		}
+		_, amount, err := r.locationAmount(addr, loc)
+		if err != nil {
+			return 0, err
+		}
+		if loc.Spend {
+			debit += amount
+		} else {
+			credit += amount
+		}
+	}
+	if balance+credit < debit {
+		return 0, fmt.Errorf("address %s has negative balance at height %d, index is inconsistent", addr, atHeight)
+	}
+	balance = balance + credit - debit
+	if !cached || atHeight > cache.Height {
+		k, v := EncodeKV(BalanceCache{HHash: hhash, Balance: balance, Height: atHeight})
+		err = r.DB.Update(func(txn kv.Txn) error {
+			return txn.Put(k, v)
+		})
+	}
+	return
+}
+
+// GetAddressHistory returns the transactions an address appears in, oldest first, skipping offset entries and returning at most limit entries. A limit of zero returns everything after the offset.
+func (r *Node) GetAddressHistory(addr string, offset, limit int) (out []AddressTx, err error) {
+	hhash := addressHHash(addr)
+	if hhash == nil {
+		return nil, ErrBadAddress
+	}
+	locs, err := r.getLocations(hhash)
+	if err != nil {
+		return
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(locs) {
+		return
+	}
+	locs = locs[offset:]
+	if limit > 0 && limit < len(locs) {
+		locs = locs[:limit]
+	}
+	for _, loc := range locs {
+		tx, amount, err := r.locationAmount(addr, loc)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, AddressTx{Location: loc, TxID: tx.Txid, Amount: amount})
+	}
+	return
+}
+
+// GetAddressUTXOs returns the outputs paying to an address that have not been spent as of the latest indexed block. Every spend of the address' coins has a location in its index record, so the unspent set is the credited outputs less the outputs consumed at those locations.
+func (r *Node) GetAddressUTXOs(addr string) (out []UTXO, err error) {
+	hhash := addressHHash(addr)
+	if hhash == nil {
+		return nil, ErrBadAddress
+	}
+	locs, err := r.getLocations(hhash)
+	if err != nil {
+		return
+	}
+	spent := make(map[string]bool)
+	for _, loc := range locs {
+		tx, err := r.txAt(loc)
+		if err != nil {
+			return nil, err
+		}
+		if loc.Spend {
+			for _, vin := range tx.Vin {
+				spent[fmt.Sprint(vin.Txid, ":", vin.Vout)] = true
+			}
+			continue
+		}
+		for _, vout := range tx.Vout {
+			if paysTo(vout, addr) {
+				out = append(out, UTXO{TxID: tx.Txid, Vout: vout.N, Value: toSatoshis(vout.Value), Height: loc.Height})
+			}
+		}
+	}
+	unspent := out[:0]
+	for _, u := range out {
+		if !spent[fmt.Sprint(u.TxID, ":", u.Vout)] {
+			unspent = append(unspent, u)
+		}
+	}
+	return unspent, nil
+}
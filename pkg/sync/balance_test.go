@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+// testMined serialises a chain with a block holding the transactions given for each height, from the genesis block on, with each block mined and linked to the real hash of the one below it
+func testMined(t *testing.T, blocks ...[]block.Tx) (raws [][]byte) {
+	prev := make([]byte, 32)
+	for _, txs := range blocks {
+		b := block.Raw{Version: 2, HashPrevBlock: prev, Bits: make([]byte, 4), Transactions: txs}
+		b.HashMerkleRoot, _ = b.ComputeMerkleRoot()
+		raw, err := block.Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpctest.Mine(raw)
+		hash, _ := p2p.BlockHash(raw)
+		raws, prev = append(raws, raw), hash.Shown()
+	}
+	return
+}
+
+// testSynced serves a chain from an rpctest.Node and syncs the index from it. The caller closes the node.
+func testSynced(t *testing.T, r *Node, raws [][]byte) *rpctest.Node {
+	n := rpctest.NewNode(Mainnet, raws)
+	r.RPC = n.Client()
+	if !r.Sync().OK() {
+		n.Close()
+		t.Fatal(r.Error())
+	}
+	return n
+}
+
+// testSpendChain serialises a chain whose block 1 pays 50 coins to the first test address and whose block 2 has only a transaction spending that, paying 30 coins to the second address and 19.99 back to the first
+func testSpendChain(t *testing.T) (raws [][]byte, txids []string) {
+	a := testCoinbase(t, 1, testAddrs[0])
+	prev, _ := a.TxID()
+	b := block.Tx{
+		Version: 1,
+		Ins:     []block.TxIn{{PrevTxHash: prev, Script: []byte{0}, Sequence: ^uint32(0)}},
+		Outs: []block.TxOut{
+			{Value: 3000000000, Script: testP2PKH(t, testAddrs[1])},
+			{Value: 1999000000, Script: testP2PKH(t, testAddrs[0])},
+		},
+	}
+	raws = testMined(t, []block.Tx{testCoinbase(t, 0, testAddrs[0])}, []block.Tx{a}, []block.Tx{b})
+	for _, tx := range []block.Tx{a, b} {
+		id, _ := tx.TxID()
+		txids = append(txids, hex.EncodeToString(id))
+	}
+	return
+}
+
+func TestAddressQueries(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	raws, txids := testSpendChain(t)
+	defer testSynced(t, r, raws).Close()
+
+	for _, c := range []struct {
+		addr    string
+		height  uint32
+		balance uint64
+	}{
+		{testAddrs[0], 2, 1999000000},
+		{testAddrs[0], 1, 5000000000},
+		{testAddrs[0], 2, 1999000000},
+		{testAddrs[1], 1, 0},
+		{testAddrs[1], 100, 3000000000},
+	} {
+		balance, err := r.GetAddressBalance(c.addr, c.height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != c.balance {
+			t.Error(c.addr, "at", c.height, "expected", c.balance, "got", balance)
+		}
+	}
+	if cache, found, _ := r.getBalanceCache(addressHHash(testAddrs[0])); !found || cache.Height != 2 {
+		t.Error("balance not cached", cache)
+	}
+
+	history, err := r.GetAddressHistory(testAddrs[0], 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].TxID != txids[1] || !history[0].Spend || history[0].Amount != 5000000000 ||
+		history[1].Spend || history[1].Amount != 1999000000 {
+		t.Error("unexpected history", history)
+	}
+
+	utxos, err := r.GetAddressUTXOs(testAddrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].TxID != txids[1] || utxos[0].Vout != 1 || utxos[0].Height != 2 {
+		t.Error("unexpected utxos", utxos)
+	}
+
+	if _, err := r.GetAddressBalance("nonsense", 1); err != ErrBadAddress {
+		t.Error("expected bad address error, got", err)
+	}
+}
@@ -1,35 +1,62 @@
 package sync
 
 import (
-	"github.com/dgraph-io/badger"
+	"bytes"
+	"encoding/binary"
+
 	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
 )
 
-// GetBlockHash returns the block hash from the chainsync database
-func (r *Node) GetBlockHash(height uint32) (out []byte) {
-	r.SetStatusIf(r.DB.View(func(txn *badger.Txn) error {
-		k := append([]byte{1}, removeTrailingZeroes(*core.IntToBytes(height))...)
-		item, err := txn.Get(k)
-		v, err := item.Value()
+// GetBlockHash returns the block hash from the chainsync database, or nil if there is no block stored at the height. A record longer than a hash is ErrRecord. It leaves the Node status alone, so it can be called alongside a sync.
+func (r *Node) GetBlockHash(height uint32) (out []byte, err error) {
+	err = r.DB.View(func(txn kv.Reader) error {
+		k, _ := EncodeKV(Block{Height: height})
+		v, err := txn.Get(k)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(v) > 32 {
+			return ErrRecord
+		}
 		out = append(make([]byte, 32-len(v)), v...)
-		return err
-	}))
+		return nil
+	})
 	return
 }
 
-// GetHeightFromHash returns the height of a block with a given hash
-func (r *Node) GetHeightFromHash(h []byte) (out uint32) {
+// GetHeightFromHash returns the height of a block with a given hash, or ^uint32(0) if the block is not in the index
+func (r *Node) GetHeightFromHash(h []byte) (out uint32, err error) {
+	if out, err = r.hashHeight(*core.Hash64(&h)); err != nil || out == ^uint32(0) {
+		return
+	}
+	// the key is only 64 bits of the hash so check it is really the same block
+	stored, err := r.GetBlockHash(out)
+	if err == nil && !bytes.Equal(stored, h) {
+		out = ^uint32(0)
+	}
+	return
+}
+
+// hashHeight reads the height from the hash record with a given key, or returns ^uint32(0) if there is none
+func (r *Node) hashHeight(hhash []byte) (out uint32, err error) {
 	out = ^uint32(0)
-	r.SetStatusIf(r.DB.View(func(txn *badger.Txn) error {
-		H := *core.Hash64(&h)
-		item, err := txn.Get(append([]byte{2}, H...))
-		if err != nil {
-			v, err := item.Value()
-			if item != nil && err == nil {
-				core.BytesToInt(&out, &v)
-			}
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(append([]byte{PrefixHash}, hhash...))
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// the height is a varint as written by EncodeKV
+		height, n := binary.Uvarint(v)
+		if n <= 0 {
+			return ErrRecord
 		}
-		return err
-	}))
+		out = uint32(height)
+		return nil
+	})
 	return
 }
@@ -0,0 +1,204 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+	"github.com/parallelcointeam/duo/pkg/wallet/db"
+)
+
+const (
+	// Mainnet is the main Parallelcoin network
+	Mainnet = "mainnet"
+	// Testnet is the Parallelcoin test network
+	Testnet = "testnet"
+)
+
+// DefaultRPCPorts are the full node's default RPC ports on each network
+var DefaultRPCPorts = map[string]int{Mainnet: 11048, Testnet: 21048}
+
+// GenesisHashes are the hashes of the genesis block of each network, which the chain a peer serves must start from
+var GenesisHashes = map[string]string{
+	Mainnet: "000009f0fcbad3aac904d3660cfdcf238bf298cfe73adf1d39d14fc5c740ccc7",
+	Testnet: "00000e41ecbaa35ef91b0c2c22ed4d85fa12bbc87da2668fe17572695fb30cdf",
+}
+
+// ErrNetwork is returned for a network other than Mainnet or Testnet
+var ErrNetwork = errors.New("unknown network, must be mainnet or testnet")
+
+// Config is the configuration of a Node. Zero values are replaced by the defaults for the network.
+type Config struct {
+	// Network is the network the full node is on, which selects the default RPC port and data directory, and the address prefixes used when decoding archived blocks
+	Network string
+	// RPCHost and RPCPort are the address of the full node's RPC server
+	RPCHost string
+	RPCPort int
+	// RPCUser and RPCPass are the RPC credentials, unless RPCCookie is set
+	RPCUser string
+	RPCPass string
+	// RPCCookie is the path of a cookie file written by the full node to use for authentication instead of a fixed user and password
+	RPCCookie string
+	// RPCTLS connects to the RPC server over TLS
+	RPCTLS bool
+	// RPCTLSConfig is how the RPC server's certificate is checked and the client certificate sent to it. Setting any of it connects over TLS whether or not RPCTLS is set.
+	RPCTLSConfig rpc.TLSConfig
+	// RPCConcurrency is the most requests sent to the RPC server at once, rpc.DefaultConcurrency if it is not set
+	RPCConcurrency int
+	// RPCEndpoints are the addresses of further RPC servers to fail over to, as hosts with optional ports that default to RPCPort, reached with the same credentials and TLS setting
+	RPCEndpoints []string
+	// RPCRetries is how many times a request that fails with a transient error is sent again, rpc.DefaultRetries if it is not set and never if it is negative
+	RPCRetries int
+	// Peer is the address of a full node to download blocks from over the peer to peer wire protocol instead of the RPC server, as a host with an optional port that defaults to the network's. The RPC server is still used to answer queries that need transactions which are not in the archive.
+	Peer string
+	// DataDir is the directory the index and the block archive are kept in
+	DataDir string
+	// Archive keeps a copy of every raw block, see Archive
+	Archive bool
+	// IgnoreSchema opens an index whatever its schema version without migrating it, which is only useful to rebuild it with Reindex
+	IgnoreSchema bool
+	// Workers and BatchSize tune the sync pipeline, see Node
+	Workers   int
+	BatchSize int
+	// DB tunes the index database
+	DB DBConfig
+}
+
+// DBConfig tunes the badger database holding the index. Zero values keep badger's defaults.
+type DBConfig struct {
+	// MaxTableSize is the size of each LSM tree table file
+	MaxTableSize int64
+	// ValueLogFileSize is the size of each value log file
+	ValueLogFileSize int64
+	// ValueThreshold is the value size from which values are kept in the value log rather than the LSM tree
+	ValueThreshold int
+	// NumMemtables is the number of tables kept in memory before writes stall
+	NumMemtables int
+	// NumCompactors is the number of concurrent compaction workers
+	NumCompactors int
+	// NoSyncWrites does not wait for writes to reach the disk, which is faster but may lose the last writes in a crash
+	NoSyncWrites bool
+	// LowMemory memory maps the LSM tree tables instead of loading them into memory
+	LowMemory bool
+}
+
+// DefaultConfig returns the configuration for a full node running on the same host with the given network's defaults
+func DefaultConfig(network string) Config {
+	return Config{
+		Network: network,
+		RPCHost: "127.0.0.1",
+		RPCPort: DefaultRPCPorts[network],
+		RPCUser: "user",
+		RPCPass: "pa55word",
+	}
+}
+
+// DefaultDataDir returns the default data directory for a network, which for the main network is the directory used before the network could be chosen
+func DefaultDataDir(network string) (dir string, err error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return
+	}
+	dir = filepath.Join(home, db.DefaultBaseDir)
+	if network != Mainnet {
+		dir = filepath.Join(dir, network)
+	}
+	return
+}
+
+// NewNode creates a new blockchain sync node/server from a configuration, opening its index database and archive
+func NewNode(cfg Config) (r *Node, err error) {
+	if cfg.Network == "" {
+		cfg.Network = Mainnet
+	}
+	if _, ok := DefaultRPCPorts[cfg.Network]; !ok {
+		return nil, ErrNetwork
+	}
+	if cfg.RPCPort == 0 {
+		cfg.RPCPort = DefaultRPCPorts[cfg.Network]
+	}
+	if cfg.DataDir == "" {
+		if cfg.DataDir, err = DefaultDataDir(cfg.Network); err != nil {
+			return nil, fmt.Errorf("getting data directory: %v", err)
+		}
+	}
+	r = &Node{Network: cfg.Network, Peer: cfg.Peer, Workers: cfg.Workers, BatchSize: cfg.BatchSize}
+	if t := cfg.RPCTLSConfig; cfg.RPCTLS || t.CAFile != "" || len(t.Fingerprints) > 0 || t.KnownHosts != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.Insecure {
+		if r.RPC, err = rpc.NewTLSClient(cfg.RPCHost, cfg.RPCPort, cfg.RPCUser, cfg.RPCPass, &cfg.RPCTLSConfig); err != nil {
+			return nil, fmt.Errorf("RPC TLS: %v", err)
+		}
+	} else {
+		r.RPC = rpc.NewClient(cfg.RPCHost, cfg.RPCPort, cfg.RPCUser, cfg.RPCPass, false)
+	}
+	r.RPC.Concurrency, r.RPC.Retries = cfg.RPCConcurrency, cfg.RPCRetries
+	for _, addr := range cfg.RPCEndpoints {
+		if err = r.RPC.AddEndpoint(addr); err != nil {
+			return nil, fmt.Errorf("RPC endpoint %s: %v", addr, err)
+		}
+	}
+	if cfg.RPCCookie != "" {
+		r.RPC.CookieFile = cfg.RPCCookie
+		if err = r.RPC.LoadCookie(); err != nil {
+			return nil, fmt.Errorf("reading cookie: %v", err)
+		}
+	}
+
+	dbOptions := badger.DefaultOptions
+	dbOptions.Dir = filepath.Join(cfg.DataDir, "index")
+	dbOptions.ValueDir = filepath.Join(dbOptions.Dir, db.DefaultValueDir)
+	if err = os.MkdirAll(dbOptions.ValueDir, 0700); err != nil {
+		return nil, err
+	}
+	cfg.DB.apply(&dbOptions)
+	if r.DB, err = kv.OpenBadger(dbOptions); err != nil {
+		return nil, fmt.Errorf("opening db: %v", err)
+	}
+	// the archive is opened first as a migration may read blocks from it
+	if cfg.Archive {
+		if r.Archive, err = OpenArchive(filepath.Join(cfg.DataDir, "blocks")); err != nil {
+			r.DB.Close()
+			return nil, fmt.Errorf("opening archive: %v", err)
+		}
+	}
+	if !cfg.IgnoreSchema {
+		if err = r.Migrate(); err != nil {
+			if r.Archive != nil {
+				r.Archive.Close()
+			}
+			r.DB.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// apply sets the options that are not zero on a set of badger options
+func (c DBConfig) apply(o *badger.Options) {
+	if c.MaxTableSize > 0 {
+		o.MaxTableSize = c.MaxTableSize
+	}
+	if c.ValueLogFileSize > 0 {
+		o.ValueLogFileSize = c.ValueLogFileSize
+	}
+	if c.ValueThreshold > 0 {
+		o.ValueThreshold = c.ValueThreshold
+	}
+	if c.NumMemtables > 0 {
+		o.NumMemtables = c.NumMemtables
+	}
+	if c.NumCompactors > 0 {
+		o.NumCompactors = c.NumCompactors
+	}
+	if c.NoSyncWrites {
+		o.SyncWrites = false
+	}
+	if c.LowMemory {
+		o.TableLoadingMode = options.MemoryMap
+	}
+}
@@ -1,84 +1,222 @@
 package sync
 
-import "github.com/parallelcointeam/duo/pkg/core"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
 
-// DecodeKV decodes the record types used in the sync indices
+// ErrRecord is returned when a record read from the index is not in the form its type is written in
+var ErrRecord = errors.New("malformed index record")
+
+// DecodeKV decodes a record read from the index, returning its prefix and the record, or nil if it is not a valid record
 func DecodeKV(k, v []byte) interface{} {
-	switch k[0] {
-	case 1:
-		// height to hash and disk location
-		hB := k[1:]
-		hL := len(hB)
-		padL := 4 - hL
-		hB = append(hB, make([]byte, padL)...)
-		var height uint32
-		core.BytesToInt(&height, &hB)
-
-		h := append(make([]byte, 32-len(v)), v...)
-
-		return []interface{}{
-			k[0],
-			&Block{
-				Height: height,
-				Hash:   h,
-			},
+	rec, err := DecodeRecord(k, v)
+	if err != nil {
+		return nil
+	}
+	return []interface{}{k[0], rec}
+}
+
+// DecodeRecord decodes a record read from the index using the decoder registered for its prefix
+func DecodeRecord(k, v []byte) (interface{}, error) {
+	if len(k) == 0 {
+		return nil, ErrRecord
+	}
+	t, ok := records[k[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown record prefix %d", k[0])
+	}
+	rec, err := t.decode(k, v)
+	if err != nil {
+		return nil, fmt.Errorf("%s record: %v", t.name, err)
+	}
+	return rec, nil
+}
+
+// uvarint reads a varint from the start of the input
+func uvarint(in []byte) (x uint64, rest []byte, err error) {
+	x, n := binary.Uvarint(in)
+	if n <= 0 {
+		return 0, nil, ErrRecord
+	}
+	return x, in[n:], nil
+}
+
+// decodeHeightKey reads the height from the key of a record keyed by height
+func decodeHeightKey(k []byte) (uint32, error) {
+	h, rest, err := uvarint(k[1:])
+	if err != nil || len(rest) > 0 || h > uint64(^uint32(0)) {
+		return 0, ErrRecord
+	}
+	return uint32(h), nil
+}
+
+// decodeHHashKey checks the key of a record keyed by a 64 bit HighwayHash and returns the hash
+func decodeHHashKey(k []byte) ([]byte, error) {
+	if len(k) != 9 {
+		return nil, ErrRecord
+	}
+	return k[1:], nil
+}
+
+func decodeBlock(k, v []byte) (interface{}, error) {
+	height, err := decodeHeightKey(k)
+	if err != nil || len(v) > 32 {
+		return nil, ErrRecord
+	}
+	// the leading zeroes are restored to give the full hash
+	return Block{Height: height, Hash: append(make([]byte, 32-len(v)), v...)}, nil
+}
+
+func decodeHash(k, v []byte) (interface{}, error) {
+	hhash, err := decodeHHashKey(k)
+	if err != nil {
+		return nil, err
+	}
+	height, rest, err := uvarint(v)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrRecord
+	}
+	return Hash{HHash: hhash, Height: uint32(height)}, nil
+}
+
+func decodeAddress(k, v []byte) (interface{}, error) {
+	hhash, err := decodeHHashKey(k)
+	if err != nil {
+		return nil, err
+	}
+	locs, err := decodeAddressRecord(v)
+	if err != nil {
+		return nil, err
+	}
+	return Address{HHash: hhash, Locations: locs}, nil
+}
+
+func decodeBalanceCache(k, v []byte) (interface{}, error) {
+	hhash, err := decodeHHashKey(k)
+	if err != nil {
+		return nil, err
+	}
+	balance, v, err := uvarint(v)
+	if err != nil {
+		return nil, err
+	}
+	height, _, err := uvarint(v)
+	if err != nil {
+		return nil, err
+	}
+	return BalanceCache{HHash: hhash, Balance: balance, Height: uint32(height)}, nil
+}
+
+func decodeTx(k, v []byte) (interface{}, error) {
+	hhash, err := decodeHHashKey(k)
+	if err != nil {
+		return nil, err
+	}
+	height, v, err := uvarint(v)
+	if err != nil {
+		return nil, err
+	}
+	txnum, _, err := uvarint(v)
+	if err != nil {
+		return nil, err
+	}
+	return Tx{HHash: hhash, Location: Location{Height: uint32(height), TxNum: uint16(txnum)}}, nil
+}
+
+func decodeUndo(k, v []byte) (interface{}, error) {
+	undo, err := decodeUndoValue(k, v, true)
+	if err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// decodeUndoValue decodes an undo record, which only holds the search prefix entries of its block if search is set, as undo records written before schema version 5 do not
+func decodeUndoValue(k, v []byte, search bool) (undo Undo, err error) {
+	if undo.Height, err = decodeHeightKey(k); err != nil {
+		return
+	}
+	txCount, v, err := uvarint(v)
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < txCount; i++ {
+		if len(v) < 8 {
+			return undo, ErrRecord
 		}
-	case 2:
-		// hash reverse lookup
-		// key is 8 bytes of HHash64
-		hhash := k[1:]
-
-		// The value only stores the non-zero trailing bytes
-		hL := len(v)
-		hPad := 4 - hL
-		var height uint32
-		hB := append(k[1:], make([]byte, hPad)...)
-		core.BytesToInt(&height, &hB)
-		return []interface{}{
-			k[0],
-			&Hash{
-				HHash:  hhash,
-				Height: height,
-			},
+		undo.Txs = append(undo.Txs, append([]byte{}, v[:8]...))
+		v = v[8:]
+	}
+	if search {
+		var count uint64
+		if count, v, err = uvarint(v); err != nil {
+			return
 		}
-	case 4:
-		// address record
-		var addr Address
-		addr.HHash = k[1:]
-		numRefs := len(v) / 6
-		for i := 0; i < numRefs; i++ {
-			h := v[6*i : 6*i+4]
-			t := v[6*i+4 : 6*i+4+2]
-			var height uint32
-			var txnum uint16
-			core.BytesToInt(&height, &h)
-			core.BytesToInt(&txnum, &t)
-			addr.Locations = append(addr.Locations,
-				Location{
-					Height: height,
-					TxNum:  txnum,
-				})
+		for i := uint64(0); i < count; i++ {
+			if len(v) < 2 {
+				return undo, ErrRecord
+			}
+			e := SearchEntry{Kind: v[0], Zeros: v[1]}
+			var chars uint64
+			if chars, v, err = uvarint(v[2:]); err != nil {
+				return
+			}
+			if chars > SearchChars || uint64(len(v)) < chars+8 {
+				return undo, ErrRecord
+			}
+			e.Chars, e.HHash, v = string(v[:chars]), append([]byte{}, v[chars:chars+8]...), v[chars+8:]
+			undo.Search = append(undo.Search, e)
 		}
-		return []interface{}{
-			k[0],
-			addr,
+	}
+	for len(v) > 0 {
+		if len(v) < 8 {
+			return undo, ErrRecord
 		}
-	case 8:
-		// cached balance query results
-		var bal BalanceCache
-		bal.HHash = k[:1]
-
-		bL := v[0]
-		b := v[1 : bL+1]
-		balance := append(b, make([]byte, 8-bL)...)
-		h := v[bL+1:]
-		height := append(h, make([]byte, 4-len(h))...)
-		core.BytesToInt(&bal.Balance, &balance)
-		core.BytesToInt(&bal.Height, &height)
-		return []interface{}{
-			k[0],
-			bal,
+		entry := UndoEntry{HHash: append([]byte{}, v[:8]...)}
+		var count uint64
+		if count, v, err = uvarint(v[8:]); err != nil {
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			var ref uint64
+			if ref, v, err = uvarint(v); err != nil {
+				return
+			}
+			entry.Locations = append(entry.Locations, refLocation(undo.Height, ref))
+		}
+		undo.Entries = append(undo.Entries, entry)
+	}
+	return
+}
+
+func decodeStats(k, v []byte) (interface{}, error) {
+	var stats Stats
+	var err error
+	if stats.Height, err = decodeHeightKey(k); err != nil {
+		return nil, err
+	}
+	var fields [6]uint64
+	for i := range fields {
+		if fields[i], v, err = uvarint(v); err != nil {
+			return nil, err
 		}
 	}
-	return nil
+	if len(v) != 12 {
+		return nil, ErrRecord
+	}
+	stats.Time, stats.Algo, stats.Txs, stats.Size = int64(fields[0]), uint32(fields[1]), uint32(fields[2]), uint32(fields[3])
+	stats.Value, stats.Fees = fields[4], fields[5]
+	stats.Bits = binary.BigEndian.Uint32(v)
+	stats.Difficulty = math.Float64frombits(binary.LittleEndian.Uint64(v[4:]))
+	return stats, nil
+}
+
+func decodeSearchEntry(k, v []byte) (interface{}, error) {
+	if len(k) < 11 || len(k) > 11+SearchChars || len(v) != 0 {
+		return nil, ErrRecord
+	}
+	return SearchEntry{Kind: k[1], Zeros: k[2], Chars: string(k[3 : len(k)-8]), HHash: append([]byte{}, k[len(k)-8:]...)}, nil
 }
@@ -2,60 +2,105 @@ package sync
 
 import (
 	"encoding/binary"
+	"math"
+
+	"github.com/parallelcointeam/duo/pkg/core"
 )
 
-// EncodeKV decodes the record types used in the sync indices
+// EncodeKV encodes a record into its key and value in the index, using the encoder registered for its type. It returns nil for a value that is not a record type.
 func EncodeKV(in interface{}) (k, v []byte) {
-	switch in.(type) {
-	case Block:
-		I := in.(Block)
-		// 1 identifies a block record, trailing zeroes are removed from height value
-		k = make([]byte, 5)
-		l := binary.PutUvarint(k, uint64(I.Height))
-		k = k[:l]
-		k = append([]byte{1}, k...)
-
-		// The full 32 byte block hash next has its 'difficulty' zero prefix bytes removed
-		v = removeLeadingZeroes(I.Hash)
-
-	case Hash:
-		I := in.(Hash)
-
-		// 2 identifies a hash to height index record. HHash is the 64 bit HighwayHash of the block hash, used as the search key
-		k = append([]byte{2}, I.HHash...)
-
-		// Height is stored with trailing zeroes omitted as in the Block record
-		v = make([]byte, 5)
-		l := binary.PutUvarint(v, uint64(I.Height))
-		v = v[:l]
-
-	case Address:
-		I := in.(Address)
-
-		// We also use the Highway Hash 64 to save space for the 20 byte address field. Prefix is 4 for no particular reason.
-		k = append([]byte{4}, I.HHash...)
-
-		for i := range I.Locations {
-			height := make([]byte, 5)
-			txnum := make([]byte, 3)
-			l := binary.PutUvarint(height, uint64(I.Locations[i].Height))
-			height = height[:l]
-			l = binary.PutUvarint(txnum, uint64(I.Locations[i].TxNum))
-			txnum = txnum[:l]
-			v = append(append(v, height...), txnum...)
+	prefix, ok := recordPrefix(in)
+	if !ok {
+		return
+	}
+	return records[prefix].encode(in)
+}
+
+// heightKey returns the key of a record keyed by height, which is stored as a varint so trailing zeroes are not stored
+func heightKey(prefix byte, height uint32) []byte {
+	k := make([]byte, 5)
+	l := binary.PutUvarint(k, uint64(height))
+	return append([]byte{prefix}, k[:l]...)
+}
+
+func encodeBlock(in interface{}) (k, v []byte) {
+	I := in.(Block)
+	// The full 32 byte block hash has its 'difficulty' zero prefix bytes removed
+	return heightKey(PrefixBlock, I.Height), removeLeadingZeroes(I.Hash)
+}
+
+func encodeHash(in interface{}) (k, v []byte) {
+	I := in.(Hash)
+	// HHash is the 64 bit HighwayHash of the block hash, used as the search key. Height is a varint as in the Block record
+	return append([]byte{PrefixHash}, I.HHash...), AppendVarint(nil, I.Height)
+}
+
+func encodeAddress(in interface{}) (k, v []byte) {
+	I := in.(Address)
+	// We also use the Highway Hash 64 to save space for the 20 byte address field
+	return append([]byte{PrefixAddress}, I.HHash...), encodeLocations(I.Locations)
+}
+
+func encodeBalanceCache(in interface{}) (k, v []byte) {
+	I := in.(BalanceCache)
+	v = AppendVarint(nil, I.Balance)
+	v = AppendVarint(v, I.Height)
+	return append([]byte{PrefixBalanceCache}, I.HHash...), v
+}
+
+func encodeTx(in interface{}) (k, v []byte) {
+	I := in.(Tx)
+	// keyed by the HighwayHash of the transaction id
+	v = AppendVarint(nil, I.Location.Height)
+	v = AppendVarint(v, I.Location.TxNum)
+	return append([]byte{PrefixTx}, I.HHash...), v
+}
+
+func encodeUndo(in interface{}) (k, v []byte) {
+	I := in.(Undo)
+	// keyed by height the same way as the Block record
+	k = heightKey(PrefixUndo, I.Height)
+	v = AppendVarint(v, uint64(len(I.Txs)))
+	for i := range I.Txs {
+		v = append(v, I.Txs[i]...)
+	}
+	v = AppendVarint(v, uint64(len(I.Search)))
+	for _, e := range I.Search {
+		v = AppendVarint(append(v, e.Kind, e.Zeros), uint64(len(e.Chars)))
+		v = append(append(v, e.Chars...), e.HHash...)
+	}
+	for i := range I.Entries {
+		v = append(v, I.Entries[i].HHash...)
+		v = AppendVarint(v, uint64(len(I.Entries[i].Locations)))
+		for j := range I.Entries[i].Locations {
+			v = AppendVarint(v, I.Entries[i].Locations[j].ref())
 		}
-	case BalanceCache:
-		I := in.(BalanceCache)
-
-		k = append([]byte{8}, I.HHash...)
-
-		b := make([]byte, 9)
-		l := binary.PutUvarint(b, I.Balance)
-		b = b[:l]
-		h := make([]byte, 5)
-		l = binary.PutUvarint(h, uint64(I.Height))
-		h = h[:l]
-		v = append(b, h...)
 	}
 	return
 }
+
+func encodeStats(in interface{}) (k, v []byte) {
+	I := in.(Stats)
+	// keyed by height the same way as the Block record
+	k = heightKey(PrefixStats, I.Height)
+	v = AppendVarint(nil, uint64(I.Time))
+	for _, x := range []uint64{uint64(I.Algo), uint64(I.Txs), uint64(I.Size), I.Value, I.Fees} {
+		v = AppendVarint(v, x)
+	}
+	v = append(v, make([]byte, 12)...)
+	binary.BigEndian.PutUint32(v[len(v)-12:], I.Bits)
+	binary.LittleEndian.PutUint64(v[len(v)-8:], math.Float64bits(I.Difficulty))
+	return
+}
+
+func encodeSearchEntry(in interface{}) (k, v []byte) {
+	I := in.(SearchEntry)
+	// the key is the whole record
+	k = append([]byte{PrefixSearch, I.Kind, I.Zeros}, I.Chars...)
+	return append(k, I.HHash...), []byte{}
+}
+
+// latestValue encodes the value of the latest record, the 4 byte little endian height of the latest indexed block followed by its hash
+func latestValue(height uint32, hash []byte) []byte {
+	return append(*core.IntToBytes(height), hash...)
+}
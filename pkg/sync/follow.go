@@ -0,0 +1,245 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	gosync "sync"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const (
+	// EventBlock is published for each newly indexed block
+	EventBlock = "block"
+	// EventReorg is published when the index is rolled back to a fork point
+	EventReorg = "reorg"
+	// EventAddress is published for each address that appears in a newly indexed block
+	EventAddress = "address"
+
+	// EventsPath is the path of the server's event stream
+	EventsPath = "/events"
+	// DefaultEventBuffer is the number of events buffered for each subscriber
+	DefaultEventBuffer = 1024
+)
+
+// Event is a change to the index. Height and Hash are the block the event refers to, for a reorg they are the fork point the index was rolled back to.
+type Event struct {
+	Type    string `json:"type"`
+	Height  uint32 `json:"height"`
+	Hash    string `json:"hash,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// hub fans events out to subscribers
+type hub struct {
+	gosync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel that receives every event published after the call, and a function that cancels the subscription and closes the channel.
+//
+// Events are never allowed to hold up indexing, so a subscriber that falls more than DefaultEventBuffer events behind misses events.
+func (r *Node) Subscribe() (events <-chan Event, cancel func()) {
+	r.events.Lock()
+	defer r.events.Unlock()
+	if r.events.subs == nil {
+		r.events.subs = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, DefaultEventBuffer)
+	r.events.subs[ch] = struct{}{}
+	var once gosync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.events.Lock()
+			defer r.events.Unlock()
+			delete(r.events.subs, ch)
+			close(ch)
+		})
+	}
+}
+
+// publish sends an event to all subscribers without blocking
+func (r *Node) publish(e Event) {
+	r.events.Lock()
+	defer r.events.Unlock()
+	for ch := range r.events.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishBatch publishes the events for a committed batch of blocks
+func (r *Node) publishBatch(b *batch) {
+	for _, f := range b.blocks {
+		hash := hex.EncodeToString(f.hash)
+		r.publish(Event{Type: EventBlock, Height: f.height, Hash: hash})
+		for _, addr := range f.touched {
+			r.publish(Event{Type: EventAddress, Height: f.height, Hash: hash, Address: addr})
+		}
+	}
+}
+
+// Behind returns true if the full node's best block is not the latest indexed block. When syncing from a peer it always returns true, as the peer is only asked for new blocks by syncing, which costs one round trip when there are none.
+func (r *Node) Behind() (bool, error) {
+	if r.Peer != "" {
+		return true, nil
+	}
+	best, err := r.RPC.GetBestBlockHash()
+	if err != nil {
+		return false, fmt.Errorf("getbestblockhash: %v", err)
+	}
+	latest, found, err := r.getLatest()
+	if err != nil || !found {
+		return !found, err
+	}
+	hash, err := r.GetBlockHash(latest)
+	return best != hex.EncodeToString(hash), err
+}
+
+// Follow keeps the index up to date with the full node until stop is closed. It checks for a new best block every interval, and immediately whenever something is received on notify, which may be nil. If the check fails and there are several RPC endpoints, the healthiest is chosen for the next one.
+func (r *Node) Follow(interval time.Duration, notify <-chan struct{}, stop <-chan struct{}) *Node {
+	for {
+		behind, err := r.Behind()
+		if err != nil {
+			fmt.Println("checking best block", err)
+			if len(r.RPC.Endpoints) > 0 {
+				// move to whichever node is up and furthest ahead
+				if _, err = r.RPC.CheckHealth(context.Background()); err != nil {
+					fmt.Println("checking RPC endpoints", err)
+				}
+			}
+		} else if behind {
+			r.UnsetStatus()
+			if !r.Sync().OK() {
+				fmt.Println("following", r.Error())
+			}
+		}
+		select {
+		case <-stop:
+			return r
+		case <-notify:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ListenNotify listens on a Unix socket for block notifications, such as from the full node's blocknotify option running
+//
+//	echo %s | nc -U /path/to/socket
+//
+// Any connection to the socket sends a signal on the returned channel, which can be passed to Follow. The socket is removed when stop is closed.
+func ListenNotify(path string, stop <-chan struct{}) (notify <-chan struct{}, err error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-stop
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}()
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// ListenRPC subscribes to the full node's block notifications, over its websocket endpoint or by polling it if it has none, and sends a signal on the returned channel for each one, which can be passed to Follow. If the subscription cannot be made or ends it is made again after retry. It stops when stop is closed.
+func ListenRPC(c *rpc.Client, retry time.Duration, stop <-chan struct{}) (notify <-chan struct{}) {
+	ch := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		for {
+			if err := forwardBlocks(ctx, c, ch); err != nil {
+				fmt.Println("block notifications", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+		}
+	}()
+	return ch
+}
+
+// forwardBlocks sends a signal on a channel for each block notification from the full node, until the subscription ends
+func forwardBlocks(ctx context.Context, c *rpc.Client, ch chan<- struct{}) error {
+	sub, err := c.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if err = sub.NotifyBlocks(ctx); err != nil {
+		return err
+	}
+	for range sub.Notifications {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return sub.Err()
+}
+
+// serveEvents streams events to an HTTP client as newline delimited JSON until the client goes away. An address query parameter restricts address events to that address.
+func (s *Server) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	addr := req.URL.Query().Get("address")
+	events, cancel := s.Node.Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e := <-events:
+			if addr != "" && e.Type == EventAddress && e.Address != addr {
+				continue
+			}
+			buf.Reset()
+			enc.Encode(e)
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+func TestEvents(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	events, cancel := r.Subscribe()
+
+	b := newBatch()
+	b.add(&fetched{height: 0, hash: testHash(0), txs: []*rpc.RawTransaction{testTx(testAddrs[0], testAddrs[1], testAddrs[0])}})
+	if err := r.commit(b, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	r.publishBatch(b)
+	r.Rollback(0)
+	indexTestBlock(t, r, 1, map[string][]uint16{"aaaaaaaa": {0}})
+	r.Rollback(0)
+
+	var got []Event
+	for len(got) < 4 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			t.Fatal("missing events, got", got)
+		}
+	}
+	if got[0].Type != EventBlock || got[0].Height != 0 ||
+		got[1].Type != EventAddress || got[1].Address != testAddrs[0] ||
+		got[2].Type != EventAddress || got[2].Address != testAddrs[1] ||
+		got[3].Type != EventReorg || got[3].Height != 0 {
+		t.Error("unexpected events", got)
+	}
+	cancel()
+	cancel()
+	if _, open := <-events; open {
+		t.Error("events channel not closed by cancel")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	srv := testServer(r)
+	defer srv.Close()
+
+	res := testRequest(t, "GET", srv.URL+EventsPath+"?address="+testAddrs[1], "", nil)
+	defer res.Body.Close()
+	// wait for the stream to subscribe before publishing
+	for i := 0; ; i++ {
+		r.events.Lock()
+		n := len(r.events.subs)
+		r.events.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("event stream did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.publish(Event{Type: EventAddress, Height: 5, Address: testAddrs[0]})
+	r.publish(Event{Type: EventAddress, Height: 5, Address: testAddrs[1]})
+	r.publish(Event{Type: EventBlock, Height: 5})
+
+	lines := bufio.NewScanner(res.Body)
+	var got []Event
+	for len(got) < 2 && lines.Scan() {
+		var e Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 || got[0].Address != testAddrs[1] || got[1].Type != EventBlock {
+		t.Error("unexpected event stream", got)
+	}
+}
+
+func TestListenNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stop := make(chan struct{})
+	defer close(stop)
+	path := filepath.Join(dir, "notify.sock")
+	notify, err := ListenNotify(path, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("000000000001bbf8ce581d88fabcc9d3b0dc130eb6d5e4b329c48e6d68d1edcf\n"))
+	conn.Close()
+	select {
+	case <-notify:
+	case <-time.After(time.Second):
+		t.Error("no notification received")
+	}
+}
+
+func TestListenRPC(t *testing.T) {
+	raws := testPeerChain(t)
+	n := rpctest.NewNode(Mainnet, raws[:2])
+	defer n.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	notify := ListenRPC(n.Client(), 10*time.Millisecond, stop)
+	for n.Received("notifyblocks") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	n.SetChain(raws)
+	select {
+	case <-notify:
+	case <-time.After(5 * time.Second):
+		t.Error("no notification received")
+	}
+
+	// the subscription is made again when the node goes away and comes back
+	n.SetWebsocket(false)
+	n.SetWebsocket(true)
+	for n.Received("notifyblocks") < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	n.Reorg(1, testBranch(t, raws[1], testAddrs[1]))
+	select {
+	case <-notify:
+	case <-time.After(5 * time.Second):
+		t.Error("no notification received after resubscribing")
+	}
+}
@@ -0,0 +1,303 @@
+package sync
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const (
+	// DefaultPeerWindow is the number of blocks asked for at once when downloading from a peer
+	DefaultPeerWindow = 16
+	// MaxPeerReorgDepth is the most indexed blocks a peer's branch may replace. A deeper reorganisation is refused, as it is far more likely to be an attack than a real one, and has to be indexed from a trusted full node.
+	MaxPeerReorgDepth = 100
+)
+
+// SyncPeer updates the index from a full node over the peer to peer wire protocol instead of its RPC server, so the node needs no RPC access. The address is a host with an optional port, which defaults to the network's, 11047 on mainnet.
+//
+// Headers are asked for after the latest indexed blocks, up to p2p.MaxHeaders at a time. Each header must be mined to its bits, and its bits must be no easier than those of the genesis block, which is the easiest target the network allows. The chain must start from the network's genesis block, and if the headers branch off below the latest block the index is only rolled back to where they branch off if that is no more than MaxPeerReorgDepth blocks down and the headers have more work than the blocks they replace. The bits are not checked against the network's difficulty retargets, so the peer must still be trusted not to serve a chain of its own mined at the easiest target, which would be indexed on a fresh sync or on top of the latest block, and which the depth limit would then keep in the index. The blocks are then downloaded DefaultPeerWindow at a time, decoded locally and indexed the same way Sync indexes them. The outputs their inputs spend are found through the transaction index, in the archive if it has their block and otherwise by downloading it again.
+func (r *Node) SyncPeer(addr string) *Node {
+	network := r.Network
+	if network == "" {
+		network = Mainnet
+	}
+	peer, err := p2p.Dial(addr, network)
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+	defer peer.Close()
+	fmt.Println("\nsyncing from peer", addr, "at height", peer.Remote.StartHeight)
+	batchSize := r.BatchSize
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	src := &peerSource{r: r, peer: peer, recent: newRecentTxs(4 * batchSize)}
+	latest, found, err := r.getLatest()
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+	if found && r.Archive != nil {
+		if !r.SetStatusIf(r.fillArchive(latest, src.rawBlock)).OK() {
+			return r
+		}
+	}
+	for {
+		locator, err := r.locator()
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+		headers, err := peer.GetHeaders(locator)
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+		if len(headers) == 0 {
+			break
+		}
+		if !r.SetStatusIf(src.follow(headers)).OK() {
+			return r
+		}
+		if len(src.hashes) == 0 {
+			// the peer is behind the index on the same chain
+			break
+		}
+		end := src.start + uint32(len(src.hashes)) - 1
+		next, err := r.syncDecoded(src.start, end, src.fetch)
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+		if next > end && len(headers) < p2p.MaxHeaders {
+			break
+		}
+	}
+	fmt.Println("done")
+	return r
+}
+
+// locator returns the hashes of indexed blocks to ask a peer for the headers after, which are the latest ten blocks, then going back twice as far each time, and then the genesis block. With nothing indexed it only holds a zero hash, which no peer has, so the peer starts after its genesis block.
+func (r *Node) locator() (locator []p2p.Hash, err error) {
+	latest, found, err := r.getLatest()
+	if err != nil || !found {
+		return []p2p.Hash{{}}, err
+	}
+	add := func(height uint32) {
+		var hash []byte
+		if hash, err = r.GetBlockHash(height); hash != nil {
+			locator = append(locator, p2p.NewHash(hash))
+		}
+	}
+	for h, step := int64(latest), int64(1); h > 0 && err == nil; h -= step {
+		add(uint32(h))
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if err == nil {
+		add(0)
+	}
+	return
+}
+
+// peerSource is a block source that downloads blocks from a peer. It serves the blocks of the headers it follows, and must only be used by a single fetch worker.
+type peerSource struct {
+	r      *Node
+	peer   *p2p.Peer
+	recent *recentTxs
+	// hashes are the hashes of the blocks from height start on, and prev is the hash of the block below start
+	start  uint32
+	hashes []p2p.Hash
+	prev   []byte
+	// ahead holds the blocks downloaded ahead of the one being fetched, by height
+	ahead map[uint32][]byte
+}
+
+// follow sets the source to serve the blocks of a run of headers from the peer, which GetHeaders has checked link to each other, after checking the proof of work of each. If they do not build on the latest indexed block the index is rolled back to the block they do build on, as long as that is no deeper than MaxPeerReorgDepth and the headers have more work than the indexed blocks they replace.
+func (s *peerSource) follow(headers []p2p.Header) error {
+	parent := headers[0].Prev
+	s.hashes, s.ahead = s.hashes[:0], make(map[uint32][]byte)
+	limit, err := s.powLimit()
+	if err != nil {
+		return err
+	}
+	for i := range headers {
+		err := headers[i].CheckPowLimit(limit)
+		if err == nil {
+			err = headers[i].CheckProofOfWork()
+		}
+		if err != nil {
+			return fmt.Errorf("the peer's header for block %v: %v", headers[i].Hash(), err)
+		}
+	}
+	latest, found, err := s.r.getLatest()
+	if err != nil {
+		return err
+	}
+	if !found {
+		// the peer starts after its genesis block, which is downloaded as well
+		if genesis := s.r.genesis(); parent.String() != genesis {
+			return fmt.Errorf("the peer's chain starts from block %v, not the genesis block %s, wrong network?", parent, genesis)
+		}
+		s.start, s.prev, s.hashes = 0, nil, append(s.hashes, parent)
+	} else {
+		height, err := s.r.GetHeightFromHash(parent.Shown())
+		if err != nil {
+			return err
+		} else if height == ^uint32(0) {
+			return fmt.Errorf("the peer's headers build on block %v, which is not indexed", parent)
+		}
+		// the locator is sparse below the latest blocks, so the peer may start with blocks the index already has
+		for len(headers) > 0 {
+			hash := headers[0].Hash()
+			known, err := s.r.GetHeightFromHash(hash.Shown())
+			if err != nil {
+				return err
+			} else if known != height+1 {
+				break
+			}
+			height, parent, headers = known, hash, headers[1:]
+		}
+		if height < latest && len(headers) > 0 {
+			if latest-height > MaxPeerReorgDepth {
+				return fmt.Errorf("the peer's headers branch off at block %d, %d blocks below the latest, deeper than the %d a peer may roll back", height, latest-height, MaxPeerReorgDepth)
+			}
+			replaced, err := s.r.chainWork(height+1, latest)
+			if err != nil {
+				return err
+			}
+			work := new(big.Int)
+			for i := range headers {
+				work.Add(work, p2p.Work(headers[i].Bits))
+			}
+			if work.Cmp(replaced) <= 0 {
+				return fmt.Errorf("the peer's branch from block %d has no more work than the indexed blocks it would replace", height+1)
+			}
+			if !s.r.Rollback(height).OK() {
+				return errors.New(s.r.Error())
+			}
+		}
+		s.start, s.prev = height+1, parent.Shown()
+	}
+	for i := range headers {
+		s.hashes = append(s.hashes, headers[i].Hash())
+	}
+	return nil
+}
+
+// powLimit returns the bits of the genesis block, from its statistics record if it is indexed and otherwise from the peer, checked against the network's genesis hash
+func (s *peerSource) powLimit() (uint32, error) {
+	if stats, err := s.r.GetBlockStats(0, 0); err != nil {
+		return 0, err
+	} else if len(stats) == 1 {
+		return stats[0].Bits, nil
+	}
+	genesis := s.r.genesis()
+	hash, err := hex.DecodeString(genesis)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := s.rawBlock(hash)
+	if err != nil {
+		return 0, err
+	}
+	header, err := p2p.DecodeHeader(raw)
+	if err != nil {
+		return 0, err
+	} else if header.Hash().String() != genesis {
+		return 0, fmt.Errorf("the peer sent block %v for the genesis block %s", header.Hash(), genesis)
+	}
+	return header.Bits, nil
+}
+
+// genesis returns the hash of the genesis block the chain a peer serves must start from
+func (r *Node) genesis() string {
+	if r.Genesis != "" {
+		return r.Genesis
+	}
+	network := r.Network
+	if network == "" {
+		network = Mainnet
+	}
+	return GenesisHashes[network]
+}
+
+// chainWork returns the total work of the indexed blocks from one height to another inclusive, found from the bits in their statistics records
+func (r *Node) chainWork(from, to uint32) (*big.Int, error) {
+	stats, err := r.GetBlockStats(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) != int(to-from+1) {
+		return nil, fmt.Errorf("blocks %d to %d are missing statistics records to compare their work with", from, to)
+	}
+	work := new(big.Int)
+	for _, s := range stats {
+		work.Add(work, p2p.Work(s.Bits))
+	}
+	return work, nil
+}
+
+// fetch downloads the block at a height, unless it was downloaded ahead, checks that it builds on the block below it, and resolves the addresses its inputs spend
+func (s *peerSource) fetch(height uint32) (f *fetched) {
+	i := int(height - s.start)
+	if height < s.start || i >= len(s.hashes) {
+		return &fetched{height: height, err: fmt.Errorf("no header for block %d", height)}
+	}
+	raw, ok := s.ahead[height]
+	if !ok {
+		end := i + DefaultPeerWindow
+		if end > len(s.hashes) {
+			end = len(s.hashes)
+		}
+		blocks, err := s.peer.GetBlocks(s.hashes[i:end])
+		if err != nil {
+			return &fetched{height: height, err: err}
+		}
+		for j := range blocks {
+			s.ahead[height+uint32(j)] = blocks[j]
+		}
+		raw = blocks[0]
+	}
+	delete(s.ahead, height)
+	prev := s.prev
+	if i > 0 {
+		prev = s.hashes[i-1].Shown()
+	}
+	if f = s.r.decodeFetched(height, s.hashes[i].Shown(), prev, raw); f.err != nil {
+		return
+	}
+	if s.r.Archive != nil {
+		f.raw = raw
+	}
+	s.recent.remember(f.block.Tx, f.txs)
+	f.err = s.r.resolveSpends(f, s.load)
+	return
+}
+
+// load returns a transaction from a recently downloaded block, or from its block as found in the transaction index
+func (s *peerSource) load(txid string) (*rpc.RawTransaction, error) {
+	return s.r.loadTx(s.recent, txid, func(height uint32) ([]byte, error) {
+		if s.r.Archive != nil && height < s.r.Archive.Count() {
+			_, raw, err := s.r.Archive.Get(height)
+			return raw, err
+		}
+		hash, err := s.r.GetBlockHash(height)
+		if err != nil {
+			return nil, err
+		} else if hash == nil {
+			return nil, fmt.Errorf("block %d is not in the index", height)
+		}
+		return s.rawBlock(hash)
+	})
+}
+
+// rawBlock downloads the serialised block with a hash
+func (s *peerSource) rawBlock(hash []byte) ([]byte, error) {
+	blocks, err := s.peer.GetBlocks([]p2p.Hash{p2p.NewHash(hash)})
+	if err != nil {
+		return nil, err
+	}
+	return blocks[0], nil
+}
@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/p2p"
+	"github.com/parallelcointeam/duo/pkg/p2p/p2ptest"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+// testPeerChain serialises the test chain with each block mined and linked to the real hash of the block below it, as a peer serves it
+func testPeerChain(t *testing.T) (raws [][]byte) {
+	raws = testChain(t)
+	for h := range raws {
+		if h > 0 {
+			prev, _ := p2p.BlockHash(raws[h-1])
+			copy(raws[h][4:36], prev[:])
+		}
+		rpctest.Mine(raws[h])
+	}
+	return
+}
+
+// testGenesis returns the hash of the genesis block of a chain, for a node to accept the chain from a peer
+func testGenesis(raws [][]byte) string {
+	hash, _ := p2p.BlockHash(raws[0])
+	return hash.String()
+}
+
+// testBranch serialises blocks on top of a block, each with a coinbase paying an address and a nonce so its header differs from the test chain
+func testBranch(t *testing.T, parent []byte, to ...string) (raws [][]byte) {
+	for i, addr := range to {
+		prev, _ := p2p.BlockHash(parent)
+		b := block.Raw{
+			Version: 2, HashPrevBlock: prev.Shown(), Bits: make([]byte, 4), Nonce: uint32(i + 1),
+			Transactions: []block.Tx{{
+				Version: 1,
+				Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{2, 9, byte(i)}, Sequence: ^uint32(0)}},
+				Outs:    []block.TxOut{{Value: 5000000000, Script: testP2PKH(t, addr)}},
+			}},
+		}
+		b.HashMerkleRoot, _ = b.ComputeMerkleRoot()
+		raw, err := block.Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpctest.Mine(raw)
+		raws, parent = append(raws, raw), raw
+	}
+	return
+}
+
+func TestSyncPeer(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	raws := testPeerChain(t)
+	peer := p2ptest.NewPeer(Mainnet, raws)
+	defer peer.Close()
+	// the node has no RPC client, so everything has to come from the peer
+	r.Peer = peer.Addr
+	if r.Sync().OK() {
+		t.Fatal("chain accepted from another genesis block than the network's")
+	}
+	r.Genesis = testGenesis(raws)
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	hash, _ := p2p.BlockHash(raws[2])
+	if latest, _, _ := r.getLatest(); latest != 2 || !bytes.Equal(storedHash(r, 2), hash.Shown()) {
+		t.Fatal("peer chain not indexed", latest)
+	}
+	_, txids, _ := decodeRawBlock(raws[2])
+	addrs, locs := indexSnapshot(t, r, []string{txids[1]})
+	expected := [][]Location{
+		{{1, 0, false}, {2, 1, true}, {2, 1, false}},
+		{{2, 0, false}, {2, 1, false}},
+	}
+	if !reflect.DeepEqual(addrs, expected) || locs[0] != (Location{Height: 2, TxNum: 1}) {
+		t.Error("unexpected index", addrs, locs)
+	}
+
+	// a peer on a branch with no more work than the block it replaces, or with a header that is not mined
+	refused := func(branch [][]byte, why string) {
+		other := p2ptest.NewPeer(Mainnet, branch)
+		defer other.Close()
+		r.Peer = other.Addr
+		if r.Sync().OK() {
+			t.Error("synced from a peer on a branch", why)
+		}
+		if latest, _, _ := r.getLatest(); latest != 2 || hex.EncodeToString(storedHash(r, 2)) != hash.String() {
+			t.Error("index changed by a peer on a branch", why, latest)
+		}
+	}
+	refused(append(append([][]byte{}, raws[:2]...), testBranch(t, raws[1], testAddrs[1])...), "as long as the index")
+	unmined := append(append([][]byte{}, raws[:2]...), testBranch(t, raws[1], testAddrs[1], testAddrs[1])...)
+	header, _ := p2p.DecodeHeader(unmined[3])
+	for header.CheckProofOfWork() == nil {
+		header.Nonce++
+	}
+	copy(unmined[3], header.Encode())
+	refused(unmined, "with a header that is not mined")
+
+	// a peer on a longer branch replacing block 2
+	branch := append(append([][]byte{}, raws[:2]...), testBranch(t, raws[1], testAddrs[1], testAddrs[1])...)
+	other := p2ptest.NewPeer(Mainnet, branch)
+	defer other.Close()
+	r.Peer = other.Addr
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	hash, _ = p2p.BlockHash(branch[3])
+	if latest, _, _ := r.getLatest(); latest != 3 || !bytes.Equal(storedHash(r, 3), hash.Shown()) {
+		t.Fatal("branch not indexed", latest)
+	}
+	addrs, _ = indexSnapshot(t, r, nil)
+	if expected = [][]Location{{{1, 0, false}}, {{2, 0, false}, {3, 0, false}}}; !reflect.DeepEqual(addrs, expected) {
+		t.Error("unexpected index after the branch", addrs)
+	}
+	if _, err := r.GetTxLocation(txids[1]); err != ErrTxNotFound {
+		t.Error("transaction of the replaced block still indexed", err)
+	}
+
+	// nothing is downloaded when the index is up to date
+	requests := other.Received(p2p.CmdGetData)
+	if !r.Sync().OK() || other.Received(p2p.CmdGetData) != requests {
+		t.Error("blocks downloaded again", r.Error())
+	}
+}
+
+// TestSyncPeerReorgDepth checks that a peer cannot roll the index back by more than MaxPeerReorgDepth blocks, however much work its branch has
+func TestSyncPeerReorgDepth(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	raws := rpctest.Generate(nil, MaxPeerReorgDepth+2)
+	peer := p2ptest.NewPeer(Mainnet, raws)
+	defer peer.Close()
+	r.Peer, r.Genesis = peer.Addr, testGenesis(raws)
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	tip := storedHash(r, MaxPeerReorgDepth+1)
+
+	// a longer branch replacing every block but the genesis block
+	deep := append([][]byte{raws[0]}, rpctest.Generate(raws[0], MaxPeerReorgDepth+2)...)
+	other := p2ptest.NewPeer(Mainnet, deep)
+	defer other.Close()
+	r.Peer = other.Addr
+	if r.Sync().OK() {
+		t.Error("rolled back deeper than", MaxPeerReorgDepth)
+	}
+	if latest, _, _ := r.getLatest(); latest != MaxPeerReorgDepth+1 || !bytes.Equal(storedHash(r, latest), tip) {
+		t.Error("index changed by a branch too deep", latest)
+	}
+
+	// a longer branch replacing as many blocks as a peer may
+	shallow := append(append([][]byte{}, raws[:2]...), rpctest.Generate(raws[1], MaxPeerReorgDepth+1)...)
+	last := p2ptest.NewPeer(Mainnet, shallow)
+	defer last.Close()
+	r.Peer = last.Addr
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	hash, _ := p2p.BlockHash(shallow[len(shallow)-1])
+	if latest, _, _ := r.getLatest(); int(latest) != len(shallow)-1 || !bytes.Equal(storedHash(r, latest), hash.Shown()) {
+		t.Error("branch not indexed", latest)
+	}
+}
+
+// TestSyncPeerPowLimit checks that a peer's headers are refused if their bits are easier than those of the genesis block
+func TestSyncPeerPowLimit(t *testing.T) {
+	const bits = 0x2000ffff
+	mine := func(raw []byte) []byte {
+		h, _ := p2p.DecodeHeader(raw)
+		for h.Bits = bits; h.CheckProofOfWork() != nil; h.Nonce++ {
+		}
+		copy(raw, h.Encode())
+		return raw
+	}
+	hard := [][]byte{mine(rpctest.Generate(nil, 1)[0])}
+	easy := append([][]byte{hard[0]}, rpctest.Generate(hard[0], 2)...)
+	for len(hard) < 3 {
+		hard = append(hard, mine(rpctest.Generate(hard[len(hard)-1], 1)[0]))
+	}
+
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	r.Genesis = testGenesis(hard)
+	peer := p2ptest.NewPeer(Mainnet, easy)
+	defer peer.Close()
+	r.Peer = peer.Addr
+	if r.Sync().OK() {
+		t.Error("chain accepted with bits easier than the genesis block's")
+	}
+	if _, found, _ := r.getLatest(); found {
+		t.Error("blocks indexed from a chain with bits easier than the genesis block's")
+	}
+	other := p2ptest.NewPeer(Mainnet, hard)
+	defer other.Close()
+	r.Peer = other.Addr
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 2 {
+		t.Error("chain not indexed", latest)
+	}
+}
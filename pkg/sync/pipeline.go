@@ -0,0 +1,442 @@
+package sync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/anaskhan96/base58check"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const (
+	// DefaultWorkers is the number of concurrent RPC fetch workers used if Node.Workers is not set
+	DefaultWorkers = 8
+	// DefaultBatchSize is the number of blocks merged in memory and committed together if Node.BatchSize is not set
+	DefaultBatchSize = 64
+)
+
+// fetched is a block and its transactions as retrieved by a fetch worker
+type fetched struct {
+	height uint32
+	hash   []byte
+	block  rpc.GetBlock
+	// raw is the serialised block, fetched only when it is to be archived
+	raw []byte
+	txs []*rpc.RawTransaction
+	// spends holds the funding addresses of the inputs of each transaction
+	spends [][]string
+	// fees is the total fees paid by the block's transactions, found while resolving the spends
+	fees uint64
+	// touched is every address that appears in the block, set when it is added to a batch
+	touched []string
+	err     error
+}
+
+// fetcher retrieves the block at a height from a block source
+type fetcher func(height uint32) *fetched
+
+// fetchJob is a height to fetch and the channel the result is delivered on
+type fetchJob struct {
+	height uint32
+	out    chan *fetched
+}
+
+// batch is the in-memory merge of the index updates for a run of consecutive blocks, written in a single transaction
+type batch struct {
+	blocks   []*fetched
+	journals []*journal
+	// new locations per address HHash, in height order
+	addrs map[string][]Location
+	order []string
+}
+
+func newBatch() *batch {
+	return &batch{addrs: make(map[string][]Location)}
+}
+
+func (b *batch) tip() *fetched {
+	if len(b.blocks) == 0 {
+		return nil
+	}
+	return b.blocks[len(b.blocks)-1]
+}
+
+// add merges the address locations of a block into the batch and journals them. For each transaction the addresses it spends from are recorded before the addresses it pays, so locations stay in ascending order.
+func (b *batch) add(f *fetched) {
+	jnl := newJournal(f.height)
+	type touch struct {
+		hhash string
+		loc   Location
+	}
+	seen := make(map[touch]bool)
+	add := func(addr string, loc Location) {
+		hhash := addressHHash(addr)
+		if hhash == nil {
+			return
+		}
+		t := touch{string(hhash), loc}
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		if _, ok := jnl.index[t.hhash]; !ok {
+			f.touched = append(f.touched, addr)
+		}
+		locs, ok := b.addrs[t.hhash]
+		if !ok {
+			b.order = append(b.order, t.hhash)
+		}
+		b.addrs[t.hhash] = append(locs, loc)
+		jnl.add(hhash, loc)
+	}
+	for _, txid := range f.block.Tx {
+		if hhash := txHHash(txid); hhash != nil {
+			jnl.undo.Txs = append(jnl.undo.Txs, hhash)
+		}
+	}
+	for j, tx := range f.txs {
+		if tx == nil {
+			continue
+		}
+		if j < len(f.spends) {
+			for _, addr := range f.spends[j] {
+				add(addr, Location{Height: f.height, TxNum: uint16(j), Spend: true})
+			}
+		}
+		for k := range tx.Vout {
+			for _, addr := range tx.Vout[k].ScriptPubKey.Addresses {
+				add(addr, Location{Height: f.height, TxNum: uint16(j)})
+			}
+		}
+	}
+	// the search entries are journalled so undoing the block removes them
+	jnl.undo.Search = blockSearchEntries(f)
+	b.blocks = append(b.blocks, f)
+	b.journals = append(b.journals, jnl)
+}
+
+// addressHHash returns the HighwayHash 64 of the 160 bit hash in a base58check address, or nil if it is not a valid address
+func addressHHash(addr string) (hhash []byte) {
+	// the decoder panics on input too short to hold a checksum
+	defer func() {
+		if recover() != nil {
+			hhash = nil
+		}
+	}()
+	id, err := base58check.Decode(addr)
+	if err != nil || len(id) < 2 {
+		return nil
+	}
+	I, err := hex.DecodeString(id[2:])
+	if err != nil {
+		return nil
+	}
+	return *core.Hash64(&I)
+}
+
+// fetchBlock retrieves a block and all of its transactions from the full node, and resolves the addresses spent by the transaction inputs. If there is an archive the serialised block is fetched as well.
+func (r *Node) fetchBlock(height uint32) (f *fetched) {
+	f = &fetched{height: height}
+	if f.hash, f.err = r.LegacyGetBlockHash(height); f.err != nil {
+		return
+	}
+	hashS := hex.EncodeToString(f.hash)
+	block, err := r.RPC.GetBlock(hashS)
+	if f.err = err; err != nil {
+		return
+	}
+	f.block = *block
+	if r.Archive != nil {
+		if f.raw, f.err = r.rpcRawBlock(hashS); f.err != nil {
+			return
+		}
+	}
+	// the transactions are fetched in one batch
+	reqs := make([]rpc.Request, len(f.block.Tx))
+	for j := range f.block.Tx {
+		reqs[j] = rpc.Request{Method: "getrawtransaction", Params: []interface{}{f.block.Tx[j], 1}}
+	}
+	resps, err := r.RPC.CallBatch(reqs)
+	if f.err = err; err != nil {
+		return
+	}
+	f.txs = make([]*rpc.RawTransaction, len(f.block.Tx))
+	for j, resp := range resps {
+		if height == 0 && j == 0 {
+			// the node never has the genesis coinbase, which cannot be spent
+			continue
+		}
+		if resp.Err != nil {
+			f.err = fmt.Errorf("getrawtransaction %s: %v", f.block.Tx[j], resp.Err)
+			return
+		}
+		if len(resp.Result) == 0 || string(resp.Result) == "null" {
+			f.err = fmt.Errorf("getrawtransaction %s: no transaction", f.block.Tx[j])
+			return
+		}
+		tx := new(rpc.RawTransaction)
+		if err = json.Unmarshal(resp.Result, tx); err != nil {
+			f.err = fmt.Errorf("getrawtransaction %s: %v", f.block.Tx[j], err)
+			return
+		}
+		f.txs[j] = tx
+	}
+	f.err = r.resolveSpends(f, r.rpcTx)
+	return
+}
+
+// fetchRange starts the fetch workers for the heights from start to end inclusive. Results are delivered strictly in height order on the returned channel, with at most workers*batchsize blocks fetched ahead of the consumer. Closing quit stops the workers.
+func (r *Node) fetchRange(start, end uint32, fetch fetcher, workers int, quit chan struct{}) <-chan *fetched {
+	batchSize := r.BatchSize
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	r.initCaches()
+	jobs := make(chan fetchJob)
+	pending := make(chan chan *fetched, workers*batchSize)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for job := range jobs {
+				job.out <- fetch(job.height)
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for h := start; h <= end; h++ {
+			out := make(chan *fetched, 1)
+			select {
+			case pending <- out:
+			case <-quit:
+				return
+			}
+			select {
+			case jobs <- fetchJob{height: h, out: out}:
+			case <-quit:
+				return
+			}
+			if h == ^uint32(0) {
+				return
+			}
+		}
+	}()
+	results := make(chan *fetched)
+	go func() {
+		defer close(results)
+		for out := range pending {
+			var f *fetched
+			select {
+			case f = <-out:
+			case <-quit:
+				return
+			}
+			select {
+			case results <- f:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// commit writes a batch to the database. Existing address records are first pruned of anything above the latest committed height, so a batch that was partly written before a crash is simply written again.
+//
+// A batch is written in a single transaction unless it is too large for one, in which case it is split, and the latest record is always written in the last transaction.
+func (r *Node) commit(b *batch, latest uint32, haveLatest bool) (err error) {
+	if len(b.blocks) == 0 {
+		return
+	}
+	txn := r.DB.NewBatch()
+	defer txn.Discard()
+	set := txn.Put
+	first := b.blocks[0].height
+	for _, hhash := range b.order {
+		k := append([]byte{PrefixAddress}, hhash...)
+		var existing []Location
+		v, err := txn.Get(k)
+		if err == nil {
+			if existing, err = decodeAddressRecord(v); err != nil {
+				return fmt.Errorf("address record %x: %v", hhash, err)
+			}
+			if haveLatest {
+				existing = pruneLocations(existing, latest)
+			} else {
+				existing = nil
+			}
+		} else if err != kv.ErrNotFound {
+			return err
+		}
+		if err = set(k, encodeLocations(append(existing, b.addrs[hhash]...))); err != nil {
+			return err
+		}
+		// a cached balance at or above the new blocks is left over from an orphaned branch
+		kb := append([]byte{PrefixBalanceCache}, hhash...)
+		if v, err = txn.Get(kb); err == nil {
+			// a cache that cannot be read is dropped as well
+			rec, err := DecodeRecord(kb, v)
+			if err != nil || rec.(BalanceCache).Height >= first {
+				if err = txn.Delete(kb); err != nil {
+					return err
+				}
+			}
+		} else if err != kv.ErrNotFound {
+			return err
+		}
+	}
+	for i, f := range b.blocks {
+		k1, v1 := EncodeKV(Block{Height: f.height, Hash: f.hash})
+		k2, v2 := EncodeKV(Hash{HHash: *core.Hash64(&f.hash), Height: f.height})
+		k3, v3 := EncodeKV(b.journals[i].undo)
+		k4, v4 := EncodeKV(blockStats(f))
+		for _, kv := range [][2][]byte{{k1, v1}, {k2, v2}, {k3, v3}, {k4, v4}} {
+			if err = set(kv[0], kv[1]); err != nil {
+				return
+			}
+		}
+		for j, hhash := range b.journals[i].undo.Txs {
+			k, v := EncodeKV(Tx{HHash: hhash, Location: Location{Height: f.height, TxNum: uint16(j)}})
+			if err = set(k, v); err != nil {
+				return
+			}
+		}
+		for _, e := range b.journals[i].undo.Search {
+			k, v := EncodeKV(e)
+			if err = set(k, v); err != nil {
+				return
+			}
+		}
+	}
+	tip := b.tip()
+	if err = set(LatestKey, latestValue(tip.height, tip.hash)); err != nil {
+		return
+	}
+	return txn.Commit()
+}
+
+// archive stores the raw blocks of a batch in the archive, if there is one. Blocks that were not fetched in serialised form, such as those being reindexed from the archive itself, are skipped.
+func (r *Node) archive(b *batch) (err error) {
+	if r.Archive == nil {
+		return
+	}
+	archived := false
+	for _, f := range b.blocks {
+		if f.raw == nil {
+			continue
+		}
+		if err = r.Archive.Put(f.height, f.hash, f.raw); err != nil {
+			return fmt.Errorf("archiving block %d: %v", f.height, err)
+		}
+		archived = true
+	}
+	if archived {
+		err = r.Archive.Sync()
+	}
+	return
+}
+
+// progress prints a character for each block in the batch in the same style the serial indexer used
+func (b *batch) progress() {
+	for i, f := range b.blocks {
+		if f.height%288 == 0 {
+			fmt.Println()
+		}
+		if f.height%72 == 0 {
+			fmt.Printf("\n%7d ", f.height)
+			continue
+		}
+		switch n := len(b.journals[i].undo.Entries); {
+		case n == 0:
+			fmt.Print(".")
+		case n < 10:
+			fmt.Print("*")
+		default:
+			fmt.Print("+")
+		}
+	}
+}
+
+// syncRange runs the fetch pipeline from start to end and commits the blocks in batches in height order. It returns the height the caller should resume from, which is below end+1 if a reorg was found and rolled back.
+func (r *Node) syncRange(start, end uint32, fetch fetcher, workers int) (next uint32, err error) {
+	batchSize := r.BatchSize
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	latest, haveLatest, err := r.getLatest()
+	if err != nil {
+		return start, err
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	b := newBatch()
+	flush := func() error {
+		// the archive is written first so the index never refers to a block that is not archived
+		if err := r.archive(b); err != nil {
+			return err
+		}
+		if err := r.commit(b, latest, haveLatest); err != nil {
+			return err
+		}
+		if tip := b.tip(); tip != nil {
+			b.progress()
+			r.publishBatch(b)
+			latest, haveLatest = tip.height, true
+			r.Latest, r.LatestHash = tip.height, tip.hash
+		}
+		b = newBatch()
+		return nil
+	}
+	for f := range r.fetchRange(start, end, fetch, workers, quit) {
+		if f.err != nil {
+			if err = flush(); err == nil {
+				err = f.err
+			}
+			return f.height, err
+		}
+		// The block must build on the one before it, either in this batch or already committed
+		parentOK := false
+		if tip := b.tip(); tip != nil {
+			parentOK = hex.EncodeToString(tip.hash) == f.block.PreviousBlockHash
+		} else {
+			if parentOK, err = r.checkParent(f.height, f.block.PreviousBlockHash); err != nil {
+				return f.height, err
+			}
+		}
+		if !parentOK {
+			if err = flush(); err != nil {
+				return f.height, err
+			}
+			fork, err := r.FindForkPoint(f.height - 1)
+			if err != nil {
+				return f.height, err
+			}
+			if !r.Rollback(fork).OK() {
+				return f.height, errors.New(r.Error())
+			}
+			return fork + 1, nil
+		}
+		b.add(f)
+		if len(b.blocks) >= batchSize {
+			if err = flush(); err != nil {
+				return f.height, err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return latest, err
+	}
+	return end + 1, nil
+}
+
+// syncDecoded runs syncRange with a single worker, for fetchers that decode blocks locally and look up the outputs their inputs spend in the blocks decoded before them. With one worker the blocks are decoded in order, so the outputs of each block are known before any later block spends them.
+func (r *Node) syncDecoded(start, end uint32, fetch fetcher) (next uint32, err error) {
+	return r.syncRange(start, end, fetch, 1)
+}
@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+var testAddrs = []string{
+	"ajkviVcqSE518qMnqME8D9smwggWSyEogW",
+	"aQ9PozAHKSNLbRFiJ7V1CBjfLF36KWjKdG",
+}
+
+func testTx(addrs ...string) *rpc.RawTransaction {
+	tx := new(rpc.RawTransaction)
+	for i, a := range addrs {
+		tx.Vout = append(tx.Vout, rpc.Vout{N: i, ScriptPubKey: rpc.ScriptPubKey{Addresses: []string{a}}})
+	}
+	return tx
+}
+
+func TestBatchCommit(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	if addressHHash(testAddrs[0]) == nil || addressHHash(testAddrs[1]) == nil {
+		t.Fatal("test addresses do not decode")
+	}
+
+	b := newBatch()
+	b.add(&fetched{height: 0, hash: testHash(0), txs: []*rpc.RawTransaction{testTx(testAddrs[0])}})
+	b.add(&fetched{height: 1, hash: testHash(1), txs: []*rpc.RawTransaction{
+		testTx(testAddrs[0], testAddrs[0]), nil, testTx(testAddrs[1], testAddrs[0]),
+	}})
+	if err := r.commit(b, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	// committing the next batch on top of a partly written copy of itself must not duplicate locations
+	b2 := newBatch()
+	b2.add(&fetched{height: 2, hash: testHash(2), txs: []*rpc.RawTransaction{testTx(testAddrs[1])}})
+	if err := r.commit(b2, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.commit(b2, 1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if latest, _, _ := r.getLatest(); latest != 2 {
+		t.Error("expected latest 2, got", latest)
+	}
+	if bad, heights := r.Verify(); len(bad) != 0 || len(heights) != 0 {
+		t.Error("batched index inconsistent with journal", bad, heights)
+	}
+	undo, err := r.GetUndo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(undo.Entries) != 2 || len(undo.Entries[0].Locations) != 2 || undo.Entries[0].Locations[1].TxNum != 2 {
+		t.Error("unexpected journal for block 1", undo)
+	}
+	if locs := b2.addrs[string(addressHHash(testAddrs[1]))]; len(locs) != 1 || locs[0].Spend {
+		t.Error("expected a single credit, got", locs)
+	}
+	if !r.Rollback(0).OK() {
+		t.Fatal(r.Error())
+	}
+	if bad, heights := r.Verify(); len(bad) != 0 || len(heights) != 0 {
+		t.Error("index inconsistent after rollback", bad, heights)
+	}
+}
+
+func TestBatchSpends(t *testing.T) {
+	b := newBatch()
+	b.add(&fetched{
+		height: 7,
+		txs: []*rpc.RawTransaction{
+			testTx(testAddrs[0]),
+			testTx(testAddrs[1], testAddrs[0]),
+		},
+		spends: [][]string{nil, {testAddrs[0], testAddrs[0]}},
+	})
+	locs := b.addrs[string(addressHHash(testAddrs[0]))]
+	expected := []Location{{7, 0, false}, {7, 1, true}, {7, 1, false}}
+	if len(locs) != len(expected) {
+		t.Fatal("expected", expected, "got", locs)
+	}
+	for i := range expected {
+		if locs[i] != expected[i] {
+			t.Error("expected", expected[i], "got", locs[i])
+		}
+	}
+	record := encodeLocations(locs)
+	if decoded, _ := decodeAddressRecord(record); len(decoded) != 3 || !decoded[1].Spend || decoded[2].Spend {
+		t.Error("spend flag not preserved", decoded)
+	}
+}
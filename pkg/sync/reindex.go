@@ -0,0 +1,336 @@
+package sync
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	gosync "sync"
+
+	"github.com/anaskhan96/base58check"
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/hash160"
+	"github.com/parallelcointeam/duo/pkg/key"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+// ErrNoArchive is returned by Reindex when there is no archive or it is empty
+var ErrNoArchive = errors.New("no archived blocks to reindex from")
+
+// Reindex deletes the whole index and rebuilds it from the block archive, without any connection to the full node. Blocks are decoded locally, and the outputs spent by each input are found through the transaction index as it is rebuilt.
+func (r *Node) Reindex() *Node {
+	if r.Archive == nil || r.Archive.Count() == 0 {
+		r.SetStatusIf(ErrNoArchive)
+		return r
+	}
+	end := r.Archive.Count() - 1
+	fmt.Println("\nclearing the index")
+	if !r.SetStatusIf(r.clearIndex()).OK() {
+		return r
+	}
+	r.Latest, r.LatestHash = 0, nil
+	r.initCaches()
+	r.outputs = newOutputCache(DefaultOutputCacheSize)
+	r.txs = newTxCache(DefaultTxCacheSize)
+	batchSize := r.BatchSize
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	src := &archiveSource{r: r, recent: newRecentTxs(4 * batchSize)}
+	fmt.Println("reindexing", end+1, "archived blocks")
+	next, err := r.syncDecoded(0, end, src.fetch)
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+	if next <= end {
+		r.SetStatus(fmt.Sprintf("archive does not form a chain at height %d", next))
+		return r
+	}
+	fmt.Println("\ndone")
+	return r
+}
+
+// clearIndex deletes every record in the database and marks it as the current schema version
+func (r *Node) clearIndex() (err error) {
+	var keys [][]byte
+	err = r.DB.View(func(txn kv.Reader) error {
+		return txn.Keys(nil, nil, func(k []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+	if err = r.deleteKeys(keys); err != nil {
+		return
+	}
+	// the rebuilt index is in the current format whatever the old one was
+	return r.setSchemaVersion(SchemaVersion)
+}
+
+// fillArchive archives the blocks that were indexed before the archive was enabled, so that it covers the whole index. The serialised blocks are got by hash from the block source.
+func (r *Node) fillArchive(latest uint32, rawBlock func(hash []byte) ([]byte, error)) (err error) {
+	start := r.Archive.Count()
+	if start > latest {
+		return
+	}
+	fmt.Println("\narchiving", latest-start+1, "blocks that were indexed before the archive")
+	for h := start; h <= latest; h++ {
+		hash, err := r.GetBlockHash(h)
+		if err != nil {
+			return err
+		} else if hash == nil {
+			return fmt.Errorf("block %d is not in the index", h)
+		}
+		raw, err := rawBlock(hash)
+		if err != nil {
+			return err
+		}
+		if err = r.Archive.Put(h, hash, raw); err != nil {
+			return err
+		}
+	}
+	return r.Archive.Sync()
+}
+
+// recentTxs keeps the transactions of the blocks a block source has most recently read, because blocks are indexed in batches and a transaction cannot be found through the index until its batch is committed
+type recentTxs struct {
+	gosync.Mutex
+	txs     map[string]*rpc.RawTransaction
+	heights [][]string
+	window  int
+}
+
+func newRecentTxs(window int) *recentTxs {
+	return &recentTxs{txs: make(map[string]*rpc.RawTransaction), window: window}
+}
+
+// remember keeps the transactions of a block, forgetting those of the oldest block once the window is full
+func (c *recentTxs) remember(txids []string, txs []*rpc.RawTransaction) {
+	c.Lock()
+	defer c.Unlock()
+	for j := range txids {
+		if txs[j] != nil {
+			c.txs[txids[j]] = txs[j]
+		}
+	}
+	c.heights = append(c.heights, txids)
+	if len(c.heights) > c.window {
+		for _, txid := range c.heights[0] {
+			delete(c.txs, txid)
+		}
+		c.heights = c.heights[1:]
+	}
+}
+
+func (c *recentTxs) get(txid string) (tx *rpc.RawTransaction, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	tx, ok = c.txs[txid]
+	return
+}
+
+// decodeFetched decodes a serialised block read by a block source that has no full node to ask, given its hash and the hash of the block below it as the source has them. It checks that the block builds on that block and that its transactions are the ones its header commits to, and fills in the fields the full node would have returned, but does not resolve its spends.
+func (r *Node) decodeFetched(height uint32, hash, prev, raw []byte) (f *fetched) {
+	f = &fetched{height: height, hash: hash}
+	if height > 0 {
+		f.block.PreviousBlockHash = hex.EncodeToString(prev)
+	}
+	blk, txids, err := decodeRawBlock(raw)
+	if err != nil {
+		f.err = fmt.Errorf("block %d: %v", height, err)
+		return
+	}
+	if height > 0 && hex.EncodeToString(blk.HashPrevBlock) != f.block.PreviousBlockHash {
+		f.err = fmt.Errorf("block %d does not build on block %d", height, height-1)
+		return
+	}
+	f.block.Hash, f.block.Height, f.block.Tx = hex.EncodeToString(f.hash), height, txids
+	// the header fields the statistics record is made from, as the full node would report them
+	f.block.Time, f.block.Size, f.block.Bits = int64(blk.Time), uint32(len(raw)), hex.EncodeToString(blk.Bits)
+	f.block.PowAlgoID = versionAlgo(blk.Version)
+	f.block.PowAlgo = AlgoName(f.block.PowAlgoID)
+	if len(blk.Bits) == 4 {
+		f.block.Difficulty = bitsDifficulty(binary.BigEndian.Uint32(blk.Bits))
+	}
+	f.txs = make([]*rpc.RawTransaction, len(txids))
+	// the full node cannot return the genesis coinbase, so it is left out here as well to index exactly what an online sync would
+	for j := range blk.Transactions {
+		if height == 0 {
+			break
+		}
+		f.txs[j] = rawTransaction(txids[j], blk.Transactions[j], r.Network)
+	}
+	return
+}
+
+// loadTx returns a transaction from the recently read blocks, or from the serialised block the transaction index places it in, as read by rawAt
+func (r *Node) loadTx(recent *recentTxs, txid string, rawAt func(height uint32) ([]byte, error)) (*rpc.RawTransaction, error) {
+	if tx, ok := recent.get(txid); ok {
+		return tx, nil
+	}
+	loc, err := r.GetTxLocation(txid)
+	if err != nil {
+		return nil, fmt.Errorf("transaction %s: %v", txid, err)
+	}
+	raw, err := rawAt(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	blk, txids, err := decodeRawBlock(raw)
+	if err != nil {
+		return nil, err
+	}
+	if int(loc.TxNum) >= len(txids) || txids[loc.TxNum] != txid {
+		return nil, fmt.Errorf("transaction %s is not at block %d position %d", txid, loc.Height, loc.TxNum)
+	}
+	return rawTransaction(txid, blk.Transactions[loc.TxNum], r.Network), nil
+}
+
+// archiveSource is a block source that reads blocks from the archive
+type archiveSource struct {
+	r      *Node
+	recent *recentTxs
+}
+
+// fetch reads the block at a height from the archive, checks that it builds on the archived block below it, and resolves the addresses its inputs spend
+func (s *archiveSource) fetch(height uint32) (f *fetched) {
+	hash, raw, err := s.r.Archive.Get(height)
+	if err != nil {
+		return &fetched{height: height, err: err}
+	}
+	var prev []byte
+	if height > 0 {
+		if prev, err = s.r.Archive.Hash(height - 1); err != nil {
+			return &fetched{height: height, err: err}
+		}
+	}
+	if f = s.r.decodeFetched(height, hash, prev, raw); f.err != nil {
+		return
+	}
+	s.recent.remember(f.block.Tx, f.txs)
+	f.err = s.r.resolveSpends(f, s.load)
+	return
+}
+
+// load returns a transaction from a recently read block, or from its archived block as found in the transaction index
+func (s *archiveSource) load(txid string) (*rpc.RawTransaction, error) {
+	return s.r.loadTx(s.recent, txid, func(height uint32) (raw []byte, err error) {
+		_, raw, err = s.r.Archive.Get(height)
+		return
+	})
+}
+
+// decodeRawBlock decodes a serialised block, computes the ids of its transactions and checks them against the block's merkle root, so the transactions returned are the ones its header commits to
+func decodeRawBlock(raw []byte) (blk block.Raw, txids []string, err error) {
+	if blk, err = block.Decode(raw); err != nil {
+		return blk, nil, fmt.Errorf("decoding block: %v", err)
+	}
+	ids, err := blk.TxIDs()
+	if err != nil {
+		return blk, nil, err
+	}
+	if err = block.VerifyMerkleRoot(blk.HashMerkleRoot, ids); err != nil {
+		return blk, nil, err
+	}
+	txids = make([]string, len(ids))
+	for j := range ids {
+		txids[j] = hex.EncodeToString(ids[j])
+	}
+	return
+}
+
+// rawTransaction converts a decoded transaction into the form the full node returns from getrawtransaction, with the fields the indexer uses filled in
+func rawTransaction(txid string, tx block.Tx, network string) *rpc.RawTransaction {
+	out := &rpc.RawTransaction{Txid: txid, Version: tx.Version, LockTime: tx.Locktime}
+	for _, in := range tx.Ins {
+		vin := rpc.Vin{ScriptSig: rpc.ScriptSig{Hex: hex.EncodeToString(in.Script)}, Sequence: in.Sequence}
+		if isNullHash(in.PrevTxHash) {
+			vin.Coinbase = hex.EncodeToString(in.Script)
+		} else {
+			vin.Txid, vin.Vout = hex.EncodeToString(in.PrevTxHash), int(in.PrevTxoutIndex)
+		}
+		out.Vin = append(out.Vin, vin)
+	}
+	for n, o := range tx.Outs {
+		out.Vout = append(out.Vout, rpc.Vout{
+			Value: float64(o.Value) / core.COIN,
+			N:     n,
+			ScriptPubKey: rpc.ScriptPubKey{
+				Hex:       hex.EncodeToString(o.Script),
+				Addresses: scriptAddresses(o.Script, network),
+			},
+		})
+	}
+	return out
+}
+
+// isNullHash returns true for the all zero previous transaction hash of a coinbase input
+func isNullHash(h []byte) bool {
+	for _, b := range h {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scriptAddresses returns the addresses an output script pays to on a network, the same as the full node reports them: the address of the key or script hash of a pay to public key hash, pay to script hash or pay to public key script, and the address of each key of a bare multisig script
+func scriptAddresses(s []byte, network string) (addrs []string) {
+	prefixes, ok := key.B58prefixes[network]
+	if !ok {
+		prefixes = key.B58prefixes[Mainnet]
+	}
+	prefix := prefixes["pubkey"]
+	var hashes [][]byte
+	switch {
+	case len(s) == 25 && s[0] == 0x76 && s[1] == 0xa9 && s[2] == 0x14 && s[23] == 0x88 && s[24] == 0xac:
+		hashes = [][]byte{s[3:23]}
+	case len(s) == 23 && s[0] == 0xa9 && s[1] == 0x14 && s[22] == 0x87:
+		prefix, hashes = prefixes["script"], [][]byte{s[2:22]}
+	case (len(s) == 67 && s[0] == 0x41 || len(s) == 35 && s[0] == 0x21) && s[len(s)-1] == 0xac:
+		pub := s[1 : len(s)-1]
+		hashes = [][]byte{*hash160.Sum(&pub)}
+	default:
+		for _, pub := range multisigKeys(s) {
+			hashes = append(hashes, *hash160.Sum(&pub))
+		}
+	}
+	for _, h := range hashes {
+		addr, err := base58check.Encode(prefix, hex.EncodeToString(h))
+		if err != nil {
+			return nil
+		}
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// multisigKeys returns the public keys of a bare multisig script, m, the keys, n and OP_CHECKMULTISIG, where m and n are from 1 to 16, m is no more than n and there are n keys of 33 to 120 bytes, which is what the full node's script templates match. It returns nil for any other script.
+func multisigKeys(s []byte) (keys [][]byte) {
+	if len(s) < 3 || s[len(s)-1] != 0xae {
+		return nil
+	}
+	m, n := int(s[0])-0x50, int(s[len(s)-2])-0x50
+	if m < 1 || n < m || n > 16 {
+		return nil
+	}
+	for rest := s[1 : len(s)-2]; len(rest) > 0; {
+		size := int(rest[0])
+		if size == 0x4c && len(rest) > 1 {
+			// OP_PUSHDATA1, for keys longer than 75 bytes
+			size, rest = int(rest[1]), rest[1:]
+		}
+		if size < 33 || size > 120 || len(rest) < 1+size {
+			return nil
+		}
+		keys, rest = append(keys, rest[1:1+size]), rest[1+size:]
+	}
+	if len(keys) != n {
+		return nil
+	}
+	return
+}
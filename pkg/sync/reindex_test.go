@@ -0,0 +1,270 @@
+package sync
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/anaskhan96/base58check"
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/hash160"
+	"github.com/parallelcointeam/duo/pkg/key"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+// testP2PKH returns the pay to public key hash script for an address
+func testP2PKH(t *testing.T, addr string) []byte {
+	id, err := base58check.Decode(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := hex.DecodeString(id[2:])
+	return append(append([]byte{0x76, 0xa9, 0x14}, h...), 0x88, 0xac)
+}
+
+// testCoinbase returns a coinbase paying 50 coins to an address, with a tag in its input script so that coinbases paying the same address differ
+func testCoinbase(t *testing.T, tag byte, to string) block.Tx {
+	return block.Tx{
+		Version: 1,
+		Ins:     []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, tag}, Sequence: ^uint32(0)}},
+		Outs:    []block.TxOut{{Value: 5000000000, Script: testP2PKH(t, to)}},
+	}
+}
+
+// testChain serialises a chain of three blocks. Block 1 pays the first test address, and block 2 spends that to both addresses.
+func testChain(t *testing.T) (raws [][]byte) {
+	blocks := [][]block.Tx{
+		{testCoinbase(t, 0, testAddrs[0])},
+		{testCoinbase(t, 1, testAddrs[0])},
+		{testCoinbase(t, 2, testAddrs[1])},
+	}
+	raws = make([][]byte, len(blocks))
+	for h := range blocks {
+		if h == 2 {
+			prev, _ := blocks[1][0].TxID()
+			blocks[h] = append(blocks[h], block.Tx{
+				Version: 1,
+				Ins:     []block.TxIn{{PrevTxHash: prev, Script: []byte{0}, Sequence: ^uint32(0)}},
+				Outs: []block.TxOut{
+					{Value: 3000000000, Script: testP2PKH(t, testAddrs[1])},
+					{Value: 2000000000, Script: testP2PKH(t, testAddrs[0])},
+				},
+			})
+		}
+		prev := make([]byte, 32)
+		if h > 0 {
+			prev = testHash(uint32(h - 1))
+		}
+		b := block.Raw{Version: 2, HashPrevBlock: prev, Bits: make([]byte, 4), Transactions: blocks[h]}
+		b.HashMerkleRoot, _ = b.ComputeMerkleRoot()
+		var err error
+		if raws[h], err = block.Encode(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+// indexSnapshot returns the address locations and transaction locations in the index
+func indexSnapshot(t *testing.T, r *Node, txids []string) (addrs [][]Location, txs []Location) {
+	for _, addr := range testAddrs {
+		locs, err := r.getLocations(addressHHash(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, locs)
+	}
+	for _, txid := range txids {
+		loc, err := r.GetTxLocation(txid)
+		if err != nil {
+			t.Fatal(txid, err)
+		}
+		txs = append(txs, loc)
+	}
+	return
+}
+
+func TestReindex(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if r.Archive, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Archive.Close()
+
+	raws := testPeerChain(t)
+	var txids []string
+	for _, raw := range raws {
+		_, ids, err := decodeRawBlock(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txids = append(txids, ids...)
+	}
+	n := rpctest.NewNode(Mainnet, raws)
+	defer n.Close()
+	r.RPC = n.Client()
+	if _, err = r.syncRange(0, 2, r.fetchBlock, 2); err != nil {
+		t.Fatal(err)
+	}
+	if r.Archive.Count() != 3 {
+		t.Fatal("expected 3 archived blocks, got", r.Archive.Count())
+	}
+	addrs, txs := indexSnapshot(t, r, txids)
+	want := [][]Location{
+		{{1, 0, false}, {2, 1, true}, {2, 1, false}},
+		{{2, 0, false}, {2, 1, false}},
+	}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Error("unexpected locations from sync", addrs)
+	}
+
+	// the rebuilt index must be the same without the full node
+	r.RPC = nil
+	if !r.Reindex().OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 2 {
+		t.Error("reindex stopped at", latest)
+	}
+	addrs2, txs2 := indexSnapshot(t, r, txids)
+	if !reflect.DeepEqual(addrs, addrs2) || !reflect.DeepEqual(txs, txs2) {
+		t.Error("reindexed locations differ", addrs2, txs2)
+	}
+
+	// a bad height is repaired from the archive, still without the full node
+	r.DB.Update(func(txn kv.Txn) error {
+		k, v := EncodeKV(Block{Height: 2, Hash: testHash(9)})
+		return txn.Put(k, v)
+	})
+	report, err := r.CheckIndex(0, 2)
+	if err != nil || len(report.BadHeights) != 1 || report.BadHeights[0] != 2 {
+		t.Fatal("unexpected report", report, err)
+	}
+	if !r.RepairIndex(report).OK() {
+		t.Fatal(r.Error())
+	}
+	if report, err = r.CheckIndex(0, 2); err != nil || !report.OK() || r.Archive.Count() != 3 {
+		t.Error("index not repaired from the archive", report, err, r.Archive.Count())
+	}
+	addrs3, txs3 := indexSnapshot(t, r, txids)
+	if !reflect.DeepEqual(addrs, addrs3) || !reflect.DeepEqual(txs, txs3) {
+		t.Error("repaired locations differ", addrs3, txs3)
+	}
+
+	// the statistics of an index from before they were recorded are the same filled in from the archive
+	stats, err := r.GetBlockStats(0, 2)
+	if err != nil || len(stats) != 3 {
+		t.Fatal("statistics from reindexing", stats, err)
+	}
+	if err = r.deletePrefix(PrefixStats); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.fillStats(); err != nil {
+		t.Fatal(err)
+	}
+	if filled, err := r.GetBlockStats(0, 2); err != nil || !reflect.DeepEqual(stats, filled) {
+		t.Error("filled in statistics differ", filled, stats, err)
+	}
+}
+
+func TestTxID(t *testing.T) {
+	raw, _ := hex.DecodeString(testBlockRaw)
+	_, txids, err := decodeRawBlock(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txids) != 1 || txids[0] != testBlockTx {
+		t.Error("unexpected transaction ids", txids)
+	}
+	_, tx, _ := block.Split(raw)
+	decoded, err := block.Decode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := rawTransaction(txids[0], decoded.Transactions[0], Mainnet).Vout[0].ScriptPubKey.Addresses; len(addrs) != 1 || addressHHash(addrs[0]) == nil || len(tx) != 1 {
+		t.Error("unexpected output addresses", addrs)
+	}
+
+	// a block whose transactions are not the ones its header commits to
+	r := &Node{Network: Mainnet}
+	hash, _ := hex.DecodeString(testBlockHash)
+	if f := r.decodeFetched(102920, hash, decoded.HashPrevBlock, raw); f.err != nil {
+		t.Error(f.err)
+	}
+	raw[len(raw)-5]++
+	if f := r.decodeFetched(102920, hash, decoded.HashPrevBlock, raw); f.err == nil {
+		t.Error("block with a changed transaction accepted")
+	}
+}
+
+func TestReindexMultisig(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if r.Archive, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Archive.Close()
+
+	// a 1 of 2 bare multisig output to a compressed and an uncompressed key
+	keys := [][]byte{append([]byte{0x02}, make([]byte, 32)...), append([]byte{0x04}, make([]byte, 64)...)}
+	keys[0][1], keys[1][1] = 1, 2
+	script := []byte{0x51}
+	var addrs []string
+	for _, k := range keys {
+		script = append(append(script, byte(len(k))), k...)
+		h := hash160.Sum(&k)
+		addr, err := base58check.Encode(key.B58prefixes[Mainnet]["pubkey"], hex.EncodeToString(*h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	script = append(script, 0x52, 0xae)
+	cb := testCoinbase(t, 1, testAddrs[0])
+	cb.Outs = append(cb.Outs, block.TxOut{Value: 1, Script: script})
+	id, _ := cb.TxID()
+	txid := hex.EncodeToString(id)
+
+	n := testSynced(t, r, testMined(t, []block.Tx{testCoinbase(t, 0, testAddrs[0])}, []block.Tx{cb}))
+	defer n.Close()
+	snapshot := func() (locs [][]Location, tx Location) {
+		for _, addr := range addrs {
+			l, err := r.getLocations(addressHHash(addr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			locs = append(locs, l)
+		}
+		if tx, err = r.GetTxLocation(txid); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	locs, tx := snapshot()
+	want := [][]Location{{{1, 0, false}}, {{1, 0, false}}}
+	if !reflect.DeepEqual(locs, want) {
+		t.Fatal("unexpected multisig locations from sync", locs)
+	}
+
+	r.RPC = nil
+	if !r.Reindex().OK() {
+		t.Fatal(r.Error())
+	}
+	if locs2, tx2 := snapshot(); !reflect.DeepEqual(locs, locs2) || tx != tx2 {
+		t.Error("reindexed multisig locations differ", locs2, tx2)
+	}
+}
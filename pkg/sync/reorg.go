@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// checkParent compares the previous block hash reported by the full node for the block at a given height against the hash stored in the index for the height before it. It returns true if the new block extends the indexed chain, or if there is nothing indexed at height-1 to compare against.
+func (r *Node) checkParent(height uint32, prevHash string) (bool, error) {
+	if height == 0 {
+		return true, nil
+	}
+	stored, err := r.GetBlockHash(height - 1)
+	if err != nil || stored == nil {
+		return err == nil, err
+	}
+	prev, err := hex.DecodeString(prevHash)
+	if err != nil {
+		return false, nil
+	}
+	return bytes.Equal(stored, prev), nil
+}
+
+// FindForkPoint walks backwards from a given height comparing the stored block hash with the one the full node currently has at each height, and returns the highest height at which they agree
+func (r *Node) FindForkPoint(from uint32) (fork uint32, err error) {
+	for h := from; ; h-- {
+		stored, err := r.GetBlockHash(h)
+		if err != nil {
+			return 0, err
+		}
+		current, err := r.LegacyGetBlockHash(h)
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(stored, current) {
+			return h, nil
+		}
+		if h == 0 {
+			return 0, errors.New("genesis block does not match the full node, wrong network?")
+		}
+	}
+}
+
+// Rollback removes all index records written for blocks above the fork height, so the winning branch can be indexed on top of the common ancestor.
+//
+// If every block above the fork has an undo record the blocks are undone one at a time from the tip. Otherwise address records are pruned of any location above the fork and deleted if nothing remains, and the search entries of the blocks, transactions and addresses that are no longer indexed are deleted. The balance cache is derived from the address records, so in that case it is simply dropped and will be recomputed on demand. Archived blocks above the fork are dropped as well.
+func (r *Node) Rollback(fork uint32) *Node {
+	return r.rollback(fork, true)
+}
+
+// rollback rolls the index back to a fork height as Rollback does, dropping the archived blocks above it only if truncate is set, so a repair can index them again from the archive
+func (r *Node) rollback(fork uint32, truncate bool) *Node {
+	latest, found, err := r.getLatest()
+	if !r.SetStatusIf(err).OK() || !found || latest <= fork {
+		return r
+	}
+	fmt.Printf("\nrolling back from %d to fork point %d\n", latest, fork)
+	journalled := true
+	for h := fork + 1; h <= latest; h++ {
+		if _, err := r.GetUndo(h); err != nil {
+			journalled = false
+			break
+		}
+	}
+	if journalled {
+		for h := latest; h > fork; h-- {
+			if !r.UndoBlock(h).OK() {
+				return r
+			}
+		}
+		if truncate {
+			r.truncateArchive(fork)
+		}
+		r.publish(Event{Type: EventReorg, Height: fork, Hash: hex.EncodeToString(r.LatestHash)})
+		return r
+	}
+	forkHash, err := r.GetBlockHash(fork)
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+
+	var blockKeys [][]byte
+	// the search entries of what is removed are found by the kind and key of the record they point at, as without a complete journal their characters are not known
+	unsearchable := map[byte]map[string]bool{SearchBlock: {}, SearchTx: {}, SearchAddress: {}}
+	for h := fork + 1; h <= latest; h++ {
+		hash, err := r.GetBlockHash(h)
+		if err != ErrRecord && !r.SetStatusIf(err).OK() {
+			return r
+		}
+		k1, _ := EncodeKV(Block{Height: h})
+		k3, _ := EncodeKV(Undo{Height: h})
+		k4, _ := EncodeKV(Stats{Height: h})
+		blockKeys = append(blockKeys, k1, k3, k4)
+		if hash != nil {
+			hhash := *core.Hash64(&hash)
+			k2, _ := EncodeKV(Hash{HHash: hhash})
+			blockKeys = append(blockKeys, k2)
+			unsearchable[SearchBlock][string(hhash)] = true
+		}
+	}
+
+	updates := make(map[string][]byte)
+	var deletes [][]byte
+	err = r.DB.View(func(txn kv.Reader) error {
+		err := txn.Iterate([]byte{PrefixAddress}, nil, func(k, v []byte) error {
+			locs, err := decodeAddressRecord(v)
+			if err != nil {
+				return fmt.Errorf("address record %x: %v", k[1:], err)
+			}
+			pruned := pruneLocations(locs, fork)
+			if len(pruned) == len(locs) {
+				return nil
+			}
+			if len(pruned) == 0 {
+				deletes = append(deletes, append([]byte{}, k...))
+				unsearchable[SearchAddress][string(k[1:])] = true
+			} else {
+				updates[string(k)] = encodeLocations(pruned)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = txn.Keys([]byte{PrefixBalanceCache}, nil, func(k []byte) error {
+			deletes = append(deletes, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = txn.Iterate([]byte{PrefixTx}, nil, func(k, v []byte) error {
+			rec, err := DecodeRecord(k, v)
+			if err != nil {
+				return err
+			}
+			if rec.(Tx).Location.Height > fork {
+				deletes = append(deletes, append([]byte{}, k...))
+				unsearchable[SearchTx][string(rec.(Tx).HHash)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return txn.Keys([]byte{PrefixSearch}, nil, func(k []byte) error {
+			if len(k) >= 11 && unsearchable[k[1]][string(k[len(k)-8:])] {
+				deletes = append(deletes, append([]byte{}, k...))
+			}
+			return nil
+		})
+	})
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+
+	err = r.DB.Update(func(txn kv.Txn) error {
+		for _, k := range append(blockKeys, deletes...) {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		for k, v := range updates {
+			if err := txn.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return txn.Put(LatestKey, latestValue(fork, forkHash))
+	})
+	if r.SetStatusIf(err).OK() {
+		r.Latest, r.LatestHash = fork, forkHash
+		if r.txs != nil {
+			r.txs.dropBlocks(fork)
+		}
+		if truncate {
+			r.truncateArchive(fork)
+		}
+		r.publish(Event{Type: EventReorg, Height: fork, Hash: hex.EncodeToString(forkHash)})
+	}
+	return r
+}
+
+// truncateArchive drops the archived blocks above a fork point. The data of the orphaned blocks is left in the data files, and it is not an error if that fails, since the winning branch replaces them anyway.
+func (r *Node) truncateArchive(fork uint32) {
+	if r.Archive == nil {
+		return
+	}
+	if err := r.Archive.Truncate(fork + 1); err != nil {
+		fmt.Println("truncating archive", err)
+	}
+}
+
+// pruneLocations returns the locations at or below a given height. Locations are stored in ascending height order so this is a simple truncation.
+func pruneLocations(in []Location, height uint32) (out []Location) {
+	for i := range in {
+		if in[i].Height > height {
+			break
+		}
+		out = append(out, in[i])
+	}
+	return
+}
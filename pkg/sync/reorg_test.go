@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+func newTestNode(t *testing.T) (r *Node, cleanup func()) {
+	db := kv.NewMemory()
+	r = &Node{DB: db}
+	return r, func() { db.Close() }
+}
+
+func testHash(height uint32) []byte {
+	h := make([]byte, 32)
+	h[31], h[30] = byte(height), 0xAA
+	return h
+}
+
+// storedHash returns the hash of the block record at a height, or nil if there is none or it cannot be read
+func storedHash(r *Node, height uint32) []byte {
+	hash, _ := r.GetBlockHash(height)
+	return hash
+}
+
+func TestRollback(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	addrKey := append([]byte{16}, 1, 2, 3, 4, 5, 6, 7, 8)
+	goneKey := append([]byte{16}, 8, 7, 6, 5, 4, 3, 2, 1)
+	var record []byte
+	err := r.DB.Update(func(txn kv.Txn) error {
+		for i := uint32(0); i <= 5; i++ {
+			h := testHash(i)
+			k1, v1 := EncodeKV(Block{Height: i, Hash: h})
+			k2, v2 := EncodeKV(Hash{HHash: *core.Hash64(&h), Height: i})
+			txn.Put(k1, v1)
+			txn.Put(k2, v2)
+			record, _ = encodeAddressRecord(record, Location{Height: i, TxNum: uint16(i)})
+		}
+		txn.Put(addrKey, record)
+		txn.Put(goneKey, encodeLocations([]Location{{Height: 5, TxNum: 1}}))
+		txn.Put(append([]byte{8}, 1, 2, 3, 4, 5, 6, 7, 8), []byte{1, 1, 5})
+		return txn.Put([]byte("latest"), append(*core.IntToBytes(uint32(5)), testHash(5)...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.Rollback(3).OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 3 {
+		t.Error("latest not rolled back, got", latest)
+	}
+	if !bytes.Equal(r.LatestHash, testHash(3)) {
+		t.Error("latest hash not rolled back")
+	}
+	for i := uint32(0); i <= 5; i++ {
+		h := storedHash(r, i)
+		if i <= 3 && !bytes.Equal(h, testHash(i)) {
+			t.Error("block below fork removed at height", i)
+		}
+		if i > 3 && h != nil {
+			t.Error("orphaned block still indexed at height", i)
+		}
+	}
+	r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(addrKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs, _ := decodeAddressRecord(v)
+		if len(locs) != 4 || locs[3].Height != 3 || locs[3].TxNum != 3 {
+			t.Error("address record not pruned to fork point", locs)
+		}
+		if _, err := txn.Get(goneKey); err != kv.ErrNotFound {
+			t.Error("address only seen in orphaned blocks was not removed")
+		}
+		if _, err := txn.Get(append([]byte{8}, 1, 2, 3, 4, 5, 6, 7, 8)); err != kv.ErrNotFound {
+			t.Error("balance cache was not dropped")
+		}
+		return nil
+	})
+}
+
+func TestAddressRecordRoundTrip(t *testing.T) {
+	var record []byte
+	in := []Location{{1, 0, false}, {1, 3, true}, {20, 1, false}, {300000, 70, true}}
+	var err error
+	for i := range in {
+		if record, err = encodeAddressRecord(record, in[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record, _ = encodeAddressRecord(record, in[len(in)-1])
+	out, err := decodeAddressRecord(record)
+	if err != nil || len(out) != len(in) {
+		t.Fatal("expected", in, "got", out, err)
+	}
+	for i := range in {
+		if in[i] != out[i] {
+			t.Error("expected", in[i], "got", out[i])
+		}
+	}
+
+	// a record that is not snappy compressed, or ends part way through a location, is an error rather than some other locations
+	raw := snappy.Encode(nil, []byte{1, 0, 5})
+	for _, bad := range [][]byte{{1, 0, 5, 2}, raw, nil} {
+		if locs, err := decodeAddressRecord(bad); err != ErrRecord {
+			t.Errorf("record %x decoded as %v, %v", bad, locs, err)
+		}
+	}
+	if _, err = encodeAddressRecord(raw, in[0]); err != ErrRecord {
+		t.Error("added a location to a corrupt record", err)
+	}
+}
@@ -0,0 +1,279 @@
+package sync
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	gosync "sync"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// DormantBlocks is the number of blocks, about a year at five minutes a block, after which a funded address that has not appeared in a transaction is counted as dormant
+const DormantBlocks = 105120
+
+// RichListQuantiles are the fractions of the richest funded addresses whose share of the coins is reported
+var RichListQuantiles = []float64{0.001, 0.01, 0.1, 0.5}
+
+// AddressStats is an address with its balance and activity as of a height
+type AddressStats struct {
+	Address string `json:"address"`
+	Balance uint64 `json:"balance"`
+	// FirstSeen and LastSeen are the heights of the first and last blocks the address appears in
+	FirstSeen uint32 `json:"firstseen"`
+	LastSeen  uint32 `json:"lastseen"`
+	// Txs is the number of transactions the address appears in
+	Txs int `json:"txs"`
+}
+
+// Quantile is the share of the coins held by the richest fraction of the funded addresses
+type Quantile struct {
+	Fraction  float64 `json:"fraction"`
+	Addresses int     `json:"addresses"`
+	Balance   uint64  `json:"balance"`
+	Share     float64 `json:"share"`
+}
+
+// BalanceBucket counts the funded addresses with a balance at least Min and less than Max, or without an upper bound if Max is zero
+type BalanceBucket struct {
+	Min       uint64 `json:"min"`
+	Max       uint64 `json:"max"`
+	Addresses int    `json:"addresses"`
+	Balance   uint64 `json:"balance"`
+}
+
+// RichList is the report produced by TopAddresses. Balances are in base units.
+type RichList struct {
+	Height uint32         `json:"height"`
+	Top    []AddressStats `json:"top"`
+	// Addresses is the number of addresses that appear in a transaction at or below the height, and Funded the number of those with a balance
+	Addresses int `json:"addresses"`
+	Funded    int `json:"funded"`
+	// Active is the number of addresses that appear in the last DormantBlocks blocks, and Dormant the number of funded addresses that do not
+	Active  int `json:"active"`
+	Dormant int `json:"dormant"`
+	// Supply is the total of the balances
+	Supply uint64 `json:"supply"`
+	// Gini is the Gini coefficient of the balances of the funded addresses, 0 if every address holds the same and approaching 1 as one address holds everything
+	Gini      float64         `json:"gini"`
+	Quantiles []Quantile      `json:"quantiles"`
+	Buckets   []BalanceBucket `json:"buckets"`
+}
+
+// addressRecord is an address record read from the index
+type addressRecord struct {
+	hhash []byte
+	locs  []Location
+}
+
+// TopAddresses computes the balance of every address in the index as of a height, which is capped at the latest indexed block, and returns the n richest with statistics on the distribution of all of them. An n less than one returns every funded address.
+//
+// The index only holds the hash of each address, so the address itself is recovered from the output of its first appearance. Every balance is computed the same way as GetAddressBalance and left in the balance cache, so this makes as many RPC calls as the history of every address does the first time it is run, spread over Node.Workers workers.
+func (r *Node) TopAddresses(n int, atHeight uint32) (list *RichList, err error) {
+	latest, found, err := r.getLatest()
+	if err != nil {
+		return
+	} else if !found {
+		return nil, ErrNotIndexed
+	}
+	if atHeight > latest {
+		atHeight = latest
+	}
+	recs, err := r.addressRecords(atHeight)
+	if err != nil {
+		return
+	}
+	stats := make([]AddressStats, len(recs))
+	workers := r.Workers
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg gosync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var e error
+				if stats[i], e = r.addressStats(recs[i], atHeight); e != nil {
+					select {
+					case errs <- e:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < len(recs) && err == nil; i++ {
+		select {
+		case jobs <- i:
+		case err = <-errs:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	if err != nil {
+		return
+	}
+	return richList(stats, n, atHeight), nil
+}
+
+// addressRecords reads every address record with the locations at or below a height, leaving out addresses that first appear above it
+func (r *Node) addressRecords(atHeight uint32) (recs []addressRecord, err error) {
+	err = r.DB.View(func(txn kv.Reader) error {
+		return txn.Iterate([]byte{PrefixAddress}, nil, func(k, v []byte) error {
+			rec, err := DecodeRecord(k, v)
+			if err != nil {
+				return err
+			}
+			a := rec.(Address)
+			end := 0
+			for end < len(a.Locations) && a.Locations[end].Height <= atHeight {
+				end++
+			}
+			if end > 0 {
+				recs = append(recs, addressRecord{hhash: append([]byte{}, a.HHash...), locs: a.Locations[:end]})
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// addressStats recovers the address of a record and computes its balance and activity
+func (r *Node) addressStats(rec addressRecord, atHeight uint32) (s AddressStats, err error) {
+	if s.Address, err = r.recoverAddress(rec); err != nil {
+		return
+	}
+	if s.Balance, err = r.GetAddressBalance(s.Address, atHeight); err != nil {
+		return
+	}
+	s.FirstSeen, s.LastSeen = rec.locs[0].Height, rec.locs[len(rec.locs)-1].Height
+	for i, loc := range rec.locs {
+		// a transaction that both spends from and pays to the address has two locations
+		if i == 0 || loc.Height != rec.locs[i-1].Height || loc.TxNum != rec.locs[i-1].TxNum {
+			s.Txs++
+		}
+	}
+	return
+}
+
+// recoverAddress finds the address an address record is for among the outputs of the first transaction that paid to it, since the index only stores the hash of the address
+func (r *Node) recoverAddress(rec addressRecord) (string, error) {
+	for _, loc := range rec.locs {
+		if loc.Spend {
+			continue
+		}
+		tx, err := r.txAt(loc)
+		if err != nil {
+			return "", err
+		}
+		for _, vout := range tx.Vout {
+			for _, addr := range vout.ScriptPubKey.Addresses {
+				if string(addressHHash(addr)) == string(rec.hhash) {
+					return addr, nil
+				}
+			}
+		}
+		break
+	}
+	return "", fmt.Errorf("no output pays to address %x", rec.hhash)
+}
+
+// richList sorts the address statistics by balance and summarises them
+func richList(stats []AddressStats, n int, atHeight uint32) (list *RichList) {
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Balance != stats[j].Balance {
+			return stats[i].Balance > stats[j].Balance
+		}
+		return stats[i].Address < stats[j].Address
+	})
+	list = &RichList{Height: atHeight, Addresses: len(stats)}
+	for _, s := range stats {
+		if s.Balance > 0 {
+			list.Funded++
+			list.Supply += s.Balance
+		}
+		if atHeight-s.LastSeen < DormantBlocks {
+			list.Active++
+		} else if s.Balance > 0 {
+			list.Dormant++
+		}
+	}
+	funded := stats[:list.Funded]
+	if n < 1 || n > len(funded) {
+		n = len(funded)
+	}
+	list.Top = funded[:n]
+
+	// with the balances in descending order, the ith richest of n addresses has rank n+1-i in the usual ascending sum
+	if list.Funded > 0 && list.Supply > 0 {
+		var weighted float64
+		for i, s := range funded {
+			weighted += float64(list.Funded-i) * float64(s.Balance)
+		}
+		count := float64(list.Funded)
+		list.Gini = 2*weighted/(count*float64(list.Supply)) - (count+1)/count
+	}
+	for _, fraction := range RichListQuantiles {
+		q := Quantile{Fraction: fraction, Addresses: int(math.Ceil(fraction * float64(list.Funded)))}
+		for _, s := range funded[:q.Addresses] {
+			q.Balance += s.Balance
+		}
+		if list.Supply > 0 {
+			q.Share = float64(q.Balance) / float64(list.Supply)
+		}
+		list.Quantiles = append(list.Quantiles, q)
+	}
+	list.Buckets = balanceBuckets(funded)
+	return
+}
+
+// balanceBuckets counts balances in powers of ten of whole coins, from less than one coin up to ten million coins and more
+func balanceBuckets(funded []AddressStats) (buckets []BalanceBucket) {
+	var min uint64
+	for max := uint64(core.COIN); max <= 1e7*core.COIN; max *= 10 {
+		buckets = append(buckets, BalanceBucket{Min: min, Max: max})
+		min = max
+	}
+	buckets = append(buckets, BalanceBucket{Min: min})
+	for _, s := range funded {
+		i := 0
+		for i < len(buckets)-1 && s.Balance >= buckets[i].Max {
+			i++
+		}
+		buckets[i].Addresses++
+		buckets[i].Balance += s.Balance
+	}
+	return
+}
+
+// WriteCSV writes the top addresses as CSV, with a header line and the rank, address, balance in base units, first and last seen heights and transaction count of each
+func (l *RichList) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"rank", "address", "balance", "firstseen", "lastseen", "txs"})
+	for i, s := range l.Top {
+		out.Write([]string{
+			strconv.Itoa(i + 1),
+			s.Address,
+			strconv.FormatUint(s.Balance, 10),
+			strconv.FormatUint(uint64(s.FirstSeen), 10),
+			strconv.FormatUint(uint64(s.LastSeen), 10),
+			strconv.Itoa(s.Txs),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
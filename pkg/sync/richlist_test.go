@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestTopAddresses(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	if _, err := r.TopAddresses(10, 2); err != ErrNotIndexed {
+		t.Error("expected not indexed error, got", err)
+	}
+	raws, _ := testSpendChain(t)
+	defer testSynced(t, r, raws).Close()
+
+	list, err := r.TopAddresses(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Height != 2 || list.Addresses != 2 || list.Funded != 2 || list.Active != 2 || list.Dormant != 0 || list.Supply != 4999000000 {
+		t.Errorf("unexpected totals %+v", list)
+	}
+	if len(list.Top) != 1 || list.Top[0] != (AddressStats{Address: testAddrs[1], Balance: 3000000000, FirstSeen: 2, LastSeen: 2, Txs: 1}) {
+		t.Error("unexpected top addresses", list.Top)
+	}
+	if math.Abs(list.Gini-0.10012) > 0.0001 {
+		t.Error("unexpected Gini coefficient", list.Gini)
+	}
+	if q := list.Quantiles[0]; q.Addresses != 1 || q.Balance != 3000000000 {
+		t.Error("unexpected quantile", q)
+	}
+	for i, bucket := range list.Buckets {
+		if bucket.Max == 100*1e8 && bucket.Addresses != 2 || bucket.Max != 100*1e8 && bucket.Addresses != 0 {
+			t.Error("unexpected bucket", i, bucket)
+		}
+	}
+
+	if list, err = r.TopAddresses(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if list.Addresses != 1 || len(list.Top) != 1 || list.Top[0].Address != testAddrs[0] || list.Top[0].Balance != 5000000000 {
+		t.Errorf("unexpected list at height 1 %+v", list)
+	}
+	var out bytes.Buffer
+	if err = list.WriteCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "rank,address,balance,firstseen,lastseen,txs\n1," + testAddrs[0] + ",5000000000,1,1,1\n"; out.String() != expected {
+		t.Error("unexpected CSV", out.String())
+	}
+}
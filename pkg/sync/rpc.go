@@ -2,85 +2,67 @@ package sync
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
-	"strconv"
 	"time"
-
-	"github.com/parallelcointeam/duo/pkg/rpc"
 )
 
-// LegacyGetBestBlockHeight returns the newest consensus block height and
-func (r *Node) LegacyGetBestBlockHeight() uint32 {
-	resp, err := r.RPC.Call("getinfo", nil)
+// LegacyGetBestBlockHeight returns the height of the full node's best block, and records it in Best with the time it was asked for in BestTime
+func (r *Node) LegacyGetBestBlockHeight() (height uint32, err error) {
+	info, err := r.RPC.GetInfo()
 	if err != nil {
-		fmt.Println("rpc getinfo", err.Error())
-		os.Exit(1)
+		return 0, fmt.Errorf("getinfo: %v", err)
+	}
+	r.Best = info.Blocks
+	r.BestTime = time.Now().Unix()
+	return info.Blocks, nil
+}
+
+// GetRawBlock gets the raw block given a block height, from the archive if it is there
+func (r *Node) GetRawBlock(height uint64) (raw []byte, err error) {
+	if r.Archive != nil && height < uint64(r.Archive.Count()) {
+		if _, raw, err = r.Archive.Get(uint32(height)); err == nil {
+			return
+		}
 	}
-	str := new(rpc.GetInfo)
-	err = json.Unmarshal(resp.Result, str)
+	hash, err := r.LegacyGetBlockHash(uint32(height))
 	if err != nil {
-		fmt.Println("unmarshalling info", err.Error())
-		os.Exit(1)
+		return
 	}
-	r.Best = str.Blocks
-	r.BestTime = time.Now().Unix()
-	return str.Blocks
+	return r.rpcRawBlock(hex.EncodeToString(hash))
 }
 
-// GetRawBlock gets the raw block given a block height
-func (r *Node) GetRawBlock(height uint64) *[]byte {
-	getHash, err := r.RPC.Call("getblockhash", []uint64{height})
+// rpcRawBlock gets the serialised block with a given hash from the full node
+func (r *Node) rpcRawBlock(hash string) (raw []byte, err error) {
+	rawS, err := r.RPC.GetBlockHex(hash)
 	if err != nil {
-	} else {
-		unquoted, _ := strconv.Unquote(string(getHash.Result))
-		bytes, _ := hex.DecodeString(string(unquoted))
-		resp, err := r.RPC.Call("getblock", []interface{}{hex.EncodeToString(bytes), false})
-		if err != nil {
-		} else {
-			unquoted, _ = strconv.Unquote(string(resp.Result))
-			bytes, _ = hex.DecodeString(unquoted)
-		}
-		return &bytes
+		return nil, fmt.Errorf("getblock %s: %v", hash, err)
 	}
-	return &[]byte{}
+	return hex.DecodeString(rawS)
 }
 
-// LegacyGetBlockHash gets the block hash using an external parallelcoind full node
-func (r *Node) LegacyGetBlockHash(height uint32) (blockHash []byte) {
-	getHash, err := r.RPC.Call("getblockhash", []uint64{uint64(height)})
+// LegacyGetBlockHash gets the block hash using an external parallelcoind full node. A hash that is not 32 bytes long is an error, so a failed call never gives a hash that could be written to the index.
+func (r *Node) LegacyGetBlockHash(height uint32) (blockHash []byte, err error) {
+	hashS, err := r.RPC.GetBlockHash(height)
 	if err != nil {
-	} else {
-		unquoted, _ := strconv.Unquote(string(getHash.Result))
-		blockHash, _ = hex.DecodeString(unquoted)
+		return nil, fmt.Errorf("getblockhash %d: %v", height, err)
+	}
+	if blockHash, err = hex.DecodeString(hashS); err == nil && len(blockHash) != 32 {
+		err = fmt.Errorf("getblockhash %d: %q is not a block hash", height, hashS)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return
 }
 
-// GetTxValue gets the transaction based on a given tx hash
-func (r *Node) GetTxValue(txhash []byte) (out float64) {
-
-	intVerbose := 1
-	txS := hex.EncodeToString(txhash)
-	// fmt.Println("getrawtransaction", txS, 1)
-	txB, err := r.RPC.Call("getrawtransaction", []interface{}{txS, intVerbose})
-
-	// vb := 1
-	// txB, err := r.RPC.Call("getrawtransaction", []string{hex.EncodeToString(txhash)})
+// GetTxValue gets the value of the first output of the transaction with a given hash
+func (r *Node) GetTxValue(txhash []byte) (out float64, err error) {
+	tx, err := r.RPC.GetRawTransaction(hex.EncodeToString(txhash))
 	if err != nil {
-		fmt.Println(err.Error())
-	} else {
-		var I interface{}
-		json.Unmarshal(txB.Result, &I)
-		ii := I.(map[string]interface{})
-		// fmt.Println(ii["vout"])
-		iii := ii["vout"].([]interface{})[0].(map[string]interface{})
-		// j, _ := json.MarshalIndent(iii["value"], "", "  ")
-		// fmt.Println(uint64(iii["value"].(float64) * float64(core.COIN)))
-		out = iii["value"].(float64)
-		// .(map[string]interface{})["value"])
-		// fmt.Println(string(txB.Result))
+		return 0, fmt.Errorf("getrawtransaction %x: %v", txhash, err)
 	}
-	return
+	if len(tx.Vout) == 0 {
+		return 0, fmt.Errorf("transaction %x has no outputs", txhash)
+	}
+	return tx.Vout[0].Value, nil
 }
@@ -0,0 +1,150 @@
+package sync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+// TestSyncRPC indexes the test chain from a fake full node, follows it through a reorganisation, and checks that a failing or slow node leaves the index as it was
+func TestSyncRPC(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	raws := testPeerChain(t)
+	n := rpctest.NewNode(Mainnet, raws)
+	defer n.Close()
+	r.RPC = n.Client()
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 2 || hex.EncodeToString(storedHash(r, 2)) != n.Hash(2) {
+		t.Fatal("chain not indexed", latest)
+	}
+	_, txids, _ := decodeRawBlock(raws[2])
+	addrs, locs := indexSnapshot(t, r, []string{txids[1]})
+	expected := [][]Location{
+		{{1, 0, false}, {2, 1, true}, {2, 1, false}},
+		{{2, 0, false}, {2, 1, false}},
+	}
+	if !reflect.DeepEqual(addrs, expected) || locs[0] != (Location{Height: 2, TxNum: 1}) {
+		t.Error("unexpected index", addrs, locs)
+	}
+
+	// a longer branch replacing block 2
+	n.Reorg(1, testBranch(t, raws[1], testAddrs[1], testAddrs[1]))
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 3 || hex.EncodeToString(storedHash(r, 3)) != n.Hash(3) {
+		t.Fatal("branch not indexed", latest)
+	}
+	addrs, _ = indexSnapshot(t, r, nil)
+	if expected = [][]Location{{{1, 0, false}}, {{2, 0, false}, {3, 0, false}}}; !reflect.DeepEqual(addrs, expected) {
+		t.Error("unexpected index after the branch", addrs)
+	}
+	if _, err := r.GetTxLocation(txids[1]); err != ErrTxNotFound {
+		t.Error("transaction of the replaced block still indexed", err)
+	}
+
+	// a node failing to return the transactions of a new block, or without a transaction index or pruned so it does not have them
+	blocks := n.Blocks()
+	n.Reorg(3, testBranch(t, blocks[3], testAddrs[0]))
+	for _, code := range []int{rpc.ErrCodeMisc, rpc.ErrCodeInvalidAddressOrKey} {
+		n.Fail("getrawtransaction", -1, &rpc.Error{Code: code, Message: "failed"})
+		r.UnsetStatus()
+		if r.Sync().OK() {
+			t.Error("sync succeeded with the node failing with code", code)
+		}
+		if latest, _, _ := r.getLatest(); latest != 3 {
+			t.Error("index moved on with the node failing with code", code, latest)
+		}
+	}
+
+	// a node too slow to answer
+	n.Fail("getrawtransaction", 0, nil)
+	n.SetDelay(time.Second)
+	r.RPC.Timeout = 10 * time.Millisecond
+	r.UnsetStatus()
+	if r.Sync().OK() {
+		t.Error("sync succeeded with the node timing out")
+	}
+	n.SetDelay(0)
+	r.UnsetStatus()
+	if !r.Sync().OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 4 || hex.EncodeToString(storedHash(r, 4)) != n.Hash(4) {
+		t.Error("new block not indexed", latest)
+	}
+}
+
+// TestNodeErrors checks that errors from the full node stop a sync without anything being written for the block that failed
+func TestNodeErrors(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	// a node that is not running
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	host, port, _ := net.SplitHostPort(down.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	r.RPC = rpc.NewClient(host, p, "", "", false)
+	r.RPC.Retries = -1
+	if r.Sync().OK() {
+		t.Error("sync succeeded with the node down")
+	}
+	if _, found, _ := r.getLatest(); found {
+		t.Error("index written with the node down")
+	}
+
+	// a node that fails to return a transaction, for not having it or for some other reason
+	hash := hex.EncodeToString(testHash(0))
+	code := int32(rpc.ErrCodeInvalidAddressOrKey)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(req.Body).Decode(&body)
+		var batch []rpc.Request
+		if json.Unmarshal(body, &batch) == nil {
+			out := make([]rpc.Response, len(batch))
+			for i := range batch {
+				out[i] = rpc.Response{ID: int64(i), Result: json.RawMessage("null"), Err: &rpc.Error{Code: int(atomic.LoadInt32(&code)), Message: "failed"}}
+			}
+			json.NewEncoder(w).Encode(out)
+			return
+		}
+		var in rpc.Request
+		json.Unmarshal(body, &in)
+		var result interface{} = hash
+		if in.Method == "getblock" {
+			result = rpc.GetBlock{Hash: hash, Tx: []string{"aa"}}
+		}
+		b, _ := json.Marshal(result)
+		json.NewEncoder(w).Encode(rpc.Response{ID: in.ID, Result: b})
+	}))
+	defer srv.Close()
+	host, port, _ = net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ = strconv.Atoi(port)
+	r.RPC = rpc.NewClient(host, p, "", "", false)
+
+	// only the genesis coinbase, which the node never has, is skipped
+	if f := r.fetchBlock(0); f.err != nil || len(f.txs) != 1 || f.txs[0] != nil {
+		t.Error("genesis coinbase not skipped", f.err)
+	}
+	if f := r.fetchBlock(1); f.err == nil {
+		t.Error("missing transaction not reported")
+	}
+	atomic.StoreInt32(&code, rpc.ErrCodeMisc)
+	if f := r.fetchBlock(1); f.err == nil {
+		t.Error("failed transaction not reported")
+	}
+}
@@ -0,0 +1,219 @@
+package sync
+
+import (
+	"fmt"
+
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// The prefix byte at the start of the key identifies the type of each record in the index
+const (
+	PrefixBlock        byte = 1
+	PrefixHash         byte = 2
+	PrefixSearch       byte = 3
+	PrefixBalanceCache byte = 8
+	PrefixAddress      byte = 16
+	PrefixUndo         byte = 32
+	PrefixTx           byte = 64
+	PrefixStats        byte = 128
+
+	// prefixLegacyAddress was reserved for an address record format that was never written
+	prefixLegacyAddress byte = 4
+)
+
+var (
+	// LatestKey is the key of the record holding the height and hash of the latest indexed block
+	LatestKey = []byte("latest")
+	// SchemaKey is the key of the record holding the schema version of the index as a varint
+	SchemaKey = []byte("schema")
+)
+
+// SchemaVersion is the version of the index format written by this package.
+//
+//	0  the serial indexer, address records of transaction numbers without spends
+//	1  address records with spend flags, undo journal and transaction index
+//	2  schema version record, and every record type has a single registered encoding
+//	3  block statistics records
+//	4  search prefix records
+//	5  undo records list the search prefix records of their block
+const SchemaVersion = 5
+
+// recordType is an entry in the registry of the record types stored in the index, with the single encoder and decoder for its on-disk form
+type recordType struct {
+	name   string
+	encode func(in interface{}) (k, v []byte)
+	decode func(k, v []byte) (interface{}, error)
+}
+
+// records is the registry of record types by prefix
+var records = map[byte]recordType{
+	PrefixBlock:        {"block", encodeBlock, decodeBlock},
+	PrefixHash:         {"hash", encodeHash, decodeHash},
+	PrefixBalanceCache: {"balance cache", encodeBalanceCache, decodeBalanceCache},
+	PrefixAddress:      {"address", encodeAddress, decodeAddress},
+	PrefixUndo:         {"undo", encodeUndo, decodeUndo},
+	PrefixTx:           {"transaction", encodeTx, decodeTx},
+	PrefixStats:        {"stats", encodeStats, decodeStats},
+	PrefixSearch:       {"search", encodeSearchEntry, decodeSearchEntry},
+}
+
+// recordPrefix returns the prefix of a record type
+func recordPrefix(in interface{}) (prefix byte, ok bool) {
+	switch in.(type) {
+	case Block:
+		return PrefixBlock, true
+	case Hash:
+		return PrefixHash, true
+	case BalanceCache:
+		return PrefixBalanceCache, true
+	case Address:
+		return PrefixAddress, true
+	case Undo:
+		return PrefixUndo, true
+	case Tx:
+		return PrefixTx, true
+	case Stats:
+		return PrefixStats, true
+	case SearchEntry:
+		return PrefixSearch, true
+	}
+	return 0, false
+}
+
+// SchemaError is returned when the index is in a format that cannot be upgraded in place to the current schema
+type SchemaError struct {
+	Version uint64
+	Reason  string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("index schema version %d is not compatible with version %d: %s", e.Version, SchemaVersion, e.Reason)
+}
+
+// migration upgrades the index from one schema version to the next. A migration without a run function cannot be done in place and the index has to be rebuilt, and one with a check function can only be done when it returns an empty reason.
+type migration struct {
+	name  string
+	run   func(r *Node) error
+	check func(r *Node) (reason string)
+}
+
+// migrations are indexed by the version they upgrade from
+var migrations = []migration{
+	{name: "address records of version 0 do not record spends, delete the index to sync it again or rebuild it with reindex"},
+	{name: "remove legacy address records", run: func(r *Node) error { return r.deletePrefix(prefixLegacyAddress) }},
+	// the blocks already indexed can only be summarised from the archive, without which the index has to be rebuilt
+	{name: "add block statistics records from the archive", run: func(r *Node) error { return r.fillStats() }, check: func(r *Node) string {
+		if latest, found, _ := r.getLatest(); found && !r.archiveCovers(latest) {
+			return "block statistics can only be added from an archive of every indexed block, rebuild the index with reindex or sync it again"
+		}
+		return ""
+	}},
+	// only block hashes can be added, the ids of transactions and addresses already indexed are not stored anywhere
+	{name: "add search prefix records for block hashes", run: func(r *Node) error { return r.indexBlockHashes() }},
+	// as above only the entries of block hashes can be journalled, the others are left for Search to skip once their block is undone
+	{name: "journal the search prefix record of each block hash in its undo record", run: func(r *Node) error { return r.journalBlockHashes() }},
+}
+
+// SchemaVersion returns the schema version of the index. An index without a version record is version 1 if it has undo records, version 0 if it has anything else in it, and new if it is empty.
+func (r *Node) SchemaVersion() (version uint64, isNew bool, err error) {
+	found := false
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(SchemaKey)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if version, _, err = uvarint(v); err != nil {
+			return fmt.Errorf("schema record: %v", err)
+		}
+		found = true
+		return nil
+	})
+	if err != nil || found {
+		return
+	}
+	err = r.DB.View(func(txn kv.Reader) error {
+		isNew = true
+		err := txn.Keys(nil, nil, func(k []byte) error {
+			isNew = false
+			return kv.ErrStop
+		})
+		if err != nil || isNew {
+			return err
+		}
+		return txn.Keys([]byte{PrefixUndo}, nil, func(k []byte) error {
+			version = 1
+			return kv.ErrStop
+		})
+	})
+	return
+}
+
+// setSchemaVersion writes the schema version record
+func (r *Node) setSchemaVersion(version uint64) error {
+	return r.DB.Update(func(txn kv.Txn) error {
+		return txn.Put(SchemaKey, AppendVarint(nil, version))
+	})
+}
+
+// Migrate upgrades the index in place to the current schema version, one version at a time. It returns a SchemaError if the index is from a newer version of this package or cannot be upgraded, in which case nothing is changed.
+func (r *Node) Migrate() error {
+	version, isNew, err := r.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if isNew {
+		return r.setSchemaVersion(SchemaVersion)
+	}
+	if version > SchemaVersion {
+		return &SchemaError{Version: version, Reason: "the index was written by a newer version"}
+	}
+	for v := version; v < SchemaVersion; v++ {
+		if migrations[v].run == nil {
+			return &SchemaError{Version: version, Reason: migrations[v].name}
+		}
+		if check := migrations[v].check; check != nil {
+			if reason := check(r); reason != "" {
+				return &SchemaError{Version: version, Reason: reason}
+			}
+		}
+	}
+	for ; version < SchemaVersion; version++ {
+		fmt.Printf("migrating index from schema version %d: %s\n", version, migrations[version].name)
+		if err = migrations[version].run(r); err != nil {
+			return fmt.Errorf("migrating index from schema version %d: %v", version, err)
+		}
+		if err = r.setSchemaVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix deletes every record with a given prefix
+func (r *Node) deletePrefix(prefix byte) (err error) {
+	var keys [][]byte
+	err = r.DB.View(func(txn kv.Reader) error {
+		return txn.Keys([]byte{prefix}, nil, func(k []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+	if err != nil {
+		return
+	}
+	return r.deleteKeys(keys)
+}
+
+// deleteKeys deletes a list of keys in one batch
+func (r *Node) deleteKeys(keys [][]byte) (err error) {
+	batch := r.DB.NewBatch()
+	defer batch.Discard()
+	for _, k := range keys {
+		if err = batch.Delete(k); err != nil {
+			return
+		}
+	}
+	return batch.Commit()
+}
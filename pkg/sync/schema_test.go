@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	hhash := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, in := range []interface{}{
+		Block{Height: 300, Hash: testHash(3)},
+		Hash{HHash: hhash, Height: 70000},
+		BalanceCache{HHash: hhash, Balance: 1 << 40, Height: 12},
+		Address{HHash: hhash, Locations: []Location{{5, 1, true}, {5, 1, false}, {900, 3, false}}},
+		Undo{Height: 9, Txs: [][]byte{hhash}, Search: []SearchEntry{{Kind: SearchAddress, Chars: "1abc", HHash: hhash}}, Entries: []UndoEntry{{HHash: hhash, Locations: []Location{{9, 0, false}}}}},
+		Tx{HHash: hhash, Location: Location{Height: 129, TxNum: 300}},
+		SearchEntry{Kind: SearchTx, Zeros: 2, Chars: "abcdef01", HHash: hhash},
+		Stats{Height: 200, Time: 1400000000, Algo: 1, Bits: 0x1c33d82a, Difficulty: 4.937, Txs: 3, Size: 900, Value: 5e9, Fees: 1e5},
+	} {
+		k, v := EncodeKV(in)
+		out, err := DecodeRecord(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("record did not round trip\n%+v\n%+v", in, out)
+		}
+	}
+	if _, err := DecodeRecord([]byte{PrefixHash, 1}, []byte{1}); err == nil {
+		t.Error("short key accepted")
+	}
+	if _, err := DecodeRecord([]byte{prefixLegacyAddress, 1}, nil); err == nil {
+		t.Error("unregistered prefix accepted")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	set := func(k, v []byte) {
+		if err := r.DB.Update(func(txn kv.Txn) error { return txn.Put(k, v) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := func() uint64 {
+		v, _, err := r.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// an index from before versioning without undo records cannot be upgraded
+	set(LatestKey, latestValue(0, testHash(0)))
+	if err, ok := r.Migrate().(*SchemaError); !ok || err.Version != 0 {
+		t.Error("expected a version 0 schema error, got", err)
+	}
+
+	// one with undo records is upgraded, and the legacy records removed, but only with an archive to add the block statistics from
+	// an undo record as written before version 5, with no transactions or addresses
+	k, _ := EncodeKV(Undo{Height: 0})
+	set(k, []byte{0})
+	k, v := EncodeKV(Block{Height: 0, Hash: testHash(0)})
+	set(k, v)
+	legacy := []byte{prefixLegacyAddress, 1, 2, 3, 4, 5, 6, 7, 8}
+	set(legacy, []byte{1})
+	if err, ok := r.Migrate().(*SchemaError); !ok || err.Version != 1 || version() != 1 {
+		t.Error("expected a version 1 schema error without an archive, got", err)
+	}
+	dir, err := ioutil.TempDir("", "chainsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if r.Archive, err = OpenArchive(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Archive.Close()
+	if err = r.Archive.Put(0, testHash(0), testChain(t)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if version() != SchemaVersion {
+		t.Error("index not upgraded")
+	}
+	if err := r.DB.View(func(txn kv.Reader) error {
+		_, err := txn.Get(legacy)
+		return err
+	}); err != kv.ErrNotFound {
+		t.Error("legacy record not removed", err)
+	}
+	if stats, err := r.GetBlockStats(0, 0); err != nil || len(stats) != 1 || stats[0].Txs != 1 {
+		t.Error("block statistics not added from the archive", stats, err)
+	}
+	hash := testHash(0)
+	want := []SearchEntry{searchEntry(SearchBlock, hex.EncodeToString(hash), *core.Hash64(&hash))}
+	if undo, err := r.GetUndo(0); err != nil || !reflect.DeepEqual(undo.Search, want) {
+		t.Error("search entry of the block hash not journalled", undo, err)
+	}
+	if err := r.Migrate(); err != nil {
+		t.Error("migrating a current index", err)
+	}
+
+	// an index from a newer version is refused
+	set(SchemaKey, AppendVarint(nil, uint64(SchemaVersion+1)))
+	if _, ok := r.Migrate().(*SchemaError); !ok {
+		t.Error("newer schema accepted")
+	}
+}
+
+func TestMigrateNew(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	if err := r.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if v, isNew, err := r.SchemaVersion(); err != nil || isNew || v != SchemaVersion {
+		t.Error("new index not marked with the current version", v, isNew, err)
+	}
+}
@@ -0,0 +1,310 @@
+package sync
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+const (
+	// SearchChars is the number of characters of an identifier kept in the prefix index after its leading zeroes
+	SearchChars = 8
+	// MinSearchPrefix is the shortest prefix of a hash, transaction id or address that is searched for
+	MinSearchPrefix = 4
+	// SearchLimit is the most results a search returns
+	SearchLimit = 20
+	// maxSearchCandidates is the most prefix index entries looked at in one search, each of which may take an RPC call to check
+	maxSearchCandidates = 200
+)
+
+// The kinds of identifier in the prefix index
+const (
+	SearchBlock   byte = 'b'
+	SearchTx      byte = 't'
+	SearchAddress byte = 'a'
+)
+
+// searchTypes are the result types of each kind of identifier
+var searchTypes = map[byte]string{SearchBlock: "block", SearchTx: "transaction", SearchAddress: "address"}
+
+// SearchResult is a block, transaction or address found by Search. Type is "block", "transaction" or "address".
+type SearchResult struct {
+	Type string `json:"type"`
+	// Height is the height of the block, of the block the transaction is in, or of the first block the address appears in
+	Height uint32 `json:"height"`
+	// Hash is the hash of the block, or of the block the transaction is in
+	Hash    string `json:"hash,omitempty"`
+	TxID    string `json:"txid,omitempty"`
+	TxNum   uint16 `json:"txnum,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// searchEntry returns the prefix index entry of an identifier
+func searchEntry(kind byte, id string, hhash []byte) SearchEntry {
+	zeros := len(id) - len(strings.TrimLeft(id, "0"))
+	if zeros > 255 {
+		zeros = 255
+	}
+	chars := id[zeros:]
+	if len(chars) > SearchChars {
+		chars = chars[:SearchChars]
+	}
+	return SearchEntry{Kind: kind, Zeros: byte(zeros), Chars: chars, HHash: hhash}
+}
+
+// blockSearchEntries returns the prefix index entries for the hash, transactions and addresses of a fetched block
+func blockSearchEntries(f *fetched) (entries []SearchEntry) {
+	entries = append(entries, searchEntry(SearchBlock, hex.EncodeToString(f.hash), *core.Hash64(&f.hash)))
+	for _, txid := range f.block.Tx {
+		entries = append(entries, searchEntry(SearchTx, txid, txHHash(txid)))
+	}
+	for _, addr := range f.touched {
+		if hhash := addressHHash(addr); hhash != nil {
+			entries = append(entries, searchEntry(SearchAddress, addr, hhash))
+		}
+	}
+	return
+}
+
+// indexBlockHashes adds every indexed block hash to the prefix index
+func (r *Node) indexBlockHashes() error {
+	var entries [][]byte
+	err := r.DB.View(func(txn kv.Reader) error {
+		return txn.Iterate([]byte{PrefixBlock}, nil, func(k, v []byte) error {
+			rec, err := DecodeRecord(k, v)
+			if err != nil {
+				return err
+			}
+			hash := rec.(Block).Hash
+			k, _ = EncodeKV(searchEntry(SearchBlock, hex.EncodeToString(hash), *core.Hash64(&hash)))
+			entries = append(entries, k)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	txn := r.DB.NewBatch()
+	defer txn.Discard()
+	for _, k := range entries {
+		if err = txn.Put(k, []byte{}); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// journalBlockHashes rewrites undo records written before schema version 5 to list the search entry of their block's hash, so undoing the block deletes it
+func (r *Node) journalBlockHashes() error {
+	var undos []Undo
+	err := r.DB.View(func(txn kv.Reader) error {
+		return txn.Iterate([]byte{PrefixUndo}, nil, func(k, v []byte) error {
+			undo, err := decodeUndoValue(k, v, false)
+			if err != nil {
+				return err
+			}
+			undos = append(undos, undo)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	txn := r.DB.NewBatch()
+	defer txn.Discard()
+	for _, undo := range undos {
+		hash, err := r.GetBlockHash(undo.Height)
+		if err != nil {
+			return err
+		}
+		if hash != nil {
+			undo.Search = []SearchEntry{searchEntry(SearchBlock, hex.EncodeToString(hash), *core.Hash64(&hash))}
+		}
+		if err = txn.Put(EncodeKV(undo)); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// searchCandidates returns the keys of the records whose identifiers of a kind might start with a prefix. A prefix of only zeroes matches every identifier with at least as many leading zeroes.
+func (r *Node) searchCandidates(kind byte, prefix string) (hhashes [][]byte, err error) {
+	e := searchEntry(kind, prefix, nil)
+	seek, _ := EncodeKV(e)
+	valid := seek
+	if e.Chars == "" {
+		valid = seek[:2]
+	}
+	err = r.DB.View(func(txn kv.Reader) error {
+		return txn.Keys(valid, seek, func(k []byte) error {
+			hhashes = append(hhashes, append([]byte{}, k[len(k)-8:]...))
+			if len(hhashes) >= maxSearchCandidates {
+				return kv.ErrStop
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// Search finds the blocks, transactions and addresses matching a query, which may be a block height, a block hash or transaction id or the start of one, or an address or the start of one. Full matches come first, and at most SearchLimit results are returned.
+//
+// Prefixes of at least MinSearchPrefix characters are found through the prefix index and then checked against the records they point at, which takes an RPC call for each transaction and address, and leaves out entries for blocks that have been rolled back. Transactions and addresses from blocks indexed before the prefix index existed are only found by their full id or address.
+func (r *Node) Search(query string) (results []SearchResult, err error) {
+	q := strings.TrimSpace(query)
+	seen := make(map[SearchResult]bool)
+	add := func(res SearchResult) bool {
+		if !seen[res] && len(results) < SearchLimit {
+			seen[res] = true
+			results = append(results, res)
+		}
+		return len(results) < SearchLimit
+	}
+	if q == "" {
+		return
+	}
+	if h, err := strconv.ParseUint(q, 10, 32); err == nil {
+		if hash, err := r.GetBlockHash(uint32(h)); err != nil {
+			return nil, err
+		} else if hash != nil {
+			add(SearchResult{Type: searchTypes[SearchBlock], Height: uint32(h), Hash: hex.EncodeToString(hash)})
+		}
+	}
+	if isHex(q) {
+		q := strings.ToLower(q)
+		if len(q) == 64 {
+			if res, ok, err := r.searchBlock(nil, q); err != nil {
+				return nil, err
+			} else if ok {
+				add(res)
+			}
+			if res, ok, err := r.searchTx(txHHash(q), q); err != nil {
+				return nil, err
+			} else if ok {
+				add(res)
+			}
+		} else if len(q) >= MinSearchPrefix {
+			for _, kind := range []byte{SearchBlock, SearchTx} {
+				if err = r.searchPrefix(kind, q, add); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if isBase58(q) {
+		if hhash := addressHHash(q); hhash != nil {
+			if res, ok, err := r.searchAddress(hhash, q); err != nil {
+				return nil, err
+			} else if ok {
+				add(res)
+			}
+		}
+		if len(q) >= MinSearchPrefix {
+			err = r.searchPrefix(SearchAddress, q, add)
+		}
+	}
+	return
+}
+
+// searchPrefix adds the identifiers of a kind starting with a prefix to the results until add returns false
+func (r *Node) searchPrefix(kind byte, prefix string, add func(SearchResult) bool) error {
+	hhashes, err := r.searchCandidates(kind, prefix)
+	if err != nil {
+		return err
+	}
+	for _, hhash := range hhashes {
+		var res SearchResult
+		var ok bool
+		switch kind {
+		case SearchBlock:
+			res, ok, err = r.searchBlock(hhash, prefix)
+		case SearchTx:
+			res, ok, err = r.searchTx(hhash, prefix)
+		case SearchAddress:
+			res, ok, err = r.searchAddress(hhash, prefix)
+		}
+		if err != nil {
+			return err
+		}
+		if ok && !add(res) {
+			break
+		}
+	}
+	return nil
+}
+
+// searchBlock returns the block found with a hash record key if its hash starts with a prefix. A full hash is looked up directly when the key is empty.
+func (r *Node) searchBlock(hhash []byte, prefix string) (res SearchResult, ok bool, err error) {
+	var height uint32
+	if len(hhash) == 0 {
+		hash, _ := hex.DecodeString(prefix)
+		height, err = r.GetHeightFromHash(hash)
+	} else {
+		height, err = r.hashHeight(hhash)
+	}
+	if err != nil || height == ^uint32(0) {
+		return
+	}
+	hash, err := r.GetBlockHash(height)
+	if err != nil || hash == nil || !strings.HasPrefix(hex.EncodeToString(hash), prefix) {
+		return
+	}
+	return SearchResult{Type: searchTypes[SearchBlock], Height: height, Hash: hex.EncodeToString(hash)}, true, nil
+}
+
+// searchTx returns the transaction found with a transaction record key if its id starts with a prefix
+func (r *Node) searchTx(hhash []byte, prefix string) (res SearchResult, ok bool, err error) {
+	loc, err := r.txLocation(hhash)
+	if err == ErrTxNotFound {
+		return res, false, nil
+	} else if err != nil {
+		return
+	}
+	txids, err := r.blockTxids(loc.Height)
+	if err == ErrNotIndexed {
+		return res, false, nil
+	} else if err != nil {
+		return
+	}
+	if int(loc.TxNum) >= len(txids) || !strings.HasPrefix(txids[loc.TxNum], prefix) {
+		return
+	}
+	hash, err := r.GetBlockHash(loc.Height)
+	if err != nil {
+		return
+	}
+	res = SearchResult{
+		Type:   searchTypes[SearchTx],
+		Height: loc.Height,
+		Hash:   hex.EncodeToString(hash),
+		TxID:   txids[loc.TxNum],
+		TxNum:  loc.TxNum,
+	}
+	return res, true, nil
+}
+
+// searchAddress returns the address found with an address record key if it starts with a prefix
+func (r *Node) searchAddress(hhash []byte, prefix string) (res SearchResult, ok bool, err error) {
+	locs, err := r.getLocations(hhash)
+	if err != nil || len(locs) == 0 {
+		return
+	}
+	addr, err := r.recoverAddress(addressRecord{hhash: hhash, locs: locs})
+	if err != nil || !strings.HasPrefix(addr, prefix) {
+		return
+	}
+	return SearchResult{Type: searchTypes[SearchAddress], Height: locs[0].Height, Address: addr}, true, nil
+}
+
+// isHex returns true if a string only has hexadecimal digits
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdefABCDEF") == ""
+}
+
+// isBase58 returns true if a string only has the characters of base58
+func isBase58(s string) bool {
+	return strings.Trim(s, "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz") == ""
+}
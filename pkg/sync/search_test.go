@@ -0,0 +1,131 @@
+package sync
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// testGrind appends three bytes to the first input script of a transaction and counts them up until the transaction's id passes a test, to make ids with the prefixes a test needs
+func testGrind(tx *block.Tx, ok func(txid string) bool) string {
+	script := append(tx.Ins[0].Script, 0, 0, 0)
+	tx.Ins[0].Script = script
+	for i := 0; ; i++ {
+		script[len(script)-3], script[len(script)-2], script[len(script)-1] = byte(i>>16), byte(i>>8), byte(i)
+		if id, _ := tx.TxID(); ok(hex.EncodeToString(id)) {
+			return hex.EncodeToString(id)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	// the first two transactions share a prefix, and the third has leading zeros
+	a, b := testCoinbase(t, 1, testAddrs[0]), testCoinbase(t, 2, testAddrs[1])
+	c := block.Tx{Version: 1, Ins: []block.TxIn{{PrevTxHash: make([]byte, 32), PrevTxoutIndex: -1, Script: []byte{1, 3}, Sequence: ^uint32(0)}}}
+	txids := make([]string, 3)
+	txids[0] = testGrind(&a, func(txid string) bool { return !strings.HasPrefix(txid, "0") })
+	txids[1] = testGrind(&b, func(txid string) bool { return txid[:4] == txids[0][:4] })
+	txids[2] = testGrind(&c, func(txid string) bool { return strings.HasPrefix(txid, "00") && txid[2] != '0' })
+	n := testSynced(t, r, testMined(t, []block.Tx{testCoinbase(t, 0, testAddrs[0])}, []block.Tx{a}, []block.Tx{b, c}))
+	defer n.Close()
+
+	search := func(q string) []SearchResult {
+		results, err := r.Search(q)
+		if err != nil {
+			t.Fatal(q, err)
+		}
+		return results
+	}
+	// a block hash may share a short prefix with a transaction id, so only the transactions found are counted
+	transactions := func(q string) (found []SearchResult) {
+		for _, result := range search(q) {
+			if result.Type == "transaction" {
+				found = append(found, result)
+			}
+		}
+		return
+	}
+	block2 := SearchResult{Type: "block", Height: 2, Hash: n.Hash(2)}
+	for _, c := range []struct {
+		query   string
+		results []SearchResult
+	}{
+		{"", nil},
+		{"2", []SearchResult{block2}},
+		{n.Hash(2), []SearchResult{block2}},
+		{strings.ToUpper(n.Hash(2)[:63]), []SearchResult{block2}},
+		{strings.ToUpper(txids[1][:10]), []SearchResult{{Type: "transaction", Height: 2, Hash: block2.Hash, TxID: txids[1]}}},
+		{txids[2], []SearchResult{{Type: "transaction", Height: 2, Hash: block2.Hash, TxID: txids[2], TxNum: 1}}},
+		{txids[2][:5], []SearchResult{{Type: "transaction", Height: 2, Hash: block2.Hash, TxID: txids[2], TxNum: 1}}},
+		{testAddrs[1][:6], []SearchResult{{Type: "address", Height: 2, Address: testAddrs[1]}}},
+		{testAddrs[0], []SearchResult{{Type: "address", Height: 1, Address: testAddrs[0]}}},
+		{txids[0][:3], nil},
+		{"xyz!", nil},
+	} {
+		results := search(c.query)
+		if len(results) != len(c.results) {
+			t.Errorf("search %q expected %v got %v", c.query, c.results, results)
+			continue
+		}
+		for i := range results {
+			if results[i] != c.results[i] {
+				t.Errorf("search %q expected %v got %v", c.query, c.results, results)
+			}
+		}
+	}
+	if results := transactions(txids[0][:4]); len(results) != 2 {
+		t.Error("expected both transactions, got", results)
+	}
+
+	entries := func() (n int) {
+		r.DB.View(func(txn kv.Reader) error {
+			return txn.Keys([]byte{PrefixSearch}, nil, func(k []byte) error {
+				n++
+				return nil
+			})
+		})
+		return
+	}
+	// the genesis block has two entries, its hash and the id of its coinbase
+	if count := entries(); count != 9 {
+		t.Error("expected 9 prefix index entries, got", count)
+	}
+
+	// the entries of an undone block are deleted, except for an address still found in an earlier block
+	if !r.UndoBlock(2).OK() {
+		t.Fatal(r.Error())
+	}
+	if count := entries(); count != 5 {
+		t.Error("expected the 5 entries of blocks 0 and 1 after undoing block 2, got", count)
+	}
+	r.txs.dropBlocks(1)
+	if results := transactions(txids[0][:4]); len(results) != 1 || results[0].TxID != txids[0] {
+		t.Error("expected only the transaction still indexed, got", results)
+	}
+	if results := search(testAddrs[1][:6]); len(results) != 0 {
+		t.Error("expected no addresses, got", results)
+	}
+
+	resp := NewServer(r).Answer(&ServerRequest{Method: "search", Params: []interface{}{"1"}})
+	if results, ok := resp.Result.([]SearchResult); !ok || len(results) != 1 || results[0].Height != 1 {
+		t.Error("unexpected search response", resp)
+	}
+
+	// a rollback without the undo journal finds the entries by the records they point at
+	r.DB.Update(func(txn kv.Txn) error {
+		k, _ := EncodeKV(Undo{Height: 1})
+		return txn.Delete(k)
+	})
+	if !r.Rollback(0).OK() {
+		t.Fatal(r.Error())
+	}
+	if count := entries(); count != 2 {
+		t.Error("expected only the genesis block's entries after rolling back block 1, got", count)
+	}
+}
@@ -0,0 +1,420 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/1lann/msgpack"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+const (
+	// MsgpackContentType is the content type of requests and responses on the msgpack endpoint
+	MsgpackContentType = "application/msgpack"
+	// MsgpackPath is the path of the msgpack endpoint, the JSON endpoint is served on every other path
+	MsgpackPath = "/msgpack"
+)
+
+// ErrParams is returned for a request with missing or malformed parameters
+var ErrParams = errors.New("invalid parameters")
+
+// DefaultProxyMethods are the full node's methods a Server passes through to it unless Proxy is changed. They only read the chain, so clients of the server cannot reach the node's wallet or stop it with the node's credentials.
+var DefaultProxyMethods = map[string]bool{
+	"decoderawtransaction": true,
+	"decodescript":         true,
+	"getbestblockhash":     true,
+	"getblock":             true,
+	"getblockcount":        true,
+	"getconnectioncount":   true,
+	"getdifficulty":        true,
+	"getmininginfo":        true,
+	"getnetworkhashps":     true,
+	"getrawmempool":        true,
+	"getrawtransaction":    true,
+	"gettxout":             true,
+	"gettxoutsetinfo":      true,
+}
+
+// Handler answers one RPC method, taking the positional parameters of the request
+type Handler func(params []interface{}) (result interface{}, err error)
+
+// Server answers search queries from the index over JSON-RPC and msgpack, and passes the methods in Proxy that it does not implement through to the full node. Every request must carry User and Pass with HTTP basic authentication, so a Server refuses everything until Pass is set. Queries only read the database and return their errors, leaving the Node's status alone, so a Server can answer them while Follow keeps the index up to date.
+type Server struct {
+	Node *Node
+	// User and Pass are the credentials clients must authenticate with
+	User string
+	Pass string
+	// Proxy are the methods passed through to the full node, DefaultProxyMethods unless it is changed
+	Proxy    map[string]bool
+	handlers map[string]Handler
+}
+
+// ServerRequest is a request to the Server. Both encodings use the same field names.
+type ServerRequest struct {
+	Method string        `json:"method" cete:"method"`
+	Params []interface{} `json:"params" cete:"params"`
+	ID     interface{}   `json:"id" cete:"id"`
+}
+
+// ServerError is the error member of a response
+type ServerError struct {
+	Code    int    `json:"code" cete:"code"`
+	Message string `json:"message" cete:"message"`
+}
+
+// ServerResponse is a response from the Server
+type ServerResponse struct {
+	Result interface{} `json:"result" cete:"result"`
+	Error  interface{} `json:"error" cete:"error"`
+	ID     interface{} `json:"id" cete:"id"`
+}
+
+// NewServer creates a server for a node with the standard set of search methods
+func NewServer(node *Node) (s *Server) {
+	s = &Server{Node: node, Proxy: DefaultProxyMethods, handlers: make(map[string]Handler)}
+	s.Handle("getaddressbalance", s.getAddressBalance)
+	s.Handle("getaddresshistory", s.getAddressHistory)
+	s.Handle("getaddresstxids", s.getAddressTxids)
+	s.Handle("getaddressutxos", s.getAddressUTXOs)
+	s.Handle("getblockhash", s.getBlockHash)
+	s.Handle("getblockheight", s.getBlockHeight)
+	s.Handle("getindexinfo", s.getIndexInfo)
+	s.Handle("gettxlocation", s.getTxLocation)
+	s.Handle("search", s.search)
+	return
+}
+
+// Handle sets the handler for a method, replacing any existing one
+func (s *Server) Handle(method string, h Handler) *Server {
+	s.handlers[method] = h
+	return s
+}
+
+// authorized returns whether a request carries the server's credentials
+func (s *Server) authorized(req *http.Request) bool {
+	user, pass, ok := req.BasicAuth()
+	return ok && s.Pass != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.User)) == 1 && subtle.ConstantTimeCompare([]byte(pass), []byte(s.Pass)) == 1
+}
+
+// ServeHTTP decodes a request in the encoding selected by the path or content type, answers it, and encodes the response the same way. Requests without the server's credentials are refused, and so are requests whose content type is neither JSON nor msgpack, which a web page can only send after the browser has asked the server whether it may.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chainsync"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method == "GET" && req.URL.Path == EventsPath {
+		s.serveEvents(w, req)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType != "application/json" && contentType != MsgpackContentType {
+		http.Error(w, "content type must be application/json or "+MsgpackContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	useMsgpack := req.URL.Path == MsgpackPath || contentType == MsgpackContentType
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request ServerRequest
+	if useMsgpack {
+		err = msgpack.Unmarshal(body, &request)
+	} else {
+		err = json.Unmarshal(body, &request)
+	}
+	var response ServerResponse
+	if err != nil {
+		response.Error = ServerError{Code: -32700, Message: "parse error: " + err.Error()}
+	} else {
+		response = s.Answer(&request)
+	}
+	if useMsgpack {
+		w.Header().Set("Content-Type", MsgpackContentType)
+		err = msgpack.NewEncoder(w).Encode(toMsgpack(response))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(response)
+	}
+	if err != nil {
+		fmt.Println("writing response", err)
+	}
+}
+
+// Answer runs the handler for a request, or forwards it to the full node if there is none and the method is in Proxy
+func (s *Server) Answer(req *ServerRequest) (resp ServerResponse) {
+	resp.ID = req.ID
+	h, ok := s.handlers[req.Method]
+	if !ok {
+		if !s.Proxy[req.Method] {
+			resp.Error = ServerError{Code: rpc.ErrCodeMethodNotFound, Message: "method not found"}
+			return
+		}
+		return s.proxy(req)
+	}
+	result, err := h(req.Params)
+	if err != nil {
+		code := -1
+		if err == ErrParams || err == ErrBadAddress {
+			code = -8
+		}
+		resp.Error = ServerError{Code: code, Message: err.Error()}
+		return
+	}
+	resp.Result = result
+	return
+}
+
+// proxy passes a request through to the full node and returns its result and error as they were received
+func (s *Server) proxy(req *ServerRequest) (resp ServerResponse) {
+	resp.ID = req.ID
+	params := req.Params
+	if params == nil {
+		params = []interface{}{}
+	}
+	r, err := s.Node.RPC.Call(req.Method, params)
+	if e, ok := err.(*rpc.Error); ok {
+		resp.Error = ServerError{Code: e.Code, Message: e.Message}
+		return
+	} else if err != nil {
+		resp.Error = ServerError{Code: -1, Message: err.Error()}
+		return
+	}
+	resp.Result = r.Result
+	if len(r.Result) == 0 {
+		resp.Result = nil
+	}
+	return
+}
+
+// toMsgpack converts the raw JSON result of a proxied call into plain values so it can be encoded as msgpack
+func toMsgpack(resp ServerResponse) ServerResponse {
+	if raw, ok := resp.Result.(json.RawMessage); ok {
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if d.Decode(&v) == nil {
+			resp.Result = plain(v)
+		}
+	}
+	return resp
+}
+
+// plain converts JSON numbers into integers where they are integral
+func plain(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case []interface{}:
+		for i := range t {
+			t[i] = plain(t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = plain(t[k])
+		}
+	}
+	return v
+}
+
+// paramString returns parameter i as a string
+func paramString(params []interface{}, i int) (string, error) {
+	if i >= len(params) {
+		return "", ErrParams
+	}
+	s, ok := params[i].(string)
+	if !ok {
+		return "", ErrParams
+	}
+	return s, nil
+}
+
+// paramUint returns parameter i as an unsigned integer, or def if it is not given. JSON numbers arrive as float64 and msgpack numbers as any of the integer types.
+func paramUint(params []interface{}, i int, def uint64) (uint64, error) {
+	if i >= len(params) || params[i] == nil {
+		return def, nil
+	}
+	v := reflect.ValueOf(params[i])
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f < 0 || f != float64(uint64(f)) {
+			return 0, ErrParams
+		}
+		return uint64(f), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() < 0 {
+			return 0, ErrParams
+		}
+		return uint64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), nil
+	}
+	return 0, ErrParams
+}
+
+func (s *Server) getAddressBalance(params []interface{}) (interface{}, error) {
+	addr, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	height, err := paramUint(params, 1, uint64(^uint32(0)))
+	if err != nil {
+		return nil, err
+	}
+	if latest, found, err := s.Node.getLatest(); err != nil {
+		return nil, err
+	} else if found && height > uint64(latest) {
+		height = uint64(latest)
+	}
+	balance, err := s.Node.GetAddressBalance(addr, uint32(height))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"address": addr, "balance": balance, "height": height}, nil
+}
+
+func (s *Server) addressHistory(params []interface{}) (history []AddressTx, err error) {
+	addr, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := paramUint(params, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := paramUint(params, 2, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.Node.GetAddressHistory(addr, int(offset), int(limit))
+}
+
+func (s *Server) getAddressHistory(params []interface{}) (interface{}, error) {
+	return s.addressHistory(params)
+}
+
+func (s *Server) getAddressTxids(params []interface{}) (interface{}, error) {
+	history, err := s.addressHistory(params)
+	if err != nil {
+		return nil, err
+	}
+	txids := []string{}
+	for i := range history {
+		if l := len(txids); l == 0 || txids[l-1] != history[i].TxID {
+			txids = append(txids, history[i].TxID)
+		}
+	}
+	return txids, nil
+}
+
+func (s *Server) getAddressUTXOs(params []interface{}) (interface{}, error) {
+	addr, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := s.Node.GetAddressUTXOs(addr)
+	if utxos == nil {
+		utxos = []UTXO{}
+	}
+	return utxos, err
+}
+
+func (s *Server) getBlockHash(params []interface{}) (interface{}, error) {
+	height, err := paramUint(params, 0, uint64(^uint32(0)))
+	if err != nil || height > uint64(^uint32(0)) {
+		return nil, ErrParams
+	}
+	hash, err := s.Node.GetBlockHash(uint32(height))
+	if err != nil {
+		return nil, err
+	} else if hash == nil {
+		return nil, ErrNotIndexed
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+func (s *Server) getBlockHeight(params []interface{}) (interface{}, error) {
+	hashS, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hex.DecodeString(hashS)
+	if err != nil || len(hash) != 32 {
+		return nil, ErrParams
+	}
+	height, err := s.Node.GetHeightFromHash(hash)
+	if err != nil {
+		return nil, err
+	} else if height == ^uint32(0) {
+		return nil, ErrNotIndexed
+	}
+	return height, nil
+}
+
+func (s *Server) getIndexInfo(params []interface{}) (interface{}, error) {
+	latest, found, err := s.Node.getLatest()
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{"synced": found}
+	if found {
+		hash, err := s.Node.GetBlockHash(latest)
+		if err != nil {
+			return nil, err
+		}
+		info["height"], info["hash"] = latest, hex.EncodeToString(hash)
+	}
+	return info, nil
+}
+
+func (s *Server) getTxLocation(params []interface{}) (interface{}, error) {
+	txid, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := s.Node.GetTxLocation(txid)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := s.Node.GetBlockHash(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"height":    loc.Height,
+		"txnum":     loc.TxNum,
+		"blockhash": hex.EncodeToString(hash),
+	}, nil
+}
+
+func (s *Server) search(params []interface{}) (interface{}, error) {
+	query, err := paramString(params, 0)
+	if err != nil {
+		return nil, err
+	}
+	results, err := s.Node.Search(query)
+	if results == nil {
+		results = []SearchResult{}
+	}
+	return results, err
+}
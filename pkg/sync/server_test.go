@@ -0,0 +1,131 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/1lann/msgpack"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+// testServer serves a node's Server over HTTP with the credentials testRequest sends
+func testServer(r *Node) *httptest.Server {
+	s := NewServer(r)
+	s.User, s.Pass = "user", "pa55word"
+	return httptest.NewServer(s)
+}
+
+// testRequest sends a request to a test server with its credentials, and a body of a content type if it is a POST
+func testRequest(t *testing.T, method, url, contentType string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.SetBasicAuth("user", "pa55word")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestServer(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	n := rpctest.NewNode(Mainnet, rpctest.Generate(nil, 1))
+	defer n.Close()
+	r.RPC = n.Client()
+	h := testHash(3)
+	r.DB.Update(func(txn kv.Txn) error {
+		k1, v1 := EncodeKV(Block{Height: 3, Hash: h})
+		k2, v2 := EncodeKV(Hash{HHash: *core.Hash64(&h), Height: 3})
+		txn.Put(k1, v1)
+		txn.Put(k2, v2)
+		return txn.Put([]byte("latest"), append(*core.IntToBytes(uint32(3)), h...))
+	})
+	srv := testServer(r)
+	defer srv.Close()
+
+	post := func(req ServerRequest) (resp map[string]interface{}) {
+		body, _ := json.Marshal(req)
+		res := testRequest(t, "POST", srv.URL, "application/json", body)
+		defer res.Body.Close()
+		json.NewDecoder(res.Body).Decode(&resp)
+		return
+	}
+	resp := post(ServerRequest{Method: "getblockhash", Params: []interface{}{3}, ID: 1})
+	if resp["result"] != hex.EncodeToString(h) || resp["error"] != nil || resp["id"] != float64(1) {
+		t.Error("unexpected getblockhash response", resp)
+	}
+	resp = post(ServerRequest{Method: "getblockhash", Params: []interface{}{"three"}, ID: 2})
+	if e, ok := resp["error"].(map[string]interface{}); !ok || e["code"] != float64(-8) {
+		t.Error("expected parameter error, got", resp)
+	}
+	resp = post(ServerRequest{Method: "getdifficulty", Params: []interface{}{}, ID: 3})
+	if resp["result"] != float64(1) || resp["error"] != nil {
+		t.Error("chain method was not passed through to the node", resp)
+	}
+	// wallet and control methods never reach the node
+	for _, method := range []string{"dumpprivkey", "sendtoaddress", "stop"} {
+		resp = post(ServerRequest{Method: method, Params: []interface{}{}, ID: 3})
+		if e, ok := resp["error"].(map[string]interface{}); !ok || e["code"] != float64(rpc.ErrCodeMethodNotFound) || n.Received(method) != 0 {
+			t.Error(method, "was passed through to the node", resp)
+		}
+	}
+
+	// requests without the credentials or of another content type are refused before they are read
+	body, _ := json.Marshal(ServerRequest{Method: "getindexinfo", Params: []interface{}{}, ID: 1})
+	res, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Error("request without credentials answered with", res.Status)
+	}
+	if res = testRequest(t, "POST", srv.URL, "text/plain", body); res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("text/plain request answered with", res.Status)
+	}
+	res.Body.Close()
+	if res = testRequest(t, "POST", srv.URL, "application/json; charset=utf-8", body); res.StatusCode != http.StatusOK {
+		t.Error("JSON request with a charset answered with", res.Status)
+	}
+	res.Body.Close()
+
+	body, _ = msgpack.Marshal(ServerRequest{Method: "getblockheight", Params: []interface{}{hex.EncodeToString(h)}, ID: 4})
+	res = testRequest(t, "POST", srv.URL+MsgpackPath, MsgpackContentType, body)
+	defer res.Body.Close()
+	var mresp ServerResponse
+	if err := msgpack.NewDecoder(res.Body).Decode(&mresp); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := paramUint([]interface{}{mresp.Result}, 0, 0); height != 3 || mresp.Error != nil {
+		t.Error("unexpected msgpack getblockheight response", mresp)
+	}
+
+	// queries run alongside a sync, so they must leave an error it set for it to find
+	r.SetStatus("commit failed")
+	post(ServerRequest{Method: "getindexinfo", Params: []interface{}{}, ID: 5})
+	if r.OK() {
+		t.Error("a query cleared the node's status")
+	}
+	r.UnsetStatus()
+
+	// a block record longer than a hash is an error rather than a panic
+	r.DB.Update(func(txn kv.Txn) error {
+		k, _ := EncodeKV(Block{Height: 4})
+		return txn.Put(k, make([]byte, 33))
+	})
+	resp = post(ServerRequest{Method: "getblockhash", Params: []interface{}{4}, ID: 6})
+	if resp["error"] == nil {
+		t.Error("expected an error for a corrupt block record, got", resp)
+	}
+}
@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"fmt"
+	gosync "sync"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+// DefaultOutputCacheSize is the number of transactions whose output addresses are remembered for resolving the inputs that spend them
+const DefaultOutputCacheSize = 1 << 16
+
+// output is the addresses and value of a transaction output
+type output struct {
+	addrs []string
+	value uint64
+}
+
+// outputCache remembers the addresses and value of each output of recently seen transactions, so that inputs spending them can be resolved without another RPC call. Most coins are spent soon after they are received, so even a small cache saves most of the lookups.
+type outputCache struct {
+	gosync.Mutex
+	outs map[string][]output
+	max  int
+}
+
+func newOutputCache(max int) *outputCache {
+	return &outputCache{outs: make(map[string][]output), max: max}
+}
+
+func (c *outputCache) get(txid string) (outs []output, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	outs, ok = c.outs[txid]
+	return
+}
+
+// put stores the outputs of a transaction. When the cache is full an arbitrary entry is evicted, which is cheap and good enough since map iteration order is random.
+func (c *outputCache) put(tx *rpc.RawTransaction) (outs []output) {
+	outs = make([]output, len(tx.Vout))
+	for _, vout := range tx.Vout {
+		if vout.N >= 0 && vout.N < len(outs) {
+			outs[vout.N] = output{addrs: vout.ScriptPubKey.Addresses, value: toSatoshis(vout.Value)}
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.outs) >= c.max {
+		for k := range c.outs {
+			delete(c.outs, k)
+			break
+		}
+	}
+	c.outs[tx.Txid] = outs
+	return
+}
+
+// txLoader returns a transaction by id from wherever a block source keeps them
+type txLoader func(txid string) (*rpc.RawTransaction, error)
+
+// rpcTx asks the full node for a transaction
+func (r *Node) rpcTx(txid string) (tx *rpc.RawTransaction, err error) {
+	if tx, err = r.RPC.GetRawTransaction(txid); err != nil {
+		return nil, fmt.Errorf("getrawtransaction %s: %v", txid, err)
+	}
+	return
+}
+
+// prevout returns output n of transaction txid, loading the transaction if it is not in the output cache
+func (r *Node) prevout(txid string, n int, load txLoader) (out output, err error) {
+	outs, ok := r.outputs.get(txid)
+	if !ok {
+		var tx *rpc.RawTransaction
+		if tx, err = load(txid); err != nil {
+			return
+		}
+		outs = r.outputs.put(tx)
+	}
+	if n < 0 || n >= len(outs) {
+		return out, fmt.Errorf("transaction %s has no output %d", txid, n)
+	}
+	return outs[n], nil
+}
+
+// resolveSpends finds the funding addresses of every input of the block's transactions, and totals the fees the block's transactions pay. The outputs of the block itself are cached first so that spends within the same block are found without loading them.
+func (r *Node) resolveSpends(f *fetched, load txLoader) error {
+	for _, tx := range f.txs {
+		if tx != nil {
+			r.outputs.put(tx)
+		}
+	}
+	f.spends = make([][]string, len(f.txs))
+	for j, tx := range f.txs {
+		if tx == nil {
+			continue
+		}
+		var in, out uint64
+		coinbase := false
+		for _, vin := range tx.Vin {
+			if vin.Coinbase != "" || vin.Txid == "" {
+				coinbase = true
+				continue
+			}
+			prev, err := r.prevout(vin.Txid, vin.Vout, load)
+			if err != nil {
+				return err
+			}
+			f.spends[j] = append(f.spends[j], prev.addrs...)
+			in += prev.value
+		}
+		for _, vout := range tx.Vout {
+			out += toSatoshis(vout.Value)
+		}
+		if !coinbase && in > out {
+			f.fees += in - out
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// PowAlgos are the names of the proof of work algorithms by id, as the full node reports them in pow_algo
+var PowAlgos = []string{"sha256d", "scrypt"}
+
+// AlgoName returns the name of a proof of work algorithm id
+func AlgoName(id uint32) string {
+	if int(id) < len(PowAlgos) {
+		return PowAlgos[id]
+	}
+	return fmt.Sprint("algo", id)
+}
+
+// versionAlgo returns the proof of work algorithm id of a block version, which is held in the bits from 9 up, so version 2 is sha256d and 514 is scrypt
+func versionAlgo(version uint32) uint32 {
+	return version >> 9 & 7
+}
+
+// bitsDifficulty computes the difficulty of a compact target, the ratio of the target with bits 0x1d00ffff to it, the same way the full node does
+func bitsDifficulty(bits uint32) float64 {
+	target := func(bits uint32) *big.Float {
+		mantissa := new(big.Float).SetInt64(int64(bits & 0xffffff))
+		return mantissa.SetMantExp(mantissa, 8*(int(bits>>24)-3))
+	}
+	t := target(bits)
+	if t.Sign() == 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(target(0x1d00ffff), t).Float64()
+	return d
+}
+
+// blockStats summarises a fetched block
+func blockStats(f *fetched) Stats {
+	s := Stats{
+		Height:     f.height,
+		Time:       f.block.Time,
+		Algo:       f.block.PowAlgoID,
+		Difficulty: f.block.Difficulty,
+		Txs:        uint32(len(f.block.Tx)),
+		Size:       f.block.Size,
+		Fees:       f.fees,
+	}
+	if bits, err := strconv.ParseUint(f.block.Bits, 16, 32); err == nil {
+		s.Bits = uint32(bits)
+	}
+	for _, tx := range f.txs {
+		if tx == nil {
+			continue
+		}
+		for _, vout := range tx.Vout {
+			s.Value += toSatoshis(vout.Value)
+		}
+	}
+	return s
+}
+
+// fillStats writes the statistics records of every indexed block from the archive, which must hold them all, for an index from before statistics were recorded. The blocks are read the same way Reindex reads them, so the fees are found through the transaction index.
+func (r *Node) fillStats() error {
+	latest, found, err := r.getLatest()
+	if err != nil || !found {
+		return err
+	}
+	if !r.archiveCovers(latest) {
+		return ErrNoArchive
+	}
+	batchSize := r.BatchSize
+	if batchSize < 1 {
+		batchSize = DefaultBatchSize
+	}
+	r.initCaches()
+	src := &archiveSource{r: r, recent: newRecentTxs(4 * batchSize)}
+	txn := r.DB.NewBatch()
+	defer txn.Discard()
+	for h := uint32(0); h <= latest; h++ {
+		f := src.fetch(h)
+		if f.err != nil {
+			return fmt.Errorf("block %d: %v", h, f.err)
+		}
+		stored, err := r.GetBlockHash(h)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", h, err)
+		}
+		if !bytes.Equal(stored, f.hash) {
+			return fmt.Errorf("archived block %d is not the indexed one", h)
+		}
+		if err = txn.Put(EncodeKV(blockStats(f))); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// archiveCovers returns true if the archive holds every block up to a height
+func (r *Node) archiveCovers(height uint32) bool {
+	return r.Archive != nil && height < r.Archive.Count()
+}
+
+// GetBlockStats returns the statistics records of the blocks from one height to another inclusive. Blocks indexed before statistics were recorded are left out.
+func (r *Node) GetBlockStats(from, to uint32) (out []Stats, err error) {
+	err = r.DB.View(func(txn kv.Reader) error {
+		for h := from; h <= to; h++ {
+			k, _ := EncodeKV(Stats{Height: h})
+			v, err := txn.Get(k)
+			if err == nil {
+				rec, err := DecodeRecord(k, v)
+				if err != nil {
+					return err
+				}
+				out = append(out, rec.(Stats))
+			} else if err != kv.ErrNotFound {
+				return err
+			}
+			if h == ^uint32(0) {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// SeriesQuery selects the blocks of a statistics time series and how they are grouped into points
+type SeriesQuery struct {
+	// From and To are the first and last heights, and To is capped at the latest indexed block
+	From, To uint32
+	// Since and Until, if not zero, only include blocks with a time at or after Since and before Until
+	Since, Until int64
+	// Step is the width of each point in seconds of block time, aligned to the epoch, or in blocks from From if ByHeight is set. A Step less than one puts every block in a single point.
+	Step     int64
+	ByHeight bool
+}
+
+// AlgoPoint is the statistics of the blocks of one proof of work algorithm in a point of a series
+type AlgoPoint struct {
+	Blocks int `json:"blocks"`
+	// Interval is the average time in seconds from the previous block of the same algorithm
+	Interval float64 `json:"interval"`
+	// Difficulty is the average difficulty
+	Difficulty float64 `json:"difficulty"`
+	// Hashrate is the estimated hashes per second, the average difficulty times 2^32 divided by the average interval
+	Hashrate  float64 `json:"hashrate"`
+	intervals int
+	total     int64
+}
+
+// SeriesPoint is the statistics of the blocks in one step of a series. Values are in base units.
+type SeriesPoint struct {
+	// Start is the time or height the step starts at
+	Start int64 `json:"start"`
+	// First and Last are the lowest and highest heights in the step
+	First  uint32                `json:"first"`
+	Last   uint32                `json:"last"`
+	Blocks int                   `json:"blocks"`
+	Txs    uint64                `json:"txs"`
+	Size   uint64                `json:"size"`
+	Value  uint64                `json:"value"`
+	Fees   uint64                `json:"fees"`
+	Algos  map[string]*AlgoPoint `json:"algos"`
+}
+
+// StatsSeries groups the statistics of the blocks selected by a query into points, in order of their start
+func (r *Node) StatsSeries(q SeriesQuery) (series []*SeriesPoint, err error) {
+	latest, found, err := r.getLatest()
+	if err != nil {
+		return
+	} else if !found {
+		return nil, ErrNotIndexed
+	}
+	if q.To > latest {
+		q.To = latest
+	}
+	if q.From > q.To {
+		return
+	}
+	stats, err := r.GetBlockStats(q.From, q.To)
+	if err != nil {
+		return
+	}
+	points := make(map[int64]*SeriesPoint)
+	// the previous block of each algorithm is tracked through the blocks left out by the time range, so the first interval in it is known
+	prev := make(map[uint32]int64)
+	for _, s := range stats {
+		last, seen := prev[s.Algo]
+		prev[s.Algo] = s.Time
+		if q.Since != 0 && s.Time < q.Since || q.Until != 0 && s.Time >= q.Until {
+			continue
+		}
+		var start int64
+		switch {
+		case q.Step < 1:
+		case q.ByHeight:
+			start = int64(q.From) + (int64(s.Height)-int64(q.From))/q.Step*q.Step
+		default:
+			start = s.Time - (s.Time%q.Step+q.Step)%q.Step
+		}
+		p, ok := points[start]
+		if !ok {
+			p = &SeriesPoint{Start: start, First: s.Height, Algos: make(map[string]*AlgoPoint)}
+			points[start] = p
+			series = append(series, p)
+		}
+		p.Last = s.Height
+		p.Blocks++
+		p.Txs += uint64(s.Txs)
+		p.Size += uint64(s.Size)
+		p.Value += s.Value
+		p.Fees += s.Fees
+		a, ok := p.Algos[AlgoName(s.Algo)]
+		if !ok {
+			a = new(AlgoPoint)
+			p.Algos[AlgoName(s.Algo)] = a
+		}
+		a.Blocks++
+		a.Difficulty += s.Difficulty
+		if seen {
+			a.intervals++
+			a.total += s.Time - last
+		}
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Start < series[j].Start })
+	for _, p := range series {
+		for _, a := range p.Algos {
+			a.Difficulty /= float64(a.Blocks)
+			if a.intervals > 0 {
+				a.Interval = float64(a.total) / float64(a.intervals)
+			}
+			if a.Interval > 0 {
+				a.Hashrate = a.Difficulty * math.Exp2(32) / a.Interval
+			}
+		}
+	}
+	return
+}
+
+// WriteSeriesCSV writes a series as CSV with a header line. The columns for each algorithm in PowAlgos follow the totals, prefixed with its name.
+func WriteSeriesCSV(w io.Writer, series []*SeriesPoint) error {
+	out := csv.NewWriter(w)
+	header := []string{"start", "first", "last", "blocks", "txs", "size", "value", "fees"}
+	for _, algo := range PowAlgos {
+		header = append(header, algo+"_blocks", algo+"_interval", algo+"_difficulty", algo+"_hashrate")
+	}
+	out.Write(header)
+	u := func(x uint64) string { return strconv.FormatUint(x, 10) }
+	f := func(x float64) string { return strconv.FormatFloat(x, 'g', -1, 64) }
+	for _, p := range series {
+		row := []string{strconv.FormatInt(p.Start, 10), u(uint64(p.First)), u(uint64(p.Last)), strconv.Itoa(p.Blocks), u(p.Txs), u(p.Size), u(p.Value), u(p.Fees)}
+		for _, algo := range PowAlgos {
+			a, ok := p.Algos[algo]
+			if !ok {
+				a = new(AlgoPoint)
+			}
+			row = append(row, strconv.Itoa(a.Blocks), f(a.Interval), f(a.Difficulty), f(a.Hashrate))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
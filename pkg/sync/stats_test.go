@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/rpc"
+)
+
+func TestBitsDifficulty(t *testing.T) {
+	for _, c := range []struct {
+		bits       uint32
+		difficulty float64
+	}{
+		{0x1d00ffff, 1},
+		{0x1b0404cb, 16307.420938523983},
+		{0x1c33d82a, 4.937778},
+	} {
+		if d := bitsDifficulty(c.bits); math.Abs(d-c.difficulty)/c.difficulty > 1e-5 {
+			t.Errorf("difficulty of %x expected %v got %v", c.bits, c.difficulty, d)
+		}
+	}
+	if versionAlgo(2) != 0 || versionAlgo(514) != 1 {
+		t.Error("wrong algorithm from block version")
+	}
+}
+
+func TestStatsSeries(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	r.initCaches()
+
+	// block 2 spends 50 from block 1 and pays out 49.9, so it pays 0.1 in fees
+	coinbase := &rpc.RawTransaction{Txid: "aa", Vin: []rpc.Vin{{Coinbase: "00"}}, Vout: []rpc.Vout{{Value: 50, N: 0}}}
+	spend := &rpc.RawTransaction{Txid: "bb", Vin: []rpc.Vin{{Txid: "aa", Vout: 0}}, Vout: []rpc.Vout{{Value: 49.9, N: 0}}}
+	blocks := []rpc.GetBlock{
+		{Time: 1000, PowAlgoID: 0, Bits: "1d00ffff", Difficulty: 1, Size: 200, Tx: []string{"aa"}},
+		{Time: 1300, PowAlgoID: 1, Bits: "1e0fffff", Difficulty: 2, Size: 300, Tx: []string{"bb"}},
+		{Time: 1400, PowAlgoID: 0, Bits: "1d00ffff", Difficulty: 3, Size: 400},
+		{Time: 2000, PowAlgoID: 1, Bits: "1e0fffff", Difficulty: 4, Size: 500},
+	}
+	batch := newBatch()
+	for i, blk := range blocks {
+		f := &fetched{height: uint32(i + 1), hash: testHash(uint32(i + 1)), block: blk}
+		switch i {
+		case 0:
+			f.txs = []*rpc.RawTransaction{coinbase}
+		case 1:
+			f.txs = []*rpc.RawTransaction{spend}
+		}
+		if err := r.resolveSpends(f, func(string) (*rpc.RawTransaction, error) { return coinbase, nil }); err != nil {
+			t.Fatal(err)
+		}
+		batch.add(f)
+	}
+	if err := r.commit(batch, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.GetBlockStats(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 4 {
+		t.Fatal("expected 4 records, got", len(stats))
+	}
+	if s := stats[1]; s != (Stats{Height: 2, Time: 1300, Algo: 1, Bits: 0x1e0fffff, Difficulty: 2, Txs: 1, Size: 300, Value: 4990000000, Fees: 10000000}) {
+		t.Errorf("unexpected record %+v", s)
+	}
+
+	series, err := r.StatsSeries(SeriesQuery{From: 1, To: 100, Step: 2, ByHeight: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Start != 1 || series[0].Blocks != 2 || series[0].Fees != 10000000 ||
+		series[1].Start != 3 || series[1].First != 3 || series[1].Last != 4 {
+		t.Error("unexpected series by height", series)
+	}
+	sha := series[1].Algos["sha256d"]
+	if sha == nil || sha.Blocks != 1 || sha.Interval != 400 || sha.Difficulty != 3 || sha.Hashrate != 3*math.Exp2(32)/400 {
+		t.Errorf("unexpected sha256d point %+v", sha)
+	}
+
+	if series, err = r.StatsSeries(SeriesQuery{From: 1, To: 4, Since: 1200, Step: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Start != 1000 || series[0].Blocks != 2 || series[1].Start != 2000 ||
+		series[1].Algos["scrypt"].Interval != 700 {
+		t.Error("unexpected series by time", series)
+	}
+	var out bytes.Buffer
+	if err = WriteSeriesCSV(&out, series); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "start,first,last,blocks,txs,size,value,fees,sha256d_blocks,") ||
+		lines[2] != "2000,4,4,1,0,500,0,0,0,0,0,0,1,700,4,2.4542670262857143e+07" {
+		t.Error("unexpected CSV", lines)
+	}
+
+	if !r.UndoBlock(4).OK() {
+		t.Fatal(r.Error())
+	}
+	if stats, _ = r.GetBlockStats(4, 4); len(stats) != 0 {
+		t.Error("statistics record not removed with the block")
+	}
+}
@@ -1,13 +1,14 @@
 package sync
 
 import (
+	gosync "sync"
+
 	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
 	"github.com/parallelcointeam/duo/pkg/rpc"
-
-	"github.com/dgraph-io/badger"
 )
 
-// Node is a sync client that updates by polling from full node, but will eventually implement as a standalone p2p client
+// Node is a sync client that updates by polling a full node over RPC, or by downloading blocks from a full node over the peer to peer wire protocol if Peer is set
 //
 // Records structures
 //
@@ -15,12 +16,29 @@ import (
 //
 // For decoding these abbreviated storage formats, the proper full length is known and the bytes are padded first to restore orignial format and then converted into the format specified, block hash has its prefix zeroes readded, which are required to generate the correct hhash64
 type Node struct {
-	RPC        *rpc.Client
-	DB         *badger.DB
+	RPC *rpc.Client
+	// DB is the store the index is kept in, a badger database as NewNode opens it, or a kv.Memory store for tests
+	DB         kv.Store
 	Latest     uint32
 	LatestHash []byte
 	Best       uint32
 	BestTime   int64
+	// Network is the network the full node is on, Mainnet if it is not set
+	Network string
+	// Archive, if set, stores the raw blocks as they are indexed so the index can be rebuilt offline with Reindex
+	Archive *Archive
+	// Peer, if set, is the address of a full node Sync downloads blocks from over the peer to peer wire protocol instead of the RPC server, see SyncPeer
+	Peer string
+	// Genesis is the hash of the genesis block the chain a peer serves must start from, GenesisHashes of Network if it is not set
+	Genesis string
+	// Workers is the number of concurrent RPC fetch workers used by Sync
+	Workers int
+	// BatchSize is the number of blocks merged in memory and committed to the database at once by Sync
+	BatchSize int
+	outputs   *outputCache
+	txs       *txCache
+	cacheOnce gosync.Once
+	events    hub
 	core.State
 }
 
@@ -40,7 +58,7 @@ type Hash struct {
 	Height uint32
 }
 
-// Address is a record that notes the places an address appears by block and transaction.
+// Address is a record that notes the places an address appears by block and transaction, both where it received coins and where it spent them.
 //
 // This is a necessary index for searching for information about addresses, especially calculating their balance at a given height.
 type Address struct {
@@ -48,14 +66,71 @@ type Address struct {
 	//     HighwayHash 64 bit hash of 160 bit address
 	HHash []byte
 	// value
-	//     This is stored as a single value, 4 bytes for height, 2 bytes to specify the position of the address' appearance in the array of transactions.
+	//     This is stored as a single snappy compressed value, for each location the height as a varint delta from the previous location and the transaction number and spend flag as a varint.
 	Locations []Location
 }
 
 // Location is a specification for a transaction in a block. 32 bits encodes up to 4 billion (more than enough) blocks and 16 bits for transaction number allows addressing up to 65536 transactions in the array inside a block, which is precisely the information required to gather the inputs and outputs and compute a balance.
+//
+// Spend distinguishes a debit, where the address funded one of the transaction's inputs, from a credit, where it received one of the outputs. An address that does both in one transaction has two locations. On disk the flag is the lowest bit of the transaction number varint.
 type Location struct {
 	Height uint32
 	TxNum  uint16
+	Spend  bool
+}
+
+// ref returns the transaction number and spend flag packed into the integer stored on disk
+func (l Location) ref() uint64 {
+	ref := uint64(l.TxNum) << 1
+	if l.Spend {
+		ref |= 1
+	}
+	return ref
+}
+
+// refLocation unpacks a stored transaction number and spend flag into a Location
+func refLocation(height uint32, ref uint64) Location {
+	return Location{Height: height, TxNum: uint16(ref >> 1), Spend: ref&1 == 1}
+}
+
+// Tx links a transaction id to the block and position in the block it was mined at, so that any transaction can be served from the block without the full node's transaction index. This record type is identified by a prefix 64 byte
+type Tx struct {
+	// key
+	//     HighwayHash 64 of the 256 bit transaction id
+	HHash []byte
+	// value
+	//     height and transaction number as varints, the spend flag is not used
+	Location Location
+}
+
+// Stats is the summary of a block kept for charting the chain over time. This record type is identified by a prefix 128 byte
+type Stats struct {
+	// key
+	//     height is stored as a varint as in the Block record
+	Height uint32
+	// value
+	//     time, algorithm, transaction count, size, output value and fees as varints, then bits as 4 bytes big endian and difficulty as an 8 byte little endian float
+	Time int64
+	// Algo is the proof of work algorithm id, 0 for sha256d and 1 for scrypt
+	Algo       uint32
+	Bits       uint32
+	Difficulty float64
+	Txs        uint32
+	Size       uint32
+	// Value is the total value of the block's outputs, including the coinbase
+	Value uint64
+	// Fees is the total fees paid by the block's transactions
+	Fees uint64
+}
+
+// SearchEntry is an entry in the prefix index used to search for blocks, transactions and addresses by the start of their hash, id or address, which the other records only hold a HighwayHash of. The whole entry is in the key, and the value is empty. This record type is identified by a prefix 3 byte
+type SearchEntry struct {
+	// key
+	//     the kind of identifier, a byte count of its leading '0' characters, up to SearchChars characters following them, and the HighwayHash 64 key of the record it is found with
+	Kind  byte
+	Zeros byte
+	Chars string
+	HHash []byte
 }
 
 // BalanceCache is a result cache that stores the results of previous queries of balances of an address with the contemporary best block height so subsequent queries don't have to make as many RPC queries to get the answer.
@@ -72,3 +147,21 @@ type BalanceCache struct {
 	// Height is trailing zero trimmed
 	Height uint32
 }
+
+// Undo is the journal of the changes a block made to the address index, so that the block can be removed again in a rollback. This record type is identified by a prefix 32 byte
+type Undo struct {
+	// key
+	//     height is stored as a varint as in the Block record
+	Height uint32
+	// value
+	//     a varint count of the block's transactions and the 8 byte HHash of each transaction id, then a varint count of the search prefix entries written for the block and the kind, zero count, varint length of the characters, the characters and the 8 byte HHash of each, then for each address 8 bytes of address HHash followed by a varint count of the locations and then the transaction number and spend flag of each location as varints
+	Txs     [][]byte
+	Search  []SearchEntry
+	Entries []UndoEntry
+}
+
+// UndoEntry lists the locations an address record gained in a block
+type UndoEntry struct {
+	HHash     []byte
+	Locations []Location
+}
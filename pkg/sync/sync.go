@@ -1,201 +1,95 @@
 package sync
 
 import (
-	"encoding/binary"
+	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
-	"strconv"
 
-	"github.com/anaskhan96/base58check"
-	homedir "github.com/mitchellh/go-homedir"
-
-	"github.com/dgraph-io/badger"
-	"github.com/parallelcointeam/duo/pkg/core"
-	"github.com/parallelcointeam/duo/pkg/rpc"
-	"github.com/parallelcointeam/duo/pkg/wallet/db"
+	"github.com/parallelcointeam/duo/pkg/kv"
 )
 
-// NewNode creates a new blockchain sync node/server
-func NewNode() (r *Node) {
-	r = new(Node)
-	r.RPC = rpc.NewClient("127.0.0.1", 11048, "user", "pa55word", false)
-
-	var path string
-	var err error
-	if path, err = homedir.Dir(); err != nil {
-		fmt.Println("getting homedir", err.Error())
-		os.Exit(1)
-	}
-
-	blockstoreBaseDir := path + "/" + db.DefaultBaseDir
-
-	dbOptions := &badger.DefaultOptions
-	// dbOptions.ValueThreshold = 40960
-	// dbOptions.NumVersionsToKeep = 1
-	dbOptions.Dir = blockstoreBaseDir + "/index"
-	dbOptions.ValueDir = dbOptions.Dir + "/values"
-	db, err := badger.Open(*dbOptions)
-	if err != nil {
-		fmt.Println("opening db", err.Error())
-		os.Exit(1)
-	}
-	r.DB = db
-
-	return
-}
-
 // Close shuts down the blockchain sync server
 func (r *Node) Close() *Node {
+	if r.Archive != nil {
+		r.SetStatusIf(r.Archive.Close())
+	}
 	r.DB.Close()
 	return r
 }
 
-// Sync updates the blockchain to the latest current available block height
+// Sync updates the blockchain to the latest current available block height.
+//
+// Blocks and their transactions are prefetched ahead of the cursor by a pool of RPC workers, and the address updates for each batch of blocks are merged in memory and committed together, strictly in height order so the latest record is always consistent with the rest of the index.
+//
+// Each new block's previous block hash is checked against the hash of the block below it. If they differ the full node has reorganised, so the index is rolled back to the fork point and the winning branch is indexed from there.
+//
+// If Peer is set the blocks are downloaded from it with SyncPeer instead.
 func (r *Node) Sync() *Node {
-	startHeight := r.getLatest()
+	if r.Peer != "" {
+		return r.SyncPeer(r.Peer)
+	}
+	var startHeight uint32
 	// If we got a latest height we are assuming that the database is consistent up to this point. If we find errors or just want to recheck we can just delete the latest key and run this function and it will start from zero
-
-	bestBlockHeight := r.LegacyGetBestBlockHeight()
-
-	var v []byte
-	var lastBlockUpdated uint32
-	for i := startHeight; i <= bestBlockHeight; i++ {
-		foundtx := false
-		foundrepeat := false
-		h := r.LegacyGetBlockHash(i)
-		k1, v1 := EncodeKV(Block{Height: i, Hash: h})
-		k2, v2 := EncodeKV(Hash{
-			HHash:  *core.Hash64(&h),
-			Height: i,
-		})
-
-		// Set the keys for the forward and reverse height/hash lookup table
-		r.SetStatusIf(r.DB.Update(func(txn *badger.Txn) error {
-			err := txn.SetWithDiscard(k1, v1, 0)
-			if err != nil {
-				return err
-			}
-			err = txn.SetWithDiscard(k2, v2, 0)
-			return err
-		}))
-
-		// Update the address index, append the new reference if the record already exists
-		resp, err := r.RPC.Call("getblock", []interface{}{hex.EncodeToString(h), true})
+	latest, found, err := r.getLatest()
+	if !r.SetStatusIf(err).OK() {
+		fmt.Println("reading latest block", r.Error())
+		return r
+	}
+	if found {
+		// The tip itself may have been replaced while we were not running
+		current, err := r.LegacyGetBlockHash(latest)
 		if !r.SetStatusIf(err).OK() {
-			fmt.Println("getting block", r.Error())
+			fmt.Println("checking latest block", r.Error())
+			return r
 		}
-		var blk rpc.GetBlock
-		if !r.SetStatusIf(json.Unmarshal(resp.Result, &blk)).OK() {
-			fmt.Println("unmarshalling block json", r.Error())
+		stored, err := r.GetBlockHash(latest)
+		if !r.SetStatusIf(err).OK() {
+			fmt.Println("checking latest block", r.Error())
 			return r
 		}
-
-		hugeaddr := false
-		for j := range blk.Tx {
-			resp, err := r.RPC.Call("getrawtransaction", []interface{}{blk.Tx[j], 1})
-			if err == nil {
-				foundtx = true
-				// fmt.Println("tx", j)
-				var tx rpc.RawTransaction
-				err = json.Unmarshal(resp.Result, &tx)
-				if err != nil {
-					fmt.Println("unmarshalling transaction", err)
-				} else {
-					for k := range tx.Vout {
-						for l := range tx.Vout[k].ScriptPubKey.Addresses {
-							addr := tx.Vout[k].ScriptPubKey.Addresses[l]
-							id, _ := base58check.Decode(addr)
-							I, _ := hex.DecodeString(id[2:])
-							hhash := *core.Hash64(&I)
-							height := make([]byte, 5)
-							l := binary.PutUvarint(height, uint64(i))
-							height = height[:l]
-
-							pos := make([]byte, 3)
-							l = binary.PutUvarint(pos, uint64(k))
-							pos = pos[:l]
-
-							k3 := append([]byte{16}, hhash...)
-							v3 := append(pos, height...)
-
-							r.SetStatusIf(r.DB.View(func(txn *badger.Txn) error {
-								item, err := txn.Get(append([]byte{16}, hhash...))
-								if item != nil {
-									existing, err := item.ValueCopy(nil)
-									if err == nil {
-										foundrepeat = true
-
-										// fmt.Print("\n", i, " ", len(existing)+len(v3), " ", hex.EncodeToString(existing))
-										// fmt.Println(" " + hex.EncodeToString(v3))
-
-										// fmt.Println(i)
-										v3 = encodeAddressRecord(existing, Location{
-											Height: i,
-											TxNum:  uint16(k),
-										})
-
-										if len(v3) > 8192 {
-											hugeaddr = true
-										}
-										return nil
-									}
-								}
-								return err
-							}))
-							r.SetStatusIf(r.DB.Update(func(txn *badger.Txn) error {
-								err = txn.Delete(k3)
-								return err
-							}))
-							r.SetStatusIf(r.DB.Update(func(txn *badger.Txn) error {
-								// v = pruneToHeight(v3, i)
-								err = txn.SetWithDiscard(k3, v3, 0)
-								return err
-							}))
-						}
-					}
-				}
+		if !bytes.Equal(stored, current) {
+			fork, err := r.FindForkPoint(latest)
+			if !r.SetStatusIf(err).OK() {
+				fmt.Println("finding fork point", r.Error())
+				return r
+			}
+			if !r.Rollback(fork).OK() {
+				fmt.Println("rolling back", r.Error())
+				return r
 			}
+			latest = fork
 		}
+		startHeight = latest + 1
+		if r.Archive != nil {
+			rawBlock := func(hash []byte) ([]byte, error) { return r.rpcRawBlock(hex.EncodeToString(hash)) }
+			if !r.SetStatusIf(r.fillArchive(latest, rawBlock)).OK() {
+				fmt.Println("filling archive", r.Error())
+				return r
+			}
+		}
+	}
 
-		lastBlockUpdated = i
-		// update the latest
-		v = append(*core.IntToBytes(lastBlockUpdated),
-			r.LegacyGetBlockHash(lastBlockUpdated)...)
-		r.SetStatusIf(r.DB.Update(func(txn *badger.Txn) error {
-			err = txn.SetWithDiscard([]byte("latest"), v, 0)
-			return err
-		}))
-		if i%288 == 0 {
-			fmt.Println()
+	bestBlockHeight, err := r.LegacyGetBestBlockHeight()
+	if !r.SetStatusIf(err).OK() {
+		fmt.Println("getting best block", r.Error())
+		return r
+	}
+	for startHeight <= bestBlockHeight {
+		next, err := r.syncRange(startHeight, bestBlockHeight, r.fetchBlock, r.Workers)
+		if !r.SetStatusIf(err).OK() {
+			fmt.Println("\nsyncing from", startHeight, r.Error())
+			return r
 		}
-		if i%72 == 0 {
-			fmt.Printf("\n%7d ", i)
-		} else {
-			switch {
-			case hugeaddr:
-				fmt.Print("!")
-			case !foundtx && !foundrepeat:
-				fmt.Print(".")
-			case foundtx && !foundrepeat:
-				fmt.Print("*")
-			case foundtx && foundrepeat:
-				fmt.Print("+")
+		if next <= bestBlockHeight {
+			// a reorg was rolled back, the node may have a new best block as well
+			if bestBlockHeight, err = r.LegacyGetBestBlockHeight(); !r.SetStatusIf(err).OK() {
+				fmt.Println("getting best block", r.Error())
+				return r
 			}
 		}
-		if !r.OK() {
-			break
-		}
+		startHeight = next
 	}
 	fmt.Println("done")
-
-	if r.OK() {
-		r.Latest = lastBlockUpdated
-		hS := string(r.LegacyGetBlockHash(lastBlockUpdated))
-		hS, _ = strconv.Unquote(hS)
-		r.LatestHash, _ = hex.DecodeString(hS)
-	}
 	return r
 }
 
@@ -207,26 +101,15 @@ func (r *Node) GetLatestSynced() (latest uint32, latesthash []byte) {
 	return
 }
 
-// RemoveOldVersions walks the database and removes old versions of records
+// RemoveOldVersions removes old versions of records from the database, if its store keeps them
 func (r *Node) RemoveOldVersions() *Node {
+	c, ok := r.DB.(kv.Compacter)
+	if !ok {
+		return r
+	}
 	fmt.Println("\nRemoving old versions of records")
-	var counter int
-	opt := badger.DefaultIteratorOptions
-	opt.PrefetchValues = false
-	err := r.DB.Update(func(txn *badger.Txn) error {
-		iter := txn.NewIterator(opt)
-		defer iter.Close()
-		for iter.Rewind(); iter.Valid(); iter.Next() {
-			item := iter.Item()
-			if item.DiscardEarlierVersions() {
-				fmt.Print("%")
-				counter++
-			}
-		}
-		fmt.Printf("\n%d old records flushed\n", counter)
-		return nil
-	})
-	r.DB.RunValueLogGC(0.5)
+	counter, err := c.Compact()
+	fmt.Printf("%d old records flushed\n", counter)
 	if !r.SetStatusIf(err).OK() {
 		fmt.Println("\nERROR:", r.Error())
 	}
@@ -5,6 +5,10 @@ import (
 )
 
 func TestSync(t *testing.T) {
-	node := NewNode()
+	node, err := NewNode(DefaultConfig(Mainnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
 	node.Sync()
 }
@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/parallelcointeam/duo/pkg/block"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// ErrTxNotFound is returned when a transaction id is not in the index
+var ErrTxNotFound = fmt.Errorf("transaction not found")
+
+// txHHash returns the HighwayHash 64 of a transaction id given in the usual hex form
+func txHHash(txid string) []byte {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		// not a valid id, but it still needs a key that will never match a real one
+		id = []byte(txid)
+	}
+	return *core.Hash64(&id)
+}
+
+// GetTxLocation returns the height of the block a transaction was mined in and its position in the block
+func (r *Node) GetTxLocation(txid string) (loc Location, err error) {
+	return r.txLocation(txHHash(txid))
+}
+
+// txLocation reads the transaction record with a given key
+func (r *Node) txLocation(hhash []byte) (loc Location, err error) {
+	k, _ := EncodeKV(Tx{HHash: hhash})
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(k)
+		if err == kv.ErrNotFound {
+			return ErrTxNotFound
+		} else if err != nil {
+			return err
+		}
+		rec, err := DecodeRecord(k, v)
+		if err == nil {
+			loc = rec.(Tx).Location
+		}
+		return err
+	})
+	return
+}
+
+// GetRawTx returns a transaction by id, taken from its block so that it does not depend on the full node having a transaction index.
+//
+// The index key is only a 64 bit hash of the id, so the id of the transaction found is checked against the one asked for and ErrTxNotFound returned if another transaction shares its key.
+func (r *Node) GetRawTx(txid string) (tx block.Tx, err error) {
+	loc, err := r.GetTxLocation(txid)
+	if err != nil {
+		return
+	}
+	raw, err := r.GetRawBlock(uint64(loc.Height))
+	if err != nil {
+		return tx, fmt.Errorf("could not get block %d: %v", loc.Height, err)
+	}
+	blk, txids, err := decodeRawBlock(raw)
+	if err != nil {
+		return tx, fmt.Errorf("block %d: %v", loc.Height, err)
+	}
+	if int(loc.TxNum) >= len(blk.Transactions) {
+		return tx, fmt.Errorf("block %d has no transaction %d", loc.Height, loc.TxNum)
+	}
+	if !strings.EqualFold(txids[loc.TxNum], txid) {
+		return tx, ErrTxNotFound
+	}
+	return blk.Transactions[loc.TxNum], nil
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// block 102920 of the Parallelcoin mainnet, as broken down in blockdecoding.txt
+const (
+	testBlockHash = "a0aa90c9392f7c9f413017b2224abbfd9336da779534902d273912c5321ae3e7"
+	testBlockTx   = "f55daf675b4f894359333d770047dc02f2be2b9b667089dfa9962909c80aaaa9"
+	testBlockRaw  = "02020000" +
+		"cfedd1686d8ec429b3e4d5b60e13dcb0d3c9bcfa881d58cef8bb010000000000" +
+		"a9aa0ac8092996a9df8970669b2bbef202dc4700773d335943894f5b67af5df5" +
+		"689d6756" + "2ad8331c" + "f30665ef" +
+		"01" +
+		"01000000" + "01" +
+		"0000000000000000000000000000000000000000000000000000000000000000" + "ffffffff" +
+		"27" + "03089201062f503253482f046a9d675608400005c9050000000d2f6e6f64655374726174756d2f" +
+		"00000000" +
+		"01" + "00c2eb0b00000000" + "19" + "76a914d824c23fda79ac92294e2174c01bc303d6bab4f488ac" +
+		"00000000"
+)
+
+func TestTxIndex(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	raws := testPeerChain(t)
+	defer testSynced(t, r, raws).Close()
+	_, txids, _ := decodeRawBlock(raws[2])
+	txid := txids[1]
+
+	loc, err := r.GetTxLocation(txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Height != 2 || loc.TxNum != 1 {
+		t.Error("unexpected location", loc)
+	}
+	tx, err := r.GetRawTx(txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Outs) != 2 || tx.Outs[0].Value != 3000000000 || !bytes.Equal(tx.Outs[0].Script, testP2PKH(t, testAddrs[1])) ||
+		tx.Outs[1].Value != 2000000000 || !bytes.Equal(tx.Outs[1].Script, testP2PKH(t, testAddrs[0])) {
+		t.Error("unexpected transaction", tx)
+	}
+	if _, err := r.GetTxLocation("00"); err != ErrTxNotFound {
+		t.Error("expected not found, got", err)
+	}
+	// another id whose key collides with the transaction's is not given the transaction
+	other := strings.Repeat("00", 32)
+	k, v := EncodeKV(Tx{HHash: txHHash(other), Location: loc})
+	if err := r.DB.Update(func(txn kv.Txn) error { return txn.Put(k, v) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetRawTx(other); err != ErrTxNotFound {
+		t.Error("transaction returned for another id", err)
+	}
+	if _, err := r.GetRawTx(strings.ToUpper(txid)); err != nil {
+		t.Error(err)
+	}
+
+	// undoing the block removes its transactions
+	if !r.UndoBlock(2).OK() {
+		t.Fatal(r.Error())
+	}
+	if _, err := r.GetTxLocation(txid); err != ErrTxNotFound {
+		t.Error("transaction still indexed after undo", err)
+	}
+}
@@ -0,0 +1,245 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+var (
+	// ErrNoUndo is returned when a block has no undo record, which is the case for blocks indexed before the journal was introduced
+	ErrNoUndo = errors.New("no undo record for block")
+	// ErrNotTip is returned when trying to undo a block that is not the latest indexed block
+	ErrNotTip = errors.New("only the latest indexed block can be undone")
+)
+
+// journal collects the address locations added while indexing a block, in the order addresses are first seen
+type journal struct {
+	undo  Undo
+	index map[string]int
+}
+
+func newJournal(height uint32) *journal {
+	return &journal{undo: Undo{Height: height}, index: make(map[string]int)}
+}
+
+func (j *journal) add(hhash []byte, loc Location) {
+	i, ok := j.index[string(hhash)]
+	if !ok {
+		i = len(j.undo.Entries)
+		j.index[string(hhash)] = i
+		j.undo.Entries = append(j.undo.Entries, UndoEntry{HHash: hhash})
+	}
+	j.undo.Entries[i].Locations = append(j.undo.Entries[i].Locations, loc)
+}
+
+// GetUndo returns the undo record for the block at a given height
+func (r *Node) GetUndo(height uint32) (undo Undo, err error) {
+	k, _ := EncodeKV(Undo{Height: height})
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(k)
+		if err == kv.ErrNotFound {
+			return ErrNoUndo
+		} else if err != nil {
+			return err
+		}
+		rec, err := DecodeRecord(k, v)
+		if err == nil {
+			undo = rec.(Undo)
+		}
+		return err
+	})
+	return
+}
+
+// UndoBlock restores the index to the state it was in before the block at the given height was indexed. Blocks can only be undone from the tip down, so height must be the latest indexed block.
+func (r *Node) UndoBlock(height uint32) *Node {
+	latest, found, err := r.getLatest()
+	if !r.SetStatusIf(err).OK() {
+		return r
+	} else if !found || latest != height {
+		r.SetStatusIf(ErrNotTip)
+		return r
+	}
+	undo, err := r.GetUndo(height)
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+	// a corrupt block record is undone the same as a missing one, so the repair of a bad height can roll back over it
+	hash, err := r.GetBlockHash(height)
+	if err != ErrRecord && !r.SetStatusIf(err).OK() {
+		return r
+	}
+	var prevHash []byte
+	if height > 0 {
+		if prevHash, err = r.GetBlockHash(height - 1); err != ErrRecord && !r.SetStatusIf(err).OK() {
+			return r
+		}
+	}
+
+	err = r.DB.Update(func(txn kv.Txn) error {
+		// addresses left without any location are no longer indexed, so are not found by search either
+		gone := make(map[string]bool)
+		for _, entry := range undo.Entries {
+			k := append([]byte{PrefixAddress}, entry.HHash...)
+			v, err := txn.Get(k)
+			if err == kv.ErrNotFound {
+				gone[string(entry.HHash)] = true
+				continue
+			} else if err != nil {
+				return err
+			}
+			locs, err := decodeAddressRecord(v)
+			if err != nil {
+				return fmt.Errorf("address record %x: %v", entry.HHash, err)
+			}
+			locs = removeLocations(locs, entry.Locations)
+			if len(locs) == 0 {
+				gone[string(entry.HHash)] = true
+				err = txn.Delete(k)
+			} else {
+				err = txn.Put(k, encodeLocations(locs))
+			}
+			if err != nil {
+				return err
+			}
+			// any cached balance for the address may include this block
+			if err = txn.Delete(append([]byte{PrefixBalanceCache}, entry.HHash...)); err != nil {
+				return err
+			}
+		}
+		for _, hhash := range undo.Txs {
+			k, _ := EncodeKV(Tx{HHash: hhash})
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, e := range undo.Search {
+			// an address found in an earlier block keeps its entry
+			if e.Kind == SearchAddress && !gone[string(e.HHash)] {
+				continue
+			}
+			k, _ := EncodeKV(e)
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		k1, _ := EncodeKV(Block{Height: height})
+		k3, _ := EncodeKV(Undo{Height: height})
+		k4, _ := EncodeKV(Stats{Height: height})
+		keys := [][]byte{k1, k3, k4}
+		if hash != nil {
+			k2, _ := EncodeKV(Hash{HHash: *core.Hash64(&hash)})
+			keys = append(keys, k2)
+		}
+		for _, k := range keys {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		if height == 0 {
+			return txn.Delete(LatestKey)
+		}
+		return txn.Put(LatestKey, latestValue(height-1, prevHash))
+	})
+	if r.SetStatusIf(err).OK() {
+		if r.txs != nil && height > 0 {
+			r.txs.dropBlocks(height - 1)
+		}
+		if height > 0 {
+			r.Latest, r.LatestHash = height-1, prevHash
+		} else {
+			r.Latest, r.LatestHash = 0, nil
+		}
+	}
+	return r
+}
+
+// removeLocations removes the given locations from a list of locations
+func removeLocations(in []Location, remove []Location) (out []Location) {
+	for i := range in {
+		found := false
+		for j := range remove {
+			if in[i] == remove[j] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, in[i])
+		}
+	}
+	return
+}
+
+// replayJournal replays the undo journal forward from the first block, returning the address locations it adds up to by address HHash and the heights that have an undo record in ascending order
+func (r *Node) replayJournal() (replay map[string][]Location, heights []uint32, err error) {
+	replay = make(map[string][]Location)
+	err = r.DB.View(func(txn kv.Reader) error {
+		// undo keys are varint heights, which do not sort in height order, so collect them all before replaying
+		undos := make(map[uint32]Undo)
+		err := txn.Iterate([]byte{PrefixUndo}, nil, func(k, v []byte) error {
+			rec, err := DecodeRecord(append([]byte{}, k...), append([]byte{}, v...))
+			if err != nil {
+				return err
+			}
+			undo := rec.(Undo)
+			undos[undo.Height] = undo
+			heights = append(heights, undo.Height)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+		for _, h := range heights {
+			for _, entry := range undos[h].Entries {
+				replay[string(entry.HHash)] = append(replay[string(entry.HHash)], entry.Locations...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Verify replays the undo journal forward from the first block and checks that the address index it produces is exactly what is stored. It returns the keys of address records that differ from the replay and any heights that have an undo record but no block record. Address records from blocks indexed before the journal existed will be reported as mismatches.
+func (r *Node) Verify() (badAddrs [][]byte, badHeights []uint32) {
+	var stored [][]byte
+	replay, heights, err := r.replayJournal()
+	if err == nil {
+		err = r.DB.View(func(txn kv.Reader) error {
+			for _, h := range heights {
+				k, _ := EncodeKV(Block{Height: h})
+				if _, err := txn.Get(k); err == kv.ErrNotFound {
+					badHeights = append(badHeights, h)
+				}
+			}
+			return txn.Iterate([]byte{PrefixAddress}, nil, func(k, v []byte) error {
+				k = append([]byte{}, k...)
+				hhash := string(k[1:])
+				// a record that does not decode is as bad as one that does not match
+				locs, err := decodeAddressRecord(v)
+				if err != nil || !bytes.Equal(encodeLocations(locs), encodeLocations(replay[hhash])) {
+					badAddrs = append(badAddrs, k)
+				}
+				stored = append(stored, k)
+				delete(replay, hhash)
+				return nil
+			})
+		})
+	}
+	r.SetStatusIf(err)
+	// anything left in the replay was journalled but its address record is missing
+	for hhash := range replay {
+		badAddrs = append(badAddrs, append([]byte{PrefixAddress}, hhash...))
+	}
+	if len(badAddrs) > 0 || len(badHeights) > 0 {
+		fmt.Printf("verify: %d of %d address records and %d blocks inconsistent with undo journal\n",
+			len(badAddrs), len(stored), len(badHeights))
+	}
+	return
+}
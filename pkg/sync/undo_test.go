@@ -0,0 +1,127 @@
+package sync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// indexTestBlock writes the records Sync would write for a block touching the given addresses at the given transaction numbers
+func indexTestBlock(t *testing.T, r *Node, height uint32, touched map[string][]uint16) {
+	h := testHash(height)
+	jnl := newJournal(height)
+	err := r.DB.Update(func(txn kv.Txn) error {
+		k1, v1 := EncodeKV(Block{Height: height, Hash: h})
+		k2, v2 := EncodeKV(Hash{HHash: *core.Hash64(&h), Height: height})
+		txn.Put(k1, v1)
+		txn.Put(k2, v2)
+		for addr, txnums := range touched {
+			k := append([]byte{16}, addr...)
+			for _, txnum := range txnums {
+				var existing []byte
+				if v, err := txn.Get(k); err == nil {
+					existing = append([]byte{}, v...)
+				}
+				record, _ := encodeAddressRecord(existing, Location{Height: height, TxNum: txnum})
+				txn.Put(k, record)
+				jnl.add([]byte(addr), Location{Height: height, TxNum: txnum})
+			}
+		}
+		k3, v3 := EncodeKV(jnl.undo)
+		txn.Put(k3, v3)
+		return txn.Put([]byte("latest"), append(*core.IntToBytes(height), h...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUndoRecordRoundTrip(t *testing.T) {
+	in := Undo{Height: 300000, Entries: []UndoEntry{
+		{HHash: []byte("aaaaaaaa"), Locations: []Location{{300000, 0, true}, {300000, 300, false}}},
+		{HHash: []byte("bbbbbbbb"), Locations: []Location{{300000, 7, false}}},
+	}}
+	k, v := EncodeKV(in)
+	out := DecodeKV(k, v).([]interface{})[1].(Undo)
+	if out.Height != in.Height || len(out.Entries) != len(in.Entries) {
+		t.Fatal("expected", in, "got", out)
+	}
+	for i := range in.Entries {
+		if !bytes.Equal(in.Entries[i].HHash, out.Entries[i].HHash) ||
+			len(in.Entries[i].Locations) != len(out.Entries[i].Locations) {
+			t.Fatal("expected", in, "got", out)
+		}
+		for j := range in.Entries[i].Locations {
+			if in.Entries[i].Locations[j] != out.Entries[i].Locations[j] {
+				t.Error("expected", in, "got", out)
+			}
+		}
+	}
+}
+
+func TestUndoBlock(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+
+	indexTestBlock(t, r, 0, map[string][]uint16{"aaaaaaaa": {0}})
+	indexTestBlock(t, r, 1, map[string][]uint16{"aaaaaaaa": {0, 2}, "bbbbbbbb": {1}})
+	indexTestBlock(t, r, 2, map[string][]uint16{"bbbbbbbb": {0}})
+
+	if bad, heights := r.Verify(); len(bad) != 0 || len(heights) != 0 {
+		t.Fatal("fresh index failed verification", bad, heights)
+	}
+	if r.UndoBlock(1).OK() {
+		t.Error("undid a block below the tip")
+	}
+	if !r.UndoBlock(2).OK() || !r.UndoBlock(1).OK() {
+		t.Fatal(r.Error())
+	}
+	if latest, _, _ := r.getLatest(); latest != 0 || !bytes.Equal(r.LatestHash, testHash(0)) {
+		t.Error("latest not moved back to height 0")
+	}
+	if storedHash(r, 1) != nil || storedHash(r, 2) != nil {
+		t.Error("undone blocks still indexed")
+	}
+	r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(append([]byte{16}, "aaaaaaaa"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locs, _ := decodeAddressRecord(v); len(locs) != 1 || locs[0].Height != 0 {
+			t.Error("address record not restored", locs)
+		}
+		if _, err := txn.Get(append([]byte{16}, "bbbbbbbb"...)); err != kv.ErrNotFound {
+			t.Error("address first seen in undone blocks still indexed")
+		}
+		return nil
+	})
+	if bad, heights := r.Verify(); len(bad) != 0 || len(heights) != 0 {
+		t.Error("index inconsistent after undo", bad, heights)
+	}
+
+	// corrupt an address record and check that verification notices
+	r.DB.Update(func(txn kv.Txn) error {
+		return txn.Put(append([]byte{16}, "aaaaaaaa"...), encodeLocations([]Location{{5, 5, false}}))
+	})
+	if bad, _ := r.Verify(); len(bad) != 1 {
+		t.Error("corrupted address record not detected")
+	}
+
+	// a record that does not decode stops the undo instead of being overwritten
+	indexTestBlock(t, r, 1, map[string][]uint16{"bbbbbbbb": {0}})
+	garbage := []byte{1, 0, 5, 2}
+	r.DB.Update(func(txn kv.Txn) error {
+		return txn.Put(append([]byte{16}, "bbbbbbbb"...), garbage)
+	})
+	if r.UndoBlock(1).OK() {
+		t.Error("undid a block over a corrupt address record")
+	}
+	r.DB.View(func(txn kv.Reader) error {
+		if v, _ := txn.Get(append([]byte{16}, "bbbbbbbb"...)); !bytes.Equal(v, garbage) {
+			t.Error("corrupt address record overwritten", v)
+		}
+		return nil
+	})
+}
@@ -2,11 +2,10 @@ package sync
 
 import (
 	"encoding/binary"
-	"fmt"
 
-	"github.com/dgraph-io/badger"
 	"github.com/golang/snappy"
 	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
 )
 
 func removeTrailingZeroes(in []byte) []byte {
@@ -31,56 +30,71 @@ func removeLeadingZeroes(in []byte) []byte {
 	return in[nonzerostart:]
 }
 
-func (r *Node) getLatest() (h uint32) {
+func (r *Node) getLatest() (h uint32, found bool, err error) {
 	var latestB []byte
-
-	r.SetStatusIf(r.DB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("latest"))
-		if err == nil {
-			latestB, err = item.Value()
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(LatestKey)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err == nil {
+			latestB = append([]byte{}, v...)
 		}
 		return err
-	}))
-	if latestB != nil {
+	})
+	if len(latestB) >= 4 {
 		heightB := latestB[:4]
 		core.BytesToInt(&h, &heightB)
+		found = true
 	}
-	r.UnsetStatus()
 	return
 }
 
-func decodeAddressRecord(addr []byte) (out []Location, length uint32) {
-	var dec []byte
-	var err error
-	dec, err = snappy.Decode(nil, addr)
-	if err == nil {
-		addr = dec
+// decodeAddressRecord decodes the locations of an address record as written by encodeLocations. A record that is not snappy compressed or ends part way through a location is ErrRecord, so a corrupt record is never read as some other list of locations and written back.
+func decodeAddressRecord(addr []byte) (out []Location, err error) {
+	dec, err := snappy.Decode(nil, addr)
+	if err != nil {
+		return nil, ErrRecord
 	}
-	cursor, length := 0, 0
-	for cursor < len(addr) {
-		var h, n uint64
+	for cursor := 0; cursor < len(dec); {
 		var height uint32
-		var txnum uint16
-		h, step := binary.Uvarint(addr[cursor:])
+		h, step := binary.Uvarint(dec[cursor:])
+		if step <= 0 {
+			return nil, ErrRecord
+		}
 		cursor += step
-		n, step = binary.Uvarint(addr[cursor:])
+		n, step := binary.Uvarint(dec[cursor:])
+		if step <= 0 {
+			return nil, ErrRecord
+		}
 		cursor += step
 		l := len(out)
-		if l > 1 {
+		if l > 0 {
 			height = out[l-1].Height + uint32(h)
 		} else {
-			height, txnum = uint32(h), uint16(n)
+			height = uint32(h)
 		}
-		out = append(out, Location{Height: uint32(height), TxNum: uint16(txnum)})
-		length++
+		out = append(out, refLocation(height, n))
 	}
 	return
 }
 
-func encodeAddressRecord(existing []byte, loc Location) (out []byte) {
-	ex, _ := decodeAddressRecord(existing)
-	// fmt.Println("ex", ex)
-	ex = append(ex, loc)
+// encodeAddressRecord adds a location to an existing address record, which may be empty
+func encodeAddressRecord(existing []byte, loc Location) (out []byte, err error) {
+	var ex []Location
+	if len(existing) > 0 {
+		if ex, err = decodeAddressRecord(existing); err != nil {
+			return
+		}
+	}
+	if l := len(ex); l > 0 && ex[l-1] == loc {
+		// the same address appearing twice in one transaction only needs one reference
+		return existing, nil
+	}
+	return encodeLocations(append(ex, loc)), nil
+}
+
+// encodeLocations serialises a list of locations in ascending height order as height deltas and transaction numbers with the spend flag, compressed with snappy
+func encodeLocations(ex []Location) (out []byte) {
 	var h, n []byte
 	for i := range ex {
 		if i == 0 {
@@ -88,29 +102,22 @@ func encodeAddressRecord(existing []byte, loc Location) (out []byte) {
 			l := binary.PutUvarint(h, uint64(ex[0].Height))
 			h = h[:l]
 			n = make([]byte, 5)
-			l = binary.PutUvarint(n, uint64(ex[0].TxNum))
+			l = binary.PutUvarint(n, ex[0].ref())
 			n = n[:l]
 			out = append(h, n...)
 		} else {
 			nh := ex[i].Height - ex[i-1].Height
-			// fmt.Println("\n", ex[i].Height, ex[i-1].Height, nh)
 			h = make([]byte, 5)
 			l := binary.PutUvarint(h, uint64(nh))
 			h = h[:l]
 			n = make([]byte, 5)
-			l = binary.PutUvarint(n, uint64(ex[i].TxNum))
+			l = binary.PutUvarint(n, ex[i].ref())
 			n = n[:l]
 			out = append(out, append(h, n...)...)
 		}
-		// fmt.Println("\n", uint64(ex[i].Height), h, uint64(ex[0].TxNum), n)
 	}
-	enc := snappy.Encode(nil, out)
-	out = enc
-	if len(enc) > len(out) {
-		fmt.Println("\ncompressor expanded!")
-	}
-	// fmt.Print(len(out)) //, hex.EncodeToString(out))
-	return
+	// records are always stored compressed, even short ones that snappy makes a few bytes longer, so they decode the same way
+	return snappy.Encode(nil, out)
 }
 
 // AppendVarint takes any type of integer and returns the Varint. This is 7 bits per byte with a continuation marker on the 8th bit
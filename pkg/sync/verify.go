@@ -0,0 +1,265 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+)
+
+// ErrJournalIncomplete is returned when address records have to be rebuilt but some blocks have no undo record to rebuild them from
+var ErrJournalIncomplete = errors.New("the undo journal does not cover every block, rebuild the index with reindex")
+
+// CheckReport is the result of CheckIndex
+type CheckReport struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	// Blocks and Addresses are the number of heights and address records checked
+	Blocks    int `json:"blocks"`
+	Addresses int `json:"addresses"`
+	// BadHeights are the heights whose block or hash record is missing or does not match the block on the chain
+	BadHeights []uint32 `json:"badheights"`
+	// BadAddresses are the keys of the address records that are malformed or do not match the undo journal
+	BadAddresses [][]byte `json:"badaddresses"`
+	// Problems describes each problem found
+	Problems []string `json:"problems"`
+}
+
+// OK returns true if no problems were found
+func (c *CheckReport) OK() bool {
+	return len(c.BadHeights) == 0 && len(c.BadAddresses) == 0
+}
+
+func (c *CheckReport) badHeight(height uint32, format string, args ...interface{}) {
+	if l := len(c.BadHeights); l == 0 || c.BadHeights[l-1] != height {
+		c.BadHeights = append(c.BadHeights, height)
+	}
+	c.Problems = append(c.Problems, fmt.Sprintf("block %d: ", height)+fmt.Sprintf(format, args...))
+}
+
+func (c *CheckReport) badAddress(k []byte, format string, args ...interface{}) {
+	c.BadAddresses = append(c.BadAddresses, k)
+	c.Problems = append(c.Problems, fmt.Sprintf("address %x: ", k[1:])+fmt.Sprintf(format, args...))
+}
+
+// chainHash returns the hash of the block at a height on the best chain, from the archive if it has the block and otherwise from the full node
+func (r *Node) chainHash(height uint32) (hash []byte, err error) {
+	if r.Archive != nil && height < r.Archive.Count() {
+		return r.Archive.Hash(height)
+	}
+	hashS, err := r.RPC.GetBlockHash(height)
+	if err != nil {
+		return nil, fmt.Errorf("getblockhash %d: %v", height, err)
+	}
+	return hex.DecodeString(hashS)
+}
+
+// checkLocations decodes an address record strictly, requiring valid snappy and varint framing and locations in ascending order without repeats
+func checkLocations(v []byte) (locs []Location, err error) {
+	dec, err := snappy.Decode(nil, v)
+	if err != nil {
+		return nil, fmt.Errorf("not snappy compressed: %v", err)
+	}
+	for len(dec) > 0 {
+		var delta, ref uint64
+		if delta, dec, err = uvarint(dec); err != nil {
+			return nil, errors.New("truncated height")
+		}
+		if ref, dec, err = uvarint(dec); err != nil {
+			return nil, errors.New("truncated transaction number")
+		}
+		var height uint64
+		if l := len(locs); l > 0 {
+			height = uint64(locs[l-1].Height) + delta
+		} else {
+			height = delta
+		}
+		if height > uint64(^uint32(0)) || ref>>1 > 0xffff {
+			return nil, errors.New("location out of range")
+		}
+		loc := refLocation(uint32(height), ref)
+		for i := len(locs) - 1; i >= 0 && locs[i].Height == loc.Height; i-- {
+			if locs[i] == loc {
+				return nil, fmt.Errorf("location %v repeated", loc)
+			}
+		}
+		locs = append(locs, loc)
+	}
+	return
+}
+
+// CheckIndex checks the block and hash records of the heights from one to another inclusive against the hashes of the blocks on the chain, which are taken from the archive if it has them and otherwise from the full node. Each height is checked on its own, so a corrupt record is reported as a bad height and the check goes on. It also decodes every address record, checking its framing, that its locations are in order and not above the latest block, and, if every block has an undo record, that it is exactly what the undo journal adds up to.
+func (r *Node) CheckIndex(from, to uint32) (report *CheckReport, err error) {
+	latest, found, err := r.getLatest()
+	if err != nil {
+		return
+	} else if !found {
+		return nil, ErrNotIndexed
+	}
+	if to > latest {
+		to = latest
+	}
+	report = &CheckReport{From: from, To: to}
+	for h := from; h <= to && from <= to; h++ {
+		report.Blocks++
+		expected, err := r.chainHash(h)
+		if err != nil {
+			return nil, fmt.Errorf("getting hash of block %d: %v", h, err)
+		}
+		stored, err := r.GetBlockHash(h)
+		if err != nil && err != ErrRecord {
+			return nil, fmt.Errorf("reading block %d: %v", h, err)
+		}
+		var hashHeight uint32
+		if err == nil && stored != nil {
+			if hashHeight, err = r.hashHeight(*core.Hash64(&stored)); err != nil && err != ErrRecord {
+				return nil, fmt.Errorf("reading hash of block %d: %v", h, err)
+			}
+		}
+		switch {
+		case err != nil:
+			report.badHeight(h, "%v", err)
+		case stored == nil:
+			report.badHeight(h, "no block record")
+		case !bytes.Equal(stored, expected):
+			report.badHeight(h, "block record has hash %x, the chain has %x", stored, expected)
+		case hashHeight != h:
+			report.badHeight(h, "hash record missing or not at this height")
+		}
+		if h == to {
+			break
+		}
+	}
+	hash, err := r.GetBlockHash(latest)
+	if err != nil && err != ErrRecord {
+		return nil, err
+	}
+	err = r.DB.View(func(txn kv.Reader) error {
+		v, err := txn.Get(LatestKey)
+		if err != nil {
+			return err
+		}
+		if len(v) < 4 || !bytes.Equal(v[4:], hash) {
+			report.badHeight(latest, "latest record is %x, the block record has %x", v, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	replay, heights, err := r.replayJournal()
+	if err != nil {
+		return
+	}
+	complete := len(heights) == int(latest)+1 && heights[0] == 0 && heights[len(heights)-1] == latest
+	err = r.DB.View(func(txn kv.Reader) error {
+		return txn.Iterate([]byte{PrefixAddress}, nil, func(k, v []byte) error {
+			k = append([]byte{}, k...)
+			report.Addresses++
+			journalled := replay[string(k[1:])]
+			delete(replay, string(k[1:]))
+			locs, err := checkLocations(v)
+			switch {
+			case len(k) != 9:
+				report.badAddress(k, "key is %d bytes long", len(k))
+			case err != nil:
+				report.badAddress(k, "%v", err)
+			case len(locs) == 0:
+				report.badAddress(k, "no locations")
+			case locs[len(locs)-1].Height > latest:
+				report.badAddress(k, "location at height %d above the latest block", locs[len(locs)-1].Height)
+			case complete && !bytes.Equal(encodeLocations(locs), encodeLocations(journalled)):
+				report.badAddress(k, "does not match the undo journal")
+			}
+			return nil
+		})
+	})
+	if complete {
+		// anything left in the replay was journalled but its address record is missing
+		for hhash := range replay {
+			report.badAddress(append([]byte{PrefixAddress}, hhash...), "journalled but missing")
+		}
+	}
+	return
+}
+
+// RepairIndex fixes the problems found by CheckIndex. Bad address records are rebuilt from the undo journal, which must cover every block. The index is then rolled back to below the lowest bad height and indexed again up to where it was, from the archive if it holds every block up to there, as CheckIndex compared against it, and otherwise from the full node.
+func (r *Node) RepairIndex(report *CheckReport) *Node {
+	latest, _, err := r.getLatest()
+	if !r.SetStatusIf(err).OK() {
+		return r
+	}
+	if len(report.BadAddresses) > 0 {
+		replay, heights, err := r.replayJournal()
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+		if len(heights) != int(latest)+1 || heights[0] != 0 {
+			r.SetStatusIf(ErrJournalIncomplete)
+			return r
+		}
+		fmt.Println("rebuilding", len(report.BadAddresses), "address records from the undo journal")
+		err = r.DB.Update(func(txn kv.Txn) error {
+			for _, k := range report.BadAddresses {
+				var err error
+				if locs := replay[string(k[1:])]; len(locs) == 0 || len(k) != 9 {
+					err = txn.Delete(k)
+				} else {
+					err = txn.Put(k, encodeLocations(locs))
+				}
+				if err != nil {
+					return err
+				}
+				// the cached balance may have been computed from the bad record
+				if err = txn.Delete(append([]byte{PrefixBalanceCache}, k[1:]...)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+	}
+	if len(report.BadHeights) > 0 {
+		low := report.BadHeights[0]
+		for _, h := range report.BadHeights {
+			if h < low {
+				low = h
+			}
+		}
+		if low == 0 {
+			r.SetStatus("the genesis block is wrong, check the network or rebuild the index with reindex")
+			return r
+		}
+		fromArchive := r.archiveCovers(latest)
+		if !r.rollback(low-1, !fromArchive).OK() {
+			return r
+		}
+		var next uint32
+		if fromArchive {
+			batchSize := r.BatchSize
+			if batchSize < 1 {
+				batchSize = DefaultBatchSize
+			}
+			src := &archiveSource{r: r, recent: newRecentTxs(4 * batchSize)}
+			fmt.Println("indexing blocks", low, "to", latest, "again from the archive")
+			next, err = r.syncDecoded(low, latest, src.fetch)
+		} else {
+			fmt.Println("indexing blocks", low, "to", latest, "again")
+			next, err = r.syncRange(low, latest, r.fetchBlock, r.Workers)
+		}
+		if !r.SetStatusIf(err).OK() {
+			return r
+		}
+		if next <= latest {
+			r.SetStatus(fmt.Sprintf("the chain changed while repairing, sync again from %d", next))
+		}
+	}
+	return r
+}
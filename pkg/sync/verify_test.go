@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"testing"
+
+	"github.com/parallelcointeam/duo/pkg/core"
+	"github.com/parallelcointeam/duo/pkg/kv"
+	"github.com/parallelcointeam/duo/pkg/rpc/rpctest"
+)
+
+func TestCheckIndex(t *testing.T) {
+	r, cleanup := newTestNode(t)
+	defer cleanup()
+	// the node does not have the genesis coinbase, so the first test address is paid by blocks 1 and 3
+	n := rpctest.NewNode(Mainnet, rpctest.Generate(nil, 4, testP2PKH(t, testAddrs[1]), testP2PKH(t, testAddrs[0])))
+	defer n.Close()
+	r.RPC = n.Client()
+	if next, err := r.syncRange(0, 3, r.fetchBlock, 2); err != nil || next != 4 {
+		t.Fatal("sync failed", next, err)
+	}
+
+	report, err := r.CheckIndex(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.To != 3 || report.Blocks != 4 || report.Addresses != 2 {
+		t.Errorf("unexpected report of a good index %+v", report)
+	}
+
+	wrong := testHash(9)
+	stored := storedHash(r, 3)
+	addrKey := append([]byte{PrefixAddress}, addressHHash(testAddrs[0])...)
+	err = r.DB.Update(func(txn kv.Txn) error {
+		k, v := EncodeKV(Block{Height: 2, Hash: wrong})
+		if err := txn.Put(k, v); err != nil {
+			return err
+		}
+		// a record too long to be a hash is a bad height, not a failed check
+		k, _ = EncodeKV(Block{Height: 1})
+		if err := txn.Put(k, make([]byte, 33)); err != nil {
+			return err
+		}
+		k, _ = EncodeKV(Hash{HHash: *core.Hash64(&stored)})
+		if err := txn.Delete(k); err != nil {
+			return err
+		}
+		return txn.Put(addrKey, []byte{0xff, 0xff})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err = r.CheckIndex(0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BadHeights) != 3 || report.BadHeights[0] != 1 || report.BadHeights[1] != 2 || report.BadHeights[2] != 3 ||
+		len(report.BadAddresses) != 1 || string(report.BadAddresses[0]) != string(addrKey) || len(report.Problems) != 4 {
+		t.Errorf("unexpected report of a bad index %+v", report)
+	}
+	if report, _ = r.CheckIndex(0, 0); len(report.BadHeights) != 0 || len(report.BadAddresses) != 1 {
+		t.Errorf("unexpected report of a range %+v", report)
+	}
+
+	if report, _ = r.CheckIndex(0, 3); !r.RepairIndex(report).OK() {
+		t.Fatal(r.Error())
+	}
+	if report, err = r.CheckIndex(0, 3); err != nil || !report.OK() {
+		t.Error("index not repaired", report, err)
+	}
+	if balance, err := r.GetAddressBalance(testAddrs[0], 3); err != nil || balance != 10000000000 {
+		t.Error("unexpected balance after repair", balance, err)
+	}
+}
+
+func TestCheckLocations(t *testing.T) {
+	good := []Location{{1, 0, false}, {1, 0, true}, {5, 2, false}}
+	if locs, err := checkLocations(encodeLocations(good)); err != nil || len(locs) != 3 {
+		t.Error("good record rejected", locs, err)
+	}
+	for _, bad := range [][]byte{
+		{1, 2, 3},
+		encodeLocations([]Location{{1, 0, false}, {1, 0, false}}),
+		encodeLocations(good)[:3],
+	} {
+		if _, err := checkLocations(bad); err == nil {
+			t.Errorf("bad record %x accepted", bad)
+		}
+	}
+}